@@ -0,0 +1,198 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/mail"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+// BlockSubject matches the subject of a message sent to the mailbox account
+// that blocks or unblocks an alias. Submatch 1 is the command and submatch 2
+// is the local part of the alias, which may be UTF-8 like in SendAsSubject.
+var BlockSubject = regexp.MustCompile(`(?i)\[(block|unblock):\s*([\p{L}\p{M}\p{N}\.\-_+]+)\]`)
+
+// readBlockedAliases returns the addresses stored in the blocked aliases file
+// at |path|, one per line. A missing file is an empty list.
+func readBlockedAliases(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var aliases []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			aliases = append(aliases, line)
+		}
+	}
+	return aliases, scanner.Err()
+}
+
+// writeBlockedAliases atomically replaces the blocked aliases file at |path|.
+func writeBlockedAliases(path string, aliases []string) error {
+	var buf bytes.Buffer
+	for _, alias := range aliases {
+		fmt.Fprintln(&buf, alias)
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf.Bytes(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// handleBlockCommand looks for a recipient of |en| that is the mailbox account
+// of the sender's domain, with a BlockSubject command in the message. If
+// found, the command is carried out, a confirmation is delivered to the
+// maildrop, and the mailbox account is removed from the recipients. It
+// returns whether any recipients remain to relay the message to.
+func (server *smtpServer) handleBlockCommand(en *smtp.Envelope) bool {
+	domain := smtp.DomainForAddress(en.MailFrom)
+	s := server.serverForAddress(en.MailFrom)
+	if s == nil {
+		return true
+	}
+
+	controlIdx := -1
+	for i, rcpt := range en.RcptTo {
+		if strings.EqualFold(rcpt.Address, MailboxAccount+domain) {
+			controlIdx = i
+			break
+		}
+	}
+	if controlIdx == -1 {
+		return true
+	}
+
+	msg, err := mail.ReadMessage(bytes.NewReader(en.Data.Header()))
+	if err != nil {
+		return true
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		subject = msg.Header.Get("Subject")
+	}
+	command := BlockSubject.FindStringSubmatch(subject)
+	if command == nil {
+		return true
+	}
+
+	verb := strings.ToLower(command[1])
+	alias := strings.ToLower(command[2]) + "@" + domain
+	server.log.Info("handling alias command",
+		zap.String("id", en.ID),
+		zap.String("command", verb),
+		zap.String("alias", alias))
+
+	result, err := server.updateBlockedAlias(s, verb == "block", alias)
+	if err != nil {
+		server.log.Error("failed to update blocked aliases", zap.String("alias", alias), zap.Error(err))
+		result = fmt.Sprintf("The %s command for %s failed: %v", verb, alias, err)
+	}
+	server.deliverBlockConfirmation(en, s, verb+": "+alias, result)
+
+	en.RcptTo = append(en.RcptTo[:controlIdx:controlIdx], en.RcptTo[controlIdx+1:]...)
+	return len(en.RcptTo) > 0
+}
+
+// updateBlockedAlias adds or removes |alias| from the stored blocked aliases
+// of |s| and reloads the blocklists. It returns a description of the change.
+func (server *smtpServer) updateBlockedAlias(s *Server, block bool, alias string) (string, error) {
+	if s.isAccount(localPart(alias)) {
+		return "", fmt.Errorf("%s cannot be blocked", alias)
+	}
+
+	server.blockedAliasesMu.Lock()
+	defer server.blockedAliasesMu.Unlock()
+
+	path := s.GetBlockedAliasesPath()
+	aliases, err := readBlockedAliases(path)
+	if err != nil {
+		return "", err
+	}
+
+	idx := -1
+	for i, a := range aliases {
+		if strings.EqualFold(a, alias) {
+			idx = i
+			break
+		}
+	}
+
+	var result string
+	if block {
+		if idx != -1 {
+			return fmt.Sprintf("%s was already blocked.", alias), nil
+		}
+		aliases = append(aliases, alias)
+		sort.Strings(aliases)
+		result = fmt.Sprintf("%s is now blocked and will no longer receive mail.", alias)
+	} else {
+		if idx == -1 {
+			return fmt.Sprintf("%s was not blocked.", alias), nil
+		}
+		aliases = append(aliases[:idx], aliases[idx+1:]...)
+		result = fmt.Sprintf("%s is no longer blocked.", alias)
+	}
+
+	if err := writeBlockedAliases(path, aliases); err != nil {
+		return "", err
+	}
+
+	if err := server.reloadBlocklist(s); err != nil {
+		return "", err
+	}
+
+	return result, nil
+}
+
+// deliverBlockConfirmation delivers a message describing the |result| of an
+// alias command, sent in |en|, to the maildrop of |s|.
+func (server *smtpServer) deliverBlockConfirmation(en *smtp.Envelope, s *Server, subject, result string) {
+	mailbox := mail.Address{Name: "mailpopbox", Address: MailboxAccount + s.Domain}
+	now := time.Now()
+
+	confirmation := smtp.Envelope{
+		MailFrom: mailbox,
+		RcptTo:   []mail.Address{mailbox},
+		ID:       en.ID + ".confirm",
+		Received: now,
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\n", mailbox.String())
+	fmt.Fprintf(&buf, "To: %s\n", mailbox.String())
+	fmt.Fprintf(&buf, "Subject: %s\n", mime.QEncoding.Encode("utf-8", "Alias "+subject))
+	fmt.Fprintf(&buf, "Message-ID: <%s@%s>\n", confirmation.ID, server.config.Hostname)
+	fmt.Fprintf(&buf, "Date: %s\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Content-Type: text/plain; charset=UTF-8\n\n")
+	fmt.Fprintf(&buf, "%s\n", result)
+	confirmation.Data = smtp.NewBody(buf.Bytes())
+
+	if reply := server.DeliverMessage(confirmation); reply != nil {
+		server.log.Error("failed to deliver alias confirmation", zap.String("id", en.ID), zap.Stringer("reply", reply))
+	}
+}
@@ -0,0 +1,222 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/mail"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/dkim"
+	"src.bluestatic.org/mailpopbox/dmarc"
+	"src.bluestatic.org/mailpopbox/smtp"
+	"src.bluestatic.org/mailpopbox/spf"
+)
+
+// authDNSTimeout bounds the DNS lookups performed to authenticate a single
+// inbound message.
+const authDNSTimeout = 30 * time.Second
+
+// dnsResolver performs the DNS lookups needed to authenticate inbound mail. It
+// is implemented by *net.Resolver.
+type dnsResolver interface {
+	dkim.Resolver
+	dmarc.Resolver
+	spf.Resolver
+}
+
+func (server *smtpServer) dnsResolver() dnsResolver {
+	if server.resolver != nil {
+		return server.resolver
+	}
+	return net.DefaultResolver
+}
+
+func (server *smtpServer) CheckSender(remoteAddr net.Addr, ehlo string, mailFrom mail.Address) *spf.Check {
+	ip := addrIP(remoteAddr)
+	if ip == nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), authDNSTimeout)
+	defer cancel()
+
+	check := spf.Evaluate(ctx, server.dnsResolver(), ip, ehlo, mailFrom.Address)
+	return &check
+}
+
+func (server *smtpServer) RejectSPFFailure(rcpt mail.Address) bool {
+	s := server.serverForAddress(rcpt)
+	return s != nil && s.SPFPolicy == SPFPolicyReject
+}
+
+// addrIP returns the IP address of |addr|, or nil if it does not have one.
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.IPAddr:
+		return addr.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+// authenticateMessage records the SPF result, verifies the DKIM signatures and
+// evaluates the DMARC policy of the inbound message |en|, and prepends an
+// RFC 8601 Authentication-Results header field with the outcome. Any existing
+// Authentication-Results fields that claim to be from this server are removed,
+// as they can only have been forged. If the message should be refused because
+// of its DMARC policy, a ReplyLine is returned.
+func (server *smtpServer) authenticateMessage(en *smtp.Envelope) *smtp.ReplyLine {
+	ctx, cancel := context.WithTimeout(context.Background(), authDNSTimeout)
+	defer cancel()
+
+	authservID := server.config.Hostname
+	header := removeAuthenticationResults(en.Data.Header(), authservID)
+	en.Data.SetHeader(header)
+
+	var results []string
+	if en.SPF != nil {
+		results = append(results, en.SPF.AuthResult())
+	}
+
+	dkimResults := dkim.Verify(ctx, server.dnsResolver(), en.Data.Reader())
+	for _, v := range dkimResults {
+		server.log.Info("verified DKIM signature",
+			zap.String("id", en.ID),
+			zap.String("result", string(v.Result)),
+			zap.String("domain", v.Domain),
+			zap.Error(v.Err))
+		results = append(results, v.AuthResult())
+	}
+
+	var reply *smtp.ReplyLine
+	if fromDomain := headerFromDomain(header); fromDomain != "" {
+		eval := dmarc.Evaluate(ctx, server.dnsResolver(), fromDomain, en.SPF, dkimResults)
+		server.log.Info("evaluated DMARC policy",
+			zap.String("id", en.ID),
+			zap.String("result", string(eval.Result)),
+			zap.String("domain", eval.Domain),
+			zap.String("disposition", string(eval.Disposition)),
+			zap.Error(eval.Err))
+		results = append(results, eval.AuthResult())
+
+		var quarantine bool
+		reply, quarantine = server.applyDMARCPolicy(en.RcptTo[0], eval)
+		if quarantine {
+			en.Data.Prepend([]byte("X-Quarantine-Reason: DMARC policy of " + eval.Domain + "\r\n"))
+		}
+	}
+
+	authResults := "Authentication-Results: " + authservID + ";\r\n\t" + strings.Join(results, ";\r\n\t") + "\r\n"
+	en.Data.Prepend([]byte(authResults))
+	return reply
+}
+
+// applyDMARCPolicy decides, based on the configured DMARCPolicy for |rcpt|,
+// whether a message with the DMARC |eval| should be refused or quarantined.
+func (server *smtpServer) applyDMARCPolicy(rcpt mail.Address, eval dmarc.Evaluation) (reply *smtp.ReplyLine, quarantine bool) {
+	s := server.serverForAddress(rcpt)
+	if s == nil || eval.Disposition == dmarc.PolicyNone {
+		return nil, false
+	}
+
+	switch s.DMARCPolicy {
+	case DMARCPolicyEnforce:
+		if eval.Disposition == dmarc.PolicyReject {
+			return &smtp.ReplyLine{Code: 550, Status: "5.7.1", Message: "message rejected by DMARC policy of " + eval.Domain}, false
+		}
+		return nil, true
+	case DMARCPolicyQuarantine:
+		return nil, true
+	}
+	return nil, false
+}
+
+// headerFromDomain returns the domain of the From header field of |msg|. If
+// the field is missing, invalid, or names addresses in different domains, an
+// empty string is returned.
+func headerFromDomain(msg []byte) string {
+	m, err := mail.ReadMessage(bytes.NewReader(msg))
+	if err != nil {
+		return ""
+	}
+	from, err := m.Header.AddressList("From")
+	if err != nil || len(from) == 0 {
+		return ""
+	}
+
+	domain := strings.ToLower(smtp.DomainForAddress(*from[0]))
+	for _, addr := range from[1:] {
+		if !strings.EqualFold(smtp.DomainForAddress(*addr), domain) {
+			return ""
+		}
+	}
+	return domain
+}
+
+// removeAuthenticationResults returns |msg| without any Authentication-Results
+// header fields whose authserv-id is |authservID|.
+func removeAuthenticationResults(msg []byte, authservID string) []byte {
+	var out bytes.Buffer
+	skipping := false
+	rest := msg
+	for len(rest) > 0 {
+		line := rest
+		if idx := bytes.IndexByte(rest, '\n'); idx != -1 {
+			line = rest[:idx+1]
+		}
+		rest = rest[len(line):]
+
+		trimmed := bytes.TrimRight(line, "\r\n")
+		if len(trimmed) == 0 {
+			// End of the header.
+			out.Write(line)
+			out.Write(rest)
+			break
+		}
+
+		if trimmed[0] == ' ' || trimmed[0] == '\t' {
+			if !skipping {
+				out.Write(line)
+			}
+			continue
+		}
+
+		skipping = isOwnAuthenticationResults(string(trimmed), authservID)
+		if !skipping {
+			out.Write(line)
+		}
+	}
+	return out.Bytes()
+}
+
+// isOwnAuthenticationResults returns whether the first line of a header field,
+// |field|, is an Authentication-Results field with the |authservID|.
+func isOwnAuthenticationResults(field, authservID string) bool {
+	colon := strings.IndexByte(field, ':')
+	if colon == -1 || !strings.EqualFold(strings.TrimSpace(field[:colon]), "Authentication-Results") {
+		return false
+	}
+	value := strings.TrimSpace(field[colon+1:])
+	id := value
+	if idx := strings.IndexAny(value, "; \t"); idx != -1 {
+		id = value[:idx]
+	}
+	return strings.EqualFold(id, authservID)
+}
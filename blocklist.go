@@ -0,0 +1,77 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+// blocklist matches mail addresses against a list of patterns, ignoring case.
+// A pattern enclosed in slashes, like "/^spam[0-9]+@/", is a regular
+// expression that must match the whole address. Any other pattern is a glob,
+// like "*-deals@example.com". A glob without an "@" is matched against just
+// the local part of the address.
+type blocklist struct {
+	globs   []string
+	regexps []*regexp.Regexp
+}
+
+func newBlocklist(patterns []string) (*blocklist, error) {
+	b := &blocklist{}
+	for _, pattern := range patterns {
+		if len(pattern) > 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+			re, err := regexp.Compile("(?i)^(?:" + pattern[1:len(pattern)-1] + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("blocklist pattern %q: %v", pattern, err)
+			}
+			b.regexps = append(b.regexps, re)
+			continue
+		}
+
+		// Envelope addresses have normalized domains, so the domains of
+		// patterns are normalized too.
+		if normalized, err := smtp.NormalizeAddress(pattern); err == nil {
+			pattern = normalized
+		}
+		pattern = strings.ToLower(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("blocklist pattern %q: %v", pattern, err)
+		}
+		b.globs = append(b.globs, pattern)
+	}
+	return b, nil
+}
+
+// matches returns whether |address| is blocked.
+func (b *blocklist) matches(address string) bool {
+	address = strings.ToLower(address)
+	localPart := address
+	if idx := strings.LastIndexByte(address, '@'); idx != -1 {
+		localPart = address[:idx]
+	}
+
+	for _, glob := range b.globs {
+		subject := address
+		if !strings.Contains(glob, "@") {
+			subject = localPart
+		}
+		if ok, _ := path.Match(glob, subject); ok {
+			return true
+		}
+	}
+	for _, re := range b.regexps {
+		if re.MatchString(address) {
+			return true
+		}
+	}
+	return false
+}
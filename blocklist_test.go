@@ -0,0 +1,53 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"testing"
+)
+
+func TestBlocklist(t *testing.T) {
+	b, err := newBlocklist([]string{
+		"Leaked@example.com",
+		"*-deals@example.com",
+		"spam?",
+		`/^promo[0-9]+@example\.com$/`,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		address string
+		blocked bool
+	}{
+		{"leaked@example.com", true},
+		{"LEAKED@EXAMPLE.COM", true},
+		{"leaked2@example.com", false},
+		{"shop-deals@example.com", true},
+		{"shop-deals@other.com", false},
+		{"spam1@example.com", true},
+		{"spam12@example.com", false},
+		{"Promo42@example.com", true},
+		{"promo@example.com", false},
+		{"xpromo42@example.com", false},
+		{"hello@example.com", false},
+	}
+	for _, test := range tests {
+		if actual := b.matches(test.address); actual != test.blocked {
+			t.Errorf("%s: expected blocked=%v, got %v", test.address, test.blocked, actual)
+		}
+	}
+}
+
+func TestBlocklistInvalidPattern(t *testing.T) {
+	for _, pattern := range []string{"[abc@example.com", "/(unclosed/"} {
+		if _, err := newBlocklist([]string{pattern}); err == nil {
+			t.Errorf("Expected %q to be invalid", pattern)
+		}
+	}
+}
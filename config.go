@@ -8,20 +8,72 @@ package main
 
 import (
 	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"src.bluestatic.org/mailpopbox/dkim"
+	"src.bluestatic.org/mailpopbox/smtp"
 )
 
 type Config struct {
 	SMTPPort int
 	POP3Port int
 
+	// POP3STLSPort is the port of a second POP3 listener, such as 110, that
+	// does not use implicit TLS. Clients upgrade their connections to it with
+	// the STLS command. If zero, it is not run. It requires TLS.
+	POP3STLSPort int
+
+	// POP3RequireTLS refuses USER and PASS on POP3 connections that are not
+	// encrypted, so that clients must use STLS first.
+	POP3RequireTLS bool
+
+	// POP3LoginDelay is the minimum number of seconds between the POP3
+	// logins of an account. A login that comes sooner is refused. If zero,
+	// logins are not limited.
+	POP3LoginDelay int
+
+	// POP3ExpireDays is the number of days after which messages that have
+	// been retrieved with POP3, but not deleted, are deleted by the server the
+	// next time the account logs in. If zero, they are kept.
+	POP3ExpireDays int
+
+	// IMAPPort is the port of the IMAP server, which shares the maildrops
+	// with POP3. If zero, the IMAP server is not run. It requires TLS.
+	IMAPPort int
+
 	// Hostname is the name of the MX server that is running.
 	Hostname string
 
+	// RelayQueuePath is the directory where outbound messages are stored until
+	// they are relayed. If empty, a directory under the system's temporary
+	// directory is used.
+	RelayQueuePath string
+
+	// RelayQueueLifetimeHours is how long delivery of an outbound message is
+	// retried before it is returned to the sender. Defaults to 5 days.
+	RelayQueueLifetimeHours int
+
 	Servers []Server
 }
 
 const MailboxAccount = "mailbox@"
 
+const (
+	SPFPolicyAnnotate = "annotate"
+	SPFPolicyReject   = "reject"
+)
+
+const (
+	DMARCPolicyAnnotate   = "annotate"
+	DMARCPolicyQuarantine = "quarantine"
+	DMARCPolicyEnforce    = "enforce"
+)
+
 type Server struct {
 	// Domain is the second component of a mail address: <local-part@domain.com>.
 	Domain string
@@ -29,14 +81,103 @@ type Server struct {
 	TLSKeyPath  string
 	TLSCertPath string
 
-	// Password for the POP3 mailbox user, mailbox@domain.com.
+	// Password for the POP3 mailbox user, mailbox@domain.com. This should be
+	// a hash created by the hash-password command. An argon2id or bcrypt hash
+	// cannot be used with SCRAM-SHA-256 authentication, but a scram-sha-256
+	// hash can be used with any mechanism. Plaintext passwords are still
+	// accepted, with a warning.
 	MailboxPassword string
 
 	// Location to store the mail messages.
 	MaildropPath string
 
-	// Blacklisted addresses that should not accept mail.
+	// If AliasSubfolders is set, mail for each address other than an account
+	// is stored in a subfolder of the account's maildrop named after the
+	// local part of the address. Logging in as the account gives access to
+	// the mail of every alias, and logging in as <account+alias@domain.com>
+	// to the mail of only that alias. A message sent to several addresses of
+	// an account is stored once, in the subfolder of its first recipient.
+	AliasSubfolders bool
+
+	// Users are the accounts besides the mailbox account, each with its own
+	// login and maildrop. Mail for other addresses at the domain is delivered
+	// to the MaildropPath.
+	Users []User
+
+	// Blacklisted addresses that should not accept mail. Entries are
+	// matched case-insensitively and may be glob patterns, or regular
+	// expressions enclosed in slashes. The list is reloaded on SIGHUP.
 	BlacklistedAddresses []string
+
+	// File in which aliases blocked by sending a BlockSubject command to the
+	// mailbox account are stored. Defaults to "blocked-aliases" in the
+	// MaildropPath.
+	BlockedAliasesPath string
+
+	// How to handle inbound mail whose sender fails its SPF check. The
+	// default, SPFPolicyAnnotate, only records the result in a Received-SPF
+	// header. SPFPolicyReject refuses the mail.
+	SPFPolicy string
+
+	// How to handle inbound mail that fails the DMARC policy of the domain in
+	// its From header. With the default, DMARCPolicyAnnotate, the result is
+	// only recorded in the Authentication-Results header.
+	// DMARCPolicyQuarantine adds an X-Quarantine-Reason header to mail that
+	// the domain owner asks to be quarantined or rejected. DMARCPolicyEnforce
+	// refuses mail that the domain owner asks to be rejected, and quarantines
+	// the rest.
+	DMARCPolicy string
+
+	// Keys used to DKIM-sign messages relayed from this domain. Configuring
+	// more than one key, e.g. an RSA and an Ed25519 key, adds a signature
+	// for each.
+	DKIMKeys []DKIMKey
+
+	// Header fields to include in DKIM signatures. If empty,
+	// dkim.DefaultHeaders is used.
+	DKIMSignedHeaders []string
+
+	// The largest message, in bytes, that is accepted for or relayed from the
+	// domain. Defaults to smtp.DefaultMaxMessageSize. A negative value
+	// removes the limit.
+	MaxMessageSize int64
+}
+
+type DKIMKey struct {
+	// Selector under which the public key is published in DNS, as a TXT
+	// record at <Selector>._domainkey.<Domain>.
+	Selector string
+
+	// Path to a PEM-encoded RSA or Ed25519 private key.
+	KeyPath string
+}
+
+// ReadConfig decodes the JSON configuration file at |path|.
+func ReadConfig(path string) (Config, error) {
+	var config Config
+
+	f, err := os.Open(path)
+	if err != nil {
+		return config, err
+	}
+	defer f.Close()
+
+	err = json.NewDecoder(f).Decode(&config)
+	return config, err
+}
+
+// Validate checks the parts of the configuration that cannot be checked when
+// it is decoded.
+func (c Config) Validate() error {
+	if c.POP3LoginDelay < 0 || c.POP3ExpireDays < 0 {
+		return errors.New("POP3LoginDelay and POP3ExpireDays cannot be negative")
+	}
+	for _, server := range c.Servers {
+		if err := server.validateUsers(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (c Config) GetTLSConfig() (*tls.Config, error) {
@@ -63,3 +204,84 @@ func (c Config) GetTLSConfig() (*tls.Config, error) {
 	config.BuildNameToCertificate()
 	return config, nil
 }
+
+// GetDKIMSigners loads the DKIM keys of each server and returns the signers,
+// keyed by normalized domain.
+func (c Config) GetDKIMSigners() (map[string][]*dkim.Signer, error) {
+	signers := make(map[string][]*dkim.Signer)
+	for _, server := range c.Servers {
+		for _, key := range server.DKIMKeys {
+			data, err := ioutil.ReadFile(key.KeyPath)
+			if err != nil {
+				return nil, err
+			}
+			privateKey, err := dkim.ParsePrivateKey(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", key.KeyPath, err)
+			}
+			domain := server.normalizedDomain()
+			signers[domain] = append(signers[domain], &dkim.Signer{
+				Domain:   domain,
+				Selector: key.Selector,
+				Key:      privateKey,
+				Headers:  server.DKIMSignedHeaders,
+			})
+		}
+	}
+	return signers, nil
+}
+
+// GetBlockedAliasesPath returns the file in which aliases blocked by email
+// command are stored.
+func (s Server) GetBlockedAliasesPath() string {
+	if s.BlockedAliasesPath != "" {
+		return s.BlockedAliasesPath
+	}
+	return filepath.Join(s.MaildropPath, "blocked-aliases")
+}
+
+// normalizedDomain returns the Domain in the form in which it is compared to
+// the domains of addresses, which may differ in case or be IDNA A-labels.
+func (s Server) normalizedDomain() string {
+	return smtp.NormalizeDomain(s.Domain)
+}
+
+// GetMaxMessageSize returns the largest message, in bytes, that is accepted
+// for the domain, or zero if there is no limit.
+func (s Server) GetMaxMessageSize() int64 {
+	if s.MaxMessageSize < 0 {
+		return 0
+	}
+	if s.MaxMessageSize == 0 {
+		return smtp.DefaultMaxMessageSize
+	}
+	return s.MaxMessageSize
+}
+
+// GetBlocklists compiles the BlacklistedAddresses and blocked aliases of each
+// server, keyed by normalized domain.
+func (c Config) GetBlocklists() (map[string]*blocklist, error) {
+	blocklists := make(map[string]*blocklist)
+	for _, server := range c.Servers {
+		b, err := server.getBlocklist(server.BlacklistedAddresses)
+		if err != nil {
+			return nil, err
+		}
+		blocklists[server.normalizedDomain()] = b
+	}
+	return blocklists, nil
+}
+
+// getBlocklist compiles |patterns|, which replace the BlacklistedAddresses,
+// together with the blocked aliases of the server.
+func (s Server) getBlocklist(patterns []string) (*blocklist, error) {
+	aliases, err := readBlockedAliases(s.GetBlockedAliasesPath())
+	if err != nil {
+		return nil, err
+	}
+	b, err := newBlocklist(append(append([]string{}, patterns...), aliases...))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", s.Domain, err)
+	}
+	return b, nil
+}
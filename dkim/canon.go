@@ -0,0 +1,238 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package dkim
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const crlf = "\r\n"
+
+// header is a single header field of a message. The raw form is the field as
+// it appears in the message, including continuation lines, with every line
+// terminated by CRLF.
+type header struct {
+	name string
+	raw  string
+}
+
+// splitMessage separates |msg| into its header fields and body. Lines may be
+// terminated by either LF or CRLF; header fields are normalized to CRLF while
+// the body is returned unmodified.
+func splitMessage(msg []byte) ([]header, []byte) {
+	r := bufio.NewReader(bytes.NewReader(msg))
+	headers, _ := readHeader(r)
+	body, _ := ioutil.ReadAll(r)
+	return headers, body
+}
+
+// readHeader reads the header fields of a message from |r|, leaving it at the
+// start of the body. Lines may be terminated by either LF or CRLF; header
+// fields are normalized to CRLF.
+func readHeader(r *bufio.Reader) ([]header, error) {
+	var headers []header
+	var current *header
+
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return headers, err
+		}
+		if len(line) == 0 && err == io.EOF {
+			return headers, nil
+		}
+		line = bytes.TrimSuffix(line, []byte("\n"))
+		line = bytes.TrimSuffix(line, []byte("\r"))
+
+		if len(line) == 0 {
+			// The blank line separates the header from the body.
+			return headers, nil
+		}
+
+		if (line[0] == ' ' || line[0] == '\t') && current != nil {
+			current.raw += string(line) + crlf
+		} else {
+			name := string(line)
+			if colon := strings.IndexByte(name, ':'); colon != -1 {
+				name = name[:colon]
+			}
+			headers = append(headers, header{
+				name: strings.TrimSpace(name),
+				raw:  string(line) + crlf,
+			})
+			current = &headers[len(headers)-1]
+		}
+
+		if err == io.EOF {
+			return headers, nil
+		}
+	}
+}
+
+func isWSP(c byte) bool {
+	return c == ' ' || c == '\t'
+}
+
+// compressWSP replaces every run of whitespace in |s| with a single space.
+func compressWSP(s string) string {
+	var b strings.Builder
+	inWSP := false
+	for i := 0; i < len(s); i++ {
+		if isWSP(s[i]) {
+			inWSP = true
+			continue
+		}
+		if inWSP {
+			b.WriteByte(' ')
+			inWSP = false
+		}
+		b.WriteByte(s[i])
+	}
+	if inWSP {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
+
+// relaxedHeader applies the "relaxed" header canonicalization algorithm of
+// RFC 6376 § 3.4.2 to the raw header field |raw|.
+func relaxedHeader(raw string) string {
+	raw = strings.ReplaceAll(raw, crlf, "")
+	raw = strings.ReplaceAll(raw, "\n", "")
+
+	colon := strings.IndexByte(raw, ':')
+	if colon == -1 {
+		return strings.ToLower(strings.TrimSpace(raw)) + ":" + crlf
+	}
+
+	name := strings.ToLower(strings.TrimRight(raw[:colon], " \t"))
+	value := strings.Trim(compressWSP(raw[colon+1:]), " ")
+	return name + ":" + value + crlf
+}
+
+// relaxedBody applies the "relaxed" body canonicalization algorithm of RFC 6376
+// § 3.4.4 to |body|.
+func relaxedBody(body []byte) []byte {
+	return canonicalizeBody("relaxed", body)
+}
+
+// simpleBody applies the "simple" body canonicalization algorithm of RFC 6376
+// § 3.4.3 to |body|.
+func simpleBody(body []byte) []byte {
+	return canonicalizeBody("simple", body)
+}
+
+// bodyCanonicalizer applies a body canonicalization algorithm to the message
+// body written to it, so that the body can be hashed without holding all of
+// it in memory. Lines may be terminated by either LF or CRLF.
+type bodyCanonicalizer struct {
+	relaxed bool
+	w       io.Writer
+	// limit is the number of canonicalized bytes to write to |w|, from the l=
+	// tag of a signature, or -1 to write all of them.
+	limit int64
+	// length is the size of the canonicalized body, including any part of it
+	// beyond the |limit|.
+	length int64
+
+	// line is the partial line that has been written so far.
+	line []byte
+	// emptyLines is the number of empty lines that have not yet been written,
+	// as they are removed if they end the body.
+	emptyLines int
+}
+
+// newBodyCanonicalizer returns a bodyCanonicalizer that writes the body
+// canonicalized by the named |algorithm| to |w|, which is expected to be a
+// hash or buffer that does not fail.
+func newBodyCanonicalizer(algorithm string, w io.Writer, limit int64) *bodyCanonicalizer {
+	return &bodyCanonicalizer{
+		relaxed: algorithm == "relaxed",
+		w:       w,
+		limit:   limit,
+	}
+}
+
+func (c *bodyCanonicalizer) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		idx := bytes.IndexByte(p, '\n')
+		if idx == -1 {
+			c.line = append(c.line, p...)
+			break
+		}
+		c.line = append(c.line, p[:idx]...)
+		c.endLine(bytes.TrimSuffix(c.line, []byte("\r")))
+		c.line = c.line[:0]
+		p = p[idx+1:]
+	}
+	return n, nil
+}
+
+// Close finishes the body, which must be done before its hash is computed.
+func (c *bodyCanonicalizer) Close() error {
+	if len(c.line) > 0 {
+		c.endLine(c.line)
+		c.line = nil
+	}
+	if !c.relaxed && c.length == 0 {
+		// An empty body is a single CRLF in the simple algorithm.
+		c.emit([]byte(crlf))
+	}
+	return nil
+}
+
+func (c *bodyCanonicalizer) endLine(line []byte) {
+	if c.relaxed {
+		line = []byte(strings.TrimRight(compressWSP(string(line)), " "))
+	}
+	if len(line) == 0 {
+		c.emptyLines++
+		return
+	}
+	for ; c.emptyLines > 0; c.emptyLines-- {
+		c.emit([]byte(crlf))
+	}
+	c.emit(line)
+	c.emit([]byte(crlf))
+}
+
+func (c *bodyCanonicalizer) emit(b []byte) {
+	start := c.length
+	c.length += int64(len(b))
+	if c.limit >= 0 {
+		if start >= c.limit {
+			return
+		}
+		if c.length > c.limit {
+			b = b[:c.limit-start]
+		}
+	}
+	c.w.Write(b)
+}
+
+// canonicalizeHeader applies the named header canonicalization algorithm to the
+// raw header field |raw|.
+func canonicalizeHeader(algorithm, raw string) string {
+	if algorithm == "relaxed" {
+		return relaxedHeader(raw)
+	}
+	return raw
+}
+
+// canonicalizeBody applies the named body canonicalization algorithm to |body|.
+func canonicalizeBody(algorithm string, body []byte) []byte {
+	var buf bytes.Buffer
+	c := newBodyCanonicalizer(algorithm, &buf, -1)
+	c.Write(body)
+	c.Close()
+	return buf.Bytes()
+}
@@ -0,0 +1,147 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package dkim
+
+import (
+	"bytes"
+	"testing"
+)
+
+// RFC 6376 § 3.4.5
+const canonExample = "A: X\r\n" +
+	"B : Y\t\r\n" +
+	"\tZ  \r\n" +
+	"\r\n" +
+	" C \r\n" +
+	"D \t E\r\n" +
+	"\r\n" +
+	"\r\n"
+
+func TestSplitMessage(t *testing.T) {
+	headers, body := splitMessage([]byte(canonExample))
+
+	if want, got := 2, len(headers); want != got {
+		t.Fatalf("Want %d headers, got %d", want, got)
+	}
+	if want, got := "A", headers[0].name; want != got {
+		t.Errorf("Want header name %q, got %q", want, got)
+	}
+	if want, got := "B", headers[1].name; want != got {
+		t.Errorf("Want header name %q, got %q", want, got)
+	}
+	if want, got := "B : Y\t\r\n\tZ  \r\n", headers[1].raw; want != got {
+		t.Errorf("Want raw header %q, got %q", want, got)
+	}
+	if want, got := " C \r\nD \t E\r\n\r\n\r\n", string(body); want != got {
+		t.Errorf("Want body %q, got %q", want, got)
+	}
+}
+
+func TestSplitMessageLF(t *testing.T) {
+	headers, body := splitMessage([]byte("From: a@b.c\nSubject: hi\n there\n\nBody\n"))
+
+	if want, got := 2, len(headers); want != got {
+		t.Fatalf("Want %d headers, got %d", want, got)
+	}
+	if want, got := "Subject: hi\r\n there\r\n", headers[1].raw; want != got {
+		t.Errorf("Want raw header %q, got %q", want, got)
+	}
+	if want, got := "Body\n", string(body); want != got {
+		t.Errorf("Want body %q, got %q", want, got)
+	}
+}
+
+func TestRelaxedHeader(t *testing.T) {
+	headers, _ := splitMessage([]byte(canonExample))
+
+	if want, got := "a:X\r\n", relaxedHeader(headers[0].raw); want != got {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+	if want, got := "b:Y Z\r\n", relaxedHeader(headers[1].raw); want != got {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+}
+
+func TestRelaxedBody(t *testing.T) {
+	_, body := splitMessage([]byte(canonExample))
+
+	if want, got := " C\r\nD E\r\n", string(relaxedBody(body)); want != got {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+
+	cases := []struct {
+		body, canon string
+	}{
+		{"", ""},
+		{"\r\n", ""},
+		{"\r\n\r\n\r\n", ""},
+		{"no newline", "no newline\r\n"},
+		{"lf only\n\n", "lf only\r\n"},
+		{"trailing  \t\r\n", "trailing\r\n"},
+	}
+	for i, c := range cases {
+		if got := string(relaxedBody([]byte(c.body))); got != c.canon {
+			t.Errorf("Case %d: want %q, got %q", i, c.canon, got)
+		}
+	}
+}
+
+func TestSimpleBody(t *testing.T) {
+	_, body := splitMessage([]byte(canonExample))
+
+	if want, got := " C \r\nD \t E\r\n", string(simpleBody(body)); want != got {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+
+	cases := []struct {
+		body, canon string
+	}{
+		{"", "\r\n"},
+		{"\r\n\r\n", "\r\n"},
+		{"no newline", "no newline\r\n"},
+		{"lf only \n\n", "lf only \r\n"},
+	}
+	for i, c := range cases {
+		if got := string(simpleBody([]byte(c.body))); got != c.canon {
+			t.Errorf("Case %d: want %q, got %q", i, c.canon, got)
+		}
+	}
+}
+
+func TestBodyCanonicalizerWrites(t *testing.T) {
+	body := "A  line\r\n\r\nsplit\r\n  across \r\nwrites\r\n\r\n"
+	for _, algorithm := range []string{"simple", "relaxed"} {
+		// Writing one byte at a time splits every CRLF.
+		var buf bytes.Buffer
+		c := newBodyCanonicalizer(algorithm, &buf, -1)
+		for i := 0; i < len(body); i++ {
+			c.Write([]byte{body[i]})
+		}
+		c.Close()
+
+		if want, got := string(canonicalizeBody(algorithm, []byte(body))), buf.String(); want != got {
+			t.Errorf("%s: want %q, got %q", algorithm, want, got)
+		}
+		if want, got := int64(buf.Len()), c.length; want != got {
+			t.Errorf("%s: want length %d, got %d", algorithm, want, got)
+		}
+	}
+}
+
+func TestBodyCanonicalizerLimit(t *testing.T) {
+	var buf bytes.Buffer
+	c := newBodyCanonicalizer("simple", &buf, 5)
+	c.Write([]byte("Hello\nworld\n"))
+	c.Close()
+
+	if want, got := "Hello", buf.String(); want != got {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+	if want, got := int64(len("Hello\r\nworld\r\n")), c.length; want != got {
+		t.Errorf("Want length %d, got %d", want, got)
+	}
+}
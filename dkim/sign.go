@@ -0,0 +1,209 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+// Package dkim implements DomainKeys Identified Mail (RFC 6376) signatures
+// using the rsa-sha256 and ed25519-sha256 (RFC 8463) algorithms.
+package dkim
+
+import (
+	"bufio"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// DefaultHeaders is the list of header fields that are signed if a Signer does
+// not specify its own. Only the fields present in a message are signed.
+var DefaultHeaders = []string{
+	"From",
+	"Reply-To",
+	"Subject",
+	"Date",
+	"To",
+	"Cc",
+	"Message-ID",
+	"In-Reply-To",
+	"References",
+	"MIME-Version",
+	"Content-Type",
+	"Content-Transfer-Encoding",
+}
+
+// Signer creates DKIM-Signature header fields for messages from a domain.
+type Signer struct {
+	// Domain is the signing domain, the d= tag.
+	Domain string
+	// Selector is the DNS selector for the public key, the s= tag.
+	Selector string
+	// Key is either an *rsa.PrivateKey or an ed25519.PrivateKey.
+	Key crypto.Signer
+	// Headers is the list of header fields to sign. The From field is always
+	// signed. If empty, DefaultHeaders is used.
+	Headers []string
+}
+
+// ParsePrivateKey decodes a PEM-encoded RSA (PKCS #1 or PKCS #8) or Ed25519
+// (PKCS #8) private key.
+func ParsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("dkim: no PEM data found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("dkim: %v", err)
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("dkim: unsupported private key type %T", key)
+}
+
+func (s *Signer) algorithm() (string, error) {
+	switch s.Key.(type) {
+	case *rsa.PrivateKey:
+		return "rsa-sha256", nil
+	case ed25519.PrivateKey:
+		return "ed25519-sha256", nil
+	}
+	return "", fmt.Errorf("dkim: unsupported key type %T", s.Key)
+}
+
+// signedHeaders returns the names of the header fields of |headers| to sign,
+// with a name repeated once for each instance of the field.
+func (s *Signer) signedHeaders(headers []header) []string {
+	names := s.Headers
+	if len(names) == 0 {
+		names = DefaultHeaders
+	}
+
+	hasFrom := false
+	for _, name := range names {
+		if strings.EqualFold(name, "From") {
+			hasFrom = true
+		}
+	}
+	if !hasFrom {
+		names = append([]string{"From"}, names...)
+	}
+
+	var signed []string
+	for _, name := range names {
+		for _, h := range headers {
+			if strings.EqualFold(h.name, name) {
+				signed = append(signed, strings.ToLower(name))
+			}
+		}
+	}
+	return signed
+}
+
+// Sign computes a DKIM signature over the message read from |msg| using the
+// relaxed/relaxed canonicalization. It returns the DKIM-Signature header
+// field, terminated by CRLF, which should be prepended to the message.
+func (s *Signer) Sign(msg io.Reader) (string, error) {
+	algorithm, err := s.algorithm()
+	if err != nil {
+		return "", err
+	}
+
+	r := bufio.NewReader(msg)
+	headers, err := readHeader(r)
+	if err != nil {
+		return "", fmt.Errorf("dkim: %v", err)
+	}
+	signed := s.signedHeaders(headers)
+	if len(signed) == 0 {
+		return "", errors.New("dkim: message has no From header")
+	}
+
+	bh := sha256.New()
+	canon := newBodyCanonicalizer("relaxed", bh, -1)
+	if _, err := io.Copy(canon, r); err != nil {
+		return "", fmt.Errorf("dkim: %v", err)
+	}
+	canon.Close()
+	bodyHash := bh.Sum(nil)
+
+	var sig strings.Builder
+	fmt.Fprintf(&sig, "DKIM-Signature: v=1; a=%s; c=relaxed/relaxed; d=%s; s=%s;%s", algorithm, s.Domain, s.Selector, crlf)
+	fmt.Fprintf(&sig, "\tt=%d; h=%s;%s", time.Now().Unix(), strings.Join(signed, ":"), crlf)
+	fmt.Fprintf(&sig, "\tbh=%s;%s", base64.StdEncoding.EncodeToString(bodyHash), crlf)
+	fmt.Fprintf(&sig, "\tb=")
+
+	h := sha256.New()
+	for _, field := range selectHeaders(headers, signed) {
+		h.Write([]byte(relaxedHeader(field.raw)))
+	}
+	h.Write([]byte(strings.TrimSuffix(relaxedHeader(sig.String()), crlf)))
+	digest := h.Sum(nil)
+
+	var b []byte
+	switch key := s.Key.(type) {
+	case *rsa.PrivateKey:
+		b, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest)
+	case ed25519.PrivateKey:
+		b = ed25519.Sign(key, digest)
+	}
+	if err != nil {
+		return "", fmt.Errorf("dkim: %v", err)
+	}
+
+	sig.WriteString(foldBase64(base64.StdEncoding.EncodeToString(b)))
+	sig.WriteString(crlf)
+	return sig.String(), nil
+}
+
+// selectHeaders returns the header fields to hash for the list of |names| from
+// an h= tag. Multiple instances of a field are selected from the bottom of the
+// header upwards (RFC 6376 § 5.4.2). Names with no remaining instance are
+// skipped.
+func selectHeaders(headers []header, names []string) []header {
+	used := make(map[int]bool)
+	var selected []header
+	for _, name := range names {
+		for i := len(headers) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(headers[i].name, name) {
+				continue
+			}
+			used[i] = true
+			selected = append(selected, headers[i])
+			break
+		}
+	}
+	return selected
+}
+
+// foldBase64 splits a long base64 tag value over multiple header lines.
+func foldBase64(s string) string {
+	const width = 72
+	var b strings.Builder
+	for len(s) > width {
+		b.WriteString(s[:width])
+		b.WriteString(crlf + "\t ")
+		s = s[width:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
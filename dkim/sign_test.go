@@ -0,0 +1,197 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package dkim
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const testMessage = "Received: from somewhere\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\n" +
+	"Subject:   Is dinner\n" +
+	"    ready?\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\n" +
+	"\n" +
+	"Hi.  \n" +
+	"\n" +
+	"We lost the game. Are you hungry yet?\n" +
+	"\n" +
+	"Joe.\n" +
+	"\n"
+
+// The canonicalized form of the signed parts of testMessage.
+const (
+	testCanonHeaders = "from:Joe SixPack <joe@football.example.com>\r\n" +
+		"subject:Is dinner ready?\r\n" +
+		"date:Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+		"to:Suzie Q <suzie@shopping.example.net>\r\n"
+	testCanonBody = "Hi.\r\n" +
+		"\r\n" +
+		"We lost the game. Are you hungry yet?\r\n" +
+		"\r\n" +
+		"Joe.\r\n"
+)
+
+var bTag = regexp.MustCompile(`b=[^;]*$`)
+
+// checkSignature verifies |sig| over testMessage by independently
+// reconstructing the hashed data.
+func checkSignature(t *testing.T, sig string, verify func(digest, b []byte) error) {
+	if !strings.HasPrefix(sig, "DKIM-Signature: ") || !strings.HasSuffix(sig, "\r\n") {
+		t.Fatalf("Malformed signature header %q", sig)
+	}
+
+	bodyHash := sha256.Sum256([]byte(testCanonBody))
+	if want := "bh=" + base64.StdEncoding.EncodeToString(bodyHash[:]) + ";"; !strings.Contains(sig, want) {
+		t.Errorf("Missing body hash %q in %q", want, sig)
+	}
+
+	unfolded := strings.Join(strings.Fields(strings.ReplaceAll(sig, "\r\n", "")), " ")
+
+	match := bTag.FindString(unfolded)
+	if match == "" {
+		t.Fatalf("No b= tag in %q", unfolded)
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(match[2:], " ", ""))
+	if err != nil {
+		t.Fatalf("Failed to decode b= tag: %v", err)
+	}
+
+	canonSig := "dkim-signature:" + strings.TrimPrefix(unfolded[:len(unfolded)-len(match)], "DKIM-Signature: ") + "b="
+
+	h := sha256.New()
+	h.Write([]byte(testCanonHeaders))
+	h.Write([]byte(canonSig))
+	if err := verify(h.Sum(nil), b); err != nil {
+		t.Errorf("Signature does not verify: %v", err)
+	}
+}
+
+func TestSignRSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Signer{
+		Domain:   "football.example.com",
+		Selector: "test",
+		Key:      key,
+		Headers:  []string{"Subject", "Date", "To", "Cc"},
+	}
+	sig, err := s.Sign(strings.NewReader(testMessage))
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+
+	for _, tag := range []string{"v=1;", "a=rsa-sha256;", "c=relaxed/relaxed;", "d=football.example.com;", "s=test;", "h=from:subject:date:to;"} {
+		if !strings.Contains(sig, tag) {
+			t.Errorf("Missing tag %q in %q", tag, sig)
+		}
+	}
+
+	checkSignature(t, sig, func(digest, b []byte) error {
+		return rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest, b)
+	})
+}
+
+func TestSignEd25519(t *testing.T) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Signer{
+		Domain:   "football.example.com",
+		Selector: "test",
+		Key:      key,
+		Headers:  []string{"From", "Subject", "Date", "To"},
+	}
+	sig, err := s.Sign(strings.NewReader(testMessage))
+	if err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+
+	if !strings.Contains(sig, "a=ed25519-sha256;") {
+		t.Errorf("Wrong algorithm in %q", sig)
+	}
+
+	checkSignature(t, sig, func(digest, b []byte) error {
+		if !ed25519.Verify(pub, digest, b) {
+			return errors.New("ed25519 signature mismatch")
+		}
+		return nil
+	})
+}
+
+func TestSignedHeaders(t *testing.T) {
+	headers, _ := splitMessage([]byte("From: a\nTo: b\nTo: c\nX-Other: d\n\n"))
+
+	s := &Signer{}
+	if want, got := "from:to:to", strings.Join(s.signedHeaders(headers), ":"); want != got {
+		t.Errorf("Want default signed headers %q, got %q", want, got)
+	}
+
+	s.Headers = []string{"x-other"}
+	if want, got := "from:x-other", strings.Join(s.signedHeaders(headers), ":"); want != got {
+		t.Errorf("Want signed headers %q, got %q", want, got)
+	}
+}
+
+func TestParsePrivateKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8RSA, err := x509.MarshalPKCS8PrivateKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8Ed, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		block *pem.Block
+		key   crypto.Signer
+	}{
+		{&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}, rsaKey},
+		{&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8RSA}, rsaKey},
+		{&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8Ed}, edKey},
+	}
+	for i, c := range cases {
+		key, err := ParsePrivateKey(pem.EncodeToMemory(c.block))
+		if err != nil {
+			t.Errorf("Case %d: failed to parse key: %v", i, err)
+			continue
+		}
+		if !c.key.Public().(interface{ Equal(crypto.PublicKey) bool }).Equal(key.Public()) {
+			t.Errorf("Case %d: parsed key does not match", i)
+		}
+	}
+
+	if _, err := ParsePrivateKey([]byte("not a key")); err == nil {
+		t.Errorf("Expected error parsing garbage")
+	}
+}
@@ -0,0 +1,461 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package dkim
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resolver looks up the DNS TXT records in which DKIM public keys are
+// published. It is implemented by *net.Resolver.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Result is the outcome of verifying a signature, using the result names of
+// RFC 8601 § 2.7.1.
+type Result string
+
+const (
+	ResultNone      Result = "none"
+	ResultPass      Result = "pass"
+	ResultFail      Result = "fail"
+	ResultTempError Result = "temperror"
+	ResultPermError Result = "permerror"
+)
+
+// Verification is the outcome of verifying a single DKIM-Signature.
+type Verification struct {
+	Result Result
+	// Domain is the signing domain, from the d= tag.
+	Domain string
+	// Selector is the key selector, from the s= tag.
+	Selector string
+	// Identifier is the agent or user identifier, from the i= tag.
+	Identifier string
+	// Algorithm is the signing algorithm, from the a= tag.
+	Algorithm string
+	// Signature is the base64 signature data, from the b= tag.
+	Signature string
+	// Err describes why the Result is not ResultPass.
+	Err error
+}
+
+// AuthResult formats the Verification as a method result for an
+// Authentication-Results header field (RFC 8601).
+func (v Verification) AuthResult() string {
+	s := "dkim=" + string(v.Result)
+	if v.Err != nil {
+		s += " (" + strings.ReplaceAll(v.Err.Error(), ")", "") + ")"
+	}
+	if v.Domain != "" {
+		s += " header.d=" + v.Domain
+	}
+	if v.Identifier != "" {
+		s += " header.i=" + v.Identifier
+	}
+	if v.Selector != "" {
+		s += " header.s=" + v.Selector
+	}
+	if v.Algorithm != "" {
+		s += " header.a=" + v.Algorithm
+	}
+	if len(v.Signature) >= 8 {
+		s += " header.b=" + v.Signature[:8]
+	}
+	return s
+}
+
+// signature holds the parsed tags of a DKIM-Signature header field.
+type signature struct {
+	algorithm     string
+	headerCanon   string
+	bodyCanon     string
+	domain        string
+	selector      string
+	identifier    string
+	headers       []string
+	bodyHash      []byte
+	data          []byte
+	bodyLength    int64
+	expiration    int64
+	rawSignature  string
+	headerWithout string
+}
+
+// Verify checks every DKIM-Signature header field in the message read from
+// |msg|, fetching public keys with |resolver|. It returns one Verification per
+// signature, or a single Verification with ResultNone if the message is not
+// signed.
+func Verify(ctx context.Context, resolver Resolver, msg io.Reader) []Verification {
+	r := bufio.NewReader(msg)
+	headers, err := readHeader(r)
+	if err != nil {
+		return []Verification{{Result: ResultTempError, Err: err}}
+	}
+
+	var checks []*signatureCheck
+	var bodyWriters []io.Writer
+	for _, h := range headers {
+		if !strings.EqualFold(h.name, "DKIM-Signature") {
+			continue
+		}
+		c := prepareSignature(ctx, resolver, h)
+		if c.canon != nil {
+			bodyWriters = append(bodyWriters, c.canon)
+		}
+		checks = append(checks, c)
+	}
+
+	// The body is read once and hashed for all the signatures together.
+	var bodyErr error
+	if len(bodyWriters) > 0 {
+		_, bodyErr = io.Copy(io.MultiWriter(bodyWriters...), r)
+	}
+
+	var results []Verification
+	for _, c := range checks {
+		if bodyErr != nil && c.canon != nil {
+			results = append(results, Verification{
+				Result:     ResultTempError,
+				Err:        bodyErr,
+				Domain:     c.sig.domain,
+				Selector:   c.sig.selector,
+				Identifier: c.sig.identifier,
+				Algorithm:  c.sig.algorithm,
+				Signature:  c.sig.rawSignature,
+			})
+			continue
+		}
+		results = append(results, c.finish(headers))
+	}
+
+	if len(results) == 0 {
+		results = append(results, Verification{Result: ResultNone})
+	}
+	return results
+}
+
+// signatureCheck is the verification of a single signature. If the signature
+// can be checked, the message body is written to its canonicalizer before the
+// check is finished.
+type signatureCheck struct {
+	v        Verification
+	sig      *signature
+	key      crypto.PublicKey
+	bodyHash hash.Hash
+	canon    *bodyCanonicalizer
+}
+
+// prepareSignature parses the DKIM-Signature header field |h| and looks up its
+// key. If either fails, the returned check has no canonicalizer and its
+// Verification is final.
+func prepareSignature(ctx context.Context, resolver Resolver, h header) *signatureCheck {
+	sig, err := parseSignature(h.raw)
+	c := &signatureCheck{
+		v:   Verification{Result: ResultPermError, Err: err},
+		sig: sig,
+	}
+	if sig == nil {
+		return c
+	}
+
+	c.v.Domain = sig.domain
+	c.v.Selector = sig.selector
+	c.v.Identifier = sig.identifier
+	c.v.Algorithm = sig.algorithm
+	c.v.Signature = sig.rawSignature
+	if err != nil {
+		return c
+	}
+
+	if sig.expiration != 0 && time.Now().Unix() > sig.expiration {
+		c.v.Err = errors.New("signature expired")
+		return c
+	}
+
+	c.key, err = lookupKey(ctx, resolver, sig)
+	if err != nil {
+		c.v.Err = err
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && !dnsErr.IsNotFound {
+			c.v.Result = ResultTempError
+		}
+		return c
+	}
+
+	c.bodyHash = sha256.New()
+	c.canon = newBodyCanonicalizer(sig.bodyCanon, c.bodyHash, sig.bodyLength)
+	return c
+}
+
+// finish completes the check after the body has been written, using the
+// message |headers| to compute the signed digest.
+func (c *signatureCheck) finish(headers []header) Verification {
+	if c.canon == nil {
+		return c.v
+	}
+	sig, v := c.sig, c.v
+
+	c.canon.Close()
+	if sig.bodyLength >= 0 && sig.bodyLength > c.canon.length {
+		v.Err = errors.New("body length exceeds message")
+		return v
+	}
+	if subtle.ConstantTimeCompare(c.bodyHash.Sum(nil), sig.bodyHash) != 1 {
+		v.Result = ResultFail
+		v.Err = errors.New("body hash did not verify")
+		return v
+	}
+
+	hash := sha256.New()
+	for _, field := range selectHeaders(headers, sig.headers) {
+		hash.Write([]byte(canonicalizeHeader(sig.headerCanon, field.raw)))
+	}
+	hash.Write([]byte(strings.TrimSuffix(canonicalizeHeader(sig.headerCanon, sig.headerWithout), crlf)))
+	digest := hash.Sum(nil)
+
+	var err error
+	switch key := c.key.(type) {
+	case *rsa.PublicKey:
+		err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, sig.data)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(key, digest, sig.data) {
+			err = errors.New("ed25519 verification failed")
+		}
+	}
+	if err != nil {
+		v.Result = ResultFail
+		v.Err = errors.New("signature did not verify")
+		return v
+	}
+
+	v.Result = ResultPass
+	v.Err = nil
+	return v
+}
+
+// parseTags parses a DKIM tag-value list (RFC 6376 § 3.2).
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(s, ";") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		eq := strings.IndexByte(spec, '=')
+		if eq == -1 {
+			return nil, fmt.Errorf("malformed tag %q", spec)
+		}
+		name := strings.TrimSpace(spec[:eq])
+		if _, ok := tags[name]; ok {
+			return nil, fmt.Errorf("duplicate tag %q", name)
+		}
+		tags[name] = strings.TrimSpace(spec[eq+1:])
+	}
+	return tags, nil
+}
+
+// removeFWS strips all folding whitespace from a tag value.
+func removeFWS(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r == ' ' || r == '\t' || r == '\r' || r == '\n' {
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// parseSignature parses the raw DKIM-Signature header field. If the tags can
+// be parsed but are semantically invalid, both the signature and an error are
+// returned so the caller can report the identity of the signer.
+func parseSignature(raw string) (*signature, error) {
+	colon := strings.IndexByte(raw, ':')
+	if colon == -1 {
+		return nil, errors.New("malformed signature")
+	}
+	tags, err := parseTags(raw[colon+1:])
+	if err != nil {
+		return nil, err
+	}
+
+	sig := &signature{
+		algorithm:     tags["a"],
+		domain:        tags["d"],
+		selector:      tags["s"],
+		identifier:    tags["i"],
+		rawSignature:  removeFWS(tags["b"]),
+		headerWithout: stripSignatureData(raw),
+		bodyLength:    -1,
+	}
+
+	for _, required := range []string{"v", "a", "b", "bh", "d", "h", "s"} {
+		if _, ok := tags[required]; !ok {
+			return sig, fmt.Errorf("missing required tag %s=", required)
+		}
+	}
+
+	if tags["v"] != "1" {
+		return sig, fmt.Errorf("unsupported version %q", tags["v"])
+	}
+	if sig.algorithm != "rsa-sha256" && sig.algorithm != "ed25519-sha256" {
+		return sig, fmt.Errorf("unsupported algorithm %q", sig.algorithm)
+	}
+
+	sig.headerCanon, sig.bodyCanon = "simple", "simple"
+	if c, ok := tags["c"]; ok {
+		parts := strings.SplitN(c, "/", 2)
+		sig.headerCanon = parts[0]
+		if len(parts) == 2 {
+			sig.bodyCanon = parts[1]
+		}
+	}
+	for _, c := range []string{sig.headerCanon, sig.bodyCanon} {
+		if c != "simple" && c != "relaxed" {
+			return sig, fmt.Errorf("unsupported canonicalization %q", c)
+		}
+	}
+
+	if sig.identifier == "" {
+		sig.identifier = "@" + sig.domain
+	} else {
+		idDomain := strings.ToLower(sig.identifier[strings.LastIndexByte(sig.identifier, '@')+1:])
+		domain := strings.ToLower(sig.domain)
+		if idDomain != domain && !strings.HasSuffix(idDomain, "."+domain) {
+			return sig, errors.New("identity is not within the signing domain")
+		}
+	}
+
+	hasFrom := false
+	for _, name := range strings.Split(tags["h"], ":") {
+		name = strings.TrimSpace(name)
+		if strings.EqualFold(name, "From") {
+			hasFrom = true
+		}
+		sig.headers = append(sig.headers, name)
+	}
+	if !hasFrom {
+		return sig, errors.New("From field not signed")
+	}
+
+	if sig.bodyHash, err = base64.StdEncoding.DecodeString(removeFWS(tags["bh"])); err != nil {
+		return sig, errors.New("malformed body hash")
+	}
+	if sig.data, err = base64.StdEncoding.DecodeString(sig.rawSignature); err != nil {
+		return sig, errors.New("malformed signature data")
+	}
+
+	if l, ok := tags["l"]; ok {
+		if sig.bodyLength, err = strconv.ParseInt(l, 10, 64); err != nil || sig.bodyLength < 0 {
+			return sig, errors.New("malformed body length")
+		}
+	}
+	if x, ok := tags["x"]; ok {
+		if sig.expiration, err = strconv.ParseInt(x, 10, 64); err != nil {
+			return sig, errors.New("malformed expiration")
+		}
+	}
+
+	return sig, nil
+}
+
+// stripSignatureData removes the value of the b= tag from the raw
+// DKIM-Signature header field, for computing the header hash.
+func stripSignatureData(raw string) string {
+	colon := strings.IndexByte(raw, ':')
+	value := strings.TrimSuffix(raw[colon+1:], crlf)
+
+	var b strings.Builder
+	b.WriteString(raw[:colon+1])
+	for i, spec := range strings.Split(value, ";") {
+		if i > 0 {
+			b.WriteByte(';')
+		}
+		eq := strings.IndexByte(spec, '=')
+		if eq != -1 && strings.TrimSpace(spec[:eq]) == "b" {
+			b.WriteString(spec[:eq+1])
+			continue
+		}
+		b.WriteString(spec)
+	}
+	b.WriteString(crlf)
+	return b.String()
+}
+
+// lookupKey fetches and parses the public key for |sig|.
+func lookupKey(ctx context.Context, resolver Resolver, sig *signature) (crypto.PublicKey, error) {
+	txts, err := resolver.LookupTXT(ctx, sig.selector+"._domainkey."+sig.domain)
+	if err != nil {
+		return nil, err
+	}
+	if len(txts) == 0 {
+		return nil, errors.New("no key for signature")
+	}
+
+	tags, err := parseTags(txts[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed key record: %v", err)
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, fmt.Errorf("unsupported key version %q", v)
+	}
+
+	p := removeFWS(tags["p"])
+	if p == "" {
+		return nil, errors.New("key revoked")
+	}
+	data, err := base64.StdEncoding.DecodeString(p)
+	if err != nil {
+		return nil, errors.New("malformed public key")
+	}
+
+	keyType := tags["k"]
+	if keyType == "" {
+		keyType = "rsa"
+	}
+	if !strings.HasPrefix(sig.algorithm, keyType+"-") {
+		return nil, fmt.Errorf("key type %q does not match algorithm %q", keyType, sig.algorithm)
+	}
+
+	switch keyType {
+	case "rsa":
+		pub, err := x509.ParsePKIXPublicKey(data)
+		if err != nil {
+			pub, err = x509.ParsePKCS1PublicKey(data)
+		}
+		if err != nil {
+			return nil, errors.New("malformed public key")
+		}
+		rsaKey, ok := pub.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("malformed public key")
+		}
+		return rsaKey, nil
+	case "ed25519":
+		if len(data) != ed25519.PublicKeySize {
+			return nil, errors.New("malformed public key")
+		}
+		return ed25519.PublicKey(data), nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", keyType)
+}
@@ -0,0 +1,209 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package dkim
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"strings"
+	"testing"
+)
+
+type testResolver struct {
+	txt map[string]string
+	err error
+}
+
+func (r *testResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if txt, ok := r.txt[name]; ok {
+		return []string{txt}, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// RFC 8463 § A.3
+const rfc8463Message = "DKIM-Signature: v=1; a=ed25519-sha256; c=relaxed/relaxed;\r\n" +
+	" d=football.example.com; i=@football.example.com;\r\n" +
+	" q=dns/txt; s=brisbane; t=1528637909; h=from : to :\r\n" +
+	" subject : date : message-id : from : subject : date;\r\n" +
+	" bh=2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8=;\r\n" +
+	" b=/gCrinpcQOoIfuHNQIbq4pgh9kyIK3AQUdt9OdqQehSwhEIug4D11Bus\r\n" +
+	" Fa3bT3FY5OsU7ZbnKELq+eXdp1Q1Dw==\r\n" +
+	"From: Joe SixPack <joe@football.example.com>\r\n" +
+	"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+	"Subject: Is dinner ready?\r\n" +
+	"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+	"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n" +
+	"\r\n" +
+	"Hi.\r\n" +
+	"\r\n" +
+	"We lost the game.  Are you hungry yet?\r\n" +
+	"\r\n" +
+	"Joe.\r\n"
+
+var rfc8463Resolver = &testResolver{
+	txt: map[string]string{
+		"brisbane._domainkey.football.example.com": "v=DKIM1; k=ed25519; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=",
+	},
+}
+
+func verifyOne(t *testing.T, resolver Resolver, msg string) Verification {
+	results := Verify(context.Background(), resolver, strings.NewReader(msg))
+	if len(results) != 1 {
+		t.Fatalf("Want 1 result, got %d: %v", len(results), results)
+	}
+	return results[0]
+}
+
+func TestVerifyRFC8463(t *testing.T) {
+	v := verifyOne(t, rfc8463Resolver, rfc8463Message)
+	if v.Result != ResultPass {
+		t.Errorf("Want pass, got %s: %v", v.Result, v.Err)
+	}
+	if want, got := "football.example.com", v.Domain; want != got {
+		t.Errorf("Want domain %q, got %q", want, got)
+	}
+	if want, got := "brisbane", v.Selector; want != got {
+		t.Errorf("Want selector %q, got %q", want, got)
+	}
+
+	want := "dkim=pass header.d=football.example.com header.i=@football.example.com header.s=brisbane header.a=ed25519-sha256 header.b=/gCrinpc"
+	if got := v.AuthResult(); want != got {
+		t.Errorf("Want AuthResult %q, got %q", want, got)
+	}
+}
+
+func TestVerifyTampered(t *testing.T) {
+	v := verifyOne(t, rfc8463Resolver, strings.Replace(rfc8463Message, "hungry", "thirsty", 1))
+	if v.Result != ResultFail || !strings.Contains(v.Err.Error(), "body hash") {
+		t.Errorf("Want body hash failure, got %s: %v", v.Result, v.Err)
+	}
+
+	v = verifyOne(t, rfc8463Resolver, strings.Replace(rfc8463Message, "Is dinner ready?", "Is lunch ready?", 1))
+	if v.Result != ResultFail || !strings.Contains(v.Err.Error(), "signature did not verify") {
+		t.Errorf("Want signature failure, got %s: %v", v.Result, v.Err)
+	}
+
+	// Whitespace changes are tolerated by relaxed canonicalization.
+	v = verifyOne(t, rfc8463Resolver, strings.Replace(rfc8463Message, "Subject: Is dinner ready?", "Subject:  Is   dinner\r\n ready? ", 1))
+	if v.Result != ResultPass {
+		t.Errorf("Want pass, got %s: %v", v.Result, v.Err)
+	}
+}
+
+func TestVerifyUnsigned(t *testing.T) {
+	v := verifyOne(t, rfc8463Resolver, "From: a@b.c\r\n\r\nHello\r\n")
+	if v.Result != ResultNone {
+		t.Errorf("Want none, got %s", v.Result)
+	}
+	if want, got := "dkim=none", v.AuthResult(); want != got {
+		t.Errorf("Want AuthResult %q, got %q", want, got)
+	}
+}
+
+func TestVerifyKeyErrors(t *testing.T) {
+	v := verifyOne(t, &testResolver{}, rfc8463Message)
+	if v.Result != ResultPermError {
+		t.Errorf("Missing key: want permerror, got %s: %v", v.Result, v.Err)
+	}
+
+	v = verifyOne(t, &testResolver{err: &net.DNSError{Err: "timeout", IsTimeout: true}}, rfc8463Message)
+	if v.Result != ResultTempError {
+		t.Errorf("DNS failure: want temperror, got %s: %v", v.Result, v.Err)
+	}
+
+	revoked := &testResolver{
+		txt: map[string]string{
+			"brisbane._domainkey.football.example.com": "v=DKIM1; k=ed25519; p=",
+		},
+	}
+	v = verifyOne(t, revoked, rfc8463Message)
+	if v.Result != ResultPermError || !strings.Contains(v.Err.Error(), "revoked") {
+		t.Errorf("Revoked key: want permerror, got %s: %v", v.Result, v.Err)
+	}
+
+	wrongType := &testResolver{
+		txt: map[string]string{
+			"brisbane._domainkey.football.example.com": "v=DKIM1; p=11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo=",
+		},
+	}
+	v = verifyOne(t, wrongType, rfc8463Message)
+	if v.Result != ResultPermError {
+		t.Errorf("Wrong key type: want permerror, got %s: %v", v.Result, v.Err)
+	}
+}
+
+func TestVerifyMalformedSignature(t *testing.T) {
+	cases := []string{
+		"DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=sel; h=from; bh=AAAA\r\n",
+		"DKIM-Signature: v=2; a=rsa-sha256; d=example.com; s=sel; h=from; bh=AAAA; b=AAAA\r\n",
+		"DKIM-Signature: v=1; a=rsa-sha1; d=example.com; s=sel; h=from; bh=AAAA; b=AAAA\r\n",
+		"DKIM-Signature: v=1; a=rsa-sha256; d=example.com; s=sel; h=to; bh=AAAA; b=AAAA\r\n",
+		"DKIM-Signature: v=1; a=rsa-sha256; d=example.com; i=a@other.com; s=sel; h=from; bh=AAAA; b=AAAA\r\n",
+		"DKIM-Signature: v=1; v=1; a=rsa-sha256; d=example.com; s=sel; h=from; bh=AAAA; b=AAAA\r\n",
+		"DKIM-Signature: garbage\r\n",
+	}
+	for i, c := range cases {
+		v := verifyOne(t, &testResolver{}, c+"From: a@example.com\r\n\r\nHi\r\n")
+		if v.Result != ResultPermError {
+			t.Errorf("Case %d: want permerror, got %s: %v", i, v.Result, v.Err)
+		}
+	}
+}
+
+func TestSignVerifyRoundTrip(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPub, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resolver := &testResolver{
+		txt: map[string]string{
+			"rsa._domainkey.example.com": "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(rsaPub),
+			"ed._domainkey.example.com":  "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(edPub),
+		},
+	}
+
+	msg := []byte(testMessage)
+	for _, s := range []*Signer{
+		{Domain: "example.com", Selector: "rsa", Key: rsaKey},
+		{Domain: "example.com", Selector: "ed", Key: edKey},
+	} {
+		sig, err := s.Sign(bytes.NewReader(msg))
+		if err != nil {
+			t.Fatalf("Failed to sign: %v", err)
+		}
+		msg = append([]byte(sig), msg...)
+	}
+
+	results := Verify(context.Background(), resolver, bytes.NewReader(msg))
+	if want, got := 2, len(results); want != got {
+		t.Fatalf("Want %d results, got %d", want, got)
+	}
+	for _, v := range results {
+		if v.Result != ResultPass {
+			t.Errorf("Signature %s: want pass, got %s: %v", v.Selector, v.Result, v.Err)
+		}
+	}
+}
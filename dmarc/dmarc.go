@@ -0,0 +1,301 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+// Package dmarc implements Domain-based Message Authentication, Reporting, and
+// Conformance (RFC 7489) policy evaluation, using the results of SPF and DKIM
+// checks. Reporting is not supported.
+package dmarc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+
+	"src.bluestatic.org/mailpopbox/dkim"
+	"src.bluestatic.org/mailpopbox/spf"
+)
+
+// Resolver looks up the DNS TXT records in which DMARC policies are published.
+// It is implemented by *net.Resolver.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// Policy is the action a domain owner requests for mail that fails DMARC.
+type Policy string
+
+const (
+	PolicyNone       Policy = "none"
+	PolicyQuarantine Policy = "quarantine"
+	PolicyReject     Policy = "reject"
+)
+
+// Result is the outcome of DMARC evaluation, using the result names of RFC 8601
+// § 2.7.
+type Result string
+
+const (
+	ResultNone      Result = "none"
+	ResultPass      Result = "pass"
+	ResultFail      Result = "fail"
+	ResultTempError Result = "temperror"
+	ResultPermError Result = "permerror"
+)
+
+// Record is a parsed DMARC policy record.
+type Record struct {
+	// Policy is the requested policy, the p= tag.
+	Policy Policy
+	// SubdomainPolicy is the policy for subdomains of the organizational
+	// domain, the sp= tag. It is the same as Policy if not specified.
+	SubdomainPolicy Policy
+	// StrictDKIM and StrictSPF are true if the identifiers must match the
+	// From domain exactly, rather than sharing an organizational domain.
+	StrictDKIM bool
+	StrictSPF  bool
+	// Percent is the percentage of failing messages to which the policy is
+	// applied, the pct= tag.
+	Percent int
+}
+
+// ParseRecord parses the DMARC record |txt| (RFC 7489 § 6.3).
+func ParseRecord(txt string) (*Record, error) {
+	r := &Record{
+		Percent: 100,
+	}
+
+	parts := strings.Split(txt, ";")
+	if version := strings.TrimSpace(parts[0]); strings.ReplaceAll(version, " ", "") != "v=DMARC1" {
+		return nil, fmt.Errorf("invalid version %q", version)
+	}
+
+	for _, part := range parts[1:] {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		eq := strings.IndexByte(part, '=')
+		if eq == -1 {
+			return nil, fmt.Errorf("invalid tag %q", part)
+		}
+		name := strings.ToLower(strings.TrimSpace(part[:eq]))
+		value := strings.TrimSpace(part[eq+1:])
+
+		var err error
+		switch name {
+		case "p":
+			r.Policy, err = parsePolicy(value)
+		case "sp":
+			r.SubdomainPolicy, err = parsePolicy(value)
+		case "adkim":
+			r.StrictDKIM, err = parseAlignment(value)
+		case "aspf":
+			r.StrictSPF, err = parseAlignment(value)
+		case "pct":
+			r.Percent, err = strconv.Atoi(value)
+			if err == nil && (r.Percent < 0 || r.Percent > 100) {
+				err = fmt.Errorf("invalid pct %q", value)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if r.Policy == "" {
+		return nil, errors.New("missing p= tag")
+	}
+	if r.SubdomainPolicy == "" {
+		r.SubdomainPolicy = r.Policy
+	}
+	return r, nil
+}
+
+func parsePolicy(s string) (Policy, error) {
+	switch p := Policy(strings.ToLower(s)); p {
+	case PolicyNone, PolicyQuarantine, PolicyReject:
+		return p, nil
+	}
+	return "", fmt.Errorf("invalid policy %q", s)
+}
+
+func parseAlignment(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "r":
+		return false, nil
+	case "s":
+		return true, nil
+	}
+	return false, fmt.Errorf("invalid alignment mode %q", s)
+}
+
+// OrganizationalDomain returns the registered domain of |domain|, using the
+// public suffix list (RFC 7489 § 3.2).
+func OrganizationalDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	org, err := publicsuffix.EffectiveTLDPlusOne(domain)
+	if err != nil {
+		return domain
+	}
+	return org
+}
+
+// lookupRecord finds the DMARC record for mail from |domain|, falling back to
+// the organizational domain (RFC 7489 § 6.6.3). It returns the domain at which
+// the record was found.
+func lookupRecord(ctx context.Context, resolver Resolver, domain string) (*Record, string, error) {
+	record, err := queryRecord(ctx, resolver, domain)
+	if record != nil || err != nil {
+		return record, domain, err
+	}
+
+	org := OrganizationalDomain(domain)
+	if org == domain {
+		return nil, "", nil
+	}
+	record, err = queryRecord(ctx, resolver, org)
+	return record, org, err
+}
+
+func queryRecord(ctx context.Context, resolver Resolver, domain string) (*Record, error) {
+	txts, err := resolver.LookupTXT(ctx, "_dmarc."+domain)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		return nil, &tempError{err}
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if strings.HasPrefix(strings.ReplaceAll(txt, " ", ""), "v=DMARC1") {
+			records = append(records, txt)
+		}
+	}
+	if len(records) != 1 {
+		// Multiple records are treated as no policy.
+		return nil, nil
+	}
+	return ParseRecord(records[0])
+}
+
+// tempError wraps a DNS failure that prevented the policy from being found.
+type tempError struct {
+	err error
+}
+
+func (e *tempError) Error() string {
+	return fmt.Sprintf("failed to look up DMARC record: %v", e.err)
+}
+
+func (e *tempError) Unwrap() error {
+	return e.err
+}
+
+// Evaluation is the outcome of evaluating the DMARC policy for a message.
+type Evaluation struct {
+	Result Result
+	// Domain is the domain of the message's From header field.
+	Domain string
+	// Record is the policy that was found, if any.
+	Record *Record
+	// Policy is the policy published by the domain owner for Domain.
+	Policy Policy
+	// Disposition is the action to take on the message after applying the
+	// pct= sampling. It is PolicyNone unless the Result is ResultFail.
+	Disposition Policy
+	// Err describes why a policy could not be evaluated.
+	Err error
+}
+
+// Evaluate applies the DMARC policy of |fromDomain|, the domain of the
+// message's From header field, using the SPF check of the reverse-path and the
+// results of verifying the message's DKIM signatures. Either may be nil.
+func Evaluate(ctx context.Context, resolver Resolver, fromDomain string, spfCheck *spf.Check, dkimResults []dkim.Verification) Evaluation {
+	fromDomain = strings.ToLower(strings.TrimSuffix(fromDomain, "."))
+	e := Evaluation{
+		Result:      ResultNone,
+		Domain:      fromDomain,
+		Disposition: PolicyNone,
+	}
+
+	record, recordDomain, err := lookupRecord(ctx, resolver, fromDomain)
+	if err != nil {
+		e.Err = err
+		e.Result = ResultPermError
+		var te *tempError
+		if errors.As(err, &te) {
+			e.Result = ResultTempError
+		}
+		return e
+	}
+	if record == nil {
+		return e
+	}
+
+	e.Record = record
+	e.Policy = record.Policy
+	if recordDomain != fromDomain {
+		e.Policy = record.SubdomainPolicy
+	}
+
+	if spfCheck != nil && spfCheck.Result == spf.ResultPass && aligned(spfCheck.Domain, fromDomain, record.StrictSPF) {
+		e.Result = ResultPass
+		return e
+	}
+	for _, v := range dkimResults {
+		if v.Result == dkim.ResultPass && aligned(v.Domain, fromDomain, record.StrictDKIM) {
+			e.Result = ResultPass
+			return e
+		}
+	}
+
+	e.Result = ResultFail
+	e.Disposition = e.Policy
+	if record.Percent < 100 && rand.Intn(100) >= record.Percent {
+		// Messages not sampled are subject to the next less strict policy
+		// (RFC 7489 § 6.6.4).
+		switch e.Disposition {
+		case PolicyReject:
+			e.Disposition = PolicyQuarantine
+		case PolicyQuarantine:
+			e.Disposition = PolicyNone
+		}
+	}
+	return e
+}
+
+// aligned returns whether the authenticated |domain| is in alignment with the
+// From domain (RFC 7489 § 3.1).
+func aligned(domain, fromDomain string, strict bool) bool {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	if strict {
+		return domain == fromDomain
+	}
+	return OrganizationalDomain(domain) == OrganizationalDomain(fromDomain)
+}
+
+// AuthResult formats the Evaluation as a method result for an
+// Authentication-Results header field (RFC 8601, RFC 7489 § 11.2).
+func (e Evaluation) AuthResult() string {
+	s := "dmarc=" + string(e.Result)
+	if e.Err != nil {
+		s += " (" + strings.NewReplacer("(", "", ")", "").Replace(e.Err.Error()) + ")"
+	} else if e.Record != nil {
+		s += fmt.Sprintf(" (p=%s dis=%s)", e.Policy, e.Disposition)
+	}
+	if e.Domain != "" {
+		s += " header.from=" + e.Domain
+	}
+	return s
+}
@@ -0,0 +1,150 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package dmarc
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"src.bluestatic.org/mailpopbox/dkim"
+	"src.bluestatic.org/mailpopbox/spf"
+)
+
+type testResolver struct {
+	txt  map[string][]string
+	fail bool
+}
+
+func (r *testResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if r.fail {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	if txt, ok := r.txt[name]; ok {
+		return txt, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func TestParseRecord(t *testing.T) {
+	r, err := ParseRecord("v=DMARC1; p=quarantine; sp=reject; adkim=s; aspf=r; pct=50; rua=mailto:dmarc@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Policy != PolicyQuarantine || r.SubdomainPolicy != PolicyReject || !r.StrictDKIM || r.StrictSPF || r.Percent != 50 {
+		t.Errorf("Unexpected record: %+v", r)
+	}
+
+	r, err = ParseRecord("v=DMARC1;p=reject")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.SubdomainPolicy != PolicyReject || r.Percent != 100 {
+		t.Errorf("Unexpected defaults: %+v", r)
+	}
+
+	for _, txt := range []string{
+		"v=DMARC2; p=none",
+		"p=none; v=DMARC1",
+		"v=DMARC1",
+		"v=DMARC1; p=drop",
+		"v=DMARC1; p=none; adkim=x",
+		"v=DMARC1; p=none; pct=101",
+		"v=DMARC1; p",
+	} {
+		if _, err := ParseRecord(txt); err == nil {
+			t.Errorf("Expected %q to be invalid", txt)
+		}
+	}
+}
+
+func TestOrganizationalDomain(t *testing.T) {
+	tests := []struct {
+		domain, org string
+	}{
+		{"example.com", "example.com"},
+		{"mail.example.com", "example.com"},
+		{"a.b.example.co.uk", "example.co.uk"},
+		{"Example.COM.", "example.com"},
+	}
+	for _, test := range tests {
+		if got := OrganizationalDomain(test.domain); got != test.org {
+			t.Errorf("%s: want %q, got %q", test.domain, test.org, got)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	resolver := &testResolver{
+		txt: map[string][]string{
+			"_dmarc.example.com":     {"v=DMARC1; p=reject; sp=quarantine"},
+			"_dmarc.strict.com":      {"v=DMARC1; p=reject; adkim=s; aspf=s"},
+			"_dmarc.monitor.com":     {"v=DMARC1; p=none"},
+			"_dmarc.sampled.com":     {"v=DMARC1; p=reject; pct=0"},
+			"_dmarc.broken.com":      {"v=DMARC1; p=bogus"},
+			"_dmarc.sub.example.com": {"v=DMARC1; p=none"},
+		},
+	}
+
+	spfPass := func(domain string) *spf.Check {
+		return &spf.Check{Result: spf.ResultPass, Domain: domain}
+	}
+	dkimPass := func(domain string) []dkim.Verification {
+		return []dkim.Verification{{Result: dkim.ResultPass, Domain: domain}}
+	}
+
+	tests := []struct {
+		from        string
+		spf         *spf.Check
+		dkim        []dkim.Verification
+		result      Result
+		disposition Policy
+	}{
+		{"example.com", spfPass("example.com"), nil, ResultPass, PolicyNone},
+		{"example.com", spfPass("bounce.example.com"), nil, ResultPass, PolicyNone},
+		{"example.com", nil, dkimPass("mail.example.com"), ResultPass, PolicyNone},
+		{"example.com", spfPass("other.net"), dkimPass("other.net"), ResultFail, PolicyReject},
+		{"example.com", &spf.Check{Result: spf.ResultFail, Domain: "example.com"}, nil, ResultFail, PolicyReject},
+		{"example.com", nil, []dkim.Verification{{Result: dkim.ResultFail, Domain: "example.com"}}, ResultFail, PolicyReject},
+		{"news.example.com", nil, nil, ResultFail, PolicyQuarantine},
+		{"sub.example.com", nil, nil, ResultFail, PolicyNone},
+		{"strict.com", spfPass("mail.strict.com"), dkimPass("mail.strict.com"), ResultFail, PolicyReject},
+		{"strict.com", nil, dkimPass("strict.com"), ResultPass, PolicyNone},
+		{"monitor.com", nil, nil, ResultFail, PolicyNone},
+		{"sampled.com", nil, nil, ResultFail, PolicyQuarantine},
+		{"nopolicy.com", nil, nil, ResultNone, PolicyNone},
+		{"broken.com", nil, nil, ResultPermError, PolicyNone},
+	}
+	for _, test := range tests {
+		e := Evaluate(context.Background(), resolver, test.from, test.spf, test.dkim)
+		if e.Result != test.result || e.Disposition != test.disposition {
+			t.Errorf("%s: want %s/%s, got %s/%s (%v)", test.from, test.result, test.disposition, e.Result, e.Disposition, e.Err)
+		}
+	}
+
+	e := Evaluate(context.Background(), &testResolver{fail: true}, "example.com", nil, nil)
+	if e.Result != ResultTempError {
+		t.Errorf("Want temperror, got %s", e.Result)
+	}
+}
+
+func TestAuthResult(t *testing.T) {
+	resolver := &testResolver{
+		txt: map[string][]string{
+			"_dmarc.example.com": {"v=DMARC1; p=reject"},
+		},
+	}
+	e := Evaluate(context.Background(), resolver, "example.com", nil, nil)
+	if want, got := "dmarc=fail (p=reject dis=reject) header.from=example.com", e.AuthResult(); want != got {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+
+	e = Evaluate(context.Background(), resolver, "other.com", nil, nil)
+	if want, got := "dmarc=none header.from=other.com", e.AuthResult(); want != got {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+}
@@ -1,5 +1,16 @@
 module src.bluestatic.org/mailpopbox
 
-go 1.14
+go 1.17
 
-require go.uber.org/zap v1.15.0
+require (
+	go.uber.org/zap v1.15.0
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0
+)
+
+require (
+	go.uber.org/atomic v1.6.0 // indirect
+	go.uber.org/multierr v1.5.0 // indirect
+	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+)
@@ -0,0 +1,380 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/imap"
+)
+
+// imapStateFile is the name of the file in a maildrop that stores the UIDs
+// and flags of its messages.
+const imapStateFile = "imap-state.json"
+
+func runIMAPServer(config Config, log *zap.Logger) <-chan ServerControlMessage {
+	server := imapServer{
+		config:      config,
+		controlChan: make(chan ServerControlMessage),
+		log:         log.With(zap.String("server", "imap")),
+	}
+	go server.run()
+	return server.controlChan
+}
+
+type imapServer struct {
+	config      Config
+	controlChan chan ServerControlMessage
+	log         *zap.Logger
+}
+
+// stateLocks serialize access to the IMAP state file of each maildrop. They
+// are shared by every imapServer, so that a server started by a reload does
+// not race with connections still open on the one it replaced.
+var (
+	stateLocksMu sync.Mutex
+	stateLocks   = make(map[string]*sync.Mutex)
+)
+
+// stateLock returns the lock for the IMAP state of |maildrop|.
+func stateLock(maildrop string) *sync.Mutex {
+	stateLocksMu.Lock()
+	defer stateLocksMu.Unlock()
+	maildrop = path.Clean(maildrop)
+	mu, ok := stateLocks[maildrop]
+	if !ok {
+		mu = &sync.Mutex{}
+		stateLocks[maildrop] = mu
+	}
+	return mu
+}
+
+func (server *imapServer) run() {
+	for _, s := range server.config.Servers {
+		for _, maildrop := range s.maildrops() {
+			if err := os.Mkdir(maildrop, 0700); err != nil && !os.IsExist(err) {
+				server.log.Error("failed to open maildrop", zap.Error(err))
+				server.controlChan <- ServerControlFatalError
+				return
+			}
+		}
+	}
+
+	l, err := server.newListener()
+	if err != nil {
+		server.controlChan <- ServerControlFatalError
+		return
+	}
+
+	connChan := make(chan net.Conn)
+	go RunAcceptLoop(l, connChan, server.log)
+
+	reloadChan := CreateReloadSignal()
+
+	for {
+		select {
+		case <-reloadChan:
+			server.log.Info("restarting server")
+			l.Close()
+			server.controlChan <- ServerControlRestart
+			break
+		case conn, ok := <-connChan:
+			if ok {
+				go imap.AcceptConnection(conn, server, server.log)
+			} else {
+				server.controlChan <- ServerControlFatalError
+				break
+			}
+		}
+	}
+}
+
+func (server *imapServer) newListener() (net.Listener, error) {
+	tlsConfig, err := server.config.GetTLSConfig()
+	if err != nil {
+		server.log.Error("failed to configure TLS", zap.Error(err))
+		return nil, err
+	}
+	if tlsConfig == nil {
+		server.log.Error("IMAP requires a TLS certificate")
+		return nil, errors.New("no TLS certificate")
+	}
+
+	addr := fmt.Sprintf(":%d", server.config.IMAPPort)
+	server.log.Info("starting server", zap.String("address", addr))
+
+	l, err := tls.Listen("tcp", addr, tlsConfig)
+	if err != nil {
+		server.log.Error("listen", zap.Error(err))
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (server *imapServer) Name() string {
+	return server.config.Hostname
+}
+
+func (server *imapServer) OpenMailbox(user, pass string) (imap.Mailbox, error) {
+	for _, s := range server.config.Servers {
+		if password, view, ok := s.account(user); ok && checkPassword(password, pass) {
+			mb := &imapMailbox{
+				server: server,
+				view:   view,
+			}
+			if err := mb.withState(func(*imapState) (bool, error) { return false, nil }); err != nil {
+				server.log.Error("failed to read IMAP state", zap.String("dir", view.maildrop), zap.Error(err))
+				return nil, errors.New("error opening maildrop")
+			}
+			return mb, nil
+		}
+	}
+	return nil, errors.New("permission denied")
+}
+
+// imapState is stored in the imapStateFile of the maildrop of an account. The
+// views of the account share its UIDs and flags, so that an alias login lists
+// a subset of the messages of the account.
+type imapState struct {
+	UIDValidity uint32
+	UIDNext     uint32
+
+	// Messages is keyed by the file name of the message, relative to the
+	// maildrop of the account.
+	Messages map[string]*imapMessageState
+}
+
+type imapMessageState struct {
+	UID   uint32
+	Size  int
+	Flags []string `json:",omitempty"`
+}
+
+type imapMailbox struct {
+	server *imapServer
+	view   maildropView
+
+	uidValidity, uidNext uint32
+}
+
+type imapMessage struct {
+	// name is the key of the message in the imapState.
+	name     string
+	filename string
+	uid      uint32
+	size     int
+	date     time.Time
+	flags    []string
+}
+
+func (m *imapMessage) UID() uint32 {
+	return m.uid
+}
+
+func (m *imapMessage) Size() int {
+	return m.size
+}
+
+func (m *imapMessage) InternalDate() time.Time {
+	return m.date
+}
+
+func (m *imapMessage) Flags() []string {
+	return m.flags
+}
+
+// withState loads the IMAP state of the maildrop and calls |fn| with it. The
+// state is saved if |fn| reports that it changed it.
+func (mb *imapMailbox) withState(fn func(*imapState) (bool, error)) error {
+	mu := stateLock(mb.view.maildrop)
+	mu.Lock()
+	defer mu.Unlock()
+
+	statePath := path.Join(mb.view.maildrop, imapStateFile)
+	state := &imapState{}
+	changed := false
+
+	data, err := ioutil.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		state.UIDValidity = uint32(time.Now().Unix())
+		state.UIDNext = 1
+		changed = true
+	} else if err != nil {
+		return err
+	} else if err := json.Unmarshal(data, state); err != nil {
+		return fmt.Errorf("%s: %v", statePath, err)
+	}
+	if state.Messages == nil {
+		state.Messages = make(map[string]*imapMessageState)
+	}
+
+	fnChanged, err := fn(state)
+	if err != nil {
+		return err
+	}
+
+	if changed || fnChanged {
+		data, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		tmp := statePath + ".tmp"
+		if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, statePath); err != nil {
+			return err
+		}
+	}
+
+	mb.uidValidity = state.UIDValidity
+	mb.uidNext = state.UIDNext
+	return nil
+}
+
+func (mb *imapMailbox) UIDValidity() uint32 {
+	return mb.uidValidity
+}
+
+func (mb *imapMailbox) UIDNext() uint32 {
+	return mb.uidNext
+}
+
+// ListMessages assigns UIDs to messages that have been delivered to the
+// maildrop since it was last listed, and forgets about the messages that
+// have been removed, such as by POP3.
+func (mb *imapMailbox) ListMessages() ([]imap.Message, error) {
+	var msgs []imap.Message
+	err := mb.withState(func(state *imapState) (bool, error) {
+		files, err := readMaildrop(mb.view)
+		if err != nil {
+			return false, err
+		}
+
+		changed := false
+		present := make(map[string]bool)
+		var added []maildropMessage
+		for _, file := range files {
+			present[mb.view.key(file.name)] = true
+			if msgState, ok := state.Messages[mb.view.key(file.name)]; ok {
+				msgs = append(msgs, mb.newMessage(file, msgState))
+			} else {
+				added = append(added, file)
+			}
+		}
+
+		// The messages of other views of the account are not listed.
+		for name := range state.Messages {
+			if mb.view.contains(name) && !present[name] {
+				delete(state.Messages, name)
+				changed = true
+			}
+		}
+
+		sort.Slice(added, func(i, j int) bool {
+			if !added[i].info.ModTime().Equal(added[j].info.ModTime()) {
+				return added[i].info.ModTime().Before(added[j].info.ModTime())
+			}
+			return added[i].name < added[j].name
+		})
+		for _, file := range added {
+			size, err := messageSize(path.Join(mb.view.dir, file.name))
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				return changed, err
+			}
+
+			msgState := &imapMessageState{
+				UID:  state.UIDNext,
+				Size: size,
+			}
+			state.UIDNext++
+			state.Messages[mb.view.key(file.name)] = msgState
+			msgs = append(msgs, mb.newMessage(file, msgState))
+			changed = true
+		}
+
+		sort.Slice(msgs, func(i, j int) bool { return msgs[i].UID() < msgs[j].UID() })
+		return changed, nil
+	})
+	if err != nil {
+		mb.server.log.Error("failed to list messages", zap.String("dir", mb.view.dir), zap.Error(err))
+		return nil, errors.New("error reading maildrop")
+	}
+	return msgs, nil
+}
+
+func (mb *imapMailbox) newMessage(file maildropMessage, msgState *imapMessageState) *imapMessage {
+	return &imapMessage{
+		name:     mb.view.key(file.name),
+		filename: path.Join(mb.view.dir, file.name),
+		uid:      msgState.UID,
+		size:     msgState.Size,
+		date:     file.info.ModTime(),
+		flags:    append([]string(nil), msgState.Flags...),
+	}
+}
+
+func messageSize(filename string) (int, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return imap.MessageSize(f)
+}
+
+func (mb *imapMailbox) Retrieve(msg imap.Message) (io.ReadCloser, error) {
+	return os.Open(msg.(*imapMessage).filename)
+}
+
+func (mb *imapMailbox) SetFlags(msg imap.Message, flags []string) error {
+	m := msg.(*imapMessage)
+	err := mb.withState(func(state *imapState) (bool, error) {
+		msgState, ok := state.Messages[m.name]
+		if !ok || msgState.UID != m.uid {
+			return false, errors.New("message no longer exists")
+		}
+		msgState.Flags = flags
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	m.flags = flags
+	return nil
+}
+
+func (mb *imapMailbox) Expunge(msg imap.Message) error {
+	m := msg.(*imapMessage)
+	if err := os.Remove(m.filename); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return mb.withState(func(state *imapState) (bool, error) {
+		delete(state.Messages, m.name)
+		return true, nil
+	})
+}
+
+func (mb *imapMailbox) Close() error {
+	return nil
+}
@@ -0,0 +1,963 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package imap
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type state int
+
+const (
+	stateNotAuthenticated state = iota
+	stateAuthenticated
+	stateSelected
+)
+
+const (
+	errState  = "command not valid in this state"
+	errSyntax = "syntax error"
+)
+
+// Only the INBOX mailbox, backed by the maildrop, is provided.
+const inbox = "INBOX"
+
+// idlePollInterval is how often the mailbox is checked for changes while a
+// client is in IDLE.
+var idlePollInterval = 15 * time.Second
+
+type connection struct {
+	po PostOffice
+	mb Mailbox
+
+	tp         *textproto.Conn
+	remoteAddr net.Addr
+	secure     bool
+
+	log *zap.Logger
+
+	state
+	readOnly bool
+
+	// msgs is the list of messages known to the client, where the index of a
+	// message is its sequence number minus one.
+	msgs []Message
+
+	user string
+}
+
+func AcceptConnection(netConn net.Conn, po PostOffice, log *zap.Logger) {
+	log = log.With(zap.Stringer("client", netConn.RemoteAddr()))
+	_, secure := netConn.(*tls.Conn)
+	conn := connection{
+		po:         po,
+		tp:         textproto.NewConn(netConn),
+		remoteAddr: netConn.RemoteAddr(),
+		secure:     secure,
+		state:      stateNotAuthenticated,
+		log:        log,
+	}
+	defer conn.tp.Close()
+
+	conn.log.Info("accepted connection")
+	conn.untagged("OK [CAPABILITY %s] IMAP4rev1 (mailpopbox) server %s", conn.capabilities(), po.Name())
+
+	for {
+		line, err := conn.readCommand()
+		if err != nil && err != errLiteralTooLarge {
+			conn.log.Error("readCommand()", zap.Error(err))
+			conn.closeMailbox()
+			return
+		}
+
+		cmd, parseErr := parseCommand(line)
+		if cmd.tag == "" {
+			conn.untagged("BAD %s", errSyntax)
+			continue
+		}
+		if err != nil {
+			conn.bad(cmd.tag, err.Error())
+			continue
+		}
+		if parseErr != nil {
+			conn.bad(cmd.tag, parseErr.Error())
+			continue
+		}
+
+		conn.log = log.With(zap.String("command", cmd.name))
+
+		switch cmd.name {
+		case "CAPABILITY":
+			conn.untagged("CAPABILITY %s", conn.capabilities())
+			conn.ok(cmd.tag, "CAPABILITY completed")
+		case "NOOP":
+			conn.doNOOP(cmd)
+		case "LOGOUT":
+			conn.untagged("BYE logging out")
+			conn.ok(cmd.tag, "LOGOUT completed")
+			conn.closeMailbox()
+			return
+		case "LOGIN":
+			conn.doLOGIN(cmd)
+		case "AUTHENTICATE":
+			if !conn.doAUTHENTICATE(cmd) {
+				conn.closeMailbox()
+				return
+			}
+		case "SELECT":
+			conn.doSELECT(cmd, false)
+		case "EXAMINE":
+			conn.doSELECT(cmd, true)
+		case "LIST", "LSUB":
+			conn.doLIST(cmd)
+		case "STATUS":
+			conn.doSTATUS(cmd)
+		case "SUBSCRIBE", "UNSUBSCRIBE":
+			if conn.requireState(cmd, stateAuthenticated, stateSelected) {
+				conn.ok(cmd.tag, cmd.name+" completed")
+			}
+		case "CREATE", "DELETE", "RENAME", "APPEND":
+			if conn.requireState(cmd, stateAuthenticated, stateSelected) {
+				conn.no(cmd.tag, "only the INBOX mailbox is available")
+			}
+		case "CHECK":
+			if conn.requireState(cmd, stateSelected) {
+				conn.doNOOP(cmd)
+			}
+		case "CLOSE":
+			conn.doCLOSE(cmd)
+		case "EXPUNGE":
+			conn.doEXPUNGE(cmd)
+		case "SEARCH":
+			conn.doSEARCH(cmd, cmd.args, false)
+		case "FETCH":
+			conn.doFETCH(cmd, cmd.args, false)
+		case "STORE":
+			conn.doSTORE(cmd, cmd.args, false)
+		case "COPY":
+			if conn.requireState(cmd, stateSelected) {
+				conn.no(cmd.tag, "only the INBOX mailbox is available")
+			}
+		case "UID":
+			conn.doUID(cmd)
+		case "IDLE":
+			if !conn.doIDLE(cmd) {
+				conn.closeMailbox()
+				return
+			}
+		default:
+			conn.bad(cmd.tag, "unknown command")
+		}
+	}
+}
+
+// readCommand reads the next command from the client, including the data of
+// any literals, which are requested with a continuation as they are
+// announced.
+func (conn *connection) readCommand() ([]byte, error) {
+	var buf []byte
+	for {
+		line, err := conn.tp.ReadLineBytes()
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, line...)
+
+		n, ok := literalSize(line)
+		if !ok {
+			return buf, nil
+		}
+		if n > maxLiteralSize {
+			return buf, errLiteralTooLarge
+		}
+
+		conn.tp.PrintfLine("+ Ready for literal data")
+		literal := make([]byte, n)
+		if _, err := io.ReadFull(conn.tp.R, literal); err != nil {
+			return nil, err
+		}
+		buf = append(buf, crlf...)
+		buf = append(buf, literal...)
+	}
+}
+
+func (conn *connection) untagged(format string, args ...interface{}) {
+	conn.tp.PrintfLine("* "+format, args...)
+}
+
+func (conn *connection) ok(tag, msg string) {
+	conn.log.Info("ok", zap.String("reply", msg))
+	conn.tp.PrintfLine("%s OK %s", tag, msg)
+}
+
+func (conn *connection) no(tag, msg string) {
+	conn.log.Error("no", zap.String("message", msg))
+	conn.tp.PrintfLine("%s NO %s", tag, msg)
+}
+
+func (conn *connection) bad(tag, msg string) {
+	conn.log.Error("bad", zap.String("message", msg))
+	conn.tp.PrintfLine("%s BAD %s", tag, msg)
+}
+
+func (conn *connection) requireState(cmd *command, states ...state) bool {
+	for _, s := range states {
+		if conn.state == s {
+			return true
+		}
+	}
+	conn.bad(cmd.tag, errState)
+	return false
+}
+
+func (conn *connection) capabilities() string {
+	caps := []string{"IMAP4rev1", "IDLE"}
+	if conn.state == stateNotAuthenticated {
+		if conn.secure {
+			caps = append(caps, "SASL-IR", "AUTH=PLAIN")
+		} else {
+			caps = append(caps, "LOGINDISABLED")
+		}
+	}
+	return strings.Join(caps, " ")
+}
+
+func (conn *connection) closeMailbox() {
+	if conn.mb != nil {
+		if err := conn.mb.Close(); err != nil {
+			conn.log.Error("failed to close mailbox", zap.Error(err))
+		}
+		conn.mb = nil
+	}
+}
+
+func (conn *connection) doNOOP(cmd *command) {
+	if conn.state == stateSelected {
+		if err := conn.refresh(); err != nil {
+			conn.log.Error("failed to list messages", zap.Error(err))
+			conn.no(cmd.tag, "failed to read mailbox")
+			return
+		}
+	}
+	conn.ok(cmd.tag, cmd.name+" completed")
+}
+
+func (conn *connection) doLOGIN(cmd *command) {
+	if !conn.requireState(cmd, stateNotAuthenticated) {
+		return
+	}
+	if len(cmd.args) != 2 {
+		conn.bad(cmd.tag, errSyntax)
+		return
+	}
+	user, ok1 := astring(cmd.args[0])
+	pass, ok2 := astring(cmd.args[1])
+	if !ok1 || !ok2 {
+		conn.bad(cmd.tag, errSyntax)
+		return
+	}
+	conn.login(cmd, user, pass)
+}
+
+// doAUTHENTICATE handles the PLAIN mechanism, with or without an initial
+// response. It returns false if the connection was lost.
+func (conn *connection) doAUTHENTICATE(cmd *command) bool {
+	if !conn.requireState(cmd, stateNotAuthenticated) {
+		return true
+	}
+	if len(cmd.args) < 1 || len(cmd.args) > 2 {
+		conn.bad(cmd.tag, errSyntax)
+		return true
+	}
+	if mech, _ := astring(cmd.args[0]); !strings.EqualFold(mech, "PLAIN") {
+		conn.no(cmd.tag, "unsupported authentication mechanism")
+		return true
+	}
+	if !conn.secure {
+		conn.no(cmd.tag, "[PRIVACYREQUIRED] TLS is required to authenticate")
+		return true
+	}
+
+	var response string
+	if len(cmd.args) == 2 {
+		response, _ = astring(cmd.args[1])
+		if response == "=" {
+			response = ""
+		}
+	} else {
+		conn.tp.PrintfLine("+ ")
+		line, err := conn.tp.ReadLine()
+		if err != nil {
+			conn.log.Error("ReadLine()", zap.Error(err))
+			return false
+		}
+		response = line
+	}
+	if response == "*" {
+		conn.bad(cmd.tag, "authentication cancelled")
+		return true
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(response)
+	if err != nil {
+		conn.bad(cmd.tag, "invalid base64")
+		return true
+	}
+	creds := strings.Split(string(decoded), "\x00")
+	if len(creds) != 3 {
+		conn.bad(cmd.tag, "invalid PLAIN response")
+		return true
+	}
+	if creds[0] != "" && creds[0] != creds[1] {
+		conn.no(cmd.tag, "[AUTHORIZATIONFAILED] cannot authorize as another user")
+		return true
+	}
+
+	conn.login(cmd, creds[1], creds[2])
+	return true
+}
+
+func (conn *connection) login(cmd *command, user, pass string) {
+	if !conn.secure {
+		conn.no(cmd.tag, "[PRIVACYREQUIRED] TLS is required to log in")
+		return
+	}
+
+	mb, err := conn.po.OpenMailbox(user, pass)
+	if err != nil {
+		conn.log.Error("failed to open mailbox", zap.String("user", user), zap.Error(err))
+		conn.no(cmd.tag, "[AUTHENTICATIONFAILED] invalid credentials")
+		return
+	}
+
+	conn.log.Info("authenticated", zap.String("user", user))
+	conn.user = user
+	conn.mb = mb
+	conn.state = stateAuthenticated
+	conn.ok(cmd.tag, cmd.name+" completed")
+}
+
+func (conn *connection) doSELECT(cmd *command, readOnly bool) {
+	if !conn.requireState(cmd, stateAuthenticated, stateSelected) {
+		return
+	}
+	if len(cmd.args) != 1 {
+		conn.bad(cmd.tag, errSyntax)
+		return
+	}
+
+	// Selecting a mailbox closes the current one, even if it fails.
+	conn.state = stateAuthenticated
+	conn.msgs = nil
+
+	if name, _ := astring(cmd.args[0]); !strings.EqualFold(name, inbox) {
+		conn.no(cmd.tag, "[NONEXISTENT] no such mailbox")
+		return
+	}
+
+	msgs, err := conn.mb.ListMessages()
+	if err != nil {
+		conn.log.Error("failed to list messages", zap.Error(err))
+		conn.no(cmd.tag, "failed to read mailbox")
+		return
+	}
+	conn.msgs = msgs
+	conn.readOnly = readOnly
+	conn.state = stateSelected
+
+	conn.untagged("FLAGS %s", formatFlags(SystemFlags))
+	conn.untagged("%d EXISTS", len(msgs))
+	conn.untagged("0 RECENT")
+	for i, msg := range msgs {
+		if !hasFlag(msg.Flags(), FlagSeen) {
+			conn.untagged("OK [UNSEEN %d] first unseen message", i+1)
+			break
+		}
+	}
+	if readOnly {
+		conn.untagged("OK [PERMANENTFLAGS ()] no permanent flags permitted")
+	} else {
+		conn.untagged("OK [PERMANENTFLAGS %s] limited", formatFlags(SystemFlags))
+	}
+	conn.untagged("OK [UIDVALIDITY %d] UIDs valid", conn.mb.UIDValidity())
+	conn.untagged("OK [UIDNEXT %d] predicted next UID", conn.mb.UIDNext())
+
+	if readOnly {
+		conn.ok(cmd.tag, "[READ-ONLY] EXAMINE completed")
+	} else {
+		conn.ok(cmd.tag, "[READ-WRITE] SELECT completed")
+	}
+}
+
+func (conn *connection) doLIST(cmd *command) {
+	if !conn.requireState(cmd, stateAuthenticated, stateSelected) {
+		return
+	}
+	if len(cmd.args) != 2 {
+		conn.bad(cmd.tag, errSyntax)
+		return
+	}
+	pattern, ok := astring(cmd.args[1])
+	if !ok {
+		conn.bad(cmd.tag, errSyntax)
+		return
+	}
+
+	if pattern == "" {
+		conn.untagged(`%s (\Noselect) "/" ""`, cmd.name)
+	} else if listMatch(pattern, inbox) {
+		conn.untagged(`%s () "/" %s`, cmd.name, inbox)
+	}
+	conn.ok(cmd.tag, cmd.name+" completed")
+}
+
+// listMatch returns whether the mailbox |name| matches a LIST |pattern|.
+func listMatch(pattern, name string) bool {
+	pattern = strings.NewReplacer("%", "*", "[", `\[`, "?", `\?`).Replace(strings.ToUpper(pattern))
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+func (conn *connection) doSTATUS(cmd *command) {
+	if !conn.requireState(cmd, stateAuthenticated, stateSelected) {
+		return
+	}
+	if len(cmd.args) != 2 {
+		conn.bad(cmd.tag, errSyntax)
+		return
+	}
+	items, ok := cmd.args[1].(list)
+	if !ok {
+		conn.bad(cmd.tag, errSyntax)
+		return
+	}
+	if name, _ := astring(cmd.args[0]); !strings.EqualFold(name, inbox) {
+		conn.no(cmd.tag, "[NONEXISTENT] no such mailbox")
+		return
+	}
+
+	msgs, err := conn.mb.ListMessages()
+	if err != nil {
+		conn.log.Error("failed to list messages", zap.Error(err))
+		conn.no(cmd.tag, "failed to read mailbox")
+		return
+	}
+
+	var status []string
+	for _, item := range items {
+		name, _ := astring(item)
+		name = strings.ToUpper(name)
+		var value int
+		switch name {
+		case "MESSAGES":
+			value = len(msgs)
+		case "RECENT":
+			value = 0
+		case "UIDNEXT":
+			value = int(conn.mb.UIDNext())
+		case "UIDVALIDITY":
+			value = int(conn.mb.UIDValidity())
+		case "UNSEEN":
+			for _, msg := range msgs {
+				if !hasFlag(msg.Flags(), FlagSeen) {
+					value++
+				}
+			}
+		default:
+			conn.bad(cmd.tag, "unknown status item")
+			return
+		}
+		status = append(status, fmt.Sprintf("%s %d", name, value))
+	}
+
+	conn.untagged("STATUS %s (%s)", inbox, strings.Join(status, " "))
+	conn.ok(cmd.tag, "STATUS completed")
+}
+
+func (conn *connection) doCLOSE(cmd *command) {
+	if !conn.requireState(cmd, stateSelected) {
+		return
+	}
+	if !conn.readOnly {
+		conn.expunge(false)
+	}
+	conn.state = stateAuthenticated
+	conn.msgs = nil
+	conn.ok(cmd.tag, "CLOSE completed")
+}
+
+func (conn *connection) doEXPUNGE(cmd *command) {
+	if !conn.requireState(cmd, stateSelected) {
+		return
+	}
+	if conn.readOnly {
+		conn.no(cmd.tag, "mailbox is read-only")
+		return
+	}
+	if err := conn.expunge(true); err != nil {
+		conn.no(cmd.tag, "failed to expunge some messages")
+		return
+	}
+	conn.ok(cmd.tag, "EXPUNGE completed")
+}
+
+// expunge removes the messages with the \Deleted flag, sending EXPUNGE
+// responses if |notify|.
+func (conn *connection) expunge(notify bool) error {
+	var lastErr error
+	for i := len(conn.msgs) - 1; i >= 0; i-- {
+		msg := conn.msgs[i]
+		if !hasFlag(msg.Flags(), FlagDeleted) {
+			continue
+		}
+		if err := conn.mb.Expunge(msg); err != nil {
+			conn.log.Error("failed to expunge message", zap.Uint32("uid", msg.UID()), zap.Error(err))
+			lastErr = err
+			continue
+		}
+		conn.log.Info("expunged message", zap.Uint32("uid", msg.UID()))
+		conn.msgs = append(conn.msgs[:i], conn.msgs[i+1:]...)
+		if notify {
+			conn.untagged("%d EXPUNGE", i+1)
+		}
+	}
+	return lastErr
+}
+
+// refresh reads the mailbox and tells the client about messages that were
+// removed, added, or had their flags changed by another session.
+func (conn *connection) refresh() error {
+	msgs, err := conn.mb.ListMessages()
+	if err != nil {
+		return err
+	}
+
+	current := make(map[uint32]Message, len(msgs))
+	for _, msg := range msgs {
+		current[msg.UID()] = msg
+	}
+
+	for i := len(conn.msgs) - 1; i >= 0; i-- {
+		if _, ok := current[conn.msgs[i].UID()]; !ok {
+			conn.msgs = append(conn.msgs[:i], conn.msgs[i+1:]...)
+			conn.untagged("%d EXPUNGE", i+1)
+		}
+	}
+
+	var lastUID uint32
+	for i, old := range conn.msgs {
+		msg := current[old.UID()]
+		if !equalFlags(old.Flags(), msg.Flags()) {
+			conn.untagged("%d FETCH (FLAGS %s)", i+1, formatFlags(msg.Flags()))
+		}
+		conn.msgs[i] = msg
+		lastUID = msg.UID()
+	}
+
+	added := false
+	for _, msg := range msgs {
+		if msg.UID() > lastUID {
+			conn.msgs = append(conn.msgs, msg)
+			added = true
+		}
+	}
+	if added {
+		conn.untagged("%d EXISTS", len(conn.msgs))
+	}
+	return nil
+}
+
+func (conn *connection) doUID(cmd *command) {
+	if len(cmd.args) < 1 {
+		conn.bad(cmd.tag, errSyntax)
+		return
+	}
+	sub, _ := astring(cmd.args[0])
+	switch strings.ToUpper(sub) {
+	case "FETCH":
+		conn.doFETCH(cmd, cmd.args[1:], true)
+	case "STORE":
+		conn.doSTORE(cmd, cmd.args[1:], true)
+	case "SEARCH":
+		conn.doSEARCH(cmd, cmd.args[1:], true)
+	case "COPY":
+		if conn.requireState(cmd, stateSelected) {
+			conn.no(cmd.tag, "only the INBOX mailbox is available")
+		}
+	default:
+		conn.bad(cmd.tag, "unknown UID command")
+	}
+}
+
+// selectMessages returns the sequence numbers of the messages in the set
+// given by |arg|, which holds UIDs if |uid|.
+func (conn *connection) selectMessages(arg interface{}, uid bool) ([]int, error) {
+	set, err := parseSeqSet(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	var seqs []int
+	if uid {
+		var maxUID uint32
+		if len(conn.msgs) > 0 {
+			maxUID = conn.msgs[len(conn.msgs)-1].UID()
+		}
+		for i, msg := range conn.msgs {
+			if set.contains(msg.UID(), maxUID) {
+				seqs = append(seqs, i+1)
+			}
+		}
+		return seqs, nil
+	}
+
+	for i := range conn.msgs {
+		if set.contains(uint32(i+1), uint32(len(conn.msgs))) {
+			seqs = append(seqs, i+1)
+		}
+	}
+	return seqs, nil
+}
+
+// loadMessage opens the content of |msg| and reads its header, and also its
+// MIME structure if |structure| is set. The caller must close the content.
+func (conn *connection) loadMessage(msg Message, structure bool) (*content, error) {
+	rc, err := conn.mb.Retrieve(msg)
+	if err != nil {
+		return nil, err
+	}
+	c, err := newContent(rc)
+	if err != nil {
+		return nil, err
+	}
+	if structure {
+		if err := c.parse(); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (conn *connection) doFETCH(cmd *command, args []interface{}, uid bool) {
+	if !conn.requireState(cmd, stateSelected) {
+		return
+	}
+	if len(args) != 2 {
+		conn.bad(cmd.tag, errSyntax)
+		return
+	}
+	seqs, err := conn.selectMessages(args[0], uid)
+	if err != nil {
+		conn.bad(cmd.tag, err.Error())
+		return
+	}
+	items, err := parseFetchItems(args[1:])
+	if err != nil {
+		conn.bad(cmd.tag, err.Error())
+		return
+	}
+
+	hasUID, hasFlags, setsSeen := false, false, false
+	needs := needsNothing
+	for _, item := range items {
+		hasUID = hasUID || item.name == "UID"
+		hasFlags = hasFlags || item.name == "FLAGS"
+		setsSeen = setsSeen || item.setsSeen()
+		if n := item.contentNeeded(); n > needs {
+			needs = n
+		}
+	}
+	if uid && !hasUID {
+		items = append([]fetchItem{{name: "UID"}}, items...)
+	}
+
+	failed := false
+	for _, seq := range seqs {
+		msg := conn.msgs[seq-1]
+
+		var c *content
+		if needs != needsNothing {
+			if c, err = conn.loadMessage(msg, needs == needsStructure); err != nil {
+				conn.log.Error("failed to retrieve message", zap.Uint32("uid", msg.UID()), zap.Error(err))
+				failed = true
+				continue
+			}
+		}
+
+		msgItems := items
+		if setsSeen && !conn.readOnly && !hasFlag(msg.Flags(), FlagSeen) {
+			if err := conn.mb.SetFlags(msg, addFlags(msg.Flags(), []string{FlagSeen})); err != nil {
+				conn.log.Error("failed to set flags", zap.Uint32("uid", msg.UID()), zap.Error(err))
+			} else if !hasFlags {
+				msgItems = append(items[:len(items):len(items)], fetchItem{name: "FLAGS"})
+			}
+		}
+
+		w := conn.tp.W
+		fmt.Fprintf(w, "* %d FETCH (", seq)
+		for i, item := range msgItems {
+			if i > 0 {
+				w.WriteByte(' ')
+			}
+			if err := writeFetchItem(w, item, msg, c); err != nil {
+				conn.log.Error("failed to read message", zap.Uint32("uid", msg.UID()), zap.Error(err))
+				failed = true
+			}
+		}
+		w.WriteString(")\r\n")
+		w.Flush()
+		if c != nil {
+			c.Close()
+		}
+	}
+
+	if failed {
+		conn.no(cmd.tag, "some messages could not be fetched")
+	} else {
+		conn.ok(cmd.tag, "FETCH completed")
+	}
+}
+
+func (conn *connection) doSTORE(cmd *command, args []interface{}, uid bool) {
+	if !conn.requireState(cmd, stateSelected) {
+		return
+	}
+	if len(args) < 3 {
+		conn.bad(cmd.tag, errSyntax)
+		return
+	}
+	if conn.readOnly {
+		conn.no(cmd.tag, "mailbox is read-only")
+		return
+	}
+	seqs, err := conn.selectMessages(args[0], uid)
+	if err != nil {
+		conn.bad(cmd.tag, err.Error())
+		return
+	}
+
+	item, _ := astring(args[1])
+	item = strings.ToUpper(item)
+	silent := strings.HasSuffix(item, ".SILENT")
+	item = strings.TrimSuffix(item, ".SILENT")
+	if item != "FLAGS" && item != "+FLAGS" && item != "-FLAGS" {
+		conn.bad(cmd.tag, "invalid store item")
+		return
+	}
+
+	flagArgs := args[2:]
+	if l, ok := flagArgs[0].(list); ok && len(flagArgs) == 1 {
+		flagArgs = l
+	}
+	var flags []string
+	for _, arg := range flagArgs {
+		a, ok := arg.(atom)
+		if !ok {
+			conn.bad(cmd.tag, "invalid flag")
+			return
+		}
+		// Keywords and other flags cannot be stored, so they are ignored.
+		if flag := canonicalFlag(string(a)); flag != "" {
+			flags = append(flags, flag)
+		}
+	}
+
+	failed := false
+	for _, seq := range seqs {
+		msg := conn.msgs[seq-1]
+
+		var newFlags []string
+		switch item {
+		case "FLAGS":
+			newFlags = addFlags(nil, flags)
+		case "+FLAGS":
+			newFlags = addFlags(msg.Flags(), flags)
+		case "-FLAGS":
+			newFlags = removeFlags(msg.Flags(), flags)
+		}
+
+		if !equalFlags(newFlags, msg.Flags()) {
+			if err := conn.mb.SetFlags(msg, newFlags); err != nil {
+				conn.log.Error("failed to set flags", zap.Uint32("uid", msg.UID()), zap.Error(err))
+				failed = true
+				continue
+			}
+		}
+
+		if !silent {
+			if uid {
+				conn.untagged("%d FETCH (UID %d FLAGS %s)", seq, msg.UID(), formatFlags(msg.Flags()))
+			} else {
+				conn.untagged("%d FETCH (FLAGS %s)", seq, formatFlags(msg.Flags()))
+			}
+		}
+	}
+
+	if failed {
+		conn.no(cmd.tag, "some flags could not be stored")
+	} else {
+		conn.ok(cmd.tag, "STORE completed")
+	}
+}
+
+func (conn *connection) doSEARCH(cmd *command, args []interface{}, uid bool) {
+	if !conn.requireState(cmd, stateSelected) {
+		return
+	}
+
+	if len(args) >= 2 {
+		if a, _ := astring(args[0]); strings.EqualFold(a, "CHARSET") {
+			charset, _ := astring(args[1])
+			if !strings.EqualFold(charset, "US-ASCII") && !strings.EqualFold(charset, "UTF-8") {
+				conn.no(cmd.tag, "[BADCHARSET (US-ASCII UTF-8)] unsupported charset")
+				return
+			}
+			args = args[2:]
+		}
+	}
+
+	key, err := parseSearch(args)
+	if err != nil {
+		conn.bad(cmd.tag, err.Error())
+		return
+	}
+
+	var maxUID uint32
+	if len(conn.msgs) > 0 {
+		maxUID = conn.msgs[len(conn.msgs)-1].UID()
+	}
+
+	results := []string{"SEARCH"}
+	for i, msg := range conn.msgs {
+		m := &searchMessage{
+			seq:    uint32(i + 1),
+			msg:    msg,
+			load:   conn.loadMessage,
+			maxSeq: uint32(len(conn.msgs)),
+			maxUID: maxUID,
+		}
+		matched := key(m)
+		m.close()
+		if !matched {
+			continue
+		}
+		if uid {
+			results = append(results, fmt.Sprintf("%d", msg.UID()))
+		} else {
+			results = append(results, fmt.Sprintf("%d", i+1))
+		}
+	}
+
+	conn.untagged("%s", strings.Join(results, " "))
+	conn.ok(cmd.tag, "SEARCH completed")
+}
+
+// doIDLE waits for the client to end the IDLE command, and meanwhile tells it
+// about changes to the mailbox. It returns false if the connection was lost.
+func (conn *connection) doIDLE(cmd *command) bool {
+	if !conn.requireState(cmd, stateAuthenticated, stateSelected) {
+		return true
+	}
+
+	type result struct {
+		line string
+		err  error
+	}
+	done := make(chan result, 1)
+	conn.tp.PrintfLine("+ idling")
+	go func() {
+		line, err := conn.tp.ReadLine()
+		done <- result{line, err}
+	}()
+
+	ticker := time.NewTicker(idlePollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if conn.state == stateSelected {
+				if err := conn.refresh(); err != nil {
+					conn.log.Error("failed to list messages", zap.Error(err))
+				}
+			}
+		case r := <-done:
+			if r.err != nil {
+				conn.log.Error("ReadLine()", zap.Error(r.err))
+				return false
+			}
+			if !strings.EqualFold(r.line, "DONE") {
+				conn.bad(cmd.tag, "expected DONE")
+				return true
+			}
+			conn.ok(cmd.tag, "IDLE terminated")
+			return true
+		}
+	}
+}
+
+// canonicalFlag returns the system flag named by |flag|, ignoring case, or
+// the empty string if it is not a system flag.
+func canonicalFlag(flag string) string {
+	for _, f := range SystemFlags {
+		if strings.EqualFold(f, flag) {
+			return f
+		}
+	}
+	return ""
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// addFlags returns the union of |flags| and |add|, in the order of
+// SystemFlags.
+func addFlags(flags, add []string) []string {
+	var result []string
+	for _, f := range SystemFlags {
+		if hasFlag(flags, f) || hasFlag(add, f) {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+func removeFlags(flags, remove []string) []string {
+	var result []string
+	for _, f := range SystemFlags {
+		if hasFlag(flags, f) && !hasFlag(remove, f) {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+func equalFlags(a, b []string) bool {
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return strings.Join(a, " ") == strings.Join(b, " ")
+}
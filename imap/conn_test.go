@@ -0,0 +1,848 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package imap
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func _fl(depth int) string {
+	_, file, line, _ := runtime.Caller(depth + 1)
+	return fmt.Sprintf("[%s:%d]", filepath.Base(file), line)
+}
+
+func ok(t testing.TB, err error) {
+	if err != nil {
+		t.Errorf("%s unexpected error: %v", _fl(1), err)
+	}
+}
+
+func getTLSConfig(t *testing.T) *tls.Config {
+	cert, err := tls.LoadX509KeyPair("../testtls/domain.crt", "../testtls/domain.key")
+	if err != nil {
+		t.Fatal(err)
+		return nil
+	}
+	return &tls.Config{
+		ServerName:         "localhost",
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+	}
+}
+
+func runServer(t *testing.T, po PostOffice, tlsConfig *tls.Config) net.Listener {
+	l, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+		return nil
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go AcceptConnection(conn, po, zap.NewNop())
+		}
+	}()
+	return l
+}
+
+func dial(t *testing.T, l net.Listener, tlsConfig *tls.Config) *textproto.Conn {
+	var nc net.Conn
+	var err error
+	if tlsConfig != nil {
+		nc, err = tls.Dial(l.Addr().Network(), l.Addr().String(), tlsConfig)
+	} else {
+		nc, err = net.Dial(l.Addr().Network(), l.Addr().String())
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := textproto.NewConn(nc)
+
+	line, err := conn.ReadLine()
+	ok(t, err)
+	if !strings.HasPrefix(line, "* OK [CAPABILITY IMAP4rev1") {
+		t.Errorf("%s unexpected greeting %q", _fl(1), line)
+	}
+	return conn
+}
+
+// sendCommand sends |cmd|, whose tag is "a", and returns the response. The
+// lines of the response are joined with CRLF.
+func sendCommand(t testing.TB, conn *textproto.Conn, cmd string) string {
+	ok(t, conn.PrintfLine("a %s", cmd))
+	return readResponse(t, conn)
+}
+
+func readResponse(t testing.TB, conn *textproto.Conn) string {
+	var lines []string
+	for {
+		line, err := conn.ReadLine()
+		if err != nil {
+			t.Fatalf("%s ReadLine: %v", _fl(2), err)
+		}
+		lines = append(lines, line)
+		if strings.HasPrefix(line, "a ") {
+			return strings.Join(lines, "\r\n")
+		}
+	}
+}
+
+func expectOK(t testing.TB, conn *textproto.Conn, cmd string) string {
+	resp := sendCommand(t, conn, cmd)
+	if !strings.Contains(resp, "\r\na OK ") && !strings.HasPrefix(resp, "a OK ") {
+		t.Errorf("%s %s: expected OK, got %q", _fl(1), cmd, resp)
+	}
+	return resp
+}
+
+type testServer struct {
+	user, pass string
+	mb         testMailbox
+}
+
+func (s *testServer) Name() string {
+	return "Test-Server"
+}
+
+func (s *testServer) OpenMailbox(user, pass string) (Mailbox, error) {
+	if s.user == user && s.pass == pass {
+		return &s.mb, nil
+	}
+	return nil, errors.New("bad username/pass")
+}
+
+type testMailbox struct {
+	mu      sync.Mutex
+	msgs    map[uint32]*testMessage
+	uidNext uint32
+}
+
+type testMessage struct {
+	uid   uint32
+	date  time.Time
+	flags []string
+	body  string
+}
+
+func (m *testMessage) UID() uint32 {
+	return m.uid
+}
+
+func (m *testMessage) Size() int {
+	size, _ := MessageSize(strings.NewReader(m.body))
+	return size
+}
+
+func (m *testMessage) InternalDate() time.Time {
+	return m.date
+}
+
+func (m *testMessage) Flags() []string {
+	return m.flags
+}
+
+func (mb *testMailbox) add(body string, flags ...string) uint32 {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	uid := mb.uidNext
+	mb.uidNext += 10
+	mb.msgs[uid] = &testMessage{
+		uid:   uid,
+		date:  time.Date(2020, time.March, 2, 10, 0, 0, 0, time.UTC),
+		flags: flags,
+		body:  body,
+	}
+	return uid
+}
+
+func (mb *testMailbox) UIDValidity() uint32 {
+	return 1234
+}
+
+func (mb *testMailbox) UIDNext() uint32 {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.uidNext
+}
+
+func (mb *testMailbox) ListMessages() ([]Message, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	msgs := make([]Message, 0, len(mb.msgs))
+	for _, msg := range mb.msgs {
+		m := *msg
+		msgs = append(msgs, &m)
+	}
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].UID() < msgs[j].UID() })
+	return msgs, nil
+}
+
+// testContent is the content of a testMessage, which can be read at an offset
+// like a file.
+type testContent struct {
+	*strings.Reader
+}
+
+func (testContent) Close() error {
+	return nil
+}
+
+func (mb *testMailbox) Retrieve(msg Message) (io.ReadCloser, error) {
+	return testContent{strings.NewReader(msg.(*testMessage).body)}, nil
+}
+
+func (mb *testMailbox) SetFlags(msg Message, flags []string) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	stored, ok := mb.msgs[msg.UID()]
+	if !ok {
+		return errors.New("no such message")
+	}
+	stored.flags = flags
+	msg.(*testMessage).flags = flags
+	return nil
+}
+
+func (mb *testMailbox) Expunge(msg Message) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	delete(mb.msgs, msg.UID())
+	return nil
+}
+
+func (mb *testMailbox) Close() error {
+	return nil
+}
+
+const (
+	textMessage = "From: Alice <alice@example.com>\r\n" +
+		"To: bob@example.com\r\n" +
+		"Subject: Hello\r\n" +
+		"Date: Mon, 2 Mar 2020 10:00:00 +0000\r\n" +
+		"Message-ID: <1@example.com>\r\n" +
+		"\r\n" +
+		"Hi Bob.\r\n"
+
+	multipartMessage = "From: carol@example.org\n" +
+		"To: bob@example.com\n" +
+		"Subject: Report\n" +
+		"MIME-Version: 1.0\n" +
+		"Content-Type: multipart/mixed; boundary=\"b1\"\n" +
+		"\n" +
+		"--b1\n" +
+		"Content-Type: text/plain\n" +
+		"\n" +
+		"See attached.\n" +
+		"--b1\n" +
+		"Content-Type: application/pdf; name=\"r.pdf\"\n" +
+		"Content-Disposition: attachment; filename=\"r.pdf\"\n" +
+		"Content-Transfer-Encoding: base64\n" +
+		"\n" +
+		"JVBERi0=\n" +
+		"--b1--\n"
+)
+
+func newTestServer() *testServer {
+	s := &testServer{
+		user: "u",
+		pass: "p",
+		mb: testMailbox{
+			msgs:    make(map[uint32]*testMessage),
+			uidNext: 10,
+		},
+	}
+	s.mb.add(textMessage)
+	s.mb.add(multipartMessage, FlagSeen)
+	return s
+}
+
+// setupSession connects to a new server and selects the INBOX.
+func setupSession(t *testing.T, s *testServer) (net.Listener, *textproto.Conn) {
+	tlsConfig := getTLSConfig(t)
+	l := runServer(t, s, tlsConfig)
+	conn := dial(t, l, tlsConfig)
+	expectOK(t, conn, "LOGIN u p")
+	expectOK(t, conn, "SELECT INBOX")
+	return l, conn
+}
+
+func TestLoginDisabledWithoutTLS(t *testing.T) {
+	l := runServer(t, newTestServer(), nil)
+	defer l.Close()
+	conn := dial(t, l, nil)
+
+	resp := expectOK(t, conn, "CAPABILITY")
+	if !strings.Contains(resp, "LOGINDISABLED") || strings.Contains(resp, "AUTH=PLAIN") {
+		t.Errorf("expected LOGINDISABLED, got %q", resp)
+	}
+
+	if want, got := "a NO [PRIVACYREQUIRED] TLS is required to log in", sendCommand(t, conn, "LOGIN u p"); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if want, got := "a NO [PRIVACYREQUIRED] TLS is required to authenticate", sendCommand(t, conn, "AUTHENTICATE PLAIN "+b64enc("\x00u\x00p")); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if want, got := "a BAD "+errState, sendCommand(t, conn, "SELECT INBOX"); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func b64enc(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func TestLogin(t *testing.T) {
+	tlsConfig := getTLSConfig(t)
+	l := runServer(t, newTestServer(), tlsConfig)
+	defer l.Close()
+	conn := dial(t, l, tlsConfig)
+
+	resp := expectOK(t, conn, "CAPABILITY")
+	if !strings.Contains(resp, "AUTH=PLAIN") || strings.Contains(resp, "LOGINDISABLED") {
+		t.Errorf("expected AUTH=PLAIN, got %q", resp)
+	}
+
+	if want, got := "a NO [AUTHENTICATIONFAILED] invalid credentials", sendCommand(t, conn, "LOGIN u wrong"); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	// Send the password as a literal.
+	ok(t, conn.PrintfLine("a LOGIN \"u\" {1}"))
+	line, err := conn.ReadLine()
+	ok(t, err)
+	if !strings.HasPrefix(line, "+ ") {
+		t.Errorf("expected continuation, got %q", line)
+	}
+	ok(t, conn.PrintfLine("p"))
+	if want, got := "a OK LOGIN completed", readResponse(t, conn); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	if want, got := "a BAD "+errState, sendCommand(t, conn, "LOGIN u p"); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestAuthenticatePlain(t *testing.T) {
+	tlsConfig := getTLSConfig(t)
+	l := runServer(t, newTestServer(), tlsConfig)
+	defer l.Close()
+
+	conn := dial(t, l, tlsConfig)
+	if want, got := "a NO unsupported authentication mechanism", sendCommand(t, conn, "AUTHENTICATE CRAM-MD5"); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if want, got := "a NO [AUTHORIZATIONFAILED] cannot authorize as another user", sendCommand(t, conn, "AUTHENTICATE PLAIN "+b64enc("x\x00u\x00p")); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if want, got := "a NO [AUTHENTICATIONFAILED] invalid credentials", sendCommand(t, conn, "AUTHENTICATE PLAIN "+b64enc("\x00u\x00q")); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	expectOK(t, conn, "AUTHENTICATE PLAIN "+b64enc("u\x00u\x00p"))
+
+	conn = dial(t, l, tlsConfig)
+	ok(t, conn.PrintfLine("a AUTHENTICATE PLAIN"))
+	line, err := conn.ReadLine()
+	ok(t, err)
+	if want, got := "+ ", line; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	ok(t, conn.PrintfLine("*"))
+	if want, got := "a BAD authentication cancelled", readResponse(t, conn); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	ok(t, conn.PrintfLine("a AUTHENTICATE PLAIN"))
+	_, err = conn.ReadLine()
+	ok(t, err)
+	ok(t, conn.PrintfLine(b64enc("\x00u\x00p")))
+	if want, got := "a OK AUTHENTICATE completed", readResponse(t, conn); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestSelect(t *testing.T) {
+	s := newTestServer()
+	l, conn := setupSession(t, s)
+	defer l.Close()
+
+	want := strings.Join([]string{
+		`* FLAGS (\Answered \Flagged \Deleted \Seen \Draft)`,
+		`* 2 EXISTS`,
+		`* 0 RECENT`,
+		`* OK [UNSEEN 1] first unseen message`,
+		`* OK [PERMANENTFLAGS ()] no permanent flags permitted`,
+		`* OK [UIDVALIDITY 1234] UIDs valid`,
+		`* OK [UIDNEXT 30] predicted next UID`,
+		`a OK [READ-ONLY] EXAMINE completed`,
+	}, "\r\n")
+	if got := sendCommand(t, conn, "EXAMINE inbox"); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	if want, got := "a NO mailbox is read-only", sendCommand(t, conn, `STORE 1 +FLAGS (\Seen)`); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	// Fetching the body of a message does not set \Seen in a read-only mailbox.
+	expectOK(t, conn, "FETCH 1 BODY[]")
+	if want, got := "* 1 FETCH (FLAGS ())\r\na OK FETCH completed", sendCommand(t, conn, "FETCH 1 FLAGS"); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	if want, got := "a NO [NONEXISTENT] no such mailbox", sendCommand(t, conn, "SELECT Archive"); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if want, got := "a BAD "+errState, sendCommand(t, conn, "FETCH 1 FLAGS"); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	if want, got := "* LIST () \"/\" INBOX\r\na OK LIST completed", sendCommand(t, conn, `LIST "" *`); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if want, got := "a OK LIST completed", sendCommand(t, conn, `LIST "" Archive`); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if want, got := "* STATUS INBOX (MESSAGES 2 UNSEEN 1 UIDNEXT 30)\r\na OK STATUS completed", sendCommand(t, conn, "STATUS INBOX (MESSAGES UNSEEN UIDNEXT)"); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	s := newTestServer()
+	l, conn := setupSession(t, s)
+	defer l.Close()
+
+	cases := []struct {
+		command string
+		want    string
+	}{
+		{
+			"FETCH 1:* (UID FLAGS RFC822.SIZE)",
+			fmt.Sprintf("* 1 FETCH (UID 10 FLAGS () RFC822.SIZE %d)\r\n", len(textMessage)) +
+				fmt.Sprintf("* 2 FETCH (UID 20 FLAGS (\\Seen) RFC822.SIZE %d)", len(strings.Replace(multipartMessage, "\n", "\r\n", -1))),
+		},
+		{
+			"FETCH 1 INTERNALDATE",
+			`* 1 FETCH (INTERNALDATE "02-Mar-2020 10:00:00 +0000")`,
+		},
+		{
+			"FETCH 1 ENVELOPE",
+			`* 1 FETCH (ENVELOPE ("Mon, 2 Mar 2020 10:00:00 +0000" "Hello" (("Alice" NIL "alice" "example.com")) (("Alice" NIL "alice" "example.com")) (("Alice" NIL "alice" "example.com")) ((NIL NIL "bob" "example.com")) NIL NIL NIL "<1@example.com>"))`,
+		},
+		{
+			"FETCH 1 BODY.PEEK[HEADER.FIELDS (SUBJECT to)]",
+			"* 1 FETCH (BODY[HEADER.FIELDS (SUBJECT TO)] {39}\r\nTo: bob@example.com\r\nSubject: Hello\r\n\r\n)",
+		},
+		{
+			"FETCH 1 BODY.PEEK[TEXT]<3.100>",
+			"* 1 FETCH (BODY[TEXT]<3> {6}\r\nBob.\r\n)",
+		},
+		{
+			"FETCH 2 BODYSTRUCTURE",
+			`* 2 FETCH (BODYSTRUCTURE (("TEXT" "PLAIN" NIL NIL NIL "7BIT" 13 1 NIL NIL NIL NIL)("APPLICATION" "PDF" ("NAME" "r.pdf") NIL NIL "BASE64" 8 NIL ("ATTACHMENT" ("FILENAME" "r.pdf")) NIL NIL) "MIXED" ("BOUNDARY" "b1") NIL NIL NIL))`,
+		},
+		{
+			"FETCH 2 BODY",
+			`* 2 FETCH (BODY (("TEXT" "PLAIN" NIL NIL NIL "7BIT" 13 1)("APPLICATION" "PDF" ("NAME" "r.pdf") NIL NIL "BASE64" 8) "MIXED"))`,
+		},
+		{
+			"FETCH 2 (BODY[1] BODY[2.MIME])",
+			"* 2 FETCH (BODY[1] {13}\r\nSee attached. BODY[2.MIME] {133}\r\nContent-Type: application/pdf; name=\"r.pdf\"\r\nContent-Disposition: attachment; filename=\"r.pdf\"\r\nContent-Transfer-Encoding: base64\r\n\r\n)",
+		},
+		{
+			"UID FETCH 15:* FLAGS",
+			`* 2 FETCH (UID 20 FLAGS (\Seen))`,
+		},
+		{
+			"UID FETCH 100:* UID",
+			`* 2 FETCH (UID 20)`,
+		},
+		// Fetching the body sets \Seen.
+		{
+			"FETCH 1 BODY[TEXT]",
+			"* 1 FETCH (BODY[TEXT] {9}\r\nHi Bob.\r\n FLAGS (\\Seen))",
+		},
+		{
+			"FETCH 1 FLAGS",
+			`* 1 FETCH (FLAGS (\Seen))`,
+		},
+	}
+	for _, c := range cases {
+		if want, got := c.want+"\r\na OK FETCH completed", sendCommand(t, conn, c.command); want != got {
+			t.Errorf("%s: want %q, got %q", c.command, want, got)
+		}
+	}
+
+	for _, bad := range []string{"FETCH 1 BODY[FOO]", "FETCH 1 X", "FETCH x FLAGS", "FETCH 1 BODY[MIME]"} {
+		if resp := sendCommand(t, conn, bad); !strings.HasPrefix(resp, "a BAD ") {
+			t.Errorf("%s: expected BAD, got %q", bad, resp)
+		}
+	}
+}
+
+func TestStoreExpunge(t *testing.T) {
+	s := newTestServer()
+	s.mb.add(textMessage)
+	l, conn := setupSession(t, s)
+	defer l.Close()
+
+	cases := []struct {
+		command string
+		want    string
+	}{
+		{`STORE 1 +FLAGS (\Deleted \Flagged $Junk)`, "* 1 FETCH (FLAGS (\\Flagged \\Deleted))\r\na OK STORE completed"},
+		{`STORE 1 -FLAGS.SILENT \Flagged`, "a OK STORE completed"},
+		{`UID STORE 30 FLAGS (\deleted \seen)`, "* 3 FETCH (UID 30 FLAGS (\\Deleted \\Seen))\r\na OK STORE completed"},
+		{`FETCH 1:3 FLAGS`, "* 1 FETCH (FLAGS (\\Deleted))\r\n* 2 FETCH (FLAGS (\\Seen))\r\n* 3 FETCH (FLAGS (\\Deleted \\Seen))\r\na OK FETCH completed"},
+		{`EXPUNGE`, "* 3 EXPUNGE\r\n* 1 EXPUNGE\r\na OK EXPUNGE completed"},
+		{`FETCH 1 UID`, "* 1 FETCH (UID 20)\r\na OK FETCH completed"},
+	}
+	for _, c := range cases {
+		if want, got := c.want, sendCommand(t, conn, c.command); want != got {
+			t.Errorf("%s: want %q, got %q", c.command, want, got)
+		}
+	}
+
+	if want, got := []uint32{20}, mailboxUIDs(&s.mb); !reflect.DeepEqual(want, got) {
+		t.Errorf("want UIDs %v, got %v", want, got)
+	}
+
+	// CLOSE expunges silently.
+	expectOK(t, conn, `STORE 1 +FLAGS.SILENT (\Deleted)`)
+	if want, got := "a OK CLOSE completed", sendCommand(t, conn, "CLOSE"); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if want, got := 0, len(mailboxUIDs(&s.mb)); want != got {
+		t.Errorf("want %d messages, got %d", want, got)
+	}
+}
+
+func mailboxUIDs(mb *testMailbox) []uint32 {
+	msgs, _ := mb.ListMessages()
+	var uids []uint32
+	for _, msg := range msgs {
+		uids = append(uids, msg.UID())
+	}
+	return uids
+}
+
+func TestSearch(t *testing.T) {
+	s := newTestServer()
+	s.mb.add(strings.Replace(textMessage, "Subject: Hello", "Subject: =?utf-8?q?Caf=C3=A9?=", 1), FlagDeleted)
+	l, conn := setupSession(t, s)
+	defer l.Close()
+
+	cases := []struct {
+		command string
+		want    string
+	}{
+		{"SEARCH ALL", "* SEARCH 1 2 3"},
+		{"SEARCH UNSEEN", "* SEARCH 1 3"},
+		{"SEARCH SEEN", "* SEARCH 2"},
+		{"SEARCH UNDELETED UNSEEN", "* SEARCH 1"},
+		{"SEARCH FROM alice", "* SEARCH 1 3"},
+		{"SEARCH SUBJECT \"café\"", "* SEARCH 3"},
+		{"SEARCH CHARSET UTF-8 SUBJECT {5}\r\ncafé", "* SEARCH 3"},
+		{"SEARCH OR SEEN DELETED", "* SEARCH 2 3"},
+		{"SEARCH NOT (FROM alice)", "* SEARCH 2"},
+		{"SEARCH HEADER Message-ID <1@example.com>", "* SEARCH 1 3"},
+		{"SEARCH BODY attached", "* SEARCH 2"},
+		{"SEARCH TEXT carol", "* SEARCH 2"},
+		{"SEARCH LARGER 200", "* SEARCH 2"},
+		{"SEARCH SENTON 2-Mar-2020", "* SEARCH 1 3"},
+		{"SEARCH SINCE 3-Mar-2020", "* SEARCH"},
+		{"SEARCH BEFORE 3-Mar-2020 2:*", "* SEARCH 2 3"},
+		{"SEARCH UID 20:*", "* SEARCH 2 3"},
+		{"UID SEARCH UNSEEN", "* SEARCH 10 30"},
+	}
+	for _, c := range cases {
+		var resp string
+		if strings.Contains(c.command, "{") {
+			lines := strings.SplitN(c.command, "\r\n", 2)
+			ok(t, conn.PrintfLine("a %s", lines[0]))
+			line, err := conn.ReadLine()
+			ok(t, err)
+			if !strings.HasPrefix(line, "+ ") {
+				t.Errorf("expected continuation, got %q", line)
+			}
+			ok(t, conn.PrintfLine("%s", lines[1]))
+			resp = readResponse(t, conn)
+		} else {
+			resp = sendCommand(t, conn, c.command)
+		}
+		if want, got := c.want+"\r\na OK SEARCH completed", resp; want != got {
+			t.Errorf("%s: want %q, got %q", c.command, want, got)
+		}
+	}
+
+	if want, got := "a NO [BADCHARSET (US-ASCII UTF-8)] unsupported charset", sendCommand(t, conn, "SEARCH CHARSET KOI8-R ALL"); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if resp := sendCommand(t, conn, "SEARCH BOGUS"); !strings.HasPrefix(resp, "a BAD ") {
+		t.Errorf("expected BAD, got %q", resp)
+	}
+}
+
+// countingContent is a message that records how much of it has been read.
+type countingContent struct {
+	*strings.Reader
+	read int64
+}
+
+func (c *countingContent) ReadAt(p []byte, off int64) (int, error) {
+	n, err := c.Reader.ReadAt(p, off)
+	if end := off + int64(n); end > c.read {
+		c.read = end
+	}
+	return n, err
+}
+
+func (*countingContent) Close() error {
+	return nil
+}
+
+func readLiteral(t *testing.T, l literal) string {
+	var buf bytes.Buffer
+	ok(t, l.writeTo(&buf))
+	prefix := fmt.Sprintf("{%d}\r\n", l.size)
+	if !strings.HasPrefix(buf.String(), prefix) {
+		t.Errorf("literal %q does not start with %q", buf.String(), prefix)
+	}
+	data := strings.TrimPrefix(buf.String(), prefix)
+	if want, got := l.size, int64(len(data)); want != got {
+		t.Errorf("want literal size %d, got %d", want, got)
+	}
+	return data
+}
+
+func TestMessageSections(t *testing.T) {
+	long := strings.Repeat("x", 3*maxLineSize)
+	msg := "Subject: outer\n" +
+		"Content-Type: multipart/mixed; boundary=outer\n" +
+		"\n" +
+		"preamble\n" +
+		"--outer\r\n" +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		long + "\n" +
+		"--outer\n" +
+		"Content-Type: message/rfc822\n" +
+		"\n" +
+		"Subject: inner\n" +
+		"Content-Type: multipart/alternative; boundary=inner\n" +
+		"\n" +
+		"--inner\n" +
+		"\n" +
+		"plain\n" +
+		"--inner\n" +
+		"Content-Type: text/html\n" +
+		"\n" +
+		"<p>html</p>\n" +
+		"--outer--\n" +
+		"epilogue\n"
+	toCRLF := func(s string) string {
+		return strings.Replace(strings.Replace(s, "\r\n", "\n", -1), "\n", "\r\n", -1)
+	}
+
+	r := &countingContent{Reader: strings.NewReader(msg)}
+	c, err := newContent(r)
+	ok(t, err)
+	if r.read >= int64(len(msg)) {
+		t.Errorf("reading the header read the whole message")
+	}
+	if want, got := "outer", c.root.mimeHeader.Get("Subject"); want != got {
+		t.Errorf("want subject %q, got %q", want, got)
+	}
+	ok(t, c.parse())
+
+	cases := []struct {
+		section string
+		want    string
+	}{
+		{"", toCRLF(msg)},
+		{"HEADER", "Subject: outer\r\nContent-Type: multipart/mixed; boundary=outer\r\n\r\n"},
+		{"TEXT", toCRLF(msg[strings.Index(msg, "\n\n")+2:])},
+		{"1", long},
+		{"1.MIME", "Content-Type: text/plain\r\n\r\n"},
+		{"2.HEADER", "Subject: inner\r\nContent-Type: multipart/alternative; boundary=inner\r\n\r\n"},
+		{"2.TEXT", "--inner\r\n\r\nplain\r\n--inner\r\nContent-Type: text/html\r\n\r\n<p>html</p>"},
+		{"2.1", "plain"},
+		{"2.2", "<p>html</p>"},
+		{"2.2.MIME", "Content-Type: text/html\r\n\r\n"},
+		{"3", ""},
+	}
+	for _, tc := range cases {
+		sec, err := parseSection(tc.section)
+		ok(t, err)
+		if want, got := tc.want, readLiteral(t, sectionContent(c, sec)); want != got {
+			t.Errorf("section %q: want %q, got %q", tc.section, want, got)
+		}
+	}
+
+	sec, err := parseSection("1")
+	ok(t, err)
+	if want, got := strings.Repeat("x", 100), readLiteral(t, sectionContent(c, sec).slice(int64(len(long)-100), 1000)); want != got {
+		t.Errorf("want partial %q, got %q", want, got)
+	}
+
+	var buf bytes.Buffer
+	writeBodyStructure(&buf, c.root, false)
+	want := fmt.Sprintf(`(("TEXT" "PLAIN" NIL NIL NIL "7BIT" %d 1)("MESSAGE" "RFC822" NIL NIL NIL "7BIT" 136 `, len(long)) +
+		`(NIL "inner" NIL NIL NIL NIL NIL NIL NIL NIL) (("TEXT" "PLAIN" ("CHARSET" "us-ascii") NIL NIL "7BIT" 5 1)("TEXT" "HTML" NIL NIL NIL "7BIT" 11 1) "ALTERNATIVE") 10) "MIXED")`
+	if got := buf.String(); want != got {
+		t.Errorf("want body structure %q, got %q", want, got)
+	}
+	ok(t, c.Close())
+}
+
+func TestReaderContainsFold(t *testing.T) {
+	for n := 32<<10 - 8; n < 32<<10+8; n++ {
+		text := strings.Repeat("a", n) + "NeedLe" + strings.Repeat("b", 8)
+		for substr, want := range map[string]bool{"needle": true, "aNEEDLEb": true, "haystack": false, "": true} {
+			if got := readerContainsFold(iotest.HalfReader(strings.NewReader(text)), substr); want != got {
+				t.Errorf("%d: want %t for %q, got %t", n, want, substr, got)
+			}
+		}
+	}
+}
+
+func TestIdle(t *testing.T) {
+	defer func(interval time.Duration) {
+		idlePollInterval = interval
+	}(idlePollInterval)
+	idlePollInterval = 10 * time.Millisecond
+
+	s := newTestServer()
+	l, conn := setupSession(t, s)
+	defer l.Close()
+
+	ok(t, conn.PrintfLine("a IDLE"))
+	line, err := conn.ReadLine()
+	ok(t, err)
+	if want, got := "+ idling", line; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	s.mb.add(textMessage)
+	line, err = conn.ReadLine()
+	ok(t, err)
+	if want, got := "* 3 EXISTS", line; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	// Changes made by another session are reported.
+	msgs, _ := s.mb.ListMessages()
+	ok(t, s.mb.Expunge(msgs[0]))
+	ok(t, s.mb.SetFlags(msgs[2], []string{FlagFlagged}))
+	line, err = conn.ReadLine()
+	ok(t, err)
+	if want, got := "* 1 EXPUNGE", line; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	line, err = conn.ReadLine()
+	ok(t, err)
+	if want, got := `* 2 FETCH (FLAGS (\Flagged))`, line; want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+
+	ok(t, conn.PrintfLine("DONE"))
+	if want, got := "a OK IDLE terminated", readResponse(t, conn); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+	if want, got := "* 1 FETCH (UID 20)\r\n* 2 FETCH (UID 30)\r\na OK FETCH completed", sendCommand(t, conn, "FETCH 1:* UID"); want != got {
+		t.Errorf("want %q, got %q", want, got)
+	}
+}
+
+func TestParseCommand(t *testing.T) {
+	cases := []struct {
+		line string
+		tag  string
+		name string
+		args []interface{}
+	}{
+		{"a1 noop", "a1", "NOOP", nil},
+		{`a2 LOGIN "user" "p\"w"`, "a2", "LOGIN", []interface{}{"user", `p"w`}},
+		{"a3 LOGIN {4}\r\nuser pw", "a3", "LOGIN", []interface{}{"user", atom("pw")}},
+		{"a4 FETCH 1:* (FLAGS BODY.PEEK[HEADER.FIELDS (FROM TO)]<0.10>)", "a4", "FETCH",
+			[]interface{}{atom("1:*"), list{atom("FLAGS"), atom("BODY.PEEK[HEADER.FIELDS (FROM TO)]<0.10>")}}},
+		{`a5 STORE 2 +FLAGS (\Seen \Deleted)`, "a5", "STORE",
+			[]interface{}{atom("2"), atom("+FLAGS"), list{atom(`\Seen`), atom(`\Deleted`)}}},
+		{"a6 SEARCH NOT (OR SEEN ())", "a6", "SEARCH", []interface{}{atom("NOT"), list{atom("OR"), atom("SEEN"), list{}}}},
+	}
+	for _, c := range cases {
+		cmd, err := parseCommand([]byte(c.line))
+		if err != nil {
+			t.Errorf("%q: %v", c.line, err)
+			continue
+		}
+		if want, got := c.tag, cmd.tag; want != got {
+			t.Errorf("%q: want tag %q, got %q", c.line, want, got)
+		}
+		if want, got := c.name, cmd.name; want != got {
+			t.Errorf("%q: want name %q, got %q", c.line, want, got)
+		}
+		if want, got := c.args, cmd.args; !reflect.DeepEqual(want, got) {
+			t.Errorf("%q: want args %#v, got %#v", c.line, want, got)
+		}
+	}
+
+	for _, line := range []string{"", "* NOOP", "a", "a  NOOP", `a LOGIN "user`, "a FETCH (1", "a X {10}\r\nabc"} {
+		if _, err := parseCommand([]byte(line)); err == nil {
+			t.Errorf("%q: expected error", line)
+		}
+	}
+}
+
+func TestSeqSet(t *testing.T) {
+	set, err := parseSeqSet(atom("2,4:6,10:*"))
+	ok(t, err)
+	for n, want := range map[uint32]bool{1: false, 2: true, 3: false, 5: true, 7: false, 12: true} {
+		if got := set.contains(n, 12); want != got {
+			t.Errorf("contains(%d) want %v, got %v", n, want, got)
+		}
+	}
+
+	// A range is the same in either order, and "*" is the largest number.
+	set, err = parseSeqSet(atom("*:5"))
+	ok(t, err)
+	if !set.contains(3, 3) || set.contains(2, 3) {
+		t.Errorf("*:5 with a maximum of 3 should contain only 3")
+	}
+
+	for _, bad := range []string{"", "0", "1:", "a", "1,,2"} {
+		if _, err := parseSeqSet(atom(bad)); err == nil {
+			t.Errorf("%q: expected error", bad)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package imap
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// section is the part of a message requested by BODY[section].
+type section struct {
+	path []int
+	// specifier is one of "", HEADER, HEADER.FIELDS, HEADER.FIELDS.NOT, TEXT,
+	// or MIME.
+	specifier string
+	fields    []string
+}
+
+func (s *section) String() string {
+	var parts []string
+	for _, n := range s.path {
+		parts = append(parts, strconv.Itoa(n))
+	}
+	if s.specifier != "" {
+		parts = append(parts, s.specifier)
+	}
+	str := strings.Join(parts, ".")
+	if s.fields != nil {
+		str += " (" + strings.Join(s.fields, " ") + ")"
+	}
+	return str
+}
+
+type fetchItem struct {
+	// name is the data item, or BODY[] for a body section.
+	name    string
+	section *section
+	peek    bool
+
+	partial       bool
+	offset, count int
+}
+
+// label is the name of the item in a FETCH response.
+func (item fetchItem) label() string {
+	if item.section == nil {
+		return item.name
+	}
+	label := "BODY[" + item.section.String() + "]"
+	if item.partial {
+		label += fmt.Sprintf("<%d>", item.offset)
+	}
+	return label
+}
+
+// setsSeen returns whether fetching the item sets the \Seen flag.
+func (item fetchItem) setsSeen() bool {
+	return (item.section != nil && !item.peek) || item.name == "RFC822" || item.name == "RFC822.TEXT"
+}
+
+// The amounts of a message that are read to fetch an item.
+const (
+	needsNothing = iota
+	needsHeader
+	needsStructure
+)
+
+// contentNeeded returns how much of the message must be read to fetch the
+// item.
+func (item fetchItem) contentNeeded() int {
+	switch item.name {
+	case "FLAGS", "UID", "INTERNALDATE", "RFC822.SIZE":
+		return needsNothing
+	case "ENVELOPE", "RFC822.HEADER":
+		return needsHeader
+	case "BODY[]":
+		if len(item.section.path) == 0 && strings.HasPrefix(item.section.specifier, "HEADER") {
+			return needsHeader
+		}
+	}
+	return needsStructure
+}
+
+func parseFetchItems(args []interface{}) ([]fetchItem, error) {
+	if len(args) != 1 {
+		return nil, errors.New("expected fetch items")
+	}
+
+	var names []string
+	switch v := args[0].(type) {
+	case atom:
+		switch strings.ToUpper(string(v)) {
+		case "ALL":
+			names = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE"}
+		case "FAST":
+			names = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE"}
+		case "FULL":
+			names = []string{"FLAGS", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODY"}
+		default:
+			names = []string{string(v)}
+		}
+	case list:
+		for _, item := range v {
+			a, ok := item.(atom)
+			if !ok {
+				return nil, errors.New("invalid fetch item")
+			}
+			names = append(names, string(a))
+		}
+	default:
+		return nil, errors.New("invalid fetch items")
+	}
+
+	items := make([]fetchItem, 0, len(names))
+	for _, name := range names {
+		item, err := parseFetchItem(name)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+func parseFetchItem(name string) (fetchItem, error) {
+	upper := strings.ToUpper(name)
+	switch upper {
+	case "FLAGS", "UID", "INTERNALDATE", "RFC822.SIZE", "ENVELOPE", "BODYSTRUCTURE", "BODY",
+		"RFC822", "RFC822.HEADER", "RFC822.TEXT":
+		return fetchItem{name: upper}, nil
+	}
+
+	item := fetchItem{name: "BODY[]"}
+	if strings.HasPrefix(upper, "BODY.PEEK[") {
+		item.peek = true
+		upper = upper[len("BODY.PEEK"):]
+	} else if strings.HasPrefix(upper, "BODY[") {
+		upper = upper[len("BODY"):]
+	} else {
+		return item, fmt.Errorf("unknown fetch item %s", name)
+	}
+
+	end := strings.IndexByte(upper, ']')
+	if end == -1 {
+		return item, errors.New("invalid body section")
+	}
+	var err error
+	if item.section, err = parseSection(upper[1:end]); err != nil {
+		return item, err
+	}
+
+	if partial := upper[end+1:]; partial != "" {
+		if len(partial) < 5 || partial[0] != '<' || partial[len(partial)-1] != '>' {
+			return item, errors.New("invalid partial")
+		}
+		bounds := strings.SplitN(partial[1:len(partial)-1], ".", 2)
+		if len(bounds) != 2 {
+			return item, errors.New("invalid partial")
+		}
+		item.offset, err = strconv.Atoi(bounds[0])
+		if err != nil || item.offset < 0 {
+			return item, errors.New("invalid partial")
+		}
+		item.count, err = strconv.Atoi(bounds[1])
+		if err != nil || item.count < 1 {
+			return item, errors.New("invalid partial")
+		}
+		item.partial = true
+	}
+	return item, nil
+}
+
+func parseSection(s string) (*section, error) {
+	sec := &section{}
+
+	if i := strings.IndexByte(s, ' '); i != -1 {
+		fields := strings.TrimSpace(s[i+1:])
+		if len(fields) < 2 || fields[0] != '(' || fields[len(fields)-1] != ')' {
+			return nil, errors.New("invalid header field list")
+		}
+		sec.fields = []string{}
+		for _, f := range strings.Fields(fields[1 : len(fields)-1]) {
+			sec.fields = append(sec.fields, strings.Trim(f, `"`))
+		}
+		s = s[:i]
+	}
+
+	parts := strings.Split(s, ".")
+	for len(parts) > 0 && parts[0] != "" {
+		n, err := strconv.Atoi(parts[0])
+		if err != nil {
+			break
+		}
+		if n < 1 {
+			return nil, errors.New("invalid section part")
+		}
+		sec.path = append(sec.path, n)
+		parts = parts[1:]
+	}
+	sec.specifier = strings.Join(parts, ".")
+
+	switch sec.specifier {
+	case "", "HEADER", "TEXT":
+	case "MIME":
+		if len(sec.path) == 0 {
+			return nil, errors.New("MIME requires a part")
+		}
+	case "HEADER.FIELDS", "HEADER.FIELDS.NOT":
+		if len(sec.fields) == 0 {
+			return nil, errors.New("missing header field list")
+		}
+		return sec, nil
+	default:
+		return nil, fmt.Errorf("invalid section %s", s)
+	}
+	if sec.fields != nil {
+		return nil, errors.New("unexpected header field list")
+	}
+	return sec, nil
+}
+
+// sectionContent returns the data of |sec| in the message |c|.
+func sectionContent(c *content, sec *section) literal {
+	p := c.root
+	for _, n := range sec.path {
+		if p = p.child(n); p == nil {
+			return bytesLiteral(nil)
+		}
+	}
+
+	if sec.specifier == "MIME" {
+		return c.span(p.start, p.bodyStart)
+	}
+	if sec.specifier == "" {
+		if len(sec.path) == 0 {
+			return c.span(p.start, p.end)
+		}
+		return c.span(p.bodyStart, p.end)
+	}
+
+	// The remaining specifiers refer to the message itself, or the message
+	// encapsulated by a message/rfc822 part.
+	if len(sec.path) > 0 {
+		if p.message == nil {
+			return bytesLiteral(nil)
+		}
+		p = p.message
+	}
+	switch sec.specifier {
+	case "HEADER":
+		return c.span(p.start, p.bodyStart)
+	case "TEXT":
+		return c.span(p.bodyStart, p.end)
+	case "HEADER.FIELDS":
+		return bytesLiteral(filterHeader(p.header, sec.fields, false))
+	case "HEADER.FIELDS.NOT":
+		return bytesLiteral(filterHeader(p.header, sec.fields, true))
+	}
+	return bytesLiteral(nil)
+}
+
+// writeFetchItem writes the data of |item| for the |msg| that has the
+// content |c|, which is nil if the item does not need it. Literals are
+// streamed from the message rather than held in memory.
+func writeFetchItem(w io.Writer, item fetchItem, msg Message, c *content) error {
+	var buf bytes.Buffer
+	buf.WriteString(item.label())
+	buf.WriteByte(' ')
+
+	var data *literal
+	switch item.name {
+	case "FLAGS":
+		buf.WriteString(formatFlags(msg.Flags()))
+	case "UID":
+		fmt.Fprintf(&buf, "%d", msg.UID())
+	case "INTERNALDATE":
+		buf.WriteString(`"` + msg.InternalDate().Format("02-Jan-2006 15:04:05 -0700") + `"`)
+	case "RFC822.SIZE":
+		fmt.Fprintf(&buf, "%d", msg.Size())
+	case "ENVELOPE":
+		writeEnvelope(&buf, c.root.mimeHeader)
+	case "BODYSTRUCTURE":
+		writeBodyStructure(&buf, c.root, true)
+	case "BODY":
+		writeBodyStructure(&buf, c.root, false)
+	case "RFC822":
+		l := c.span(c.root.start, c.root.end)
+		data = &l
+	case "RFC822.HEADER":
+		l := c.span(c.root.start, c.root.bodyStart)
+		data = &l
+	case "RFC822.TEXT":
+		l := c.span(c.root.bodyStart, c.root.end)
+		data = &l
+	case "BODY[]":
+		l := sectionContent(c, item.section)
+		if item.partial {
+			l = l.slice(int64(item.offset), int64(item.count))
+		}
+		data = &l
+	}
+
+	if _, err := buf.WriteTo(w); err != nil || data == nil {
+		return err
+	}
+	return data.writeTo(w)
+}
+
+// formatFlags returns a parenthesized list of |flags|.
+func formatFlags(flags []string) string {
+	return "(" + strings.Join(flags, " ") + ")"
+}
@@ -0,0 +1,717 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package imap
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+var crlf = []byte("\r\n")
+
+// maxLineSize is the longest line of a message that is held in memory while
+// the message is scanned. Only the start of a longer line is kept, which is
+// enough to recognize a MIME boundary delimiter.
+const maxLineSize = 64 << 10
+
+// maxHeaderSize is the largest header of a message or body part that is held
+// in memory to be parsed. A larger header is still sent whole to clients.
+const maxHeaderSize = 1 << 20
+
+// MessageSize returns the size of the message read from |r| once its line
+// endings are converted to CRLF, which is how it is sent to clients.
+func MessageSize(r io.Reader) (int, error) {
+	br := bufio.NewReader(r)
+	size := 0
+	var prev byte
+	for {
+		c, err := br.ReadByte()
+		if err == io.EOF {
+			return size, nil
+		} else if err != nil {
+			return 0, err
+		}
+		if c == '\n' && prev != '\r' {
+			size++
+		}
+		size++
+		prev = c
+	}
+}
+
+// offset is a position in a message as it is stored. Messages are sent to
+// clients with CRLF line endings, which moves the position by the number of
+// bare LFs before it.
+type offset struct {
+	pos int64
+	// lf is the number of bare LFs before pos, and lines the number of line
+	// breaks.
+	lf, lines int64
+}
+
+// sent returns the position in the message as it is sent to clients.
+func (o offset) sent() int64 {
+	return o.pos + o.lf
+}
+
+// line is a line of a message.
+type line struct {
+	// text is the start of the line, without its line break.
+	text []byte
+	// start is the offset of the line, and end the offset of its line break.
+	start, end offset
+	// broken is whether the line has a line break, which the last line of a
+	// message may not.
+	broken bool
+}
+
+// scanner reads a message line by line, keeping track of offsets.
+type scanner struct {
+	r   *bufio.Reader
+	off offset
+	// last is the line that was read last, and prev the one before it.
+	last, prev line
+}
+
+func newScanner(r io.Reader) *scanner {
+	return &scanner{r: bufio.NewReaderSize(r, maxLineSize)}
+}
+
+// next reads the next line, or returns io.EOF at the end of the message.
+func (s *scanner) next() (line, error) {
+	l := line{start: s.off}
+	var last byte
+	for first := true; ; first = false {
+		chunk, err := s.r.ReadSlice('\n')
+		if first {
+			l.text = append([]byte(nil), chunk...)
+		}
+		s.off.pos += int64(len(chunk))
+
+		if err == bufio.ErrBufferFull {
+			last = chunk[len(chunk)-1]
+			continue
+		} else if err == io.EOF {
+			if s.off.pos == l.start.pos {
+				return l, io.EOF
+			}
+			l.end = s.off
+			break
+		} else if err != nil {
+			return l, err
+		}
+
+		n := len(chunk)
+		l.end = offset{pos: s.off.pos - 1, lf: l.start.lf, lines: l.start.lines}
+		if (n >= 2 && chunk[n-2] == '\r') || (n == 1 && last == '\r') {
+			l.end.pos--
+		} else {
+			s.off.lf++
+		}
+		s.off.lines++
+		l.broken = true
+		break
+	}
+	if n := l.end.pos - l.start.pos; int64(len(l.text)) > n {
+		l.text = l.text[:n]
+	}
+	s.prev, s.last = s.last, l
+	return l, nil
+}
+
+// delimiter returns whether |text| is a delimiter line for |boundary|, and if
+// so whether it is the close delimiter that ends the multipart body.
+func delimiter(text []byte, boundary string) (ok, close bool) {
+	text = bytes.TrimRight(text, " \t")
+	if !bytes.HasPrefix(text, []byte("--"+boundary)) {
+		return false, false
+	}
+	switch string(text[len(boundary)+2:]) {
+	case "":
+		return true, false
+	case "--":
+		return true, true
+	}
+	return false, false
+}
+
+// isDelimiter returns whether |text| is a delimiter line for any of
+// |boundaries|.
+func isDelimiter(text []byte, boundaries []string) bool {
+	for _, b := range boundaries {
+		if ok, _ := delimiter(text, b); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// part is a MIME entity of a message. Only its header is held in memory; the
+// rest is located by offsets into the message.
+type part struct {
+	// start is the offset of the entity, bodyStart the offset of its body, and
+	// end the offset after it.
+	start, bodyStart, end offset
+	// lines is the number of lines in the body.
+	lines int64
+
+	// header is the header with CRLF line endings, including the blank line
+	// that ends it. It is truncated if it is larger than maxHeaderSize.
+	header []byte
+
+	mimeHeader textproto.MIMEHeader
+	mediaType  string
+	params     map[string]string
+
+	// children are the parts of a multipart entity.
+	children []*part
+	// message is the encapsulated message of a message/rfc822 part.
+	message *part
+}
+
+// parseHeader sets the fields of |p| that come from its header, using
+// |defaultType| if it has no valid Content-Type.
+func (p *part) parseHeader(defaultType string) {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(p.header)))
+	p.mimeHeader, _ = r.ReadMIMEHeader()
+	if p.mimeHeader == nil {
+		p.mimeHeader = make(textproto.MIMEHeader)
+	}
+
+	var err error
+	p.mediaType, p.params, err = mime.ParseMediaType(p.mimeHeader.Get("Content-Type"))
+	if err != nil || !strings.Contains(p.mediaType, "/") {
+		p.mediaType = defaultType
+		p.params = map[string]string{}
+		if defaultType == "text/plain" {
+			p.params["charset"] = "us-ascii"
+		}
+	}
+}
+
+// bodySize returns the size of the body of |p| as it is sent to clients.
+func (p *part) bodySize() int64 {
+	return p.end.sent() - p.bodyStart.sent()
+}
+
+// mimeParser reads the MIME structure of a message.
+type mimeParser struct {
+	s *scanner
+}
+
+// readHeader reads the header of |p|, up to and including the blank line that
+// ends it. If a delimiter line for one of |boundaries| comes first, it is
+// returned.
+func (ps *mimeParser) readHeader(p *part, boundaries []string) (*line, error) {
+	for {
+		l, err := ps.s.next()
+		if err == io.EOF {
+			p.bodyStart = ps.s.off
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if isDelimiter(l.text, boundaries) {
+			p.bodyStart = l.start
+			return &l, nil
+		}
+		if len(l.text) == 0 {
+			p.header = append(p.header, crlf...)
+			p.bodyStart = ps.s.off
+			return nil, nil
+		}
+		if len(p.header) < maxHeaderSize {
+			p.header = append(append(p.header, l.text...), crlf...)
+		}
+	}
+}
+
+// skip reads up to a delimiter line for one of |boundaries|, which is
+// returned, or to the end of the message.
+func (ps *mimeParser) skip(boundaries []string) (*line, error) {
+	for {
+		l, err := ps.s.next()
+		if err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if isDelimiter(l.text, boundaries) {
+			return &l, nil
+		}
+	}
+}
+
+// parsePart parses a MIME entity that starts at the current line and has the
+// type |defaultType| unless its header says otherwise. The entity ends at the
+// end of the message, or before a delimiter line for one of |boundaries|,
+// which is returned.
+func (ps *mimeParser) parsePart(defaultType string, boundaries []string) (*part, *line, error) {
+	p := &part{start: ps.s.off}
+	stop, err := ps.readHeader(p, boundaries)
+	if err != nil {
+		return nil, nil, err
+	}
+	p.parseHeader(defaultType)
+
+	if stop == nil {
+		if strings.HasPrefix(p.mediaType, "multipart/") && p.params["boundary"] != "" {
+			stop, err = ps.parseMultipart(p, boundaries)
+		} else if p.mediaType == "message/rfc822" {
+			p.message, stop, err = ps.parsePart("text/plain", boundaries)
+		} else {
+			stop, err = ps.skip(boundaries)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if strings.HasPrefix(p.mediaType, "multipart/") && len(p.children) == 0 {
+		p.mediaType = "text/plain"
+		p.params = map[string]string{"charset": "us-ascii"}
+	}
+
+	// The entity ends before the line break that precedes |stop|, which
+	// belongs to the delimiter.
+	endsLine := false
+	if stop == nil {
+		p.end = ps.s.off
+		endsLine = ps.s.last.broken
+	} else {
+		before := ps.s.prev
+		p.end = before.end
+		endsLine = before.start.pos == before.end.pos
+	}
+	if p.end.pos < p.start.pos {
+		p.end = p.start
+	}
+	if p.bodyStart.pos > p.end.pos {
+		p.bodyStart = p.end
+	}
+	if p.end.pos > p.bodyStart.pos {
+		p.lines = p.end.lines - p.bodyStart.lines
+		if !endsLine {
+			p.lines++
+		}
+	}
+	return p, stop, nil
+}
+
+// parseMultipart parses the body parts of the multipart entity |p|, skipping
+// its preamble and epilogue.
+func (ps *mimeParser) parseMultipart(p *part, boundaries []string) (*line, error) {
+	boundary := p.params["boundary"]
+	inner := append(boundaries[:len(boundaries):len(boundaries)], boundary)
+	childType := "text/plain"
+	if p.mediaType == "multipart/digest" {
+		childType = "message/rfc822"
+	}
+
+	stop, err := ps.skip(inner)
+	for err == nil && stop != nil {
+		ok, close := delimiter(stop.text, boundary)
+		if !ok {
+			// The delimiter of an enclosing entity ends this one early.
+			return stop, nil
+		}
+		if close {
+			return ps.skip(boundaries)
+		}
+		var child *part
+		if child, stop, err = ps.parsePart(childType, inner); err == nil {
+			p.children = append(p.children, child)
+		}
+	}
+	return stop, err
+}
+
+// child returns the part numbered |n| within |p|, as used in a body section.
+func (p *part) child(n int) *part {
+	if p.message != nil {
+		p = p.message
+	}
+	if len(p.children) > 0 {
+		if n < 1 || n > len(p.children) {
+			return nil
+		}
+		return p.children[n-1]
+	}
+	if n == 1 {
+		return p
+	}
+	return nil
+}
+
+// content is the content of a message, which is read as it is needed rather
+// than all at once.
+type content struct {
+	r      io.ReaderAt
+	closer io.Closer
+
+	// root is the message. Only its header is parsed until parse is called.
+	root   *part
+	parsed bool
+}
+
+// newContent reads the header of the message read by |rc|. If |rc| is not an
+// io.ReaderAt, the message is read into memory.
+func newContent(rc io.ReadCloser) (*content, error) {
+	c := &content{closer: rc}
+	if ra, ok := rc.(io.ReaderAt); ok {
+		c.r = ra
+	} else {
+		data, err := ioutil.ReadAll(rc)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		c.r = bytes.NewReader(data)
+	}
+
+	c.root = &part{}
+	ps := &mimeParser{s: newScanner(c.reader(0))}
+	if _, err := ps.readHeader(c.root, nil); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	c.root.parseHeader("text/plain")
+	return c, nil
+}
+
+// reader returns a reader of the message from |pos| to its end.
+func (c *content) reader(pos int64) io.Reader {
+	return io.NewSectionReader(c.r, pos, math.MaxInt64-pos)
+}
+
+// parse reads the MIME structure of the whole message.
+func (c *content) parse() error {
+	if c.parsed {
+		return nil
+	}
+	ps := &mimeParser{s: newScanner(c.reader(0))}
+	root, _, err := ps.parsePart("text/plain", nil)
+	if err != nil {
+		return err
+	}
+	c.root = root
+	c.parsed = true
+	return nil
+}
+
+// span returns the data of the message from |from| to |to|.
+func (c *content) span(from, to offset) literal {
+	if to.pos < from.pos {
+		to = from
+	}
+	return literal{
+		r:    &crlfReader{r: io.NewSectionReader(c.r, from.pos, to.pos-from.pos)},
+		size: to.sent() - from.sent(),
+	}
+}
+
+func (c *content) Close() error {
+	return c.closer.Close()
+}
+
+// crlfReader converts the bare LF line endings read from |r| to CRLF.
+type crlfReader struct {
+	r    io.Reader
+	prev byte
+	buf  []byte
+	// out is the converted data that has not been read yet.
+	out, conv []byte
+}
+
+func (c *crlfReader) Read(p []byte) (int, error) {
+	if len(c.out) == 0 {
+		if c.buf == nil {
+			c.buf = make([]byte, 32<<10)
+		}
+		n, err := c.r.Read(c.buf)
+		c.conv = c.conv[:0]
+		for _, b := range c.buf[:n] {
+			if b == '\n' && c.prev != '\r' {
+				c.conv = append(c.conv, '\r')
+			}
+			c.conv = append(c.conv, b)
+			c.prev = b
+		}
+		c.out = c.conv
+		if len(c.out) == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, c.out)
+	c.out = c.out[n:]
+	return n, nil
+}
+
+// literal is data that is sent to clients as a literal.
+type literal struct {
+	r io.Reader
+	// skip is the number of bytes of |r| before the data.
+	skip, size int64
+}
+
+func bytesLiteral(b []byte) literal {
+	return literal{r: bytes.NewReader(b), size: int64(len(b))}
+}
+
+// slice returns at most |count| bytes of |l| starting at |offset|.
+func (l literal) slice(offset, count int64) literal {
+	if offset >= l.size {
+		return bytesLiteral(nil)
+	}
+	if count > l.size-offset {
+		count = l.size - offset
+	}
+	return literal{r: l.r, skip: l.skip + offset, size: count}
+}
+
+// writeTo writes the literal to |w|. If its data cannot be read, the rest of
+// the literal is filled with spaces so that the response stays well formed.
+func (l literal) writeTo(w io.Writer) error {
+	fmt.Fprintf(w, "{%d}\r\n", l.size)
+	_, err := io.CopyN(ioutil.Discard, l.r, l.skip)
+	var n int64
+	if err == nil {
+		n, err = io.CopyN(w, l.r, l.size)
+	}
+	if err != nil {
+		w.Write(bytes.Repeat([]byte{' '}, int(l.size-n)))
+	}
+	return err
+}
+
+// filterHeader returns the fields of |header| that are named in |fields|, or
+// that are not if |not| is set, followed by a blank line.
+func filterHeader(header []byte, fields []string, not bool) []byte {
+	var out []byte
+	include := false
+	for pos := 0; pos < len(header); {
+		end := bytes.Index(header[pos:], crlf)
+		if end == -1 {
+			end = len(header) - pos
+		} else {
+			end += 2
+		}
+		line := header[pos : pos+end]
+		pos += end
+
+		if len(bytes.TrimSpace(line)) == 0 {
+			break
+		}
+		if line[0] != ' ' && line[0] != '\t' {
+			name := line
+			if i := bytes.IndexByte(line, ':'); i != -1 {
+				name = line[:i]
+			}
+			include = not
+			for _, f := range fields {
+				if strings.EqualFold(strings.TrimSpace(string(name)), f) {
+					include = !not
+					break
+				}
+			}
+		}
+		if include {
+			out = append(out, line...)
+		}
+	}
+	return append(out, crlf...)
+}
+
+// writeString writes |s| as a quoted string, or as a literal if it cannot be
+// quoted.
+func writeString(buf *bytes.Buffer, s string) {
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '\r' || c == '\n' || c >= 0x80 || c == 0 {
+			fmt.Fprintf(buf, "{%d}\r\n%s", len(s), s)
+			return
+		}
+	}
+	buf.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c == '"' || c == '\\' {
+			buf.WriteByte('\\')
+		}
+		buf.WriteByte(s[i])
+	}
+	buf.WriteByte('"')
+}
+
+// writeNString writes |s|, or NIL if it is empty.
+func writeNString(buf *bytes.Buffer, s string) {
+	if s == "" {
+		buf.WriteString("NIL")
+	} else {
+		writeString(buf, s)
+	}
+}
+
+func writeEnvelope(buf *bytes.Buffer, h textproto.MIMEHeader) {
+	from := h.Get("From")
+	sender := h.Get("Sender")
+	if sender == "" {
+		sender = from
+	}
+	replyTo := h.Get("Reply-To")
+	if replyTo == "" {
+		replyTo = from
+	}
+
+	buf.WriteByte('(')
+	writeNString(buf, h.Get("Date"))
+	buf.WriteByte(' ')
+	writeNString(buf, h.Get("Subject"))
+	for _, addrs := range []string{from, sender, replyTo, h.Get("To"), h.Get("Cc"), h.Get("Bcc")} {
+		buf.WriteByte(' ')
+		writeAddressList(buf, addrs)
+	}
+	buf.WriteByte(' ')
+	writeNString(buf, h.Get("In-Reply-To"))
+	buf.WriteByte(' ')
+	writeNString(buf, h.Get("Message-Id"))
+	buf.WriteByte(')')
+}
+
+func writeAddressList(buf *bytes.Buffer, value string) {
+	addrs, err := mail.ParseAddressList(value)
+	if value == "" || err != nil || len(addrs) == 0 {
+		buf.WriteString("NIL")
+		return
+	}
+
+	buf.WriteByte('(')
+	for _, addr := range addrs {
+		local, domain := addr.Address, ""
+		if i := strings.LastIndexByte(local, '@'); i != -1 {
+			local, domain = local[:i], local[i+1:]
+		}
+		name := addr.Name
+		for _, r := range name {
+			if r >= 0x80 {
+				name = mime.QEncoding.Encode("utf-8", name)
+				break
+			}
+		}
+
+		buf.WriteByte('(')
+		writeNString(buf, name)
+		buf.WriteString(" NIL ")
+		writeNString(buf, local)
+		buf.WriteByte(' ')
+		writeNString(buf, domain)
+		buf.WriteByte(')')
+	}
+	buf.WriteByte(')')
+}
+
+// writeBodyStructure writes the BODY, or if |extended| the BODYSTRUCTURE, of
+// |p|.
+func writeBodyStructure(buf *bytes.Buffer, p *part, extended bool) {
+	mediaType := strings.SplitN(strings.ToUpper(p.mediaType), "/", 2)
+
+	buf.WriteByte('(')
+	if len(p.children) > 0 {
+		for _, child := range p.children {
+			writeBodyStructure(buf, child, extended)
+		}
+		buf.WriteByte(' ')
+		writeString(buf, mediaType[1])
+		if extended {
+			buf.WriteByte(' ')
+			writeParams(buf, p.params)
+			buf.WriteByte(' ')
+			writeDisposition(buf, p.mimeHeader)
+			buf.WriteString(" NIL NIL")
+		}
+		buf.WriteByte(')')
+		return
+	}
+
+	encoding := strings.ToUpper(p.mimeHeader.Get("Content-Transfer-Encoding"))
+	if encoding == "" {
+		encoding = "7BIT"
+	}
+
+	writeString(buf, mediaType[0])
+	buf.WriteByte(' ')
+	writeString(buf, mediaType[1])
+	buf.WriteByte(' ')
+	writeParams(buf, p.params)
+	buf.WriteByte(' ')
+	writeNString(buf, p.mimeHeader.Get("Content-Id"))
+	buf.WriteByte(' ')
+	writeNString(buf, p.mimeHeader.Get("Content-Description"))
+	buf.WriteByte(' ')
+	writeString(buf, encoding)
+	fmt.Fprintf(buf, " %d", p.bodySize())
+
+	if p.message != nil {
+		buf.WriteByte(' ')
+		writeEnvelope(buf, p.message.mimeHeader)
+		buf.WriteByte(' ')
+		writeBodyStructure(buf, p.message, extended)
+	}
+	if p.message != nil || mediaType[0] == "TEXT" {
+		fmt.Fprintf(buf, " %d", p.lines)
+	}
+
+	if extended {
+		buf.WriteString(" NIL ")
+		writeDisposition(buf, p.mimeHeader)
+		buf.WriteString(" NIL NIL")
+	}
+	buf.WriteByte(')')
+}
+
+// writeParams writes a list of body parameters, sorted by name.
+func writeParams(buf *bytes.Buffer, params map[string]string) {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	if len(keys) == 0 {
+		buf.WriteString("NIL")
+		return
+	}
+	buf.WriteByte('(')
+	for i, k := range keys {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		writeString(buf, strings.ToUpper(k))
+		buf.WriteByte(' ')
+		writeString(buf, params[k])
+	}
+	buf.WriteByte(')')
+}
+
+func writeDisposition(buf *bytes.Buffer, h textproto.MIMEHeader) {
+	disposition, params, err := mime.ParseMediaType(h.Get("Content-Disposition"))
+	if err != nil {
+		buf.WriteString("NIL")
+		return
+	}
+	buf.WriteByte('(')
+	writeString(buf, strings.ToUpper(disposition))
+	buf.WriteByte(' ')
+	writeParams(buf, params)
+	buf.WriteByte(')')
+}
@@ -0,0 +1,275 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The arguments of a command are parsed into an atom, a string (from a quoted
+// string or a literal), or a list of arguments. An atom is any bare word,
+// including NIL and sequence sets. Brackets in an atom, like in
+// "BODY[HEADER.FIELDS (FROM)]", are consumed whole.
+type atom string
+
+type list []interface{}
+
+type command struct {
+	tag  string
+	name string
+	args []interface{}
+}
+
+var errLiteralTooLarge = errors.New("literal too large")
+
+// maxLiteralSize bounds the size of a literal in a command.
+const maxLiteralSize = 64 * 1024
+
+// literalSize returns the size of the literal announced at the end of |line|.
+func literalSize(line []byte) (int, bool) {
+	if len(line) < 3 || line[len(line)-1] != '}' {
+		return 0, false
+	}
+	start := strings.LastIndexByte(string(line), '{')
+	if start == -1 {
+		return 0, false
+	}
+	n, err := strconv.Atoi(string(line[start+1 : len(line)-1]))
+	if err != nil || n < 0 {
+		return 0, false
+	}
+	return n, true
+}
+
+type parser struct {
+	b   []byte
+	pos int
+}
+
+// parseCommand parses a command that was read by readCommand. If the tag
+// could be read, it is set even if an error is returned.
+func parseCommand(b []byte) (*command, error) {
+	p := &parser{b: b}
+	cmd := &command{}
+
+	cmd.tag = p.word()
+	if cmd.tag == "" || strings.ContainsAny(cmd.tag, "+(){%*\"\\") {
+		cmd.tag = ""
+		return cmd, errors.New("invalid tag")
+	}
+	if !p.consume(' ') {
+		return cmd, errors.New("missing command")
+	}
+	cmd.name = strings.ToUpper(p.word())
+	if cmd.name == "" {
+		return cmd, errors.New("missing command")
+	}
+
+	for !p.eof() {
+		if !p.consume(' ') {
+			return cmd, errors.New("expected space")
+		}
+		v, err := p.value()
+		if err != nil {
+			return cmd, err
+		}
+		cmd.args = append(cmd.args, v)
+	}
+	return cmd, nil
+}
+
+func (p *parser) eof() bool {
+	return p.pos >= len(p.b)
+}
+
+func (p *parser) consume(c byte) bool {
+	if !p.eof() && p.b[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+// word reads up to the next space.
+func (p *parser) word() string {
+	start := p.pos
+	for !p.eof() && p.b[p.pos] != ' ' {
+		p.pos++
+	}
+	return string(p.b[start:p.pos])
+}
+
+func (p *parser) value() (interface{}, error) {
+	if p.eof() {
+		return nil, errors.New("expected argument")
+	}
+	switch p.b[p.pos] {
+	case '(':
+		p.pos++
+		l := list{}
+		for {
+			if p.consume(')') {
+				return l, nil
+			}
+			if len(l) > 0 && !p.consume(' ') {
+				return nil, errors.New("expected space in list")
+			}
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			l = append(l, v)
+		}
+	case '"':
+		return p.quoted()
+	case '{':
+		return p.literal()
+	default:
+		return p.atom()
+	}
+}
+
+func (p *parser) quoted() (string, error) {
+	p.pos++
+	var sb strings.Builder
+	for !p.eof() {
+		c := p.b[p.pos]
+		p.pos++
+		switch c {
+		case '"':
+			return sb.String(), nil
+		case '\\':
+			if p.eof() {
+				return "", errors.New("unterminated quoted string")
+			}
+			sb.WriteByte(p.b[p.pos])
+			p.pos++
+		case '\r', '\n':
+			return "", errors.New("newline in quoted string")
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", errors.New("unterminated quoted string")
+}
+
+func (p *parser) literal() (string, error) {
+	end := strings.IndexByte(string(p.b[p.pos:]), '}')
+	if end == -1 {
+		return "", errors.New("invalid literal")
+	}
+	n, err := strconv.Atoi(string(p.b[p.pos+1 : p.pos+end]))
+	if err != nil || n < 0 {
+		return "", errors.New("invalid literal size")
+	}
+	p.pos += end + 1
+	if !p.consume('\r') || !p.consume('\n') || p.pos+n > len(p.b) {
+		return "", errors.New("invalid literal")
+	}
+	s := string(p.b[p.pos : p.pos+n])
+	p.pos += n
+	return s, nil
+}
+
+func (p *parser) atom() (atom, error) {
+	start := p.pos
+	for !p.eof() {
+		c := p.b[p.pos]
+		if c == ' ' || c == '(' || c == ')' || c == '"' || c == '{' || c < ' ' {
+			break
+		}
+		if c == '[' {
+			end := strings.IndexByte(string(p.b[p.pos:]), ']')
+			if end == -1 {
+				return "", errors.New("unterminated [")
+			}
+			p.pos += end
+		}
+		p.pos++
+	}
+	if p.pos == start {
+		return "", fmt.Errorf("unexpected %q", p.b[p.pos])
+	}
+	return atom(p.b[start:p.pos]), nil
+}
+
+// astring returns the value of an argument that is an atom or a string.
+func astring(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case atom:
+		return string(v), true
+	case string:
+		return v, true
+	}
+	return "", false
+}
+
+// seqRange is an inclusive range of sequence numbers or UIDs. Zero stands for
+// "*", the largest number in use.
+type seqRange struct {
+	start, stop uint32
+}
+
+type seqSet []seqRange
+
+func parseSeqSet(v interface{}) (seqSet, error) {
+	a, ok := v.(atom)
+	if !ok {
+		return nil, errors.New("invalid sequence set")
+	}
+
+	var set seqSet
+	for _, r := range strings.Split(string(a), ",") {
+		bounds := strings.SplitN(r, ":", 2)
+		start, err := parseSeqNumber(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		stop := start
+		if len(bounds) == 2 {
+			if stop, err = parseSeqNumber(bounds[1]); err != nil {
+				return nil, err
+			}
+		}
+		set = append(set, seqRange{start, stop})
+	}
+	return set, nil
+}
+
+func parseSeqNumber(s string) (uint32, error) {
+	if s == "*" {
+		return 0, nil
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil || n == 0 {
+		return 0, fmt.Errorf("invalid sequence number %q", s)
+	}
+	return uint32(n), nil
+}
+
+// contains returns whether |n| is in the set, where |max| is the value of "*".
+func (set seqSet) contains(n, max uint32) bool {
+	for _, r := range set {
+		start, stop := r.start, r.stop
+		if start == 0 {
+			start = max
+		}
+		if stop == 0 {
+			stop = max
+		}
+		if start > stop {
+			start, stop = stop, start
+		}
+		if n >= start && n <= stop {
+			return true
+		}
+	}
+	return false
+}
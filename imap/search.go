@@ -0,0 +1,338 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package imap
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// searchMessage is a message being matched against search keys. Its content
+// is only read if a key needs it.
+type searchMessage struct {
+	seq     uint32
+	msg     Message
+	content *content
+	failed  bool
+	load    func(Message, bool) (*content, error)
+
+	// The values of "*" for sequence numbers and UIDs.
+	maxSeq, maxUID uint32
+}
+
+// header returns the header of the message, or nil if it cannot be read.
+func (m *searchMessage) header() textproto.MIMEHeader {
+	if m.content == nil && !m.failed {
+		var err error
+		if m.content, err = m.load(m.msg, false); err != nil {
+			m.failed = true
+		}
+	}
+	if m.content == nil {
+		return nil
+	}
+	return m.content.root.mimeHeader
+}
+
+// textContains returns whether the message contains |s|, ignoring case. If
+// |body| is set, only the body of the message is searched.
+func (m *searchMessage) textContains(s string, body bool) bool {
+	if m.header() == nil {
+		return false
+	}
+	var pos int64
+	if body {
+		pos = m.content.root.bodyStart.pos
+	}
+	return readerContainsFold(m.content.reader(pos), s)
+}
+
+// close releases the content of the message, if it was read.
+func (m *searchMessage) close() {
+	if m.content != nil {
+		m.content.Close()
+		m.content = nil
+	}
+}
+
+func (m *searchMessage) hasFlag(flag string) bool {
+	for _, f := range m.msg.Flags() {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+// headerContains returns whether a |field| of the message contains |s|,
+// ignoring case. An empty |s| matches any message with the field.
+func (m *searchMessage) headerContains(field, s string) bool {
+	values, ok := m.header()[textproto.CanonicalMIMEHeaderKey(field)]
+	if !ok {
+		return false
+	}
+	for _, v := range values {
+		if decoded, err := new(mime.WordDecoder).DecodeHeader(v); err == nil {
+			v = decoded
+		}
+		if containsFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+type searchKey func(*searchMessage) bool
+
+type searchParser struct {
+	args []interface{}
+}
+
+// parseSearch parses the search keys in |args|, all of which must match.
+func parseSearch(args []interface{}) (searchKey, error) {
+	p := &searchParser{args: args}
+	keys, err := p.keys()
+	if err != nil {
+		return nil, err
+	}
+	if len(p.args) > 0 {
+		return nil, errors.New("unexpected search argument")
+	}
+	return keys, nil
+}
+
+func (p *searchParser) keys() (searchKey, error) {
+	var keys []searchKey
+	for len(p.args) > 0 {
+		key, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return nil, errors.New("missing search key")
+	}
+	return func(m *searchMessage) bool {
+		for _, key := range keys {
+			if !key(m) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+func (p *searchParser) next() (interface{}, error) {
+	if len(p.args) == 0 {
+		return nil, errors.New("missing search argument")
+	}
+	v := p.args[0]
+	p.args = p.args[1:]
+	return v, nil
+}
+
+func (p *searchParser) string() (string, error) {
+	v, err := p.next()
+	if err != nil {
+		return "", err
+	}
+	s, ok := astring(v)
+	if !ok {
+		return "", errors.New("expected string")
+	}
+	return s, nil
+}
+
+func (p *searchParser) date() (time.Time, error) {
+	s, err := p.string()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Parse("2-Jan-2006", s)
+}
+
+func (p *searchParser) number() (int, error) {
+	s, err := p.string()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(s)
+}
+
+func (p *searchParser) key() (searchKey, error) {
+	v, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+
+	if l, ok := v.(list); ok {
+		return (&searchParser{args: l}).keys()
+	}
+	a, ok := v.(atom)
+	if !ok {
+		return nil, errors.New("invalid search key")
+	}
+
+	name := strings.ToUpper(string(a))
+	switch name {
+	case "ALL", "OLD":
+		return func(*searchMessage) bool { return true }, nil
+	case "NEW", "RECENT":
+		return func(*searchMessage) bool { return false }, nil
+	case "ANSWERED", "DELETED", "DRAFT", "FLAGGED", "SEEN":
+		flag := `\` + name[:1] + strings.ToLower(name[1:])
+		return func(m *searchMessage) bool { return m.hasFlag(flag) }, nil
+	case "UNANSWERED", "UNDELETED", "UNDRAFT", "UNFLAGGED", "UNSEEN":
+		flag := `\` + name[2:3] + strings.ToLower(name[3:])
+		return func(m *searchMessage) bool { return !m.hasFlag(flag) }, nil
+	case "KEYWORD", "UNKEYWORD":
+		if _, err := p.string(); err != nil {
+			return nil, err
+		}
+		match := name == "UNKEYWORD"
+		return func(*searchMessage) bool { return match }, nil
+	case "BCC", "CC", "FROM", "SUBJECT", "TO":
+		s, err := p.string()
+		if err != nil {
+			return nil, err
+		}
+		return func(m *searchMessage) bool { return m.headerContains(name, s) }, nil
+	case "HEADER":
+		field, err := p.string()
+		if err != nil {
+			return nil, err
+		}
+		s, err := p.string()
+		if err != nil {
+			return nil, err
+		}
+		return func(m *searchMessage) bool { return m.headerContains(field, s) }, nil
+	case "BODY":
+		s, err := p.string()
+		if err != nil {
+			return nil, err
+		}
+		return func(m *searchMessage) bool { return m.textContains(s, true) }, nil
+	case "TEXT":
+		s, err := p.string()
+		if err != nil {
+			return nil, err
+		}
+		return func(m *searchMessage) bool { return m.textContains(s, false) }, nil
+	case "BEFORE", "ON", "SINCE":
+		date, err := p.date()
+		if err != nil {
+			return nil, err
+		}
+		return func(m *searchMessage) bool { return compareDate(name, day(m.msg.InternalDate()), date) }, nil
+	case "SENTBEFORE", "SENTON", "SENTSINCE":
+		date, err := p.date()
+		if err != nil {
+			return nil, err
+		}
+		return func(m *searchMessage) bool {
+			sent, err := mail.ParseDate(m.header().Get("Date"))
+			if err != nil {
+				return false
+			}
+			return compareDate(name[len("SENT"):], day(sent), date)
+		}, nil
+	case "LARGER", "SMALLER":
+		n, err := p.number()
+		if err != nil {
+			return nil, err
+		}
+		if name == "LARGER" {
+			return func(m *searchMessage) bool { return m.msg.Size() > n }, nil
+		}
+		return func(m *searchMessage) bool { return m.msg.Size() < n }, nil
+	case "UID":
+		v, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		set, err := parseSeqSet(v)
+		if err != nil {
+			return nil, err
+		}
+		return func(m *searchMessage) bool { return set.contains(m.msg.UID(), m.maxUID) }, nil
+	case "NOT":
+		key, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		return func(m *searchMessage) bool { return !key(m) }, nil
+	case "OR":
+		key1, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		key2, err := p.key()
+		if err != nil {
+			return nil, err
+		}
+		return func(m *searchMessage) bool { return key1(m) || key2(m) }, nil
+	}
+
+	set, err := parseSeqSet(a)
+	if err != nil {
+		return nil, fmt.Errorf("unknown search key %s", a)
+	}
+	return func(m *searchMessage) bool { return set.contains(m.seq, m.maxSeq) }, nil
+}
+
+// day returns the date of |t|, disregarding its time and timezone.
+func day(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func compareDate(op string, t, date time.Time) bool {
+	switch op {
+	case "BEFORE":
+		return t.Before(date)
+	case "ON":
+		return t.Equal(date)
+	default:
+		return !t.Before(date)
+	}
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// readerContainsFold is containsFold for the text read from |r|, which is
+// searched in chunks so that it is never all held in memory.
+func readerContainsFold(r io.Reader, substr string) bool {
+	// Each chunk starts with the end of the previous one, so that matches that
+	// span chunks are found. Lowercasing can change the length of a character,
+	// so the overlap is longer than |substr|.
+	overlap := 2*len(substr) + utf8.UTFMax
+	buf := make([]byte, 32<<10+overlap)
+	n := 0
+	for {
+		m, err := io.ReadFull(r, buf[n:])
+		n += m
+		if containsFold(string(buf[:n]), substr) {
+			return true
+		}
+		if err != nil {
+			return false
+		}
+		n = copy(buf, buf[n-overlap:])
+	}
+}
@@ -0,0 +1,59 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package imap
+
+import (
+	"io"
+	"time"
+)
+
+// System flags that can be stored on a message.
+const (
+	FlagSeen     = `\Seen`
+	FlagAnswered = `\Answered`
+	FlagFlagged  = `\Flagged`
+	FlagDeleted  = `\Deleted`
+	FlagDraft    = `\Draft`
+)
+
+// SystemFlags lists the flags that can be stored, in the order they are
+// reported to clients.
+var SystemFlags = []string{FlagAnswered, FlagFlagged, FlagDeleted, FlagSeen, FlagDraft}
+
+type Message interface {
+	// UID is the unique identifier of the message, which is strictly
+	// ascending in the order that messages were added to the mailbox.
+	UID() uint32
+	// Size is the size of the message in octets, with CRLF line endings.
+	Size() int
+	InternalDate() time.Time
+	Flags() []string
+}
+
+type Mailbox interface {
+	UIDValidity() uint32
+	// UIDNext is the UID that will be assigned to the next message.
+	UIDNext() uint32
+	// ListMessages reads the current messages in the mailbox, in ascending
+	// UID order. It is called again to find changes made by other sessions.
+	ListMessages() ([]Message, error)
+	// Retrieve opens the content of the message. If the reader is also an
+	// io.ReaderAt, like an *os.File, the parts of the message that are
+	// fetched are read from it directly; otherwise the whole message is read
+	// into memory.
+	Retrieve(Message) (io.ReadCloser, error)
+	// SetFlags replaces the flags of the message.
+	SetFlags(Message, []string) error
+	// Expunge permanently removes the message.
+	Expunge(Message) error
+	Close() error
+}
+
+type PostOffice interface {
+	Name() string
+	OpenMailbox(user, pass string) (Mailbox, error)
+}
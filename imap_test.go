@@ -0,0 +1,147 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/imap"
+)
+
+func listUIDs(t *testing.T, mb imap.Mailbox) ([]imap.Message, []uint32) {
+	msgs, err := mb.ListMessages()
+	if err != nil {
+		t.Fatalf("Failed to list messages: %v", err)
+	}
+	var uids []uint32
+	for _, msg := range msgs {
+		uids = append(uids, msg.UID())
+	}
+	return msgs, uids
+}
+
+func TestIMAPMailbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeMessage := func(name, body string, age time.Duration) {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(body), 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		mtime := time.Now().Add(-age)
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatalf("Failed to set time of %s: %v", name, err)
+		}
+	}
+
+	// The newer message is listed last, regardless of its name.
+	writeMessage("a.msg", "Subject: a\n\nbody\n", time.Minute)
+	writeMessage("b.msg", "Subject: b\r\n\r\nbody\r\n", time.Hour)
+	writeMessage("blocked-aliases", "spam@example.com\n", 0)
+
+	newServer := func() *imapServer {
+		return &imapServer{
+			config: Config{
+				Servers: []Server{
+					{
+						Domain:          "example.com",
+						MailboxPassword: "letmein",
+						MaildropPath:    dir,
+					},
+				},
+			},
+			log: zap.NewNop(),
+		}
+	}
+
+	s := newServer()
+	if _, err := s.OpenMailbox("mailbox@example.com", "wrong"); err == nil {
+		t.Errorf("Expected error opening mailbox with the wrong password")
+	}
+	mb, err := s.OpenMailbox("mailbox@example.com", "letmein")
+	if err != nil {
+		t.Fatalf("Failed to open mailbox: %v", err)
+	}
+
+	msgs, uids := listUIDs(t, mb)
+	if want, got := []uint32{1, 2}, uids; !reflect.DeepEqual(want, got) {
+		t.Errorf("Want UIDs %v, got %v", want, got)
+	}
+	if want, got := "b.msg", filepath.Base(msgs[0].(*imapMessage).filename); want != got {
+		t.Errorf("Want first message %q, got %q", want, got)
+	}
+	for _, msg := range msgs {
+		if want, got := len("Subject: a\r\n\r\nbody\r\n"), msg.Size(); want != got {
+			t.Errorf("Want size %d, got %d", want, got)
+		}
+	}
+	if want, got := uint32(3), mb.UIDNext(); want != got {
+		t.Errorf("Want UIDNEXT %d, got %d", want, got)
+	}
+
+	if err := mb.SetFlags(msgs[1], []string{imap.FlagSeen}); err != nil {
+		t.Errorf("Failed to set flags: %v", err)
+	}
+
+	// A new session sees the same UIDs and flags.
+	mb2, err := newServer().OpenMailbox("mailbox@example.com", "letmein")
+	if err != nil {
+		t.Fatalf("Failed to open mailbox: %v", err)
+	}
+	if want, got := mb.UIDValidity(), mb2.UIDValidity(); want != got {
+		t.Errorf("Want UIDVALIDITY %d, got %d", want, got)
+	}
+	msgs, _ = listUIDs(t, mb2)
+	if want, got := []string{imap.FlagSeen}, msgs[1].Flags(); !reflect.DeepEqual(want, got) {
+		t.Errorf("Want flags %v, got %v", want, got)
+	}
+
+	// Messages that are delivered get new UIDs, and messages that are removed
+	// by another session are no longer listed.
+	writeMessage("0.msg", "Subject: c\n\nbody\n", 0)
+	if err := os.Remove(filepath.Join(dir, "a.msg")); err != nil {
+		t.Fatal(err)
+	}
+	msgs, uids = listUIDs(t, mb)
+	if want, got := []uint32{1, 3}, uids; !reflect.DeepEqual(want, got) {
+		t.Errorf("Want UIDs %v, got %v", want, got)
+	}
+
+	if err := mb.Expunge(msgs[0]); err != nil {
+		t.Errorf("Failed to expunge: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "b.msg")); !os.IsNotExist(err) {
+		t.Errorf("Expunged message was not removed: %v", err)
+	}
+	if err := mb2.SetFlags(msgs[0], []string{imap.FlagDeleted}); err == nil {
+		t.Errorf("Expected error setting flags of expunged message")
+	}
+	_, uids = listUIDs(t, mb2)
+	if want, got := []uint32{3}, uids; !reflect.DeepEqual(want, got) {
+		t.Errorf("Want UIDs %v, got %v", want, got)
+	}
+}
+
+func TestIMAPStateLockIsPerMaildrop(t *testing.T) {
+	if stateLock("/var/mail/a") != stateLock("/var/mail/a/") {
+		t.Errorf("Expected the same lock for the same maildrop")
+	}
+	if stateLock("/var/mail/a") == stateLock("/var/mail/b") {
+		t.Errorf("Expected different locks for different maildrops")
+	}
+}
@@ -0,0 +1,109 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+// maildropView is the set of messages that an account sees when it logs in.
+type maildropView struct {
+	// maildrop is the maildrop of the account, which is dir or contains it.
+	// The state of the messages of the account is stored in it.
+	maildrop string
+	// dir is the maildrop of the account, or one of its alias subfolders.
+	dir string
+	// alias is the name of the subfolder that is dir, or empty if dir is the
+	// maildrop.
+	alias string
+	// subfolders is whether the messages in the alias subfolders of dir are
+	// included, along with those in dir itself.
+	subfolders bool
+}
+
+// maildropMessage is a message file in a maildropView.
+type maildropMessage struct {
+	// name is the path of the file, relative to the dir of the view.
+	name string
+	info os.FileInfo
+}
+
+// key returns the name of the message file |name|, which is relative to the
+// dir of |v|, relative to the maildrop instead. The state of the messages is
+// keyed by it, so that all the views of an account share it.
+func (v maildropView) key(name string) string {
+	return path.Join(v.alias, name)
+}
+
+// contains returns whether the message with |key| is in the view.
+func (v maildropView) contains(key string) bool {
+	dir := path.Dir(key)
+	if v.alias != "" {
+		return dir == v.alias
+	}
+	return dir == "." || v.subfolders
+}
+
+// aliasSubfolder returns the name of the subfolder in which mail for |local|
+// is stored, when the AliasSubfolders option is set. It is the local part in
+// lower case, with the characters that are not safe in a file name or a login
+// replaced by "_".
+func aliasSubfolder(local string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(local) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', strings.ContainsRune("+-._", r):
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	name := b.String()
+	if name == "" || name[0] == '.' {
+		name = "_" + name
+	}
+	return name
+}
+
+// readMaildrop lists the message files of |view|. A view of an alias
+// subfolder that does not exist yet has no messages.
+func readMaildrop(view maildropView) ([]maildropMessage, error) {
+	files, err := ioutil.ReadDir(view.dir)
+	if os.IsNotExist(err) && !view.subfolders {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var msgs []maildropMessage
+	for _, file := range files {
+		if file.IsDir() && view.subfolders {
+			subfiles, err := ioutil.ReadDir(path.Join(view.dir, file.Name()))
+			if err != nil {
+				return nil, err
+			}
+			for _, subfile := range subfiles {
+				if isMessageFile(subfile) {
+					msgs = append(msgs, maildropMessage{
+						name: path.Join(file.Name(), subfile.Name()),
+						info: subfile,
+					})
+				}
+			}
+		} else if isMessageFile(file) {
+			msgs = append(msgs, maildropMessage{name: file.Name(), info: file})
+		}
+	}
+	return msgs, nil
+}
+
+func isMessageFile(file os.FileInfo) bool {
+	return !file.IsDir() && path.Ext(file.Name()) == ".msg"
+}
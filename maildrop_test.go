@@ -0,0 +1,224 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"io/ioutil"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+func TestAliasSubfolder(t *testing.T) {
+	cases := map[string]string{
+		"amazon":     "amazon",
+		"Amazon":     "amazon",
+		"shop+books": "shop+books",
+		"first.last": "first.last",
+		"a/b":        "a_b",
+		"..":         "_..",
+		".hidden":    "_.hidden",
+		"":           "_",
+		"bücher":     "b_cher",
+		"with space": "with_space",
+	}
+	for local, want := range cases {
+		if got := aliasSubfolder(local); want != got {
+			t.Errorf("%q: want %q, got %q", local, want, got)
+		}
+	}
+}
+
+func TestAliasSubfolders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	mailboxDir := filepath.Join(dir, "mailbox")
+	aliceDir := filepath.Join(dir, "alice")
+	for _, d := range []string{mailboxDir, aliceDir} {
+		if err := os.Mkdir(d, 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	config := Config{
+		Hostname:       "mx.example.com",
+		POP3ExpireDays: 7,
+		Servers: []Server{
+			{
+				Domain:          "example.com",
+				MailboxPassword: "letmein",
+				MaildropPath:    mailboxDir,
+				AliasSubfolders: true,
+				Users: []User{
+					{
+						Name:         "alice",
+						Password:     "alice-pass",
+						MaildropPath: aliceDir,
+						Prefixes:     []string{"alice-"},
+					},
+				},
+			},
+		},
+	}
+
+	s := smtpServer{config: config, log: zap.NewNop()}
+	deliver := func(id string, rcpts ...string) {
+		env := smtp.Envelope{
+			MailFrom: mail.Address{Address: "sender@mail.net"},
+			Data:     smtp.NewBody([]byte("Subject: test\r\n\r\nbody\r\n")),
+			ID:       id,
+		}
+		for _, rcpt := range rcpts {
+			env.RcptTo = append(env.RcptTo, mail.Address{Address: rcpt})
+		}
+		if rl := s.DeliverMessage(env); rl != nil {
+			t.Fatalf("Failed to deliver %s: %v", id, rl)
+		}
+	}
+	deliver("m1", "amazon@example.com", "mailbox@example.com")
+	deliver("m2", "Amazon@example.com")
+	deliver("m3", "alice-shop@example.com", "alice@example.com")
+	deliver("m4", "amazon@example.com", "ebay@example.com")
+
+	// Each account gets one copy, in the subfolder of its first recipient.
+	files := map[string]bool{
+		filepath.Join(mailboxDir, "amazon", "m1.msg"):          true,
+		filepath.Join(mailboxDir, "amazon", "m2.msg"):          true,
+		filepath.Join(mailboxDir, "amazon", "m4.msg"):          true,
+		filepath.Join(aliceDir, "alice-shop", "m3.msg"):        true,
+		filepath.Join(mailboxDir, "m1.msg"):                    false,
+		filepath.Join(mailboxDir, "ebay", "m4.msg"):            false,
+		filepath.Join(aliceDir, "m3.msg"):                      false,
+		filepath.Join(mailboxDir, "alice-shop", "m3.msg"):      false,
+		filepath.Join(mailboxDir, "mailbox", "m1.msg"):         false,
+		filepath.Join(aliceDir, "alice", "m3.msg"):             false,
+		filepath.Join(mailboxDir, "amazon", "imap-state.json"): false,
+	}
+	for file, want := range files {
+		_, err := os.Stat(file)
+		if got := err == nil; want != got {
+			t.Errorf("%s: want exists=%v, got %v", file, want, got)
+		}
+	}
+
+	pop3 := &pop3Server{config: config, log: zap.NewNop()}
+	uidls := func(user, pass string) []string {
+		mb, err := pop3.OpenMailbox(user, pass)
+		if err != nil {
+			t.Fatalf("Failed to open %s: %v", user, err)
+		}
+		defer mb.Close()
+		msgs, err := mb.ListMessages()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var uids []string
+		for _, msg := range msgs {
+			uids = append(uids, msg.UniqueID())
+		}
+		sort.Strings(uids)
+		return uids
+	}
+
+	uidlTests := []struct {
+		user, pass string
+		uids       []string
+	}{
+		{"mailbox@example.com", "letmein", []string{"amazon/m1", "amazon/m2", "amazon/m4"}},
+		{"mailbox+amazon@example.com", "letmein", []string{"m1", "m2", "m4"}},
+		{"mailbox+AMAZON@example.com", "letmein", []string{"m1", "m2", "m4"}},
+		{"mailbox+ebay@example.com", "letmein", nil},
+		{"alice@example.com", "alice-pass", []string{"alice-shop/m3"}},
+		{"alice+alice-shop@example.com", "alice-pass", []string{"m3"}},
+	}
+	for _, test := range uidlTests {
+		if want, got := test.uids, uidls(test.user, test.pass); !reflect.DeepEqual(want, got) {
+			t.Errorf("%s: want UIDLs %v, got %v", test.user, want, got)
+		}
+	}
+
+	for _, login := range []string{"mailbox+@example.com", "alice+amazon@example.com"} {
+		if _, err := pop3.OpenMailbox(login, "letmein"); err == nil {
+			t.Errorf("%s: expected error", login)
+		}
+	}
+
+	imap := &imapServer{config: config, log: zap.NewNop()}
+	mb, err := imap.OpenMailbox("mailbox@example.com", "letmein")
+	if err != nil {
+		t.Fatalf("Failed to open IMAP mailbox: %v", err)
+	}
+	msgs, uids := listUIDs(t, mb)
+	if want, got := []uint32{1, 2, 3}, uids; !reflect.DeepEqual(want, got) {
+		t.Errorf("Want UIDs %v, got %v", want, got)
+	}
+	var remaining []uint32
+	for _, msg := range msgs {
+		if m := msg.(*imapMessage); m.name != "amazon/m2.msg" {
+			remaining = append(remaining, m.UID())
+		} else if err := mb.Expunge(msg); err != nil {
+			t.Errorf("Failed to expunge: %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(mailboxDir, "amazon", "m2.msg")); !os.IsNotExist(err) {
+		t.Errorf("Expunged message still exists: %v", err)
+	}
+
+	mb, err = imap.OpenMailbox("mailbox+amazon@example.com", "letmein")
+	if err != nil {
+		t.Fatalf("Failed to open IMAP alias mailbox: %v", err)
+	}
+	// The views of an account share the UIDs of its state.
+	if _, uids := listUIDs(t, mb); !reflect.DeepEqual(remaining, uids) {
+		t.Errorf("Want alias UIDs %v, got %v", remaining, uids)
+	}
+	if _, err := os.Stat(filepath.Join(mailboxDir, "amazon", imapStateFile)); !os.IsNotExist(err) {
+		t.Errorf("Alias IMAP state was stored in its subfolder: %v", err)
+	}
+
+	// Opening the alias does not prune the rest of the account.
+	mb, err = imap.OpenMailbox("mailbox@example.com", "letmein")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, uids := listUIDs(t, mb); !reflect.DeepEqual(remaining, uids) {
+		t.Errorf("Want UIDs %v after expunge, got %v", remaining, uids)
+	}
+
+	// The POP3 state is also kept for the account, so closing one view does
+	// not drop the messages retrieved through another.
+	pmb, err := pop3.OpenMailbox("mailbox+amazon@example.com", "letmein")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pmb.(*mailbox).MarkRetrieved(pmb.GetMessage(1))
+	pmb.Close()
+	for _, login := range []string{"mailbox+ebay@example.com", "mailbox@example.com"} {
+		uidls(login, "letmein")
+	}
+	retrieved, err := readPOP3State(mailboxDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := retrieved["amazon/m1.msg"]; !ok || len(retrieved) != 1 {
+		t.Errorf("Want amazon/m1.msg in the POP3 state, got %v", retrieved)
+	}
+	if _, err := os.Stat(filepath.Join(mailboxDir, "amazon", pop3StateFile)); !os.IsNotExist(err) {
+		t.Errorf("Alias POP3 state was stored in its subfolder: %v", err)
+	}
+}
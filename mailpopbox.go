@@ -7,7 +7,6 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
 
@@ -15,8 +14,17 @@ import (
 )
 
 func main() {
+	if len(os.Args) >= 2 && os.Args[1] == "hash-password" {
+		if err := hashPasswordCommand(os.Args[2:], os.Stdin, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "hash-password: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	if len(os.Args) != 2 {
 		fmt.Fprintf(os.Stderr, "Usage: %s config.json\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "       %s hash-password [argon2id|bcrypt|scram-sha-256] < password\n", os.Args[0])
 		os.Exit(1)
 	}
 
@@ -25,19 +33,15 @@ func main() {
 		os.Exit(0)
 	}
 
-	configFile, err := os.Open(os.Args[1])
+	config, err := ReadConfig(os.Args[1])
+	if err == nil {
+		err = config.Validate()
+	}
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "config file: %s\n", err)
 		os.Exit(2)
 	}
 
-	var config Config
-	if err := json.NewDecoder(configFile).Decode(&config); err != nil {
-		fmt.Fprintf(os.Stderr, "config file: %s\n", err)
-		os.Exit(3)
-	}
-	configFile.Close()
-
 	logConfig := zap.NewDevelopmentConfig()
 	logConfig.Development = false
 	logConfig.DisableStacktrace = true
@@ -50,8 +54,26 @@ func main() {
 
 	log.Info("starting mailpopbox", zap.String("hostname", config.Hostname))
 
+	for _, s := range config.Servers {
+		if !isHashedPassword(s.MailboxPassword) {
+			log.Warn("mailbox password is stored in plaintext, replace it with the output of hash-password",
+				zap.String("domain", s.Domain))
+		}
+		for _, u := range s.Users {
+			if !isHashedPassword(u.Password) {
+				log.Warn("user password is stored in plaintext, replace it with the output of hash-password",
+					zap.String("domain", s.Domain), zap.String("user", u.Name))
+			}
+		}
+	}
+
 	pop3 := runPOP3Server(config, log)
-	smtp := runSMTPServer(config, log)
+	smtp := runSMTPServer(config, os.Args[1], log)
+
+	var imap <-chan ServerControlMessage
+	if config.IMAPPort != 0 {
+		imap = runIMAPServer(config, log)
+	}
 
 	for {
 		select {
@@ -61,6 +83,12 @@ func main() {
 			} else {
 				break
 			}
+		case cm := <-imap:
+			if cm == ServerControlRestart {
+				imap = runIMAPServer(config, log)
+			} else {
+				break
+			}
 		case <-smtp:
 			// smtp never reloads.
 			break
@@ -0,0 +1,215 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+
+	"src.bluestatic.org/mailpopbox/sasl"
+)
+
+// The schemes with which a MailboxPassword can be hashed.
+const (
+	PasswordSchemeArgon2id    = "argon2id"
+	PasswordSchemeBcrypt      = "bcrypt"
+	PasswordSchemeScramSHA256 = "scram-sha-256"
+)
+
+// The parameters of new argon2id hashes, which are the second recommended
+// option of RFC 9106 § 4.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 4
+	argon2KeyLen  = 32
+	argon2SaltLen = 16
+)
+
+const (
+	argon2idPrefix = "$argon2id$"
+	scramPrefix    = "SCRAM-SHA-256$"
+)
+
+var errInvalidPasswordHash = errors.New("invalid password hash")
+
+// hashPassword hashes |password| with |scheme|, in the form in which it is
+// stored in a MailboxPassword.
+func hashPassword(scheme, password string) (string, error) {
+	switch scheme {
+	case PasswordSchemeArgon2id:
+		salt := make([]byte, argon2SaltLen)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version,
+			argon2Memory, argon2Time, argon2Threads,
+			base64.RawStdEncoding.EncodeToString(salt),
+			base64.RawStdEncoding.EncodeToString(key)), nil
+	case PasswordSchemeBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hash), err
+	case PasswordSchemeScramSHA256:
+		creds, err := sasl.NewScramCredentials(password)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s%d:%s$%s:%s", scramPrefix, creds.Iterations,
+			base64.StdEncoding.EncodeToString(creds.Salt),
+			base64.StdEncoding.EncodeToString(creds.StoredKey),
+			base64.StdEncoding.EncodeToString(creds.ServerKey)), nil
+	}
+	return "", fmt.Errorf("unknown password scheme %q", scheme)
+}
+
+// isHashedPassword returns whether |stored| is a password hash, rather than a
+// legacy plaintext password.
+func isHashedPassword(stored string) bool {
+	return isBcryptHash(stored) ||
+		strings.HasPrefix(stored, argon2idPrefix) ||
+		strings.HasPrefix(stored, scramPrefix)
+}
+
+func isBcryptHash(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") ||
+		strings.HasPrefix(stored, "$2b$") ||
+		strings.HasPrefix(stored, "$2y$")
+}
+
+// checkPassword returns whether |password| matches the |stored| password,
+// which is either a hash or plaintext. The comparison takes constant time.
+func checkPassword(stored, password string) bool {
+	switch {
+	case isBcryptHash(stored):
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil
+	case strings.HasPrefix(stored, argon2idPrefix):
+		return checkArgon2id(stored, password)
+	case strings.HasPrefix(stored, scramPrefix):
+		creds, err := parseScramCredentials(stored)
+		if err != nil {
+			return false
+		}
+		derived := sasl.DeriveScramCredentials(password, creds.Salt, creds.Iterations)
+		return subtle.ConstantTimeCompare(derived.StoredKey, creds.StoredKey) == 1
+	}
+	// Hashing both values first keeps the comparison from revealing the
+	// length of the plaintext password.
+	storedSum := sha256.Sum256([]byte(stored))
+	passwordSum := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(storedSum[:], passwordSum[:]) == 1
+}
+
+// checkArgon2id verifies |password| against an argon2id hash in the PHC string
+// format, "$argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>".
+func checkArgon2id(stored, password string) bool {
+	fields := strings.Split(stored, "$")
+	if len(fields) != 6 || fields[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return false
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(fields[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(fields[4])
+	if err != nil {
+		return false
+	}
+	key, err := base64.RawStdEncoding.DecodeString(fields[5])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	derived := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(derived, key) == 1
+}
+
+// parseScramCredentials parses SCRAM-SHA-256 credentials in the form of
+// RFC 5803 § 3, "SCRAM-SHA-256$<iterations>:<salt>$<StoredKey>:<ServerKey>".
+func parseScramCredentials(stored string) (sasl.ScramCredentials, error) {
+	var creds sasl.ScramCredentials
+	fields := strings.Split(strings.TrimPrefix(stored, scramPrefix), "$")
+	if len(fields) != 2 {
+		return creds, errInvalidPasswordHash
+	}
+	params := strings.Split(fields[0], ":")
+	keys := strings.Split(fields[1], ":")
+	if len(params) != 2 || len(keys) != 2 {
+		return creds, errInvalidPasswordHash
+	}
+
+	var err error
+	if creds.Iterations, err = strconv.Atoi(params[0]); err != nil || creds.Iterations < 1 {
+		return creds, errInvalidPasswordHash
+	}
+	if creds.Salt, err = base64.StdEncoding.DecodeString(params[1]); err != nil {
+		return creds, errInvalidPasswordHash
+	}
+	if creds.StoredKey, err = base64.StdEncoding.DecodeString(keys[0]); err != nil || len(creds.StoredKey) != sha256.Size {
+		return creds, errInvalidPasswordHash
+	}
+	if creds.ServerKey, err = base64.StdEncoding.DecodeString(keys[1]); err != nil || len(creds.ServerKey) != sha256.Size {
+		return creds, errInvalidPasswordHash
+	}
+	return creds, nil
+}
+
+// scramCredentials returns the SCRAM-SHA-256 credentials for the |stored|
+// password. They can be derived from a plaintext password or a SCRAM hash, but
+// not from the other hashes, in which case false is returned.
+func scramCredentials(stored string) (sasl.ScramCredentials, bool, error) {
+	if strings.HasPrefix(stored, scramPrefix) {
+		creds, err := parseScramCredentials(stored)
+		return creds, err == nil, err
+	}
+	if isHashedPassword(stored) {
+		return sasl.ScramCredentials{}, false, nil
+	}
+	creds, err := sasl.NewScramCredentials(stored)
+	return creds, err == nil, err
+}
+
+// hashPasswordCommand implements the hash-password command, which reads a
+// password from the first line of |in| and writes its hash to |out|. The
+// |args| may name the scheme, which defaults to argon2id.
+func hashPasswordCommand(args []string, in io.Reader, out io.Writer) error {
+	scheme := PasswordSchemeArgon2id
+	switch len(args) {
+	case 0:
+	case 1:
+		scheme = strings.ToLower(args[0])
+	default:
+		return errors.New("too many arguments")
+	}
+
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return errors.New("empty password")
+	}
+
+	hash, err := hashPassword(scheme, password)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(out, hash)
+	return err
+}
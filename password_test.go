@@ -0,0 +1,145 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	for _, scheme := range []string{PasswordSchemeArgon2id, PasswordSchemeBcrypt, PasswordSchemeScramSHA256} {
+		hash, err := hashPassword(scheme, "letmein")
+		if err != nil {
+			t.Fatalf("%s: %v", scheme, err)
+		}
+		if !isHashedPassword(hash) {
+			t.Errorf("%s: %q is not recognized as a hash", scheme, hash)
+		}
+		if !checkPassword(hash, "letmein") {
+			t.Errorf("%s: correct password was not accepted", scheme)
+		}
+		if checkPassword(hash, "letmeout") {
+			t.Errorf("%s: wrong password was accepted", scheme)
+		}
+		if checkPassword(hash, hash) {
+			t.Errorf("%s: hash was accepted as the password", scheme)
+		}
+	}
+
+	if _, err := hashPassword("md5", "letmein"); err == nil {
+		t.Errorf("Expected error for unknown scheme")
+	}
+}
+
+func TestCheckPlaintextPassword(t *testing.T) {
+	if isHashedPassword("letmein") {
+		t.Errorf("Plaintext password is recognized as a hash")
+	}
+	if !checkPassword("letmein", "letmein") {
+		t.Errorf("Correct password was not accepted")
+	}
+	for _, wrong := range []string{"", "letmei", "letmein2", "LETMEIN"} {
+		if checkPassword("letmein", wrong) {
+			t.Errorf("Wrong password %q was accepted", wrong)
+		}
+	}
+}
+
+func TestCheckInvalidHash(t *testing.T) {
+	hashes := []string{
+		"$argon2id$v=19$m=65536,t=3,p=4$c2FsdA",
+		"$argon2id$v=16$m=65536,t=3,p=4$c2FsdHNhbHQ$a2V5a2V5",
+		"$argon2id$v=19$m=65536$c2FsdHNhbHQ$a2V5a2V5",
+		"$argon2id$v=19$m=65536,t=3,p=4$!!!$a2V5a2V5",
+		"SCRAM-SHA-256$4096:c2FsdA==$a2V5:a2V5",
+		"SCRAM-SHA-256$0:c2FsdA==$a2V5:a2V5",
+		"SCRAM-SHA-256$4096$a2V5:a2V5",
+		"$2a$10$tooshort",
+	}
+	for _, hash := range hashes {
+		if checkPassword(hash, "") || checkPassword(hash, hash) {
+			t.Errorf("Invalid hash %q accepted a password", hash)
+		}
+	}
+}
+
+func TestScramCredentialsFromPassword(t *testing.T) {
+	scramHash, err := hashPassword(PasswordSchemeScramSHA256, "letmein")
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds, ok, err := scramCredentials(scramHash)
+	if !ok || err != nil {
+		t.Fatalf("Failed to get credentials from SCRAM hash: %v", err)
+	}
+	parsed, err := parseScramCredentials(scramHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(creds.StoredKey, parsed.StoredKey) || creds.Iterations != parsed.Iterations {
+		t.Errorf("Credentials do not match the hash")
+	}
+
+	creds, ok, err = scramCredentials("letmein")
+	if !ok || err != nil {
+		t.Fatalf("Failed to get credentials from plaintext: %v", err)
+	}
+	if len(creds.StoredKey) == 0 {
+		t.Errorf("Empty credentials from plaintext")
+	}
+
+	bcryptHash, err := hashPassword(PasswordSchemeBcrypt, "letmein")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := scramCredentials(bcryptHash); ok || err != nil {
+		t.Errorf("Expected no credentials from bcrypt hash, got %v %v", ok, err)
+	}
+
+	if _, ok, err := scramCredentials("SCRAM-SHA-256$bad"); ok || err == nil {
+		t.Errorf("Expected error from invalid SCRAM hash, got %v %v", ok, err)
+	}
+}
+
+func TestHashPasswordCommand(t *testing.T) {
+	var out bytes.Buffer
+	if err := hashPasswordCommand(nil, strings.NewReader("letmein\r\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+	hash := strings.TrimSuffix(out.String(), "\n")
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		t.Errorf("Expected argon2id hash, got %q", hash)
+	}
+	if !checkPassword(hash, "letmein") {
+		t.Errorf("Hash does not match the password")
+	}
+
+	out.Reset()
+	if err := hashPasswordCommand([]string{"BCRYPT"}, strings.NewReader("letmein"), &out); err != nil {
+		t.Fatal(err)
+	}
+	if !checkPassword(strings.TrimSpace(out.String()), "letmein") {
+		t.Errorf("Hash does not match the password")
+	}
+
+	errorTests := []struct {
+		args  []string
+		input string
+	}{
+		{nil, ""},
+		{nil, "\n"},
+		{[]string{"md5"}, "letmein\n"},
+		{[]string{"bcrypt", "argon2id"}, "letmein\n"},
+	}
+	for i, test := range errorTests {
+		if err := hashPasswordCommand(test.args, strings.NewReader(test.input), &out); err == nil {
+			t.Errorf("Test %d: expected error", i)
+		}
+	}
+}
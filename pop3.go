@@ -8,6 +8,7 @@ package main
 
 import (
 	"crypto/tls"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
@@ -15,10 +16,28 @@ import (
 	"net"
 	"os"
 	"path"
+	"strings"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
 	"src.bluestatic.org/mailpopbox/pop3"
+	"src.bluestatic.org/mailpopbox/sasl"
+)
+
+// pop3StateFile is the name of the file in a maildrop that stores when its
+// messages were retrieved, for POP3ExpireDays.
+const pop3StateFile = "pop3-state.json"
+
+// The POP3 sessions outlive the pop3Server when it is reloaded, so they are
+// tracked by maildrop in these package variables.
+var (
+	pop3SessionsMu sync.Mutex
+	// pop3Sessions is the set of maildrops that are open in a POP3 session.
+	pop3Sessions = make(map[string]bool)
+	// pop3Logins holds the time of the last POP3 login to each maildrop.
+	pop3Logins = make(map[string]time.Time)
 )
 
 func runPOP3Server(config Config, log *zap.Logger) <-chan ServerControlMessage {
@@ -33,19 +52,22 @@ func runPOP3Server(config Config, log *zap.Logger) <-chan ServerControlMessage {
 
 type pop3Server struct {
 	config      Config
+	tlsConfig   *tls.Config
 	controlChan chan ServerControlMessage
 	log         *zap.Logger
 }
 
 func (server *pop3Server) run() {
 	for _, s := range server.config.Servers {
-		if err := os.Mkdir(s.MaildropPath, 0700); err != nil && !os.IsExist(err) {
-			server.log.Error("failed to open maildrop", zap.Error(err))
-			server.controlChan <- ServerControlFatalError
+		for _, maildrop := range s.maildrops() {
+			if err := os.Mkdir(maildrop, 0700); err != nil && !os.IsExist(err) {
+				server.log.Error("failed to open maildrop", zap.Error(err))
+				server.controlChan <- ServerControlFatalError
+			}
 		}
 	}
 
-	l, err := server.newListener()
+	l, stlsListener, err := server.newListeners()
 	if err != nil {
 		server.controlChan <- ServerControlFatalError
 		return
@@ -54,6 +76,14 @@ func (server *pop3Server) run() {
 	connChan := make(chan net.Conn)
 	go RunAcceptLoop(l, connChan, server.log)
 
+	// The STLS listener has its own channel, as RunAcceptLoop closes it when
+	// the listener is closed. If there is no listener, it is never ready.
+	var stlsConnChan chan net.Conn
+	if stlsListener != nil {
+		stlsConnChan = make(chan net.Conn)
+		go RunAcceptLoop(stlsListener, stlsConnChan, server.log)
+	}
+
 	reloadChan := CreateReloadSignal()
 
 	for {
@@ -61,6 +91,9 @@ func (server *pop3Server) run() {
 		case <-reloadChan:
 			server.log.Info("restarting server")
 			l.Close()
+			if stlsListener != nil {
+				stlsListener.Close()
+			}
 			server.controlChan <- ServerControlRestart
 			break
 		case conn, ok := <-connChan:
@@ -70,90 +103,292 @@ func (server *pop3Server) run() {
 				server.controlChan <- ServerControlFatalError
 				break
 			}
+		case conn, ok := <-stlsConnChan:
+			if ok {
+				go pop3.AcceptConnection(conn, server, server.log)
+			} else {
+				server.controlChan <- ServerControlFatalError
+				break
+			}
 		}
 	}
 }
 
-func (server *pop3Server) newListener() (net.Listener, error) {
-	tlsConfig, err := server.config.GetTLSConfig()
+// newListeners creates the listener on the POP3Port, which uses implicit TLS
+// if it is configured, and the listener on the POP3STLSPort, if any.
+func (server *pop3Server) newListeners() (net.Listener, net.Listener, error) {
+	var err error
+	server.tlsConfig, err = server.config.GetTLSConfig()
 	if err != nil {
 		server.log.Error("failed to configure TLS", zap.Error(err))
-		return nil, err
+		return nil, nil, err
+	}
+
+	if (server.config.POP3STLSPort != 0 || server.config.POP3RequireTLS) && server.tlsConfig == nil {
+		err = errors.New("POP3STLSPort and POP3RequireTLS require TLS")
+		server.log.Error("failed to configure STLS", zap.Error(err))
+		return nil, nil, err
 	}
 
 	addr := fmt.Sprintf(":%d", server.config.POP3Port)
 	server.log.Info("starting server", zap.String("address", addr))
 
 	var l net.Listener
-	if tlsConfig == nil {
+	if server.tlsConfig == nil {
 		l, err = net.Listen("tcp", addr)
 	} else {
-		l, err = tls.Listen("tcp", addr, tlsConfig)
+		l, err = tls.Listen("tcp", addr, server.tlsConfig)
 	}
 	if err != nil {
 		server.log.Error("listen", zap.Error(err))
-		return nil, err
+		return nil, nil, err
 	}
 
-	return l, nil
+	if server.config.POP3STLSPort == 0 {
+		return l, nil, nil
+	}
+
+	addr = fmt.Sprintf(":%d", server.config.POP3STLSPort)
+	server.log.Info("starting STLS server", zap.String("address", addr))
+
+	stlsListener, err := net.Listen("tcp", addr)
+	if err != nil {
+		server.log.Error("listen", zap.Error(err))
+		l.Close()
+		return nil, nil, err
+	}
+
+	return l, stlsListener, nil
 }
 
 func (server *pop3Server) Name() string {
 	return server.config.Hostname
 }
 
+func (server *pop3Server) TLSConfig() *tls.Config {
+	return server.tlsConfig
+}
+
+func (server *pop3Server) RequireTLS() bool {
+	return server.config.POP3RequireTLS
+}
+
 func (server *pop3Server) OpenMailbox(user, pass string) (pop3.Mailbox, error) {
 	for _, s := range server.config.Servers {
-		if user == MailboxAccount+s.Domain && pass == s.MailboxPassword {
-			return server.openMailbox(s.MaildropPath)
+		if password, view, ok := s.account(user); ok && checkPassword(password, pass) {
+			return server.openMailbox(view)
 		}
 	}
 	return nil, errors.New("permission denied")
 }
 
-func (server *pop3Server) openMailbox(maildrop string) (*mailbox, error) {
-	files, err := ioutil.ReadDir(maildrop)
+// APOPEnabled returns whether any account has a password that is not hashed,
+// as APOP needs the password in the clear.
+func (server *pop3Server) APOPEnabled() bool {
+	for _, s := range server.config.Servers {
+		if apopPassword(s.MailboxPassword) {
+			return true
+		}
+		for _, u := range s.Users {
+			if apopPassword(u.Password) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (server *pop3Server) APOPSecret(user string) (string, bool) {
+	for _, s := range server.config.Servers {
+		if password, _, ok := s.account(user); ok && apopPassword(password) {
+			return password, true
+		}
+	}
+	return "", false
+}
+
+func apopPassword(password string) bool {
+	return password != "" && !isHashedPassword(password)
+}
+
+func (server *pop3Server) Authenticate(authz, authc, passwd string) bool {
+	s, password, _ := server.authorizedAccount(authz, authc)
+	return s != nil && checkPassword(password, passwd)
+}
+
+func (server *pop3Server) ScramCredentials(authz, authc string) (sasl.ScramCredentials, bool) {
+	s, password, _ := server.authorizedAccount(authz, authc)
+	if s == nil {
+		return sasl.ScramCredentials{}, false
+	}
+	creds, ok, err := scramCredentials(password)
+	if err != nil {
+		server.log.Error("failed to get SCRAM credentials", zap.String("domain", s.Domain), zap.Error(err))
+	}
+	return creds, ok
+}
+
+func (server *pop3Server) OpenAuthorizedMailbox(authz, authc string) (pop3.Mailbox, error) {
+	if s, _, view := server.authorizedAccount(authz, authc); s != nil {
+		return server.openMailbox(view)
+	}
+	return nil, errors.New("permission denied")
+}
+
+// authorizedAccount returns the Server that has the account |authc|, the
+// account's password, and the messages that are opened for |authz|. The
+// |authz| must be empty or a login of the same account, such as one of its
+// aliases with AliasSubfolders.
+func (server *pop3Server) authorizedAccount(authz, authc string) (*Server, string, maildropView) {
+	for i, s := range server.config.Servers {
+		password, view, ok := s.account(authc)
+		if !ok {
+			continue
+		}
+		if authz != "" {
+			if !s.sameAccount(authz, authc) {
+				return nil, "", view
+			}
+			if _, view, ok = s.account(authz); !ok {
+				return nil, "", view
+			}
+		}
+		return &server.config.Servers[i], password, view
+	}
+	return nil, "", maildropView{}
+}
+
+func (server *pop3Server) openMailbox(view maildropView) (*mailbox, error) {
+	maildrop := path.Clean(view.maildrop)
+	pop3SessionsMu.Lock()
+	defer pop3SessionsMu.Unlock()
+
+	if pop3Sessions[maildrop] {
+		return nil, &pop3.Error{Code: pop3.RespCodeInUse, Message: "maildrop is open in another session"}
+	}
+	now := time.Now()
+	if last, ok := pop3Logins[maildrop]; ok && now.Sub(last) < server.LoginDelay() {
+		return nil, &pop3.Error{Code: pop3.RespCodeLoginDelay, Message: "logged in too recently"}
+	}
+
+	files, err := readMaildrop(view)
 	if err != nil {
-		server.log.Error("failed read maildrop dir", zap.String("dir", maildrop), zap.Error(err))
-		return nil, errors.New("error opening maildrop")
+		server.log.Error("failed read maildrop dir", zap.String("dir", view.dir), zap.Error(err))
+		return nil, &pop3.Error{Code: pop3.RespCodeSysTemp, Message: "error opening maildrop"}
 	}
 
 	mb := &mailbox{
 		messages: make([]message, 0, len(files)),
+		view:     view,
+		maildrop: maildrop,
+		log:      server.log,
 	}
 
-	i := 0
-	for _, file := range files {
-		if file.IsDir() {
-			continue
+	expiry := time.Duration(server.config.POP3ExpireDays) * 24 * time.Hour
+	if expiry > 0 {
+		if mb.retrieved, err = readPOP3State(view.maildrop); err != nil {
+			server.log.Error("failed to read POP3 state", zap.String("dir", view.maildrop), zap.Error(err))
+			return nil, &pop3.Error{Code: pop3.RespCodeSysTemp, Message: "error opening maildrop"}
 		}
+	}
 
+	for _, file := range files {
 		msg := message{
-			filename: path.Join(maildrop, file.Name()),
-			index:    i,
-			size:     file.Size(),
+			filename: path.Join(view.dir, file.name),
+			key:      view.key(file.name),
+			uid:      strings.TrimSuffix(file.name, ".msg"),
+			index:    len(mb.messages),
+			size:     file.info.Size(),
+		}
+		if retrieved, ok := mb.retrieved[msg.key]; ok && now.Sub(retrieved) >= expiry {
+			if err := os.Remove(msg.filename); err == nil || os.IsNotExist(err) {
+				server.log.Info("expired message", zap.String("file", msg.filename))
+				continue
+			}
+			server.log.Error("failed to expire message", zap.String("file", msg.filename), zap.Error(err))
 		}
 		mb.messages = append(mb.messages, msg)
-		i++
 	}
 
+	pop3Sessions[maildrop] = true
+	pop3Logins[maildrop] = now
 	return mb, nil
 }
 
+func (server *pop3Server) LoginDelay() time.Duration {
+	return time.Duration(server.config.POP3LoginDelay) * time.Second
+}
+
+func (server *pop3Server) ExpireDays() int {
+	return server.config.POP3ExpireDays
+}
+
+// pop3State is stored in the pop3StateFile of the maildrop of an account, if
+// POP3ExpireDays is set. Retrieved is keyed by the file name of a message,
+// relative to the maildrop like the imapState, and holds the time at which it
+// was first retrieved in any view of the account.
+type pop3State struct {
+	Retrieved map[string]time.Time
+}
+
+func readPOP3State(dir string) (map[string]time.Time, error) {
+	state := pop3State{}
+	data, err := ioutil.ReadFile(path.Join(dir, pop3StateFile))
+	if os.IsNotExist(err) {
+		return make(map[string]time.Time), nil
+	} else if err != nil {
+		return nil, err
+	} else if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	if state.Retrieved == nil {
+		state.Retrieved = make(map[string]time.Time)
+	}
+	return state.Retrieved, nil
+}
+
+func writePOP3State(dir string, retrieved map[string]time.Time) error {
+	data, err := json.Marshal(pop3State{Retrieved: retrieved})
+	if err != nil {
+		return err
+	}
+	statePath := path.Join(dir, pop3StateFile)
+	tmp := statePath + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, statePath)
+}
+
 type mailbox struct {
 	messages []message
+
+	view maildropView
+	// maildrop is the key of the session in pop3Sessions.
+	maildrop string
+
+	// retrieved is the state of the maildrop, or nil if POP3ExpireDays is
+	// not set.
+	retrieved map[string]time.Time
+
+	log *zap.Logger
 }
 
 type message struct {
 	filename string
-	index    int
-	size     int64
-	deleted  bool
+	// key is the name of the file relative to the maildrop of the account.
+	key string
+	// uid is the name of the file without its extension, and with the alias
+	// subfolder it is in, if any.
+	uid       string
+	index     int
+	size      int64
+	deleted   bool
+	retrieved bool
 }
 
 func (m message) UniqueID() string {
-	l := len(m.filename)
-	return path.Base(m.filename[:l-len(".msg")])
+	return m.uid
 }
 
 func (m message) ID() int {
@@ -184,8 +419,12 @@ func (mb *mailbox) GetMessage(id int) pop3.Message {
 }
 
 func (mb *mailbox) Retrieve(msg pop3.Message) (io.ReadCloser, error) {
-	filename := msg.(*message).filename
-	return os.Open(filename)
+	return os.Open(msg.(*message).filename)
+}
+
+// MarkRetrieved records that |msg| was retrieved, for POP3ExpireDays.
+func (mb *mailbox) MarkRetrieved(msg pop3.Message) {
+	msg.(*message).retrieved = true
 }
 
 func (mb *mailbox) Delete(msg pop3.Message) error {
@@ -194,14 +433,50 @@ func (mb *mailbox) Delete(msg pop3.Message) error {
 }
 
 func (mb *mailbox) Close() error {
+	defer mb.Abort()
+
+	now := time.Now()
 	for _, message := range mb.messages {
 		if message.deleted {
 			os.Remove(message.filename)
 		}
 	}
+
+	if mb.retrieved == nil {
+		return nil
+	}
+	// Of the messages in the view, only those that are left are kept in the
+	// state, which drops those that were deleted, or expired, or removed by
+	// other means. The messages of other views of the account are kept.
+	left := make(map[string]bool)
+	for _, message := range mb.messages {
+		if message.deleted {
+			continue
+		}
+		left[message.key] = true
+		if _, ok := mb.retrieved[message.key]; !ok && message.retrieved {
+			mb.retrieved[message.key] = now
+		}
+	}
+	for key := range mb.retrieved {
+		if mb.view.contains(key) && !left[key] {
+			delete(mb.retrieved, key)
+		}
+	}
+	if err := writePOP3State(mb.view.maildrop, mb.retrieved); err != nil {
+		mb.log.Error("failed to write POP3 state", zap.String("dir", mb.view.maildrop), zap.Error(err))
+		return err
+	}
 	return nil
 }
 
+// Abort ends the session without deleting any messages.
+func (mb *mailbox) Abort() {
+	pop3SessionsMu.Lock()
+	defer pop3SessionsMu.Unlock()
+	delete(pop3Sessions, mb.maildrop)
+}
+
 func (mb *mailbox) Reset() {
 	for i, _ := range mb.messages {
 		mb.messages[i].deleted = false
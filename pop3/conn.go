@@ -7,13 +7,24 @@
 package pop3
 
 import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"net/textproto"
+	"os"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/sasl"
 )
 
 type state int
@@ -29,6 +40,7 @@ const (
 	errStateTxn   = "not in TRANSACTION"
 	errSyntax     = "syntax error"
 	errDeletedMsg = "no such message - deleted"
+	errNeedsTLS   = "plaintext authentication requires TLS, use STLS"
 )
 
 type connection struct {
@@ -36,14 +48,23 @@ type connection struct {
 	mb Mailbox
 
 	tp         *textproto.Conn
+	nc         net.Conn
 	remoteAddr net.Addr
 
+	// tls is the state of the TLS connection, or nil if the connection is
+	// not encrypted.
+	tls *tls.ConnectionState
+
 	log *zap.Logger
 
 	state
 	line string
 
 	user string
+
+	// timestamp is the msg-id in the greeting, from which the APOP digest is
+	// computed, or empty if APOP is not offered.
+	timestamp string
 }
 
 func AcceptConnection(netConn net.Conn, po PostOffice, log *zap.Logger) {
@@ -51,12 +72,30 @@ func AcceptConnection(netConn net.Conn, po PostOffice, log *zap.Logger) {
 	conn := connection{
 		po:    po,
 		tp:    textproto.NewConn(netConn),
+		nc:    netConn,
 		state: stateAuth,
 		log:   log,
 	}
 
+	// A connection from a listener with implicit TLS is already encrypted.
+	if tlsConn, ok := netConn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			conn.log.Error("failed to do TLS handshake", zap.Error(err))
+			netConn.Close()
+			return
+		}
+		connState := tlsConn.ConnectionState()
+		conn.tls = &connState
+	}
+
+	greeting := fmt.Sprintf("POP3 (mailpopbox) server %s", po.Name())
+	if apo, ok := po.(APOPPostOffice); ok && apo.APOPEnabled() {
+		conn.timestamp = newTimestamp(po.Name())
+		greeting += " " + conn.timestamp
+	}
+
 	conn.log.Info("accepted connection")
-	conn.ok(fmt.Sprintf("POP3 (mailpopbox) server %s", po.Name()))
+	conn.ok(greeting)
 
 	var err error
 
@@ -64,6 +103,9 @@ func AcceptConnection(netConn net.Conn, po PostOffice, log *zap.Logger) {
 		conn.line, err = conn.tp.ReadLine()
 		if err != nil {
 			conn.log.Error("ReadLine()", zap.Error(err))
+			if amb, ok := conn.mb.(AbortMailbox); ok {
+				amb.Abort()
+			}
 			conn.tp.Close()
 			return
 		}
@@ -84,12 +126,18 @@ func AcceptConnection(netConn net.Conn, po PostOffice, log *zap.Logger) {
 			conn.doUSER()
 		case "PASS":
 			conn.doPASS()
+		case "APOP":
+			conn.doAPOP()
+		case "AUTH":
+			conn.doAUTH()
 		case "STAT":
 			conn.doSTAT()
 		case "LIST":
 			conn.doLIST()
 		case "RETR":
 			conn.doRETR()
+		case "TOP":
+			conn.doTOP()
 		case "DELE":
 			conn.doDELE()
 		case "NOOP":
@@ -100,6 +148,8 @@ func AcceptConnection(netConn net.Conn, po PostOffice, log *zap.Logger) {
 			conn.doUIDL()
 		case "CAPA":
 			conn.doCAPA()
+		case "STLS":
+			conn.doSTLS()
 		default:
 			conn.err("unknown command")
 		}
@@ -122,6 +172,17 @@ func (conn *connection) err(msg string) {
 	}
 }
 
+// loginErr replies to a failed login with the response code of |err|, or
+// with RespCodeAuth if it has none. Other errors are not sent to the client,
+// as they may tell why the credentials are wrong.
+func (conn *connection) loginErr(err error) {
+	var perr *Error
+	if !errors.As(err, &perr) {
+		perr = &Error{Code: RespCodeAuth, Message: "authentication failed"}
+	}
+	conn.err(perr.Error())
+}
+
 func (conn *connection) doQUIT() {
 	defer conn.tp.Close()
 
@@ -135,12 +196,23 @@ func (conn *connection) doQUIT() {
 	conn.ok("goodbye")
 }
 
+// plaintextAuthAllowed returns whether USER and PASS may be used on the
+// connection.
+func (conn *connection) plaintextAuthAllowed() bool {
+	return conn.tls != nil || !conn.po.RequireTLS()
+}
+
 func (conn *connection) doUSER() {
 	if conn.state != stateAuth {
 		conn.err(errStateAuth)
 		return
 	}
 
+	if !conn.plaintextAuthAllowed() {
+		conn.err(errNeedsTLS)
+		return
+	}
+
 	cmd := len("USER ")
 	if len(conn.line) < cmd {
 		conn.err("invalid user")
@@ -157,6 +229,11 @@ func (conn *connection) doPASS() {
 		return
 	}
 
+	if !conn.plaintextAuthAllowed() {
+		conn.err(errNeedsTLS)
+		return
+	}
+
 	if len(conn.user) == 0 {
 		conn.err("no USER")
 		return
@@ -176,10 +253,212 @@ func (conn *connection) doPASS() {
 		conn.ok("")
 	} else {
 		conn.log.Error("failed to open mailbox", zap.Error(err))
-		conn.err(err.Error())
+		conn.loginErr(err)
 	}
 }
 
+// newTimestamp returns a msg-id that is unique to the greeting of a
+// connection, for the APOP command (RFC 1939 § 7).
+func newTimestamp(name string) string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return fmt.Sprintf("<%d.%d.%x@%s>", os.Getpid(), time.Now().UnixNano(), b, name)
+}
+
+func (conn *connection) doAPOP() {
+	if conn.state != stateAuth {
+		conn.err(errStateAuth)
+		return
+	}
+
+	apo, ok := conn.po.(APOPPostOffice)
+	if !ok || conn.timestamp == "" {
+		conn.err("command not permitted")
+		return
+	}
+
+	cmd := len("APOP ")
+	idx := strings.LastIndexByte(conn.line, ' ')
+	if idx < cmd {
+		conn.err(errSyntax)
+		return
+	}
+	user, digest := conn.line[cmd:idx], strings.ToLower(conn.line[idx+1:])
+
+	// The digest is checked even if there is no secret, so that the time it
+	// takes does not tell whether the user exists.
+	secret, ok := apo.APOPSecret(user)
+	sum := md5.Sum([]byte(conn.timestamp + secret))
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(digest)) != 1 || !ok {
+		conn.log.Error("failed to authenticate", zap.String("user", user))
+		conn.loginErr(nil)
+		return
+	}
+
+	if mbox, err := conn.po.OpenMailbox(user, secret); err == nil {
+		conn.log.Info("authenticated", zap.String("user", user))
+		conn.state = stateTxn
+		conn.mb = mbox
+		conn.ok("")
+	} else {
+		conn.log.Error("failed to open mailbox", zap.Error(err))
+		conn.loginErr(err)
+	}
+}
+
+// saslMechanisms returns the mechanisms that the AUTH command offers on the
+// connection. Those that send the password in the clear are left out when
+// USER and PASS are.
+func (conn *connection) saslMechanisms() []string {
+	mechs := []string{sasl.Plain}
+	if _, ok := conn.po.(AuthPostOffice); ok {
+		mechs = sasl.Mechanisms()
+	}
+
+	var allowed []string
+	for _, mech := range mechs {
+		if conn.plaintextAuthAllowed() || (mech != sasl.Plain && mech != sasl.Login) {
+			allowed = append(allowed, mech)
+		}
+	}
+	return allowed
+}
+
+// doAUTH authenticates the client with a SASL mechanism (RFC 5034).
+func (conn *connection) doAUTH() {
+	if conn.state != stateAuth {
+		conn.err(errStateAuth)
+		return
+	}
+
+	fields := strings.Fields(conn.line)
+	if len(fields) < 2 || len(fields) > 3 {
+		conn.err(errSyntax)
+		return
+	}
+
+	name := strings.ToUpper(fields[1])
+	var offered bool
+	for _, mech := range conn.saslMechanisms() {
+		offered = offered || mech == name
+	}
+	if !offered {
+		if !conn.plaintextAuthAllowed() && (name == sasl.Plain || name == sasl.Login) {
+			conn.err(errNeedsTLS)
+		} else {
+			conn.err("unrecognized authentication type")
+		}
+		return
+	}
+
+	var creds sasl.Credentials
+	apo, ok := conn.po.(AuthPostOffice)
+	if ok {
+		creds = apo
+	} else {
+		creds = &postOfficeCredentials{po: conn.po}
+	}
+	mech := sasl.NewMechanism(name, creds)
+
+	conn.log.Info("doAUTH()", zap.String("mechanism", name))
+
+	// An initial response of "=" is empty, which is different from none
+	// (RFC 5034 § 4).
+	var response []byte
+	if len(fields) == 3 {
+		var err error
+		if response, err = decodeAuthResponse(fields[2]); err != nil {
+			conn.err(errSyntax)
+			return
+		}
+	}
+
+	for {
+		challenge, done, err := mech.Next(response)
+		if err == sasl.ErrAuthenticationFailed {
+			_, authc := mech.Identity()
+			conn.log.Error("failed to authenticate", zap.String("authc", authc))
+			if pc, ok := creds.(*postOfficeCredentials); ok {
+				conn.loginErr(pc.err)
+			} else {
+				conn.loginErr(nil)
+			}
+			return
+		} else if err != nil {
+			conn.log.Error("bad auth response", zap.Error(err))
+			conn.err(errSyntax)
+			return
+		}
+		if done {
+			break
+		}
+
+		conn.tp.PrintfLine("+ %s", base64.StdEncoding.EncodeToString(challenge))
+
+		line, err := conn.tp.ReadLine()
+		if err != nil {
+			conn.log.Error("failed to read auth line", zap.Error(err))
+			conn.err(errSyntax)
+			return
+		}
+		if line == "*" {
+			conn.err("authentication cancelled")
+			return
+		}
+		if response, err = base64.StdEncoding.DecodeString(line); err != nil {
+			conn.err(errSyntax)
+			return
+		}
+	}
+
+	authz, authc := mech.Identity()
+	var mbox Mailbox
+	var err error
+	if apo != nil {
+		mbox, err = apo.OpenAuthorizedMailbox(authz, authc)
+	} else {
+		mbox = creds.(*postOfficeCredentials).mb
+	}
+	if err != nil {
+		conn.log.Error("failed to open mailbox", zap.Error(err))
+		conn.loginErr(err)
+		return
+	}
+
+	conn.log.Info("authenticated", zap.String("authz", authz), zap.String("authc", authc))
+	conn.state = stateTxn
+	conn.mb = mbox
+	conn.ok("")
+}
+
+func decodeAuthResponse(response string) ([]byte, error) {
+	if response == "=" {
+		return []byte{}, nil
+	}
+	return base64.StdEncoding.DecodeString(response)
+}
+
+// postOfficeCredentials verifies the credentials of the PLAIN mechanism with
+// a PostOffice that does not implement AuthPostOffice, and keeps the mailbox
+// that it opens, or the error with which it failed.
+type postOfficeCredentials struct {
+	po  PostOffice
+	mb  Mailbox
+	err error
+}
+
+func (c *postOfficeCredentials) Authenticate(authz, authc, password string) bool {
+	if authz != "" && authz != authc {
+		return false
+	}
+	c.mb, c.err = c.po.OpenMailbox(authc, password)
+	return c.err == nil
+}
+
+func (c *postOfficeCredentials) ScramCredentials(authz, authc string) (sasl.ScramCredentials, bool) {
+	return sasl.ScramCredentials{}, false
+}
+
 func (conn *connection) doSTAT() {
 	if conn.state != stateTxn {
 		conn.err(errStateTxn)
@@ -252,6 +531,52 @@ func (conn *connection) doRETR() {
 	conn.log.Info("retrieve message", zap.String("unique-id", msg.UniqueID()))
 	conn.ok(fmt.Sprintf("%d", msg.Size()))
 
+	w := conn.tp.DotWriter()
+	_, err = io.Copy(w, rc)
+	if w.Close() == nil && err == nil {
+		if emb, ok := conn.mb.(ExpireMailbox); ok {
+			emb.MarkRetrieved(msg)
+		}
+	}
+}
+
+func (conn *connection) doTOP() {
+	if conn.state != stateTxn {
+		conn.err(errStateTxn)
+		return
+	}
+
+	var cmd string
+	var idx, lines int
+	if _, err := fmt.Sscanf(conn.line, "%s %d %d", &cmd, &idx, &lines); err != nil || lines < 0 {
+		conn.err(errSyntax)
+		return
+	}
+
+	msg := conn.getRequestedMessage()
+	if msg == nil {
+		return
+	}
+
+	if msg.Deleted() {
+		conn.err(errDeletedMsg)
+		return
+	}
+
+	// The message is read with Retrieve until the requested lines have been
+	// sent.
+	rc, err := conn.mb.Retrieve(msg)
+	if err != nil {
+		conn.log.Error("failed to retrieve messages", zap.Error(err))
+		conn.err(err.Error())
+		return
+	}
+	rc = newTopReader(rc, lines)
+	defer rc.Close()
+
+	conn.log.Info("retrieve top of message", zap.String("unique-id", msg.UniqueID()), zap.Int("lines", lines))
+	conn.ok("top of message follows")
+
 	w := conn.tp.DotWriter()
 	io.Copy(w, rc)
 	w.Close()
@@ -318,16 +643,67 @@ func (conn *connection) doUIDL() {
 func (conn *connection) doCAPA() {
 	conn.ok("capability list")
 
-	caps := []string{
-		"USER",
-		"UIDL",
-		".",
+	var caps []string
+	if conn.plaintextAuthAllowed() {
+		caps = append(caps, "USER")
+	}
+	if mechs := conn.saslMechanisms(); len(mechs) > 0 {
+		caps = append(caps, "SASL "+strings.Join(mechs, " "))
 	}
+	if conn.canStartTLS() {
+		caps = append(caps, "STLS")
+	}
+	caps = append(caps, "UIDL", "TOP", "RESP-CODES", "AUTH-RESP-CODE")
+	if ppo, ok := conn.po.(PolicyPostOffice); ok {
+		if delay := ppo.LoginDelay(); delay > 0 {
+			caps = append(caps, fmt.Sprintf("LOGIN-DELAY %d", delay/time.Second))
+		}
+		if days := ppo.ExpireDays(); days > 0 {
+			caps = append(caps, fmt.Sprintf("EXPIRE %d", days))
+		}
+	}
+	caps = append(caps, ".")
 	for _, c := range caps {
 		conn.tp.PrintfLine(c)
 	}
 }
 
+// canStartTLS returns whether the connection can be upgraded with STLS.
+func (conn *connection) canStartTLS() bool {
+	return conn.state == stateAuth && conn.tls == nil && conn.po.TLSConfig() != nil
+}
+
+// doSTLS upgrades the connection to TLS (RFC 2595 § 4).
+func (conn *connection) doSTLS() {
+	if conn.state != stateAuth {
+		conn.err(errStateAuth)
+		return
+	}
+	if !conn.canStartTLS() {
+		conn.err("command not permitted")
+		return
+	}
+
+	conn.ok("begin TLS negotiation")
+
+	tlsConn := tls.Server(conn.nc, conn.po.TLSConfig())
+	if err := tlsConn.Handshake(); err != nil {
+		conn.log.Error("failed to do TLS handshake", zap.Error(err))
+		conn.nc.Close()
+		return
+	}
+
+	// Anything that the client sent before the handshake is discarded with
+	// the reader, as it was not protected by TLS.
+	conn.nc = tlsConn
+	conn.tp = textproto.NewConn(tlsConn)
+	conn.user = ""
+
+	connState := tlsConn.ConnectionState()
+	conn.tls = &connState
+	conn.log.Info("TLS connection done")
+}
+
 func (conn *connection) getRequestedMessage() Message {
 	var cmd string
 	var idx int
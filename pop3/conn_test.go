@@ -7,6 +7,9 @@
 package pop3
 
 import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -18,8 +21,11 @@ import (
 	"sort"
 	"strings"
 	"testing"
+	"time"
 
 	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/sasl"
 )
 
 func _fl(depth int) string {
@@ -77,12 +83,23 @@ func runServer(t *testing.T, po PostOffice) net.Listener {
 type testServer struct {
 	user, pass string
 	mb         testMailbox
+
+	tlsConfig  *tls.Config
+	requireTLS bool
 }
 
 func (s *testServer) Name() string {
 	return "Test-Server"
 }
 
+func (s *testServer) TLSConfig() *tls.Config {
+	return s.tlsConfig
+}
+
+func (s *testServer) RequireTLS() bool {
+	return s.requireTLS
+}
+
 func (s *testServer) OpenMailbox(user, pass string) (Mailbox, error) {
 	if s.user == user && s.pass == pass {
 		return &s.mb, nil
@@ -234,7 +251,7 @@ func expectOKResponse(predicate func(string) bool) func(testing.TB, *textproto.C
 	}
 }
 
-func clientServerTest(t *testing.T, s *testServer, sequence []requestResponse) {
+func clientServerTest(t *testing.T, s PostOffice, sequence []requestResponse) {
 	l := runServer(t, s)
 	defer l.Close()
 
@@ -360,6 +377,536 @@ func TestRetr(t *testing.T) {
 	})
 }
 
+func expectDotLines(want []string) func(testing.TB, *textproto.Conn) string {
+	return func(t testing.TB, tp *textproto.Conn) string {
+		responseOK(t, tp)
+		if t.Failed() {
+			return ""
+		}
+
+		resp, err := tp.ReadDotLines()
+		if err != nil {
+			t.Error(err)
+			return ""
+		}
+		if !reflect.DeepEqual(resp, want) {
+			t.Errorf("%s Want %q, got %q", _fl(1), want, resp)
+		}
+		return ""
+	}
+}
+
+const topTestMessage = "Subject: test\r\nFrom: a@example.com\r\n\r\nline 1\r\n.\r\nline 3\r\n"
+
+func TestTop(t *testing.T) {
+	s := newTestServer()
+	s.mb.msgs[1] = &testMessage{1, len(topTestMessage), false, topTestMessage}
+	s.mb.msgs[2] = &testMessage{2, 1, true, "Z"}
+
+	header := []string{"Subject: test", "From: a@example.com", ""}
+	clientServerTest(t, s, []requestResponse{
+		{"TOP 1 0", responseERR},
+		{"USER u", responseOK},
+		{"PASS p", responseOK},
+		{"TOP 1 0", expectDotLines(header)},
+		{"TOP 1 2", expectDotLines(append(header, "line 1", "."))},
+		{"top 1 10", expectDotLines(append(header, "line 1", ".", "line 3"))},
+		{"TOP 1", responseERR},
+		{"TOP 1 -1", responseERR},
+		{"TOP 2 0", responseERR},
+		{"TOP 3 0", responseERR},
+		{"QUIT", responseOK},
+	})
+}
+
+func TestTopReader(t *testing.T) {
+	cases := []struct {
+		msg   string
+		lines int
+		want  string
+	}{
+		{topTestMessage, 0, "Subject: test\r\nFrom: a@example.com\r\n\r\n"},
+		{topTestMessage, 1, "Subject: test\r\nFrom: a@example.com\r\n\r\nline 1\r\n"},
+		{topTestMessage, 100, topTestMessage},
+		{"A: b\n\nc\nd\n", 1, "A: b\n\nc\n"},
+		{"A: b\nC: d", 3, "A: b\nC: d"},
+		{"A: b\n\nno newline", 5, "A: b\n\nno newline"},
+		{"", 5, ""},
+	}
+	for i, c := range cases {
+		data, err := ioutil.ReadAll(newTopReader(ioutil.NopCloser(strings.NewReader(c.msg)), c.lines))
+		if err != nil {
+			t.Errorf("Case %d: %v", i, err)
+		}
+		if want, got := c.want, string(data); want != got {
+			t.Errorf("Case %d: want %q, got %q", i, want, got)
+		}
+	}
+
+	// The reader stops reading once it has read the lines.
+	r := strings.NewReader(topTestMessage + strings.Repeat("more\r\n", 100000))
+	if _, err := ioutil.ReadAll(newTopReader(ioutil.NopCloser(r), 2)); err != nil {
+		t.Fatal(err)
+	}
+	if r.Len() == 0 {
+		t.Errorf("The whole message was read")
+	}
+}
+
+func getTLSConfig(t testing.TB) *tls.Config {
+	cert, err := tls.LoadX509KeyPair("../testtls/domain.crt", "../testtls/domain.key")
+	if err != nil {
+		t.Fatal(err)
+		return nil
+	}
+	return &tls.Config{
+		ServerName:         "localhost",
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+	}
+}
+
+// startTLS upgrades |conn|, a connection to |nc|, with STLS.
+func startTLS(t testing.TB, nc net.Conn, conn *textproto.Conn) *textproto.Conn {
+	ok(t, conn.PrintfLine("STLS"))
+	responseOK(t, conn)
+
+	tc := tls.Client(nc, getTLSConfig(t))
+	ok(t, tc.Handshake())
+	return textproto.NewConn(tc)
+}
+
+func TestSTLS(t *testing.T) {
+	s := newTestServer()
+	s.tlsConfig = getTLSConfig(t)
+	l := runServer(t, s)
+	defer l.Close()
+
+	nc, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	ok(t, err)
+	conn := textproto.NewConn(nc)
+	responseOK(t, conn)
+
+	for _, pair := range []requestResponse{
+		{"CAPA", expectDotLines([]string{"USER", "SASL PLAIN", "STLS", "UIDL", "TOP", "RESP-CODES", "AUTH-RESP-CODE"})},
+		{"USER u", responseOK},
+	} {
+		ok(t, conn.PrintfLine(pair.command))
+		pair.expecter(t, conn)
+	}
+
+	conn = startTLS(t, nc, conn)
+	for _, pair := range []requestResponse{
+		{"CAPA", expectDotLines([]string{"USER", "SASL PLAIN", "UIDL", "TOP", "RESP-CODES", "AUTH-RESP-CODE"})},
+		{"STLS", responseERR},
+		// The USER before STLS is forgotten.
+		{"PASS p", responseERR},
+		{"USER u", responseOK},
+		{"PASS p", responseOK},
+		{"STLS", responseERR},
+		{"QUIT", responseOK},
+	} {
+		ok(t, conn.PrintfLine(pair.command))
+		pair.expecter(t, conn)
+		if t.Failed() {
+			t.Logf("command %q", pair.command)
+		}
+	}
+}
+
+func TestSTLSNotConfigured(t *testing.T) {
+	clientServerTest(t, newTestServer(), []requestResponse{
+		{"CAPA", expectDotLines([]string{"USER", "SASL PLAIN", "UIDL", "TOP", "RESP-CODES", "AUTH-RESP-CODE"})},
+		{"STLS", responseERR},
+		{"USER u", responseOK},
+		{"PASS p", responseOK},
+		{"QUIT", responseOK},
+	})
+}
+
+func TestRequireTLS(t *testing.T) {
+	s := newTestServer()
+	s.tlsConfig = getTLSConfig(t)
+	s.requireTLS = true
+	l := runServer(t, s)
+	defer l.Close()
+
+	nc, err := net.Dial(l.Addr().Network(), l.Addr().String())
+	ok(t, err)
+	conn := textproto.NewConn(nc)
+	responseOK(t, conn)
+
+	for _, pair := range []requestResponse{
+		{"CAPA", expectDotLines([]string{"STLS", "UIDL", "TOP", "RESP-CODES", "AUTH-RESP-CODE"})},
+		{"USER u", responseERR},
+		{"PASS p", responseERR},
+	} {
+		ok(t, conn.PrintfLine(pair.command))
+		pair.expecter(t, conn)
+	}
+
+	conn = startTLS(t, nc, conn)
+	for _, pair := range []requestResponse{
+		{"CAPA", expectDotLines([]string{"USER", "SASL PLAIN", "UIDL", "TOP", "RESP-CODES", "AUTH-RESP-CODE"})},
+		{"USER u", responseOK},
+		{"PASS p", responseOK},
+		{"QUIT", responseOK},
+	} {
+		ok(t, conn.PrintfLine(pair.command))
+		pair.expecter(t, conn)
+	}
+}
+
+func TestImplicitTLS(t *testing.T) {
+	s := newTestServer()
+	s.tlsConfig = getTLSConfig(t)
+	s.requireTLS = true
+
+	l, err := tls.Listen("tcp", "localhost:0", s.tlsConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go AcceptConnection(conn, s, zap.NewNop())
+		}
+	}()
+
+	tc, err := tls.Dial(l.Addr().Network(), l.Addr().String(), getTLSConfig(t))
+	ok(t, err)
+	conn := textproto.NewConn(tc)
+	responseOK(t, conn)
+
+	for _, pair := range []requestResponse{
+		{"CAPA", expectDotLines([]string{"USER", "SASL PLAIN", "UIDL", "TOP", "RESP-CODES", "AUTH-RESP-CODE"})},
+		{"STLS", responseERR},
+		{"USER u", responseOK},
+		{"PASS p", responseOK},
+		{"QUIT", responseOK},
+	} {
+		ok(t, conn.PrintfLine(pair.command))
+		pair.expecter(t, conn)
+	}
+}
+
+func b64(s string) string {
+	return base64.StdEncoding.EncodeToString([]byte(s))
+}
+
+func expectChallenge(want string) func(testing.TB, *textproto.Conn) string {
+	return func(t testing.TB, conn *textproto.Conn) string {
+		line, err := conn.ReadLine()
+		if err != nil {
+			t.Errorf("%s expectChallenge: %v", _fl(1), err)
+		}
+		if got := strings.TrimPrefix(line, "+ "); line == got || want != got {
+			t.Errorf("%s expected challenge %q, got %q", _fl(1), want, line)
+		}
+		return line
+	}
+}
+
+func TestAuthPlain(t *testing.T) {
+	s := newTestServer()
+	s.mb.msgs[1] = &testMessage{1, 3, false, ""}
+
+	clientServerTest(t, s, []requestResponse{
+		{"AUTH", responseERR},
+		{"AUTH LOGIN", responseERR},
+		{"AUTH SCRAM-SHA-256", responseERR},
+		{"AUTH PLAIN " + b64("\x00u\x00x"), responseERR},
+		{"AUTH PLAIN " + b64("other\x00u\x00p"), responseERR},
+		{"AUTH PLAIN !!!", responseERR},
+		{"AUTH PLAIN", expectChallenge("")},
+		{"*", responseERR},
+		{"STAT", responseERR},
+		{"AUTH plain", expectChallenge("")},
+		{b64("u\x00u\x00p"), responseOK},
+		{"STAT", expectOKResponse(func(s string) bool {
+			return s == "+OK 1 3"
+		})},
+		{"AUTH PLAIN " + b64("\x00u\x00p"), responseERR},
+		{"QUIT", responseOK},
+	})
+
+	clientServerTest(t, s, []requestResponse{
+		{"AUTH PLAIN " + b64("\x00u\x00p"), responseOK},
+		{"STAT", responseOK},
+		{"QUIT", responseOK},
+	})
+}
+
+func TestAuthRequireTLS(t *testing.T) {
+	s := newTestServer()
+	s.requireTLS = true
+	clientServerTest(t, s, []requestResponse{
+		{"AUTH PLAIN " + b64("\x00u\x00p"), responseERR},
+		{"STAT", responseERR},
+		{"QUIT", responseOK},
+	})
+}
+
+type testAuthServer struct {
+	*testServer
+	authz, authc string
+}
+
+func (s *testAuthServer) Authenticate(authz, authc, password string) bool {
+	return (authz == "" || authz == "shared") && authc == s.user && password == s.pass
+}
+
+func (s *testAuthServer) ScramCredentials(authz, authc string) (sasl.ScramCredentials, bool) {
+	return sasl.ScramCredentials{}, false
+}
+
+func (s *testAuthServer) OpenAuthorizedMailbox(authz, authc string) (Mailbox, error) {
+	s.authz, s.authc = authz, authc
+	return &s.mb, nil
+}
+
+func TestAuthPostOffice(t *testing.T) {
+	s := &testAuthServer{testServer: newTestServer()}
+
+	clientServerTest(t, s, []requestResponse{
+		{"CAPA", expectDotLines([]string{"USER", "SASL SCRAM-SHA-256 PLAIN LOGIN", "UIDL", "TOP", "RESP-CODES", "AUTH-RESP-CODE"})},
+		{"AUTH PLAIN " + b64("other\x00u\x00p"), responseERR},
+		{"AUTH LOGIN", expectChallenge(b64("Username:"))},
+		{b64("u"), expectChallenge(b64("Password:"))},
+		{b64("p"), responseOK},
+		{"QUIT", responseOK},
+	})
+	if want, got := "u", s.authc; want != got {
+		t.Errorf("Want authc %q, got %q", want, got)
+	}
+	if want, got := "", s.authz; want != got {
+		t.Errorf("Want authz %q, got %q", want, got)
+	}
+
+	clientServerTest(t, s, []requestResponse{
+		{"AUTH PLAIN " + b64("shared\x00u\x00p"), responseOK},
+		{"QUIT", responseOK},
+	})
+	if want, got := "shared", s.authz; want != got {
+		t.Errorf("Want authz %q, got %q", want, got)
+	}
+
+	// SCRAM does not send the password, so it is offered without TLS.
+	s.requireTLS = true
+	clientServerTest(t, s, []requestResponse{
+		{"CAPA", expectDotLines([]string{"SASL SCRAM-SHA-256", "UIDL", "TOP", "RESP-CODES", "AUTH-RESP-CODE"})},
+		{"AUTH LOGIN", responseERR},
+		{"AUTH PLAIN " + b64("\x00u\x00p"), responseERR},
+		{"QUIT", responseOK},
+	})
+}
+
+type testAPOPServer struct {
+	*testServer
+	enabled bool
+}
+
+func (s *testAPOPServer) APOPEnabled() bool {
+	return s.enabled
+}
+
+func (s *testAPOPServer) APOPSecret(user string) (string, bool) {
+	if user == s.user {
+		return s.pass, true
+	}
+	return "", false
+}
+
+func TestAPOP(t *testing.T) {
+	s := &testAPOPServer{testServer: newTestServer(), enabled: true}
+	s.mb.msgs[1] = &testMessage{1, 3, false, ""}
+	l := runServer(t, s)
+	defer l.Close()
+
+	dial := func() (*textproto.Conn, string) {
+		conn, err := textproto.Dial(l.Addr().Network(), l.Addr().String())
+		ok(t, err)
+		line := responseOK(t, conn)
+		start, end := strings.IndexByte(line, '<'), strings.IndexByte(line, '>')
+		if start == -1 || end < start || !strings.HasSuffix(line, "@Test-Server>") {
+			t.Fatalf("Greeting has no timestamp: %q", line)
+		}
+		return conn, line[start : end+1]
+	}
+	digest := func(timestamp, secret string) string {
+		return fmt.Sprintf("%x", md5.Sum([]byte(timestamp+secret)))
+	}
+
+	conn, timestamp := dial()
+	_, other := dial()
+	if timestamp == other {
+		t.Errorf("Timestamp %q is not unique", timestamp)
+	}
+	for _, pair := range []requestResponse{
+		{"APOP u", responseERR},
+		{"APOP u " + digest(timestamp, "x"), responseERR},
+		{"APOP x " + digest(timestamp, "p"), responseERR},
+		{"APOP x " + digest(timestamp, ""), responseERR},
+		{"APOP u " + digest(other, "p"), responseERR},
+		{"STAT", responseERR},
+		{"APOP u " + strings.ToUpper(digest(timestamp, "p")), responseOK},
+		{"STAT", expectOKResponse(func(s string) bool {
+			return s == "+OK 1 3"
+		})},
+		{"APOP u " + digest(timestamp, "p"), responseERR},
+		{"QUIT", responseOK},
+	} {
+		ok(t, conn.PrintfLine(pair.command))
+		pair.expecter(t, conn)
+		if t.Failed() {
+			t.Logf("command %q", pair.command)
+		}
+	}
+}
+
+func TestAPOPDisabled(t *testing.T) {
+	for _, po := range []PostOffice{newTestServer(), &testAPOPServer{testServer: newTestServer()}} {
+		l := runServer(t, po)
+		defer l.Close()
+
+		conn, err := textproto.Dial(l.Addr().Network(), l.Addr().String())
+		ok(t, err)
+		if line := responseOK(t, conn); strings.Contains(line, "<") {
+			t.Errorf("Greeting has a timestamp: %q", line)
+		}
+		ok(t, conn.PrintfLine("APOP u %x", md5.Sum([]byte("p"))))
+		responseERR(t, conn)
+	}
+}
+
+type testPolicyServer struct {
+	*testServer
+	openErr   error
+	aborted   chan bool
+	retrieved []int
+}
+
+func (s *testPolicyServer) LoginDelay() time.Duration {
+	return 15 * time.Minute
+}
+
+func (s *testPolicyServer) ExpireDays() int {
+	return 30
+}
+
+func (s *testPolicyServer) OpenMailbox(user, pass string) (Mailbox, error) {
+	if s.openErr != nil {
+		return nil, s.openErr
+	}
+	if _, err := s.testServer.OpenMailbox(user, pass); err != nil {
+		return nil, err
+	}
+	return &testPolicyMailbox{&s.mb, s}, nil
+}
+
+type testPolicyMailbox struct {
+	*testMailbox
+	server *testPolicyServer
+}
+
+func (mb *testPolicyMailbox) Abort() {
+	mb.server.aborted <- true
+}
+
+func (mb *testPolicyMailbox) MarkRetrieved(msg Message) {
+	mb.server.retrieved = append(mb.server.retrieved, msg.ID())
+}
+
+func TestRespCodes(t *testing.T) {
+	s := &testPolicyServer{testServer: newTestServer()}
+
+	expectERR := func(want string) func(testing.TB, *textproto.Conn) string {
+		return func(t testing.TB, conn *textproto.Conn) string {
+			line := responseERR(t, conn)
+			if want != line {
+				t.Errorf("%s Want %q, got %q", _fl(1), want, line)
+			}
+			return line
+		}
+	}
+
+	clientServerTest(t, s, []requestResponse{
+		{"CAPA", expectDotLines([]string{"USER", "SASL PLAIN", "UIDL", "TOP",
+			"RESP-CODES", "AUTH-RESP-CODE", "LOGIN-DELAY 900", "EXPIRE 30"})},
+		{"USER u", responseOK},
+		{"PASS x", expectERR("-ERR [AUTH] authentication failed")},
+		{"AUTH PLAIN " + b64("\x00u\x00x"), expectERR("-ERR [AUTH] authentication failed")},
+		{"QUIT", responseOK},
+	})
+
+	for _, code := range []string{RespCodeInUse, RespCodeLoginDelay, RespCodeSysTemp} {
+		s.openErr = &Error{Code: code, Message: "try again later"}
+		clientServerTest(t, s, []requestResponse{
+			{"USER u", responseOK},
+			{"PASS p", expectERR("-ERR [" + code + "] try again later")},
+			{"AUTH PLAIN " + b64("\x00u\x00p"), expectERR("-ERR [" + code + "] try again later")},
+			{"QUIT", responseOK},
+		})
+	}
+}
+
+func TestAbortMailbox(t *testing.T) {
+	s := &testPolicyServer{testServer: newTestServer(), aborted: make(chan bool, 1)}
+	l := runServer(t, s)
+	defer l.Close()
+
+	conn, err := textproto.Dial(l.Addr().Network(), l.Addr().String())
+	ok(t, err)
+	responseOK(t, conn)
+	for _, pair := range []requestResponse{
+		{"USER u", responseOK},
+		{"PASS p", responseOK},
+	} {
+		ok(t, conn.PrintfLine(pair.command))
+		pair.expecter(t, conn)
+	}
+	conn.Close()
+
+	select {
+	case <-s.aborted:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Mailbox was not aborted when the connection was closed")
+	}
+
+	clientServerTest(t, s, []requestResponse{
+		{"USER u", responseOK},
+		{"PASS p", responseOK},
+		{"QUIT", responseOK},
+	})
+	select {
+	case <-s.aborted:
+		t.Errorf("Mailbox was aborted after QUIT")
+	default:
+	}
+}
+
+func TestExpireMailbox(t *testing.T) {
+	s := &testPolicyServer{testServer: newTestServer()}
+	s.mb.msgs[1] = &testMessage{1, len(topTestMessage), false, topTestMessage}
+	s.mb.msgs[2] = &testMessage{2, 3, false, "abc"}
+
+	clientServerTest(t, s, []requestResponse{
+		{"USER u", responseOK},
+		{"PASS p", responseOK},
+		{"TOP 1 0", expectDotLines([]string{"Subject: test", "From: a@example.com", ""})},
+		{"RETR 2", expectDotLines([]string{"abc"})},
+		{"QUIT", responseOK},
+	})
+
+	if want, got := []int{2}, s.retrieved; !reflect.DeepEqual(want, got) {
+		t.Errorf("Want retrieved messages %v, got %v", want, got)
+	}
+}
+
 func TestUidl(t *testing.T) {
 	s := newTestServer()
 	s.mb.msgs[1] = &testMessage{1, 3, false, "abc"}
@@ -464,8 +1011,12 @@ func TestCapa(t *testing.T) {
 		)
 
 		caps := map[string]int{
-			"USER": capNeeded,
-			"UIDL": capNeeded,
+			"USER":           capNeeded,
+			"SASL PLAIN":     capNeeded,
+			"UIDL":           capNeeded,
+			"TOP":            capNeeded,
+			"RESP-CODES":     capNeeded,
+			"AUTH-RESP-CODE": capNeeded,
 		}
 		for _, line := range resp {
 			if val, ok := caps[line]; ok {
@@ -7,9 +7,41 @@
 package pop3
 
 import (
+	"crypto/tls"
+	"fmt"
 	"io"
+	"time"
+
+	"src.bluestatic.org/mailpopbox/sasl"
+)
+
+// Response codes that are sent with -ERR responses (RFC 2449 § 8, RFC 3206).
+const (
+	// RespCodeAuth is sent when a login fails because of the credentials.
+	RespCodeAuth = "AUTH"
+	// RespCodeSysTemp is sent when a command fails because of a problem on
+	// the server that may go away.
+	RespCodeSysTemp = "SYS/TEMP"
+	// RespCodeInUse is sent when a login fails because the maildrop is
+	// already open in another session.
+	RespCodeInUse = "IN-USE"
+	// RespCodeLoginDelay is sent when a login fails because the user logged
+	// in too recently.
+	RespCodeLoginDelay = "LOGIN-DELAY"
 )
 
+// Error may be returned by a PostOffice or a Mailbox to send a response code
+// with the -ERR response. Failed logins that do not return an Error are sent
+// with RespCodeAuth.
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("[%s] %s", e.Code, e.Message)
+}
+
 type Message interface {
 	UniqueID() string
 	ID() int
@@ -26,7 +58,64 @@ type Mailbox interface {
 	Reset()
 }
 
+// AbortMailbox may be implemented by a Mailbox that must be released when the
+// session ends without QUIT. Unlike Close, Abort does not delete the messages
+// marked as deleted.
+type AbortMailbox interface {
+	Abort()
+}
+
+// ExpireMailbox may be implemented by a Mailbox that deletes the messages that
+// the client has retrieved after some time, as advertised by the ExpireDays of
+// a PolicyPostOffice. Only RETR counts as retrieving a message, not TOP.
+type ExpireMailbox interface {
+	// MarkRetrieved is called once |msg| has been sent in full by RETR.
+	MarkRetrieved(msg Message)
+}
+
 type PostOffice interface {
 	Name() string
+	// TLSConfig returns the configuration with which the STLS command
+	// upgrades a connection, or nil if STLS is not offered.
+	TLSConfig() *tls.Config
+	// RequireTLS returns whether USER and PASS are refused on connections
+	// that are not encrypted.
+	RequireTLS() bool
 	OpenMailbox(user, pass string) (Mailbox, error)
 }
+
+// APOPPostOffice may be implemented by a PostOffice that supports the APOP
+// command, in which the client proves that it knows a secret it shares with
+// the server without sending it (RFC 1939 § 7).
+type APOPPostOffice interface {
+	// APOPEnabled returns whether any user can log in with APOP. If not, the
+	// greeting does not include the timestamp that APOP needs.
+	APOPEnabled() bool
+	// APOPSecret returns the secret of |user|, if the user can log in with
+	// APOP. The mailbox is then opened by passing it to OpenMailbox.
+	APOPSecret(user string) (secret string, ok bool)
+}
+
+// PolicyPostOffice may be implemented by a PostOffice that limits how often
+// users log in, or how long retrieved messages are kept, to advertise its
+// policies with the LOGIN-DELAY and EXPIRE capabilities (RFC 2449 § 6). The
+// PostOffice enforces them itself.
+type PolicyPostOffice interface {
+	// LoginDelay returns the minimum time between the logins of a user, or 0
+	// if there is none.
+	LoginDelay() time.Duration
+	// ExpireDays returns the number of days after which retrieved messages
+	// are deleted, or 0 if they are kept until the client deletes them.
+	ExpireDays() int
+}
+
+// AuthPostOffice may be implemented by a PostOffice that verifies the
+// credentials of the AUTH command itself, which enables all the mechanisms of
+// the sasl package. Otherwise, AUTH only offers PLAIN, which checks the
+// password with OpenMailbox and has no separate authorization identity.
+type AuthPostOffice interface {
+	sasl.Credentials
+	// OpenAuthorizedMailbox opens the mailbox of |authz|, or of |authc| if
+	// authz is empty, for a client that has been authenticated as |authc|.
+	OpenAuthorizedMailbox(authz, authc string) (Mailbox, error)
+}
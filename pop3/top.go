@@ -0,0 +1,81 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package pop3
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+type topReader struct {
+	rc io.ReadCloser
+	// br reads the message line by line. It is allocated on the first Read.
+	br *bufio.Reader
+
+	inBody bool
+	lines  int
+	// pending is the rest of the last line read, which did not fit in the
+	// caller's buffer.
+	pending []byte
+	done    bool
+}
+
+// newTopReader returns a reader of the header of the message read from |rc|,
+// the blank line that ends it, and the first |lines| lines of its body. The
+// rest of the message is not read. Closing the returned reader closes |rc|.
+func newTopReader(rc io.ReadCloser, lines int) io.ReadCloser {
+	return &topReader{rc: rc, lines: lines}
+}
+
+func (t *topReader) Read(p []byte) (int, error) {
+	if len(t.pending) == 0 {
+		if t.done {
+			return 0, io.EOF
+		}
+		if err := t.nextLine(); err != nil && len(t.pending) == 0 {
+			return 0, err
+		}
+	}
+	n := copy(p, t.pending)
+	t.pending = t.pending[n:]
+	return n, nil
+}
+
+// nextLine reads the next line of the message into pending, or marks the
+// reader as done once the requested lines have been read.
+func (t *topReader) nextLine() error {
+	if t.inBody && t.lines <= 0 {
+		t.done = true
+		return io.EOF
+	}
+	if t.br == nil {
+		t.br = bufio.NewReader(t.rc)
+	}
+
+	line, err := t.br.ReadBytes('\n')
+	t.pending = line
+	if err != nil {
+		// The message ends without a newline after its last line.
+		t.done = true
+		if err == io.EOF && len(line) > 0 {
+			err = nil
+		}
+		return err
+	}
+
+	if t.inBody {
+		t.lines--
+	} else if len(bytes.TrimRight(line, "\r\n")) == 0 {
+		t.inBody = true
+	}
+	return nil
+}
+
+func (t *topReader) Close() error {
+	return t.rc.Close()
+}
@@ -7,20 +7,26 @@
 package main
 
 import (
+	"errors"
 	"io/ioutil"
 	"net/textproto"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sort"
 	"testing"
+	"time"
 
 	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/pop3"
 )
 
 func TestReset(t *testing.T) {
 	mbox := mailbox{
 		messages: []message{
-			{"msg1", 1, 4, false},
-			{"msg2", 2, 4, false},
+			{"msg1", "msg1", "msg1", 1, 4, false, false},
+			{"msg2", "msg2", "msg2", 2, 4, false, false},
 		},
 	}
 
@@ -68,6 +74,13 @@ func TestOpenMailboxAuth(t *testing.T) {
 					Domain:          "test.net",
 					MailboxPassword: "open-sesame",
 					MaildropPath:    dir,
+					Users: []User{
+						{
+							Name:         "alice",
+							Password:     "alice-pass",
+							MaildropPath: dir,
+						},
+					},
 				},
 			},
 		},
@@ -83,6 +96,9 @@ func TestOpenMailboxAuth(t *testing.T) {
 		{"mailbox@example.com", "open-sesame", false},
 		{"test@test.net", "open-sesame", false},
 		{"mailbox@an-example.net", "letmein", false},
+		{"alice@test.net", "alice-pass", true},
+		{"alice@test.net", "open-sesame", false},
+		{"alice@example.com", "alice-pass", false},
 	}
 	for i, c := range cases {
 		mb, err := s.OpenMailbox(c.user, c.pass)
@@ -90,6 +106,120 @@ func TestOpenMailboxAuth(t *testing.T) {
 		if got != c.ok {
 			t.Errorf("Expected error=%v for case %d (%#v), got %v (error=%v, mb=%v)", c.ok, i, c, got, err, mb)
 		}
+		if got {
+			mb.Close()
+		}
+	}
+}
+
+func TestAuthorizedMailbox(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &pop3Server{
+		config: Config{
+			Servers: []Server{
+				{
+					Domain:          "example.com",
+					MailboxPassword: "letmein",
+					MaildropPath:    dir,
+					AliasSubfolders: true,
+					Users: []User{
+						{
+							Name:         "alice",
+							Password:     "alice-pass",
+							MaildropPath: dir,
+						},
+					},
+				},
+			},
+		},
+		log: zap.NewNop(),
+	}
+
+	cases := []struct {
+		authz, authc, pass string
+		ok                 bool
+	}{
+		{"", "mailbox@example.com", "letmein", true},
+		{"mailbox@example.com", "mailbox@example.com", "letmein", true},
+		{"mailbox+amazon@example.com", "mailbox@example.com", "letmein", true},
+		{"mailbox@example.com", "mailbox+amazon@example.com", "letmein", true},
+		{"", "mailbox@example.com", "alice-pass", false},
+		{"alice@example.com", "mailbox@example.com", "letmein", false},
+		{"mailbox@example.com", "alice@example.com", "alice-pass", false},
+		{"alice+shop@example.com", "alice@example.com", "alice-pass", true},
+		{"mailbox@test.net", "mailbox@example.com", "letmein", false},
+		{"mailbox+@example.com", "mailbox@example.com", "letmein", false},
+	}
+	for i, c := range cases {
+		if want, got := c.ok, s.Authenticate(c.authz, c.authc, c.pass); want != got {
+			t.Errorf("Case %d (%#v): want Authenticate %v, got %v", i, c, want, got)
+		}
+		if _, ok := s.ScramCredentials(c.authz, c.authc); c.ok && !ok {
+			t.Errorf("Case %d (%#v): no SCRAM credentials", i, c)
+		}
+		mb, err := s.OpenAuthorizedMailbox(c.authz, c.authc)
+		if c.ok && (mb == nil || err != nil) {
+			t.Errorf("Case %d (%#v): failed to open mailbox: %v", i, c, err)
+		}
+		if err == nil {
+			mb.Close()
+		}
+	}
+
+	if mb, err := s.OpenAuthorizedMailbox("alice@example.com", "mailbox@example.com"); mb != nil || err == nil {
+		t.Errorf("Opened the mailbox of another account")
+	}
+}
+
+func TestAPOPSecret(t *testing.T) {
+	hash, err := hashPassword(PasswordSchemeBcrypt, "alice-pass")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := Config{
+		Servers: []Server{
+			{
+				Domain:          "example.com",
+				MailboxPassword: "letmein",
+				Users: []User{
+					{Name: "alice", Password: hash},
+				},
+			},
+			{
+				Domain:          "test.net",
+				MailboxPassword: hash,
+			},
+		},
+	}
+	s := &pop3Server{config: config, log: zap.NewNop()}
+
+	if !s.APOPEnabled() {
+		t.Errorf("APOP should be enabled for a plaintext password")
+	}
+	cases := []struct {
+		user, secret string
+		ok           bool
+	}{
+		{"mailbox@example.com", "letmein", true},
+		{"alice@example.com", "", false},
+		{"mailbox@test.net", "", false},
+		{"bob@example.com", "", false},
+	}
+	for _, c := range cases {
+		secret, ok := s.APOPSecret(c.user)
+		if secret != c.secret || ok != c.ok {
+			t.Errorf("%s: want (%q, %v), got (%q, %v)", c.user, c.secret, c.ok, secret, ok)
+		}
+	}
+
+	s.config.Servers = s.config.Servers[1:]
+	if s.APOPEnabled() {
+		t.Errorf("APOP should not be enabled for hashed passwords")
 	}
 }
 
@@ -130,6 +260,22 @@ func TestBasicListener(t *testing.T) {
 	}
 }
 
+func TestSTLSRequiresTLS(t *testing.T) {
+	configs := []Config{
+		{POP3Port: 9649, POP3STLSPort: 9650},
+		{POP3Port: 9649, POP3RequireTLS: true},
+	}
+	for i, config := range configs {
+		s := &pop3Server{config: config, log: zap.NewNop()}
+		l, stlsListener, err := s.newListeners()
+		if err == nil {
+			l.Close()
+			stlsListener.Close()
+			t.Errorf("Case %d: expected error", i)
+		}
+	}
+}
+
 func TestMailbox(t *testing.T) {
 	dir, err := ioutil.TempDir("", "maildrop")
 	if err != nil {
@@ -168,6 +314,12 @@ func TestMailbox(t *testing.T) {
 	}
 	f.Close()
 
+	// Files that are not messages are not listed.
+	if err := ioutil.WriteFile(filepath.Join(dir, "blocked-aliases"), []byte("spam@example.com\n"), 0600); err != nil {
+		t.Errorf("Failed to create blocked-aliases: %v", err)
+		return
+	}
+
 	s := &pop3Server{
 		config: Config{
 			Servers: []Server{
@@ -273,3 +425,155 @@ func TestMailbox(t *testing.T) {
 		t.Errorf("Message Unique ID should be %s, got %s", want, got)
 	}
 }
+
+func TestMailboxSessions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	s := &pop3Server{
+		config: Config{
+			Servers: []Server{
+				{
+					Domain:          "example.com",
+					MailboxPassword: "letmein",
+					MaildropPath:    dir,
+					AliasSubfolders: true,
+				},
+			},
+		},
+		log: zap.NewNop(),
+	}
+	expectCode := func(code string, err error) {
+		var perr *pop3.Error
+		if !errors.As(err, &perr) || perr.Code != code {
+			t.Errorf("Want error with code %s, got %v", code, err)
+		}
+	}
+
+	mb, err := s.OpenMailbox("mailbox@example.com", "letmein")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.OpenAuthorizedMailbox("mailbox+amazon@example.com", "mailbox@example.com")
+	expectCode(pop3.RespCodeInUse, err)
+	mb.(pop3.AbortMailbox).Abort()
+
+	mb, err = s.OpenMailbox("mailbox+amazon@example.com", "letmein")
+	if err != nil {
+		t.Fatalf("Failed to open mailbox after Abort: %v", err)
+	}
+	mb.Close()
+
+	s.config.POP3LoginDelay = 60
+	_, err = s.OpenMailbox("mailbox@example.com", "letmein")
+	expectCode(pop3.RespCodeLoginDelay, err)
+
+	pop3SessionsMu.Lock()
+	pop3Logins[dir] = time.Now().Add(-time.Minute)
+	pop3SessionsMu.Unlock()
+	mb, err = s.OpenMailbox("mailbox@example.com", "letmein")
+	if err != nil {
+		t.Fatalf("Failed to open mailbox after LoginDelay: %v", err)
+	}
+	mb.Close()
+
+	for _, config := range []Config{{POP3LoginDelay: -1}, {POP3ExpireDays: -1}} {
+		if err := config.Validate(); err == nil {
+			t.Errorf("Expected error for %+v", config)
+		}
+	}
+}
+
+func TestMailboxExpire(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name+".msg"), []byte("Subject: "+name+"\r\n\r\nbody\r\n"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := &pop3Server{
+		config: Config{
+			POP3ExpireDays: 7,
+			Servers: []Server{
+				{
+					Domain:          "example.com",
+					MailboxPassword: "letmein",
+					MaildropPath:    dir,
+				},
+			},
+		},
+		log: zap.NewNop(),
+	}
+
+	open := func() (pop3.Mailbox, []string) {
+		mb, err := s.OpenMailbox("mailbox@example.com", "letmein")
+		if err != nil {
+			t.Fatalf("Failed to open mailbox: %v", err)
+		}
+		msgs, _ := mb.ListMessages()
+		var uids []string
+		for _, msg := range msgs {
+			uids = append(uids, msg.UniqueID())
+		}
+		sort.Strings(uids)
+		return mb, uids
+	}
+
+	// Retrieve a and b, read the top of c, and delete d.
+	mb, _ := open()
+	for _, id := range []int{1, 2} {
+		mb.(pop3.ExpireMailbox).MarkRetrieved(mb.GetMessage(id))
+	}
+	rc, err := mb.Retrieve(mb.GetMessage(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc.Close()
+	mb.Delete(mb.GetMessage(4))
+	if err := mb.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	retrieved, err := readPOP3State(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, got := 2, len(retrieved); want != got {
+		t.Errorf("Want %d retrieved messages, got %v", want, retrieved)
+	}
+	if _, ok := retrieved["a.msg"]; !ok {
+		t.Errorf("Retrieved message is not in the state: %v", retrieved)
+	}
+
+	// Messages are kept until they expire.
+	mb, uids := open()
+	mb.Close()
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(want, uids) {
+		t.Errorf("Want messages %v, got %v", want, uids)
+	}
+
+	retrieved["a.msg"] = time.Now().Add(-8 * 24 * time.Hour)
+	if err := writePOP3State(dir, retrieved); err != nil {
+		t.Fatal(err)
+	}
+	mb, uids = open()
+	mb.Close()
+	if want := []string{"b", "c"}; !reflect.DeepEqual(want, uids) {
+		t.Errorf("Want messages %v after expiry, got %v", want, uids)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a.msg")); !os.IsNotExist(err) {
+		t.Errorf("Expired message still exists: %v", err)
+	}
+	if retrieved, _ = readPOP3State(dir); len(retrieved) != 1 {
+		t.Errorf("Want only b in the state, got %v", retrieved)
+	}
+}
@@ -0,0 +1,128 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+// Package sasl implements the server side of Simple Authentication and
+// Security Layer mechanisms (RFC 4422), for the protocols that authenticate
+// users.
+package sasl
+
+import (
+	"errors"
+	"strings"
+)
+
+// The names of the supported mechanisms.
+const (
+	Plain       = "PLAIN"
+	Login       = "LOGIN"
+	ScramSHA256 = "SCRAM-SHA-256"
+)
+
+var (
+	// ErrAuthenticationFailed is returned by a Mechanism if the client's
+	// credentials are not valid.
+	ErrAuthenticationFailed = errors.New("sasl: authentication failed")
+	// ErrMalformedResponse is returned by a Mechanism if a response from the
+	// client cannot be parsed.
+	ErrMalformedResponse = errors.New("sasl: malformed response")
+)
+
+// Credentials looks up and verifies the credentials of users.
+type Credentials interface {
+	// Authenticate verifies that the user |authc| has the |password| and may
+	// act as |authz|, which is empty if the client did not give one.
+	Authenticate(authz, authc, password string) bool
+	// ScramCredentials returns the SCRAM credentials of the user |authc|, if
+	// the user exists and may act as |authz|.
+	ScramCredentials(authz, authc string) (ScramCredentials, bool)
+}
+
+// Mechanism is the server side of a single authentication exchange.
+type Mechanism interface {
+	// Next handles a |response| from the client, which is nil if the client
+	// did not send an initial response, and returns the challenge to send
+	// next. Once done is true, the client is authenticated. An error ends the
+	// exchange without authenticating the client.
+	Next(response []byte) (challenge []byte, done bool, err error)
+	// Identity returns the authorization and authentication identities of
+	// the client, once the exchange is done. The authorization identity is
+	// empty if the client did not give one.
+	Identity() (authz, authc string)
+}
+
+// Mechanisms returns the names of the supported mechanisms, in order of
+// preference.
+func Mechanisms() []string {
+	return []string{ScramSHA256, Plain, Login}
+}
+
+// NewMechanism returns the mechanism called |name|, which verifies clients
+// with |creds|, or nil if it is not supported.
+func NewMechanism(name string, creds Credentials) Mechanism {
+	switch strings.ToUpper(name) {
+	case Plain:
+		return &plain{creds: creds}
+	case Login:
+		return &login{creds: creds}
+	case ScramSHA256:
+		return &scram{creds: creds, nonce: randomNonce}
+	}
+	return nil
+}
+
+// plain implements the PLAIN mechanism (RFC 4616).
+type plain struct {
+	creds        Credentials
+	authz, authc string
+}
+
+func (m *plain) Next(response []byte) ([]byte, bool, error) {
+	if response == nil {
+		return []byte{}, false, nil
+	}
+	parts := strings.Split(string(response), "\x00")
+	if len(parts) != 3 {
+		return nil, false, ErrMalformedResponse
+	}
+	if !m.creds.Authenticate(parts[0], parts[1], parts[2]) {
+		return nil, false, ErrAuthenticationFailed
+	}
+	m.authz, m.authc = parts[0], parts[1]
+	return nil, true, nil
+}
+
+func (m *plain) Identity() (string, string) {
+	return m.authz, m.authc
+}
+
+// login implements the obsolete LOGIN mechanism, which is still used by some
+// clients. The client sends its user name and then its password, each in
+// reply to a prompt.
+type login struct {
+	creds    Credentials
+	username *string
+	authc    string
+}
+
+func (m *login) Next(response []byte) ([]byte, bool, error) {
+	if response == nil {
+		return []byte("Username:"), false, nil
+	}
+	if m.username == nil {
+		username := string(response)
+		m.username = &username
+		return []byte("Password:"), false, nil
+	}
+	if !m.creds.Authenticate("", *m.username, string(response)) {
+		return nil, false, ErrAuthenticationFailed
+	}
+	m.authc = *m.username
+	return nil, true, nil
+}
+
+func (m *login) Identity() (string, string) {
+	return "", m.authc
+}
@@ -0,0 +1,121 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package sasl
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+// testCredentials has the users "user", with the password "pencil", who may
+// act as "admin", and "other".
+type testCredentials struct{}
+
+func (testCredentials) Authenticate(authz, authc, password string) bool {
+	if authz != "" && authz != authc && !(authz == "admin" && authc == "user") {
+		return false
+	}
+	return (authc == "user" && password == "pencil") || (authc == "other" && password == "other")
+}
+
+func (testCredentials) ScramCredentials(authz, authc string) (ScramCredentials, bool) {
+	if authc != "user" || (authz != "" && authz != "user" && authz != "admin") {
+		return ScramCredentials{}, false
+	}
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	return DeriveScramCredentials("pencil", salt, 4096), true
+}
+
+// exchange runs |m| with the client |responses|, and returns the challenges
+// that were sent and the final error.
+func exchange(m Mechanism, responses ...[]byte) ([]string, bool, error) {
+	var challenges []string
+	for _, response := range responses {
+		challenge, done, err := m.Next(response)
+		if err != nil || done {
+			return challenges, done, err
+		}
+		challenges = append(challenges, string(challenge))
+	}
+	return challenges, false, nil
+}
+
+func TestMechanisms(t *testing.T) {
+	for _, name := range Mechanisms() {
+		if NewMechanism(name, testCredentials{}) == nil {
+			t.Errorf("Mechanism %s is not supported", name)
+		}
+	}
+	if NewMechanism("plain", testCredentials{}) == nil {
+		t.Errorf("Mechanism names should not be case sensitive")
+	}
+	if NewMechanism("CRAM-MD5", testCredentials{}) != nil {
+		t.Errorf("Want unsupported mechanism to be nil")
+	}
+}
+
+func TestPlain(t *testing.T) {
+	cases := []struct {
+		responses    [][]byte
+		challenges   int
+		err          error
+		authz, authc string
+	}{
+		{[][]byte{[]byte("\x00user\x00pencil")}, 0, nil, "", "user"},
+		{[][]byte{nil, []byte("admin\x00user\x00pencil")}, 1, nil, "admin", "user"},
+		{[][]byte{[]byte("other\x00user\x00pencil")}, 0, ErrAuthenticationFailed, "", ""},
+		{[][]byte{[]byte("\x00user\x00wrong")}, 0, ErrAuthenticationFailed, "", ""},
+		{[][]byte{[]byte("user\x00pencil")}, 0, ErrMalformedResponse, "", ""},
+		{[][]byte{nil, {}}, 1, ErrMalformedResponse, "", ""},
+	}
+	for i, c := range cases {
+		m := NewMechanism(Plain, testCredentials{})
+		challenges, done, err := exchange(m, c.responses...)
+		if want, got := c.err, err; want != got {
+			t.Errorf("Case %d: want error %v, got %v", i, want, got)
+		}
+		if want, got := c.err == nil, done; want != got {
+			t.Errorf("Case %d: want done=%v, got %v", i, want, got)
+		}
+		if want, got := c.challenges, len(challenges); want != got {
+			t.Errorf("Case %d: want %d challenges, got %d", i, want, got)
+		}
+		authz, authc := m.Identity()
+		if authz != c.authz || authc != c.authc {
+			t.Errorf("Case %d: want identity %q %q, got %q %q", i, c.authz, c.authc, authz, authc)
+		}
+	}
+}
+
+func TestLogin(t *testing.T) {
+	m := NewMechanism(Login, testCredentials{})
+	challenges, done, err := exchange(m, nil, []byte("user"), []byte("pencil"))
+	if err != nil || !done {
+		t.Fatalf("Want successful login, got done=%v err=%v", done, err)
+	}
+	if want, got := "Username:,Password:", challenges[0]+","+challenges[1]; want != got {
+		t.Errorf("Want challenges %q, got %q", want, got)
+	}
+	if _, authc := m.Identity(); authc != "user" {
+		t.Errorf("Want user to be authenticated, got %q", authc)
+	}
+
+	// The user name may be the initial response.
+	m = NewMechanism(Login, testCredentials{})
+	challenges, done, err = exchange(m, []byte("other"), []byte("other"))
+	if err != nil || !done || len(challenges) != 1 {
+		t.Errorf("Want successful login with initial response, got %v done=%v err=%v", challenges, done, err)
+	}
+
+	m = NewMechanism(Login, testCredentials{})
+	if _, _, err = exchange(m, []byte("user"), []byte("wrong")); err != ErrAuthenticationFailed {
+		t.Errorf("Want %v, got %v", ErrAuthenticationFailed, err)
+	}
+	if _, authc := m.Identity(); authc != "" {
+		t.Errorf("Want no identity after failure, got %q", authc)
+	}
+}
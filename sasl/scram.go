@@ -0,0 +1,250 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package sasl
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+)
+
+// ScramIterations is the iteration count of credentials created by
+// NewScramCredentials, which is the minimum of RFC 7677 § 4.
+const ScramIterations = 4096
+
+// ScramCredentials are the values that a server stores to authenticate a user
+// with SCRAM-SHA-256, from which the password cannot be recovered (RFC 5802
+// § 3).
+type ScramCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewScramCredentials derives the SCRAM-SHA-256 credentials for |password|
+// with a random salt.
+func NewScramCredentials(password string) (ScramCredentials, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return ScramCredentials{}, err
+	}
+	return DeriveScramCredentials(password, salt, ScramIterations), nil
+}
+
+// DeriveScramCredentials derives the SCRAM-SHA-256 credentials for |password|
+// with the |salt| and the |iterations| of the hash function.
+func DeriveScramCredentials(password string, salt []byte, iterations int) ScramCredentials {
+	salted := hi([]byte(password), salt, iterations)
+	storedKey := sha256.Sum256(hmacSHA256(salted, "Client Key"))
+	return ScramCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  hmacSHA256(salted, "Server Key"),
+	}
+}
+
+// hi is PBKDF2 with HMAC-SHA-256 as the pseudorandom function, producing a
+// single block (RFC 5802 § 2.2).
+func hi(str, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, str)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// randomNonce returns the server's part of a SCRAM nonce.
+func randomNonce() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawStdEncoding.EncodeToString(b), nil
+}
+
+// decodeSaslname decodes a user name in a SCRAM message, in which "," and "="
+// are written as "=2C" and "=3D".
+func decodeSaslname(s string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '=' {
+			b.WriteByte(s[i])
+			continue
+		}
+		switch {
+		case strings.HasPrefix(s[i:], "=2C"):
+			b.WriteByte(',')
+		case strings.HasPrefix(s[i:], "=3D"):
+			b.WriteByte('=')
+		default:
+			return "", false
+		}
+		i += 2
+	}
+	return b.String(), b.Len() > 0
+}
+
+// scram implements the SCRAM-SHA-256 mechanism (RFC 7677), without channel
+// binding. Passwords are used as they are, rather than being prepared with
+// SASLprep.
+type scram struct {
+	creds Credentials
+	// nonce returns the server's part of the nonce. Tests replace it.
+	nonce func() (string, error)
+
+	step         int
+	authz, authc string
+
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	fullNonce       string
+
+	stored ScramCredentials
+	// known is false if the user was not found, in which case the exchange
+	// continues with made-up credentials so that it fails at the end, like
+	// for a wrong password.
+	known bool
+}
+
+func (m *scram) Next(response []byte) ([]byte, bool, error) {
+	switch m.step {
+	case 0:
+		if response == nil {
+			return []byte{}, false, nil
+		}
+		return m.clientFirst(string(response))
+	case 1:
+		return m.clientFinal(string(response))
+	case 2:
+		// The client acknowledges the server's signature with an empty
+		// response.
+		if len(response) != 0 {
+			return nil, false, ErrMalformedResponse
+		}
+		m.step++
+		return nil, true, nil
+	}
+	return nil, false, ErrMalformedResponse
+}
+
+func (m *scram) Identity() (string, string) {
+	return m.authz, m.authc
+}
+
+// clientFirst handles the client-first-message and returns the
+// server-first-message.
+func (m *scram) clientFirst(msg string) ([]byte, bool, error) {
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, false, ErrMalformedResponse
+	}
+	// Channel binding is not supported, so the flag must be "n", or "y" if
+	// the client supports it but thinks that the server does not.
+	if parts[0] != "n" && parts[0] != "y" {
+		return nil, false, ErrMalformedResponse
+	}
+	var authz string
+	if parts[1] != "" {
+		var ok bool
+		if !strings.HasPrefix(parts[1], "a=") {
+			return nil, false, ErrMalformedResponse
+		}
+		if authz, ok = decodeSaslname(parts[1][2:]); !ok {
+			return nil, false, ErrMalformedResponse
+		}
+	}
+
+	attrs := strings.Split(parts[2], ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") || len(attrs[1]) == 2 {
+		return nil, false, ErrMalformedResponse
+	}
+	authc, ok := decodeSaslname(attrs[0][2:])
+	if !ok {
+		return nil, false, ErrMalformedResponse
+	}
+
+	nonce, err := m.nonce()
+	if err != nil {
+		return nil, false, err
+	}
+
+	m.stored, m.known = m.creds.ScramCredentials(authz, authc)
+	if !m.known {
+		if m.stored, err = NewScramCredentials(""); err != nil {
+			return nil, false, err
+		}
+	}
+
+	m.authz, m.authc = authz, authc
+	m.gs2Header = parts[0] + "," + parts[1] + ","
+	m.clientFirstBare = parts[2]
+	m.fullNonce = attrs[1][2:] + nonce
+	m.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", m.fullNonce,
+		base64.StdEncoding.EncodeToString(m.stored.Salt), m.stored.Iterations)
+	m.step++
+	return []byte(m.serverFirst), false, nil
+}
+
+// clientFinal verifies the proof in the client-final-message and returns the
+// server-final-message.
+func (m *scram) clientFinal(msg string) ([]byte, bool, error) {
+	idx := strings.LastIndex(msg, ",p=")
+	if idx == -1 {
+		return nil, false, ErrMalformedResponse
+	}
+	withoutProof := msg[:idx]
+	proof, err := base64.StdEncoding.DecodeString(msg[idx+len(",p="):])
+	if err != nil {
+		return nil, false, ErrMalformedResponse
+	}
+
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 ||
+		attrs[0] != "c="+base64.StdEncoding.EncodeToString([]byte(m.gs2Header)) ||
+		attrs[1] != "r="+m.fullNonce {
+		return nil, false, ErrAuthenticationFailed
+	}
+
+	authMessage := m.clientFirstBare + "," + m.serverFirst + "," + withoutProof
+	clientSignature := hmacSHA256(m.stored.StoredKey, authMessage)
+	if len(proof) != len(clientSignature) {
+		return nil, false, ErrAuthenticationFailed
+	}
+	for i := range proof {
+		proof[i] ^= clientSignature[i]
+	}
+	storedKey := sha256.Sum256(proof)
+	if subtle.ConstantTimeCompare(storedKey[:], m.stored.StoredKey) != 1 || !m.known {
+		return nil, false, ErrAuthenticationFailed
+	}
+
+	m.step++
+	serverSignature := hmacSHA256(m.stored.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), false, nil
+}
@@ -0,0 +1,97 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package sasl
+
+import (
+	"testing"
+)
+
+// The exchange of RFC 7677 § 3.
+const (
+	rfcClientFirst = "n,,n=user,r=rOprNGfwEbeRWgbNEkqO"
+	rfcServerFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	rfcClientFinal = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	rfcServerFinal = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+)
+
+func newTestScram() *scram {
+	return &scram{
+		creds: testCredentials{},
+		nonce: func() (string, error) { return "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0", nil },
+	}
+}
+
+func TestScramExchange(t *testing.T) {
+	m := newTestScram()
+	challenges, done, err := exchange(m, nil, []byte(rfcClientFirst), []byte(rfcClientFinal), []byte{})
+	if err != nil || !done {
+		t.Fatalf("Want successful exchange, got done=%v err=%v", done, err)
+	}
+	if want, got := 3, len(challenges); want != got {
+		t.Fatalf("Want %d challenges, got %d", want, got)
+	}
+	if want, got := rfcServerFirst, challenges[1]; want != got {
+		t.Errorf("Want server-first-message %q, got %q", want, got)
+	}
+	if want, got := rfcServerFinal, challenges[2]; want != got {
+		t.Errorf("Want server-final-message %q, got %q", want, got)
+	}
+	if authz, authc := m.Identity(); authz != "" || authc != "user" {
+		t.Errorf("Want identity user, got %q %q", authz, authc)
+	}
+}
+
+func TestScramFailures(t *testing.T) {
+	wrongProof := rfcClientFinal[:len(rfcClientFinal)-5] + "AAAA="
+	cases := []struct {
+		clientFirst, clientFinal string
+		err                      error
+	}{
+		{rfcClientFirst, wrongProof, ErrAuthenticationFailed},
+		// The client's proof is for a different nonce.
+		{"n,,n=user,r=other", rfcClientFinal, ErrAuthenticationFailed},
+		// The gs2 header does not match the channel binding data.
+		{"y,,n=user,r=rOprNGfwEbeRWgbNEkqO", rfcClientFinal, ErrAuthenticationFailed},
+		// The user does not exist.
+		{"n,,n=nobody,r=rOprNGfwEbeRWgbNEkqO", rfcClientFinal, ErrAuthenticationFailed},
+		{"n,a=other,n=user,r=rOprNGfwEbeRWgbNEkqO", rfcClientFinal, ErrAuthenticationFailed},
+		{"p=tls-unique,,n=user,r=abc", "", ErrMalformedResponse},
+		{"n,,r=abc,n=user", "", ErrMalformedResponse},
+		{"n,,n=us=er,r=abc", "", ErrMalformedResponse},
+		{"n,,n=user,r=", "", ErrMalformedResponse},
+		{"n,,n=user,r=abc", "c=biws,r=abc", ErrMalformedResponse},
+	}
+	for i, c := range cases {
+		responses := [][]byte{[]byte(c.clientFirst)}
+		if c.clientFinal != "" {
+			responses = append(responses, []byte(c.clientFinal))
+		}
+		_, done, err := exchange(newTestScram(), responses...)
+		if done || err != c.err {
+			t.Errorf("Case %d: want error %v, got done=%v err=%v", i, c.err, done, err)
+		}
+	}
+}
+
+func TestDecodeSaslname(t *testing.T) {
+	cases := []struct {
+		in, out string
+		ok      bool
+	}{
+		{"user", "user", true},
+		{"a=2Cb=3Dc", "a,b=c", true},
+		{"a=2", "", false},
+		{"a=41", "", false},
+		{"", "", false},
+	}
+	for i, c := range cases {
+		out, ok := decodeSaslname(c.in)
+		if out != c.out || ok != c.ok {
+			t.Errorf("Case %d: want %q %v, got %q %v", i, c.out, c.ok, out, ok)
+		}
+	}
+}
@@ -7,21 +7,28 @@
 package main
 
 import (
+	"bytes"
 	"crypto/tls"
 	"fmt"
 	"net"
 	"net/mail"
 	"os"
 	"path"
+	"path/filepath"
+	"sync"
+	"time"
 
 	"go.uber.org/zap"
 
+	"src.bluestatic.org/mailpopbox/dkim"
+	"src.bluestatic.org/mailpopbox/sasl"
 	"src.bluestatic.org/mailpopbox/smtp"
 )
 
-func runSMTPServer(config Config, log *zap.Logger) <-chan ServerControlMessage {
+func runSMTPServer(config Config, configPath string, log *zap.Logger) <-chan ServerControlMessage {
 	server := smtpServer{
 		config:      config,
+		configPath:  configPath,
 		controlChan: make(chan ServerControlMessage),
 		log:         log.With(zap.String("server", "smtp")),
 	}
@@ -30,8 +37,32 @@ func runSMTPServer(config Config, log *zap.Logger) <-chan ServerControlMessage {
 }
 
 type smtpServer struct {
-	config    Config
-	tlsConfig *tls.Config
+	config     Config
+	configPath string
+	tlsConfig  *tls.Config
+
+	// blocklists holds the compiled BlacklistedAddresses of each domain. It
+	// is replaced when the configuration is reloaded.
+	blocklistsMu sync.RWMutex
+	blocklists   map[string]*blocklist
+	// blacklistedAddresses holds the BlacklistedAddresses of each domain from
+	// the most recently loaded configuration, which may be newer than config.
+	blacklistedAddresses map[string][]string
+
+	// blockedAliasesMu serializes changes to the blocked aliases files and
+	// the loading of the blocklists from them.
+	blockedAliasesMu sync.Mutex
+
+	// dkimSigners holds the DKIM signers of each domain. It is replaced when
+	// the configuration is reloaded.
+	dkimSignersMu sync.RWMutex
+	dkimSigners   map[string][]*dkim.Signer
+
+	queue *smtp.Queue
+
+	// resolver is used to authenticate inbound mail. If nil, the system
+	// resolver is used.
+	resolver dnsResolver
 
 	log *zap.Logger
 
@@ -39,7 +70,17 @@ type smtpServer struct {
 }
 
 func (server *smtpServer) run() {
-	if !server.loadTLSConfig() {
+	if !server.loadTLSConfig() || !server.loadDKIMSigners() {
+		return
+	}
+
+	if err := server.loadBlocklists(server.config); err != nil {
+		server.log.Error("failed to load blacklisted addresses", zap.Error(err))
+		server.controlChan <- ServerControlFatalError
+		return
+	}
+
+	if !server.createQueue() {
 		return
 	}
 
@@ -64,6 +105,8 @@ func (server *smtpServer) run() {
 			if !server.loadTLSConfig() {
 				return
 			}
+			server.reloadDKIMSigners()
+			server.reloadBlocklists()
 		case conn, ok := <-connChan:
 			if ok {
 				go smtp.AcceptConnection(conn, server, server.log)
@@ -86,6 +129,154 @@ func (server *smtpServer) loadTLSConfig() bool {
 	return true
 }
 
+func (server *smtpServer) loadDKIMSigners() bool {
+	signers, err := server.config.GetDKIMSigners()
+	if err != nil {
+		server.log.Error("failed to load DKIM keys", zap.Error(err))
+		server.controlChan <- ServerControlFatalError
+		return false
+	}
+	server.setDKIMSigners(signers)
+	server.log.Info("loaded DKIM keys")
+	return true
+}
+
+// reloadDKIMSigners re-reads the DKIM keys. On error, the current keys are
+// kept, so that a bad key does not stop the server.
+func (server *smtpServer) reloadDKIMSigners() {
+	signers, err := server.config.GetDKIMSigners()
+	if err != nil {
+		server.log.Error("failed to reload DKIM keys", zap.Error(err))
+		return
+	}
+	server.setDKIMSigners(signers)
+	server.log.Info("reloaded DKIM keys")
+}
+
+func (server *smtpServer) setDKIMSigners(signers map[string][]*dkim.Signer) {
+	server.dkimSignersMu.Lock()
+	defer server.dkimSignersMu.Unlock()
+	server.dkimSigners = signers
+}
+
+// dkimSignersFor returns the DKIM signers of |domain|.
+func (server *smtpServer) dkimSignersFor(domain string) []*dkim.Signer {
+	server.dkimSignersMu.RLock()
+	defer server.dkimSignersMu.RUnlock()
+	return server.dkimSigners[domain]
+}
+
+// reloadBlocklists re-reads the configuration file and replaces the
+// blacklisted addresses. Other changes to the configuration are not applied.
+// On error, the current lists are kept.
+func (server *smtpServer) reloadBlocklists() {
+	if server.configPath == "" {
+		return
+	}
+
+	config, err := ReadConfig(server.configPath)
+	if err != nil {
+		server.log.Error("failed to reload config", zap.Error(err))
+		return
+	}
+
+	if err := server.loadBlocklists(config); err != nil {
+		server.log.Error("failed to reload blacklisted addresses", zap.Error(err))
+		return
+	}
+	server.log.Info("reloaded blacklisted addresses")
+}
+
+// loadBlocklists compiles the BlacklistedAddresses of |config|, together with
+// the blocked aliases, and replaces the current blocklists.
+func (server *smtpServer) loadBlocklists(config Config) error {
+	server.blockedAliasesMu.Lock()
+	defer server.blockedAliasesMu.Unlock()
+
+	blocklists, err := config.GetBlocklists()
+	if err != nil {
+		return err
+	}
+	patterns := make(map[string][]string)
+	for _, s := range config.Servers {
+		patterns[s.normalizedDomain()] = s.BlacklistedAddresses
+	}
+
+	server.blocklistsMu.Lock()
+	defer server.blocklistsMu.Unlock()
+	server.blocklists = blocklists
+	server.blacklistedAddresses = patterns
+	return nil
+}
+
+// reloadBlocklist recompiles the blocklist of |s| after its blocked aliases
+// have changed, keeping the BlacklistedAddresses that were last loaded. The
+// caller must hold blockedAliasesMu.
+func (server *smtpServer) reloadBlocklist(s *Server) error {
+	server.blocklistsMu.RLock()
+	patterns, ok := server.blacklistedAddresses[s.normalizedDomain()]
+	server.blocklistsMu.RUnlock()
+	if !ok {
+		patterns = s.BlacklistedAddresses
+	}
+
+	b, err := s.getBlocklist(patterns)
+	if err != nil {
+		return err
+	}
+
+	server.blocklistsMu.Lock()
+	defer server.blocklistsMu.Unlock()
+	blocklists := make(map[string]*blocklist, len(server.blocklists)+1)
+	for domain, other := range server.blocklists {
+		blocklists[domain] = other
+	}
+	blocklists[s.normalizedDomain()] = b
+	server.blocklists = blocklists
+	return nil
+}
+
+// IsBlocked returns whether |addr| matches the blacklisted addresses of its
+// domain. The mailbox account and the Users can never be blocked.
+func (server *smtpServer) IsBlocked(addr mail.Address) bool {
+	domain := smtp.DomainForAddress(addr)
+	if s := server.serverForAddress(addr); s != nil && s.isAccount(localPart(addr.Address)) {
+		return false
+	}
+
+	server.blocklistsMu.RLock()
+	defer server.blocklistsMu.RUnlock()
+	b := server.blocklists[domain]
+	if b != nil && b.matches(addr.Address) {
+		server.log.Info("rejecting blacklisted address", zap.String("address", addr.Address))
+		return true
+	}
+	return false
+}
+
+func (server *smtpServer) createQueue() bool {
+	dir := server.config.RelayQueuePath
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "mailpopbox-queue")
+		server.log.Warn("RelayQueuePath is not configured, queued messages may not survive a reboot", zap.String("dir", dir))
+	}
+
+	lifetime := smtp.DefaultQueueLifetime
+	if server.config.RelayQueueLifetimeHours > 0 {
+		lifetime = time.Duration(server.config.RelayQueueLifetimeHours) * time.Hour
+	}
+
+	var err error
+	server.queue, err = smtp.NewQueue(server, dir, lifetime, server.log)
+	if err != nil {
+		server.log.Error("failed to open relay queue", zap.Error(err))
+		server.controlChan <- ServerControlFatalError
+		return false
+	}
+	go server.queue.Run()
+	return true
+}
+
 func (server *smtpServer) Name() string {
 	return server.config.Hostname
 }
@@ -102,59 +293,208 @@ func (server *smtpServer) VerifyAddress(addr mail.Address) smtp.ReplyLine {
 }
 
 func (server *smtpServer) Authenticate(authz, authc, passwd string) bool {
+	s, password := server.accountServer(authz, authc)
+	return s != nil && checkPassword(password, passwd)
+}
+
+func (server *smtpServer) ScramCredentials(authz, authc string) (sasl.ScramCredentials, bool) {
+	s, password := server.accountServer(authz, authc)
+	if s == nil {
+		return sasl.ScramCredentials{}, false
+	}
+	creds, ok, err := scramCredentials(password)
+	if err != nil {
+		server.log.Error("failed to get SCRAM credentials", zap.String("domain", s.Domain), zap.Error(err))
+	}
+	return creds, ok
+}
+
+// accountServer returns the Server that has the account |authc|, which is
+// its mailbox account or one of its Users, and the account's password. The
+// |authz| must be empty or an address of the same domain.
+func (server *smtpServer) accountServer(authz, authc string) (*Server, string) {
 	authcAddr, err := mail.ParseAddress(authc)
 	if err != nil {
-		return false
+		return nil, ""
 	}
 
 	authzAddr, err := mail.ParseAddress(authz)
 	if authz != "" && err != nil {
-		return false
+		return nil, ""
 	}
 
 	domain := smtp.DomainForAddress(*authcAddr)
+	for i, s := range server.config.Servers {
+		if domain != s.normalizedDomain() {
+			continue
+		}
+		password, _, ok := s.account(authcAddr.Address)
+		if !ok {
+			return nil, ""
+		}
+		if authzAddr != nil && smtp.DomainForAddress(*authzAddr) != domain {
+			return nil, ""
+		}
+		return &server.config.Servers[i], password
+	}
+	return nil, ""
+}
+
+func (server *smtpServer) MaxMessageSize(addr mail.Address) int64 {
+	if s := server.serverForAddress(addr); s != nil {
+		return s.GetMaxMessageSize()
+	}
+
+	// Mail for other domains is limited by the largest of the domains.
+	var maxSize int64
 	for _, s := range server.config.Servers {
-		if domain == s.Domain {
-			authOk := authc == MailboxAccount+s.Domain && passwd == s.MailboxPassword
-			if authzAddr != nil {
-				authOk = authOk && smtp.DomainForAddress(*authzAddr) == domain
-			}
-			return authOk
+		size := s.GetMaxMessageSize()
+		if size == 0 {
+			return 0
+		}
+		if size > maxSize {
+			maxSize = size
 		}
 	}
-	return false
+	return maxSize
 }
 
 func (server *smtpServer) DeliverMessage(en smtp.Envelope) *smtp.ReplyLine {
-	maildrop := server.maildropForAddress(en.RcptTo[0])
-	if maildrop == "" {
+	// The recipients are grouped by the account to which their mail is
+	// delivered, so that each account gets one copy of the message. With
+	// AliasSubfolders, the copy is filed in the subfolder of the first of
+	// the recipients, so that the account does not list it once per alias.
+	var maildrops []string
+	dirs := make(map[string]string)
+	rcpts := make(map[string][]mail.Address)
+	for _, rcpt := range en.RcptTo {
+		s := server.serverForAddress(rcpt)
+		if s == nil {
+			continue
+		}
+		local := localPart(rcpt.Address)
+		maildrop := s.accountMaildropForLocalPart(local)
+		if _, ok := rcpts[maildrop]; !ok {
+			maildrops = append(maildrops, maildrop)
+			dirs[maildrop] = s.maildropForLocalPart(local)
+		}
+		rcpts[maildrop] = append(rcpts[maildrop], rcpt)
+	}
+	if len(maildrops) == 0 {
 		server.log.Error("faild to open maildrop to deliver message", zap.String("id", en.ID))
 		return &smtp.ReplyBadMailbox
 	}
 
-	f, err := os.Create(path.Join(maildrop, en.ID+".msg"))
+	// Messages generated by this server, such as delivery failure reports,
+	// have no remote address and do not need to be authenticated.
+	if en.RemoteAddr != nil {
+		if reply := server.authenticateMessage(&en); reply != nil {
+			return reply
+		}
+	}
+
+	for _, maildrop := range maildrops {
+		delivery := en
+		delivery.RcptTo = rcpts[maildrop]
+		if reply := server.writeMessage(dirs[maildrop], delivery); reply != nil {
+			return reply
+		}
+	}
+	return nil
+}
+
+// writeMessage stores the message |en| in |maildrop|.
+func (server *smtpServer) writeMessage(maildrop string, en smtp.Envelope) *smtp.ReplyLine {
+	// An alias subfolder is created by the first message to the alias.
+	if err := os.MkdirAll(maildrop, 0700); err != nil {
+		server.log.Error("failed to create maildrop", zap.String("dir", maildrop), zap.Error(err))
+		return &smtp.ReplyBadMailbox
+	}
+
+	// The message is written under a temporary name, so that the POP3 and
+	// IMAP servers do not see it until it is complete.
+	filename := path.Join(maildrop, en.ID+".msg")
+	f, err := os.Create(filename + ".tmp")
 	if err != nil {
 		server.log.Error("failed to create message file", zap.String("id", en.ID), zap.Error(err))
 		return &smtp.ReplyBadMailbox
 	}
 
-	smtp.WriteEnvelopeForDelivery(f, en)
-	f.Close()
+	err = smtp.WriteEnvelopeForDelivery(f, en)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		server.log.Error("failed to write message file", zap.String("id", en.ID), zap.Error(err))
+		os.Remove(filename + ".tmp")
+		return &smtp.ReplyBadMailbox
+	}
+	if err := os.Rename(filename+".tmp", filename); err != nil {
+		server.log.Error("failed to store message file", zap.String("id", en.ID), zap.Error(err))
+		os.Remove(filename + ".tmp")
+		return &smtp.ReplyBadMailbox
+	}
+	return nil
+}
+
+func (server *smtpServer) RelayMessage(en smtp.Envelope) *smtp.ReplyLine {
+	if !server.handleBlockCommand(&en) {
+		return nil
+	}
+
+	server.signMessage(&en)
+	if err := server.queue.Enqueue(en); err != nil {
+		server.log.Error("failed to queue message for relay", zap.String("id", en.ID), zap.Error(err))
+		return &smtp.ReplyLocalError
+	}
 	return nil
 }
 
-func (server *smtpServer) RelayMessage(en smtp.Envelope) {
-	log := server.log.With(zap.String("id", en.ID))
-	go smtp.RelayMessage(server, en, log)
+// signMessage prepends a DKIM-Signature for each of the keys configured for
+// the sender's domain. For the null reverse-path of a delivery status
+// notification, this is the domain of the From header.
+func (server *smtpServer) signMessage(en *smtp.Envelope) {
+	from := en.MailFrom
+	if from.Address == "" {
+		if msg, err := mail.ReadMessage(bytes.NewReader(en.Data.Header())); err == nil {
+			if addr, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+				from = *addr
+			}
+		}
+	}
+
+	var sigs []byte
+	for _, signer := range server.dkimSignersFor(smtp.DomainForAddress(from)) {
+		sig, err := signer.Sign(en.Data.Reader())
+		if err != nil {
+			server.log.Error("failed to DKIM sign message",
+				zap.String("id", en.ID),
+				zap.String("selector", signer.Selector),
+				zap.Error(err))
+			continue
+		}
+		sigs = append(sigs, sig...)
+	}
+	en.Data.Prepend(sigs)
 }
 
+// maildropForAddress returns the maildrop to which mail for |addr| is
+// delivered, which is that of the User whose routing rules match it or else
+// that of the mailbox account. If the domain is not served, it returns an
+// empty string.
 func (server *smtpServer) maildropForAddress(addr mail.Address) string {
+	if s := server.serverForAddress(addr); s != nil {
+		return s.maildropForLocalPart(localPart(addr.Address))
+	}
+	return ""
+}
+
+func (server *smtpServer) serverForAddress(addr mail.Address) *Server {
 	domain := smtp.DomainForAddress(addr)
-	for _, s := range server.config.Servers {
-		if domain == s.Domain {
-			return s.MaildropPath
+	for i, s := range server.config.Servers {
+		if domain == s.normalizedDomain() {
+			return &server.config.Servers[i]
 		}
 	}
-
-	return ""
+	return nil
 }
@@ -0,0 +1,233 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package smtp
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// spoolThreshold is the size above which a Body is spooled to a temporary
+// file rather than held in memory.
+var spoolThreshold = 1 << 20
+
+// maxHeaderSize is the largest message header that a Body separates from the
+// rest of the message. A larger header is left in the content.
+const maxHeaderSize = 1 << 20
+
+// Body is the content of a message. The header of the message is held in
+// memory so that it can be changed, while the rest of the message is either
+// held in memory or, if it is large, read from a file.
+type Body struct {
+	header []byte
+
+	content []byte
+
+	file         *os.File
+	offset, size int64
+	// temp is whether the file is removed when the Body is closed.
+	temp bool
+}
+
+// NewBody returns a Body that holds |data| in memory.
+func NewBody(data []byte) *Body {
+	n := headerLength(data)
+	return &Body{
+		header:  data[:n:n],
+		content: data[n:],
+	}
+}
+
+// ReadBody reads a Body from |r|, spooling it to a temporary file if it is
+// larger than the memory threshold.
+func ReadBody(r io.Reader) (*Body, error) {
+	w := &bodyWriter{}
+	if _, err := io.Copy(w, r); err != nil {
+		w.discard()
+		return nil, err
+	}
+	return w.body()
+}
+
+// OpenBody returns a Body that reads the file at |path|, which is not removed
+// when the Body is closed.
+func OpenBody(path string) (*Body, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return newFileBody(f, fi.Size(), false)
+}
+
+func newFileBody(f *os.File, size int64, temp bool) (*Body, error) {
+	prefix := make([]byte, maxHeaderSize)
+	n, err := f.ReadAt(prefix, 0)
+	if err != nil && err != io.EOF {
+		f.Close()
+		return nil, err
+	}
+	prefix = prefix[:n]
+
+	hl := headerLength(prefix)
+	return &Body{
+		header: append([]byte(nil), prefix[:hl]...),
+		file:   f,
+		offset: int64(hl),
+		size:   size - int64(hl),
+		temp:   temp,
+	}, nil
+}
+
+// headerLength returns the length of the message header in |data|, including
+// the blank line that ends it. If the end of the header is not found, the
+// header is all of |data| if it is small enough, or else empty.
+func headerLength(data []byte) int {
+	if bytes.HasPrefix(data, []byte("\n")) {
+		return 1
+	}
+	if bytes.HasPrefix(data, []byte("\r\n")) {
+		return 2
+	}
+	for i := 0; i < len(data); i++ {
+		if data[i] != '\n' {
+			continue
+		}
+		if bytes.HasPrefix(data[i+1:], []byte("\n")) {
+			return i + 2
+		}
+		if bytes.HasPrefix(data[i+1:], []byte("\r\n")) {
+			return i + 3
+		}
+	}
+	if len(data) < maxHeaderSize {
+		return len(data)
+	}
+	return 0
+}
+
+// Header returns the header of the message, including the blank line that
+// separates it from the message body.
+func (b *Body) Header() []byte {
+	if b == nil {
+		return nil
+	}
+	return b.header
+}
+
+// SetHeader replaces the header of the message.
+func (b *Body) SetHeader(header []byte) {
+	b.header = header
+}
+
+// Prepend adds |data|, such as header fields, to the start of the message.
+func (b *Body) Prepend(data []byte) {
+	b.header = append(append([]byte(nil), data...), b.header...)
+}
+
+// Len returns the size of the message in bytes.
+func (b *Body) Len() int64 {
+	if b == nil {
+		return 0
+	}
+	if b.file != nil {
+		return int64(len(b.header)) + b.size
+	}
+	return int64(len(b.header) + len(b.content))
+}
+
+// Reader returns a new reader of the whole message.
+func (b *Body) Reader() io.Reader {
+	if b == nil {
+		return bytes.NewReader(nil)
+	}
+	if b.file != nil {
+		return io.MultiReader(bytes.NewReader(b.header), io.NewSectionReader(b.file, b.offset, b.size))
+	}
+	return io.MultiReader(bytes.NewReader(b.header), bytes.NewReader(b.content))
+}
+
+// WriteTo writes the whole message to |w|.
+func (b *Body) WriteTo(w io.Writer) (int64, error) {
+	return io.Copy(w, b.Reader())
+}
+
+// Bytes reads the whole message into memory.
+func (b *Body) Bytes() ([]byte, error) {
+	return ioutil.ReadAll(b.Reader())
+}
+
+// Close releases the file that backs the Body, after which it cannot be read.
+func (b *Body) Close() error {
+	if b == nil || b.file == nil {
+		return nil
+	}
+	err := b.file.Close()
+	if b.temp {
+		os.Remove(b.file.Name())
+	}
+	b.file = nil
+	b.size = 0
+	return err
+}
+
+// bodyWriter collects a Body in memory until it grows larger than the
+// spoolThreshold, and then in a temporary file.
+type bodyWriter struct {
+	buf  bytes.Buffer
+	file *os.File
+	size int64
+}
+
+func (w *bodyWriter) Write(p []byte) (int, error) {
+	if w.file == nil && w.buf.Len()+len(p) > spoolThreshold {
+		f, err := ioutil.TempFile("", "mailpopbox-body-")
+		if err != nil {
+			return 0, err
+		}
+		w.file = f
+		if _, err := w.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+
+	var n int
+	var err error
+	if w.file != nil {
+		n, err = w.file.Write(p)
+	} else {
+		n, err = w.buf.Write(p)
+	}
+	w.size += int64(n)
+	return n, err
+}
+
+// body finishes writing and returns the Body that was written.
+func (w *bodyWriter) body() (*Body, error) {
+	if w.file == nil {
+		return NewBody(w.buf.Bytes()), nil
+	}
+	b, err := newFileBody(w.file, w.size, true)
+	if err != nil {
+		os.Remove(w.file.Name())
+	}
+	return b, err
+}
+
+// discard removes anything that was written.
+func (w *bodyWriter) discard() {
+	if w.file != nil {
+		w.file.Close()
+		os.Remove(w.file.Name())
+	}
+}
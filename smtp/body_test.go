@@ -0,0 +1,124 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package smtp
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func bodyString(t *testing.T, b *Body) string {
+	data, err := b.Bytes()
+	if err != nil {
+		t.Errorf("Failed to read body: %v", err)
+	}
+	return string(data)
+}
+
+func TestBodyHeader(t *testing.T) {
+	cases := []struct {
+		msg, header string
+	}{
+		{"Subject: a\n\nbody\n", "Subject: a\n\n"},
+		{"Subject: a\r\nTo: b\r\n\r\nbody\r\n\r\n", "Subject: a\r\nTo: b\r\n\r\n"},
+		{"\nbody\n", "\n"},
+		{"\r\nbody\r\n", "\r\n"},
+		{"Subject: no body\n", "Subject: no body\n"},
+		{"", ""},
+	}
+	for i, c := range cases {
+		b := NewBody([]byte(c.msg))
+		if want, got := c.header, string(b.Header()); want != got {
+			t.Errorf("Case %d: want header %q, got %q", i, want, got)
+		}
+		if want, got := c.msg, bodyString(t, b); want != got {
+			t.Errorf("Case %d: want message %q, got %q", i, want, got)
+		}
+	}
+}
+
+func TestBodyPrepend(t *testing.T) {
+	data := []byte("Subject: a\n\nbody\n")
+	b := NewBody(data)
+	b.Prepend([]byte("Received: here\r\n"))
+	b.SetHeader(append(b.Header()[:0:0], []byte("X-Other: yes\n")...))
+	b.Prepend([]byte("Received: there\r\n"))
+
+	if want, got := "Received: there\r\nX-Other: yes\nbody\n", bodyString(t, b); want != got {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+	if want, got := int64(len("Received: there\r\nX-Other: yes\nbody\n")), b.Len(); want != got {
+		t.Errorf("Want length %d, got %d", want, got)
+	}
+	if want, got := "Subject: a\n\nbody\n", string(data); want != got {
+		t.Errorf("Original data was modified: %q", got)
+	}
+}
+
+func TestReadBodySpooled(t *testing.T) {
+	defer func(threshold int) { spoolThreshold = threshold }(spoolThreshold)
+	spoolThreshold = 16
+
+	msg := "Subject: spooled\n\n" + strings.Repeat("line of the body\n", 10)
+	b, err := ReadBody(strings.NewReader(msg))
+	if err != nil {
+		t.Fatalf("Failed to read body: %v", err)
+	}
+	if b.file == nil {
+		t.Fatalf("Body was not spooled to a file")
+	}
+	filename := b.file.Name()
+
+	if want, got := "Subject: spooled\n\n", string(b.Header()); want != got {
+		t.Errorf("Want header %q, got %q", want, got)
+	}
+	b.Prepend([]byte("Received: here\r\n"))
+	if want, got := "Received: here\r\n"+msg, bodyString(t, b); want != got {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+	// The body can be read more than once.
+	if want, got := "Received: here\r\n"+msg, bodyString(t, b); want != got {
+		t.Errorf("Want %q, got %q on second read", want, got)
+	}
+
+	if err := b.Close(); err != nil {
+		t.Errorf("Failed to close body: %v", err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("Spooled file was not removed: %v", err)
+	}
+}
+
+func TestOpenBody(t *testing.T) {
+	dir, err := ioutil.TempDir("", "body")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "msg")
+	msg := "Subject: file\n\nbody\n"
+	if err := ioutil.WriteFile(filename, []byte(msg), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := OpenBody(filename)
+	if err != nil {
+		t.Fatalf("Failed to open body: %v", err)
+	}
+	if want, got := msg, bodyString(t, b); want != got {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+	b.Close()
+
+	if _, err := os.Stat(filename); err != nil {
+		t.Errorf("Opened file should not be removed: %v", err)
+	}
+}
@@ -10,14 +10,22 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/base64"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
 	"net"
 	"net/mail"
 	"net/textproto"
+	"strconv"
 	"strings"
 	"time"
 
 	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/sasl"
+	"src.bluestatic.org/mailpopbox/spf"
 )
 
 type state int
@@ -27,7 +35,7 @@ const (
 	stateInitial
 	stateMail
 	stateRecipient
-	stateData
+	stateData // Receiving a message in BDAT chunks.
 )
 
 type delivery int
@@ -63,8 +71,8 @@ type connection struct {
 
 	log *zap.Logger
 
-	// The authcid from a PLAIN SASL login. Non-empty iff tls is non-nil and
-	// doAUTH() succeeded.
+	// The authcid from a SASL login. Non-empty iff tls is non-nil and doAUTH()
+	// succeeded.
 	authc string
 
 	state
@@ -77,6 +85,25 @@ type connection struct {
 	ehlo     string
 	mailFrom *mail.Address
 	rcptTo   []mail.Address
+
+	// The result of checking the SPF policy of mailFrom, for deliverInbound.
+	spf *spf.Check
+
+	// The SIZE declared by the client in MAIL FROM, or zero.
+	declaredSize int64
+	// The BODY declared by the client in MAIL FROM, or empty.
+	bodyType string
+	// Whether the client gave the SMTPUTF8 parameter in MAIL FROM.
+	smtpUTF8 bool
+	// The DSN parameters of MAIL FROM and of each recipient.
+	dsnReturn  string
+	envelopeID string
+	rcptDSN    map[string]RecipientDSN
+	// The largest message that is accepted in the current transaction, or
+	// zero if there is no limit.
+	maxSize int64
+	// The message received so far from BDAT chunks, for stateData.
+	chunks *bodyWriter
 }
 
 func AcceptConnection(netConn net.Conn, server Server, log *zap.Logger) {
@@ -88,6 +115,8 @@ func AcceptConnection(netConn net.Conn, server Server, log *zap.Logger) {
 		log:        log.With(zap.Stringer("client", netConn.RemoteAddr())),
 		state:      stateNew,
 	}
+	// Removes a message that was partly received with BDAT.
+	defer conn.resetBuffers()
 
 	conn.log.Info("accepted connection")
 	conn.writeReply(220, fmt.Sprintf("%s ESMTP [%s] (mailpopbox)",
@@ -103,9 +132,8 @@ func AcceptConnection(netConn net.Conn, server Server, log *zap.Logger) {
 		}
 
 		lineForLog := conn.line
-		const authPlain = "AUTH PLAIN "
-		if strings.HasPrefix(conn.line, authPlain) {
-			lineForLog = authPlain + "[redacted]"
+		if fields := strings.Fields(conn.line); len(fields) > 2 && strings.EqualFold(fields[0], "AUTH") {
+			lineForLog = fields[0] + " " + fields[1] + " [redacted]"
 		}
 		conn.log.Info("ReadLine()", zap.String("line", lineForLog))
 
@@ -117,7 +145,8 @@ func AcceptConnection(netConn net.Conn, server Server, log *zap.Logger) {
 
 		switch strings.ToUpper(cmd) {
 		case "QUIT":
-			conn.writeReply(221, "Goodbye")
+			conn.reply(ReplyLine{221, "2.0.0", "Goodbye"})
+			conn.tp.W.Flush()
 			conn.tp.Close()
 			return
 		case "HELO":
@@ -136,33 +165,54 @@ func AcceptConnection(netConn net.Conn, server Server, log *zap.Logger) {
 			conn.doRCPT()
 		case "DATA":
 			conn.doDATA()
+		case "BDAT":
+			conn.doBDAT()
 		case "RSET":
 			conn.doRSET()
 		case "VRFY":
-			conn.writeReply(252, "I'll do my best")
+			conn.reply(ReplyLine{252, "2.5.0", "I'll do my best"})
 		case "EXPN":
-			conn.writeReply(550, "access denied")
+			conn.reply(ReplyLine{550, "5.7.1", "access denied"})
 		case "NOOP":
 			conn.reply(ReplyOK)
 		case "HELP":
-			conn.writeReply(250, "https://tools.ietf.org/html/rfc5321")
+			conn.reply(ReplyLine{250, "2.0.0", "https://tools.ietf.org/html/rfc5321"})
 		default:
-			conn.writeReply(500, "unrecognized command")
+			conn.reply(ReplyBadCommand)
 		}
 	}
 }
 
 func (conn *connection) reply(reply ReplyLine) error {
-	return conn.writeReply(reply.Code, reply.Message)
+	return conn.writeReply(reply.Code, reply.text())
 }
 
 func (conn *connection) writeReply(code int, msg string) error {
+	return conn.writeReplyLines(code, []string{msg})
+}
+
+// writeReplyLines writes a reply, which is multiline if there is more than
+// one line of text. Replies are buffered while the client has pipelined more
+// commands, so that they are sent together (RFC 2920).
+func (conn *connection) writeReplyLines(code int, lines []string) error {
 	conn.log.Info("writeReply", zap.Int("code", code))
 	var err error
-	if len(msg) > 0 {
-		err = conn.tp.PrintfLine("%d %s", code, msg)
-	} else {
-		err = conn.tp.PrintfLine("%d", code)
+	for i, line := range lines {
+		sep := " "
+		if i < len(lines)-1 {
+			sep = "-"
+		}
+		if len(line) == 0 && sep == " " {
+			_, err = fmt.Fprintf(conn.tp.W, "%d\r\n", code)
+		} else {
+			_, err = fmt.Fprintf(conn.tp.W, "%d%s%s\r\n", code, sep, line)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == nil && !conn.hasPipelinedCommand() {
+		err = conn.tp.W.Flush()
 	}
 	if err != nil {
 		conn.log.Error("writeReply",
@@ -172,22 +222,67 @@ func (conn *connection) writeReply(code int, msg string) error {
 	return err
 }
 
+// hasPipelinedCommand returns whether a complete command line from the client
+// has already been received, so that its reply can be sent with the previous
+// one.
+func (conn *connection) hasPipelinedCommand() bool {
+	n := conn.tp.R.Buffered()
+	if n == 0 {
+		return false
+	}
+	buf, _ := conn.tp.R.Peek(n)
+	return bytes.IndexByte(buf, '\n') != -1
+}
+
 // parsePath parses out either a forward-, reverse-, or return-path from the
-// current connection line. Returns a (valid-path, ReplyOK) if it was
-// successfully parsed.
-func (conn *connection) parsePath(command string) (string, ReplyLine) {
+// current connection line. Returns a (valid-path, parameters, ReplyOK) if it
+// was successfully parsed, where the parameters are the ESMTP parameters that
+// follow the path. The case of the path is kept, as local parts may be case
+// sensitive.
+func (conn *connection) parsePath(command string) (string, map[string]string, ReplyLine) {
 	if len(conn.line) < len(command) {
-		return "", ReplyBadSyntax
+		return "", nil, ReplyBadSyntax
 	}
 	if strings.ToUpper(command) != strings.ToUpper(conn.line[:len(command)]) {
-		return "", ReplyLine{500, "unrecognized command"}
+		return "", nil, ReplyBadCommand
 	}
 	params := conn.line[len(command):]
 	idx := strings.Index(params, ">")
 	if idx == -1 {
-		return "", ReplyBadSyntax
+		return "", nil, ReplyBadSyntax
+	}
+
+	esmtpParams := make(map[string]string)
+	for _, param := range strings.Fields(params[idx+1:]) {
+		var key, value string
+		if eq := strings.IndexByte(param, '='); eq != -1 {
+			key, value = param[:eq], param[eq+1:]
+		} else {
+			key = param
+		}
+		if key == "" {
+			return "", nil, ReplyBadSyntax
+		}
+		esmtpParams[strings.ToUpper(key)] = value
+	}
+
+	return params[:idx+1], esmtpParams, ReplyOK
+}
+
+// parseAddress parses the address in |path| and normalizes its domain. An
+// address that is not ASCII is only accepted if |smtpUTF8| is set.
+func parseAddress(path string, smtpUTF8 bool) (*mail.Address, ReplyLine) {
+	address, err := mail.ParseAddress(path)
+	if err != nil || address == nil {
+		return nil, ReplyBadSyntax
+	}
+	if !smtpUTF8 && !isASCII(address.Address) {
+		return nil, ReplyNeedsSMTPUTF8
+	}
+	if address.Address, err = NormalizeAddress(address.Address); err != nil {
+		return nil, ReplyMailboxUnallowed
 	}
-	return strings.ToLower(params[:idx+1]), ReplyOK
+	return address, ReplyOK
 }
 
 func (conn *connection) doEHLO() {
@@ -203,14 +298,28 @@ func (conn *connection) doEHLO() {
 	if cmd == "HELO" {
 		conn.writeReply(250, fmt.Sprintf("Hello %s [%s]", conn.ehlo, conn.remoteAddr))
 	} else {
-		conn.tp.PrintfLine("250-Hello %s [%s]", conn.ehlo, conn.remoteAddr)
+		lines := []string{
+			fmt.Sprintf("Hello %s [%s]", conn.ehlo, conn.remoteAddr),
+			"PIPELINING",
+			"8BITMIME",
+			"CHUNKING",
+			"BINARYMIME",
+			"ENHANCEDSTATUSCODES",
+			"SMTPUTF8",
+			"DSN",
+		}
 		if conn.server.TLSConfig() != nil && conn.tls == nil {
-			conn.tp.PrintfLine("250-STARTTLS")
+			lines = append(lines, "STARTTLS")
 		}
 		if conn.tls != nil {
-			conn.tp.PrintfLine("250-AUTH PLAIN")
+			lines = append(lines, "AUTH "+strings.Join(sasl.Mechanisms(), " "))
+		}
+		if maxSize := conn.server.MaxMessageSize(mail.Address{}); maxSize > 0 {
+			lines = append(lines, fmt.Sprintf("SIZE %d", maxSize))
+		} else {
+			lines = append(lines, "SIZE")
 		}
-		conn.tp.PrintfLine("250 SIZE %d", 40960000)
+		conn.writeReplyLines(250, lines)
 	}
 
 	conn.log.Info("doEHLO()", zap.String("ehlo", conn.ehlo))
@@ -226,12 +335,15 @@ func (conn *connection) doSTARTTLS() {
 
 	tlsConfig := conn.server.TLSConfig()
 	if !conn.esmtp || tlsConfig == nil {
-		conn.writeReply(500, "unrecognized command")
+		conn.reply(ReplyBadCommand)
 		return
 	}
 
 	conn.log.Info("doSTARTTLS()")
-	conn.writeReply(220, "initiate TLS connection")
+	conn.reply(ReplyLine{220, "2.0.0", "initiate TLS connection"})
+	// Any commands that were pipelined after STARTTLS are discarded with the
+	// reader, as they were not protected by TLS.
+	conn.tp.W.Flush()
 
 	tlsConn := tls.Server(conn.nc, tlsConfig)
 	if err := tlsConn.Handshake(); err != nil {
@@ -256,63 +368,87 @@ func (conn *connection) doAUTH() {
 	}
 
 	if conn.authc != "" {
-		conn.writeReply(503, "already authenticated")
+		conn.reply(ReplyLine{503, "5.5.1", "already authenticated"})
 		return
 	}
 
-	var cmd, authType, authString string
-	n, err := fmt.Sscanf(conn.line, "%s %s %s", &cmd, &authType, &authString)
-	if n < 2 {
+	fields := strings.Fields(conn.line)
+	if len(fields) < 2 || len(fields) > 3 {
 		conn.reply(ReplyBadSyntax)
 		return
 	}
 
-	if authType != "PLAIN" {
-		conn.writeReply(504, "unrecognized auth type")
+	mech := sasl.NewMechanism(fields[1], conn.server)
+	if mech == nil {
+		conn.reply(ReplyLine{504, "5.5.4", "unrecognized auth type"})
 		return
 	}
 
-	// If only 2 tokens were scanned, then an initial response was not provided.
-	if n == 2 && conn.line[len(conn.line)-1] != ' ' {
-		conn.reply(ReplyBadSyntax)
-		return
+	conn.log.Info("doAUTH()", zap.String("mechanism", fields[1]))
+
+	// An initial response of "=" is empty, which is different from none
+	// (RFC 4954 § 4).
+	var response []byte
+	if len(fields) == 3 {
+		var err error
+		if response, err = decodeAuthResponse(fields[2]); err != nil {
+			conn.reply(ReplyBadSyntax)
+			return
+		}
 	}
 
-	conn.log.Info("doAUTH()")
+	for {
+		challenge, done, err := mech.Next(response)
+		if err == sasl.ErrAuthenticationFailed {
+			_, authc := mech.Identity()
+			conn.log.Error("failed to authenticate", zap.String("authc", authc))
+			conn.reply(ReplyLine{535, "5.7.8", "invalid credentials"})
+			return
+		} else if err != nil {
+			conn.log.Error("bad auth response", zap.Error(err))
+			conn.reply(ReplyBadSyntax)
+			return
+		}
+		if done {
+			break
+		}
 
-	if authString == "" {
-		conn.writeReply(334, " ")
+		// An empty challenge is still sent with the separating space, which
+		// some clients expect (RFC 4954 § 4). writeReply would drop it.
+		if len(challenge) == 0 {
+			conn.tp.PrintfLine("334 ")
+		} else {
+			conn.writeReply(334, base64.StdEncoding.EncodeToString(challenge))
+		}
 
-		authString, err = conn.tp.ReadLine()
+		line, err := conn.tp.ReadLine()
 		if err != nil {
 			conn.log.Error("failed to read auth line", zap.Error(err))
 			conn.reply(ReplyBadSyntax)
 			return
 		}
+		if line == "*" {
+			conn.reply(ReplyLine{501, "5.0.0", "authentication cancelled"})
+			return
+		}
+		if response, err = base64.StdEncoding.DecodeString(line); err != nil {
+			conn.reply(ReplyBadSyntax)
+			return
+		}
 	}
 
-	authBytes, err := base64.StdEncoding.DecodeString(authString)
-	if err != nil {
-		conn.reply(ReplyBadSyntax)
-		return
-	}
-
-	authParts := strings.Split(string(authBytes), "\x00")
-	if len(authParts) != 3 {
-		conn.log.Error("bad auth line syntax")
-		conn.reply(ReplyBadSyntax)
-		return
-	}
+	authz, authc := mech.Identity()
+	conn.log.Info("authenticated", zap.String("authz", authz), zap.String("authc", authc))
+	conn.authc = authc
+	conn.reply(ReplyAuthOK)
+}
 
-	if !conn.server.Authenticate(authParts[0], authParts[1], authParts[2]) {
-		conn.log.Error("failed to authenticate", zap.String("authc", authParts[1]))
-		conn.writeReply(535, "invalid credentials")
-		return
+// decodeAuthResponse decodes the initial response of AUTH.
+func decodeAuthResponse(s string) ([]byte, error) {
+	if s == "=" {
+		return []byte{}, nil
 	}
-
-	conn.log.Info("authenticated", zap.String("authz", authParts[0]), zap.String("authc", authParts[1]))
-	conn.authc = authParts[1]
-	conn.reply(ReplyAuthOK)
+	return base64.StdEncoding.DecodeString(s)
 }
 
 func (conn *connection) doMAIL() {
@@ -321,28 +457,95 @@ func (conn *connection) doMAIL() {
 		return
 	}
 
-	mailFrom, reply := conn.parsePath("MAIL FROM:")
+	mailFrom, params, reply := conn.parsePath("MAIL FROM:")
 	if reply != ReplyOK {
 		conn.reply(reply)
 		return
 	}
 
-	var err error
-	conn.mailFrom, err = mail.ParseAddress(mailFrom)
-	if err != nil || conn.mailFrom == nil {
-		conn.reply(ReplyBadSyntax)
+	var declaredSize int64
+	if size, ok := params["SIZE"]; ok {
+		var err error
+		declaredSize, err = strconv.ParseInt(size, 10, 64)
+		if err != nil || declaredSize < 0 {
+			conn.reply(ReplyBadParameter)
+			return
+		}
+	}
+
+	bodyType, ok := params["BODY"]
+	if ok {
+		bodyType = strings.ToUpper(bodyType)
+		if bodyType != BodyType7Bit && bodyType != BodyType8BitMIME && bodyType != BodyTypeBinaryMIME {
+			conn.reply(ReplyBadParameter)
+			return
+		}
+	}
+
+	smtpUTF8 := false
+	if value, ok := params["SMTPUTF8"]; ok {
+		if value != "" {
+			conn.reply(ReplyBadParameter)
+			return
+		}
+		smtpUTF8 = true
+	}
+
+	dsnReturn, ok := params["RET"]
+	if ok {
+		dsnReturn = strings.ToUpper(dsnReturn)
+		if dsnReturn != DSNReturnFull && dsnReturn != DSNReturnHeaders {
+			conn.reply(ReplyBadParameter)
+			return
+		}
+	}
+
+	var envelopeID string
+	if value, ok := params["ENVID"]; ok {
+		var err error
+		envelopeID, err = decodeXtext(value)
+		if err != nil || envelopeID == "" || len(value) > maxEnvelopeIDLength {
+			conn.reply(ReplyBadParameter)
+			return
+		}
+	}
+
+	conn.mailFrom, reply = parseAddress(mailFrom, smtpUTF8)
+	if reply != ReplyOK {
+		conn.reply(reply)
 		return
 	}
 
 	if conn.server.VerifyAddress(*conn.mailFrom) == ReplyOK {
 		if DomainForAddress(*conn.mailFrom) != DomainForAddressString(conn.authc) {
-			conn.writeReply(550, "not authenticated")
+			conn.reply(ReplyLine{550, "5.7.1", "not authenticated"})
 			return
 		}
 		conn.delivery = deliverOutbound
+		conn.maxSize = conn.server.MaxMessageSize(*conn.mailFrom)
 	} else {
 		conn.delivery = deliverInbound
+		// The limit is lowered as recipients are added.
+		conn.maxSize = conn.server.MaxMessageSize(mail.Address{})
+		conn.spf = conn.server.CheckSender(conn.remoteAddr, conn.ehlo, *conn.mailFrom)
+		if conn.spf != nil {
+			conn.log.Info("checked SPF",
+				zap.String("address", conn.mailFrom.Address),
+				zap.String("result", string(conn.spf.Result)),
+				zap.NamedError("reason", conn.spf.Err))
+		}
+	}
+
+	if conn.maxSize > 0 && declaredSize > conn.maxSize {
+		conn.log.Warn("declared message size is too large", zap.Int64("size", declaredSize))
+		conn.reply(ReplyTooLarge)
+		return
 	}
+	conn.declaredSize = declaredSize
+	conn.bodyType = bodyType
+	conn.smtpUTF8 = smtpUTF8
+	conn.dsnReturn = dsnReturn
+	conn.envelopeID = envelopeID
 
 	conn.log.Info("doMAIL()", zap.String("address", conn.mailFrom.Address))
 
@@ -356,15 +559,29 @@ func (conn *connection) doRCPT() {
 		return
 	}
 
-	rcptTo, reply := conn.parsePath("RCPT TO:")
+	rcptTo, params, reply := conn.parsePath("RCPT TO:")
 	if reply != ReplyOK {
 		conn.reply(reply)
 		return
 	}
 
-	address, err := mail.ParseAddress(rcptTo)
-	if err != nil {
-		conn.reply(ReplyBadSyntax)
+	var dsn RecipientDSN
+	if value, ok := params["NOTIFY"]; ok {
+		if dsn.Notify, ok = parseNotify(value); !ok {
+			conn.reply(ReplyBadParameter)
+			return
+		}
+	}
+	if value, ok := params["ORCPT"]; ok {
+		if dsn.OriginalRecipient, ok = parseOriginalRecipient(value); !ok {
+			conn.reply(ReplyBadParameter)
+			return
+		}
+	}
+
+	address, reply := parseAddress(rcptTo, conn.smtpUTF8)
+	if reply != ReplyOK {
+		conn.reply(reply)
 		return
 	}
 
@@ -376,11 +593,44 @@ func (conn *connection) doRCPT() {
 		return
 	}
 
+	if conn.delivery == deliverInbound && conn.server.IsBlocked(*address) {
+		conn.log.Warn("blocked address", zap.String("address", address.Address))
+		conn.reply(ReplyBadMailbox)
+		return
+	}
+
+	if conn.delivery == deliverInbound && conn.spf != nil && conn.spf.Result == spf.ResultFail &&
+		conn.server.RejectSPFFailure(*address) {
+		conn.log.Warn("rejecting recipient for SPF failure", zap.String("address", address.Address))
+		conn.reply(ReplyLine{550, "5.7.23", fmt.Sprintf("%s is not authorized to send mail for %s", conn.spf.IP, conn.spf.Domain)})
+		return
+	}
+
+	if conn.delivery == deliverInbound {
+		maxSize := conn.server.MaxMessageSize(*address)
+		if maxSize > 0 && conn.declaredSize > maxSize {
+			conn.log.Warn("declared message size is too large for recipient",
+				zap.String("address", address.Address),
+				zap.Int64("size", conn.declaredSize))
+			conn.reply(ReplyTooLarge)
+			return
+		}
+		if maxSize > 0 && (conn.maxSize == 0 || maxSize < conn.maxSize) {
+			conn.maxSize = maxSize
+		}
+	}
+
 	conn.log.Info("doRCPT()",
 		zap.String("address", address.Address),
 		zap.String("delivery", conn.delivery.String()))
 
 	conn.rcptTo = append(conn.rcptTo, *address)
+	if dsn.Notify != nil || dsn.OriginalRecipient != "" {
+		if conn.rcptDSN == nil {
+			conn.rcptDSN = make(map[string]RecipientDSN)
+		}
+		conn.rcptDSN[address.Address] = dsn
+	}
 
 	conn.state = stateRecipient
 	conn.reply(ReplyOK)
@@ -392,18 +642,118 @@ func (conn *connection) doDATA() {
 		return
 	}
 
+	// A binary message cannot be dot-stuffed, so it must be sent with BDAT
+	// (RFC 3030 § 3).
+	if conn.bodyType == BodyTypeBinaryMIME {
+		conn.reply(ReplyLine{503, "5.5.1", "BINARYMIME requires BDAT"})
+		return
+	}
+
 	conn.writeReply(354, "Start mail input; end with <CRLF>.<CRLF>")
 	conn.log.Info("doDATA()")
 
-	data, err := conn.tp.ReadDotBytes()
+	// The transaction is over once the message has been received, whether or
+	// not it is accepted.
+	defer conn.endTransaction()
+
+	dot := conn.tp.DotReader()
+	var r io.Reader = dot
+	if conn.maxSize > 0 {
+		r = &sizeLimitReader{r: dot, remaining: conn.maxSize}
+	}
+	data, err := ReadBody(r)
 	if err != nil {
-		conn.log.Error("failed to ReadDotBytes()",
-			zap.Error(err),
-			zap.String("bytes", fmt.Sprintf("%x", data)))
-		conn.writeReply(552, "transaction failed")
+		// Discard the rest of the message, so that the end of it is not read
+		// as commands.
+		io.Copy(ioutil.Discard, dot)
+		if err == errMessageTooLarge {
+			conn.log.Warn("message is too large", zap.Int64("max-size", conn.maxSize))
+			conn.reply(ReplyTooLarge)
+			return
+		}
+		conn.log.Error("failed to read message data", zap.Error(err))
+		conn.reply(ReplyLine{552, "5.3.0", "transaction failed"})
+		return
+	}
+	defer data.Close()
+
+	conn.receiveMessage(data)
+}
+
+// doBDAT receives a chunk of a message (RFC 3030). The chunks are collected
+// until the one marked LAST, after which the message is delivered like one
+// received with DATA.
+func (conn *connection) doBDAT() {
+	fields := strings.Fields(conn.line)
+	if len(fields) < 2 || len(fields) > 3 {
+		conn.reply(ReplyBadSyntax)
+		return
+	}
+	size, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil || size < 0 {
+		conn.reply(ReplyBadSyntax)
+		return
+	}
+	last := len(fields) == 3
+	if last && strings.ToUpper(fields[2]) != "LAST" {
+		conn.reply(ReplyBadSyntax)
+		return
+	}
+
+	// The chunk is always read, so that it is not read as commands.
+	chunk := io.LimitReader(conn.tp.R, size)
+
+	if conn.state != stateRecipient && conn.state != stateData {
+		io.Copy(ioutil.Discard, chunk)
+		conn.reply(ReplyBadSequence)
+		return
+	}
+
+	conn.log.Info("doBDAT()", zap.Int64("size", size), zap.Bool("last", last))
+
+	if conn.chunks == nil {
+		conn.chunks = &bodyWriter{}
+		conn.state = stateData
+	}
+
+	if conn.maxSize > 0 && conn.chunks.size+size > conn.maxSize {
+		io.Copy(ioutil.Discard, chunk)
+		conn.log.Warn("message is too large", zap.Int64("max-size", conn.maxSize))
+		conn.endTransaction()
+		conn.reply(ReplyTooLarge)
+		return
+	}
+
+	if _, err := io.Copy(conn.chunks, chunk); err != nil {
+		io.Copy(ioutil.Discard, chunk)
+		conn.log.Error("failed to read message chunk", zap.Error(err))
+		conn.endTransaction()
+		conn.reply(ReplyLine{552, "5.3.0", "transaction failed"})
 		return
 	}
 
+	if !last {
+		conn.reply(ReplyLine{250, "2.0.0", fmt.Sprintf("%d octets received", size)})
+		return
+	}
+
+	defer conn.endTransaction()
+
+	data, err := conn.chunks.body()
+	conn.chunks = nil
+	if err != nil {
+		conn.log.Error("failed to read message data", zap.Error(err))
+		conn.reply(ReplyLine{552, "5.3.0", "transaction failed"})
+		return
+	}
+	defer data.Close()
+
+	conn.receiveMessage(data)
+}
+
+// receiveMessage delivers or relays the message |data| of the current
+// transaction, and replies with the result.
+func (conn *connection) receiveMessage(data *Body) {
 	received := time.Now()
 	env := Envelope{
 		RemoteAddr: conn.remoteAddr,
@@ -413,19 +763,29 @@ func (conn *connection) doDATA() {
 		Received:   received,
 		ID:         generateEnvelopeId("m", received),
 		Data:       data,
+		SPF:        conn.spf,
+		BodyType:   conn.bodyType,
+		SMTPUTF8:   conn.smtpUTF8,
+		DSNReturn:  conn.dsnReturn,
+		EnvelopeID: conn.envelopeID,
+		RcptDSN:    conn.rcptDSN,
 	}
 
 	conn.handleSendAs(&env)
 
 	conn.log.Info("received message",
-		zap.Int("bytes", len(data)),
+		zap.Int64("bytes", data.Len()),
 		zap.Time("date", received),
 		zap.String("id", env.ID),
 		zap.String("delivery", conn.delivery.String()))
 
 	trace := conn.getReceivedInfo(env)
+	if conn.spf != nil {
+		receivedSPF := "Received-SPF: " + conn.spf.ReceivedSPF(conn.server.Name()) + "\r\n"
+		trace = append([]byte(receivedSPF), trace...)
+	}
 
-	env.Data = append(trace, env.Data...)
+	env.Data.Prepend(trace)
 
 	if conn.delivery == deliverInbound {
 		if reply := conn.server.DeliverMessage(env); reply != nil {
@@ -433,22 +793,85 @@ func (conn *connection) doDATA() {
 			conn.reply(*reply)
 			return
 		}
+		conn.notifyDelivered(env)
 	} else if conn.delivery == deliverOutbound {
-		conn.server.RelayMessage(env)
+		if reply := conn.server.RelayMessage(env); reply != nil {
+			conn.log.Warn("message was not queued for relay", zap.String("id", env.ID))
+			conn.reply(*reply)
+			return
+		}
 	}
 
-	conn.state = stateInitial
-	conn.resetBuffers()
 	conn.reply(ReplyOK)
 }
 
+// notifyDelivered sends a delivery status notification for the recipients of
+// the inbound message |env| that asked to be notified of success.
+func (conn *connection) notifyDelivered(env Envelope) {
+	// A message with the null reverse-path is not notified (RFC 3461 § 6.2).
+	if env.MailFrom.Address == "" {
+		return
+	}
+
+	var rcpts []dsnRecipient
+	for _, rcpt := range env.RcptTo {
+		if env.notifies(rcpt.Address, NotifySuccess) {
+			rcpts = append(rcpts, dsnRecipient{
+				to:     rcpt.Address,
+				action: dsnActionDelivered,
+				status: "2.0.0",
+			})
+		}
+	}
+	if len(rcpts) == 0 {
+		return
+	}
+
+	from := mail.Address{Name: "mailpopbox", Address: "mailbox@" + DomainForAddress(env.RcptTo[0])}
+	notice, err := newStatusNotification(conn.server.Name(), from, env, rcpts)
+	if err != nil {
+		conn.log.Error("failed to create delivery status notification", zap.Error(err))
+		return
+	}
+	defer notice.Data.Close()
+	if reply := conn.server.RelayMessage(notice); reply != nil {
+		conn.log.Warn("delivery status notification was not queued for relay", zap.String("id", env.ID))
+	}
+}
+
+// errMessageTooLarge is returned by a sizeLimitReader when the message is
+// larger than its limit.
+var errMessageTooLarge = errors.New("message exceeds maximum size")
+
+// sizeLimitReader reads from |r| until more than |remaining| bytes have been
+// read, after which it returns errMessageTooLarge.
+type sizeLimitReader struct {
+	r         io.Reader
+	remaining int64
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	// Reading one byte past the limit distinguishes a message that is exactly
+	// the maximum size from one that is too large.
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.r.Read(p)
+	l.remaining -= int64(n)
+	if l.remaining < 0 {
+		return n, errMessageTooLarge
+	}
+	return n, err
+}
+
 func (conn *connection) handleSendAs(env *Envelope) {
 	if conn.delivery != deliverOutbound {
 		return
 	}
 
 	// Find the separator between the message header and body.
-	headerIdx := bytes.Index(env.Data, []byte("\n\n"))
+	header := env.Data.Header()
+	headerIdx := bytes.Index(header, []byte("\n\n"))
 	if headerIdx == -1 {
 		conn.log.Error("send-as: could not find headers index")
 		return
@@ -456,9 +879,9 @@ func (conn *connection) handleSendAs(env *Envelope) {
 
 	var buf bytes.Buffer
 
-	headers := bytes.SplitAfter(env.Data[:headerIdx], []byte("\n"))
+	headers := bytes.SplitAfter(header[:headerIdx], []byte("\n"))
 
-	var fromIdx, subjectIdx int
+	fromIdx, subjectIdx := -1, -1
 	for i, header := range headers {
 		if bytes.HasPrefix(header, []byte("From:")) {
 			fromIdx = i
@@ -479,22 +902,39 @@ func (conn *connection) handleSendAs(env *Envelope) {
 		return
 	}
 
-	sendAs := SendAsSubject.FindSubmatchIndex(headers[subjectIdx])
+	// A subject that is not ASCII is usually sent as RFC 2047 encoded-words,
+	// so the send-as magic is looked for in the decoded subject.
+	subject := string(headers[subjectIdx][len("Subject:"):])
+	decoded, err := new(mime.WordDecoder).DecodeHeader(subject)
+	if err != nil {
+		decoded = subject
+	}
+
+	sendAs := SendAsSubject.FindStringSubmatchIndex(decoded)
 	if sendAs == nil {
 		// No send-as modification.
 		return
 	}
 
 	// Submatch 0 is the whole sendas magic. Submatch 1 is the address prefix.
-	sendAsUser := headers[subjectIdx][sendAs[2]:sendAs[3]]
-	sendAsAddress := string(sendAsUser) + "@" + DomainForAddressString(conn.authc)
+	sendAsUser := decoded[sendAs[2]:sendAs[3]]
+	sendAsAddress := sendAsUser + "@" + DomainForAddressString(conn.authc)
 
 	conn.log.Info("handling send-as", zap.String("address", sendAsAddress))
 
+	newSubject := decoded[:sendAs[0]] + decoded[sendAs[1]:]
+	if decoded != subject {
+		eol := "\n"
+		if strings.HasSuffix(subject, "\r\n") {
+			eol = "\r\n"
+		}
+		newSubject = " " + mime.QEncoding.Encode("utf-8", strings.TrimSpace(newSubject)) + eol
+	}
+
 	for i, header := range headers {
 		if i == subjectIdx {
-			buf.Write(header[:sendAs[0]])
-			buf.Write(header[sendAs[1]:])
+			buf.WriteString("Subject:")
+			buf.WriteString(newSubject)
 		} else if i == fromIdx {
 			addressStart := bytes.LastIndexByte(header, byte('<'))
 			buf.Write(header[:addressStart+1])
@@ -505,10 +945,14 @@ func (conn *connection) handleSendAs(env *Envelope) {
 		}
 	}
 
-	buf.Write(env.Data[headerIdx:])
+	buf.Write(header[headerIdx:])
 
-	env.Data = buf.Bytes()
+	env.Data.SetHeader(buf.Bytes())
 	env.MailFrom.Address = sendAsAddress
+	// A UTF-8 address can only be relayed with SMTPUTF8.
+	if !isASCII(sendAsAddress) {
+		env.SMTPUTF8 = true
+	}
 }
 
 func (conn *connection) getReceivedInfo(envelope Envelope) []byte {
@@ -601,9 +1045,28 @@ func (conn *connection) doRSET() {
 	conn.reply(ReplyOK)
 }
 
+// endTransaction abandons the current mail transaction, or ends it after its
+// message has been received.
+func (conn *connection) endTransaction() {
+	conn.state = stateInitial
+	conn.resetBuffers()
+}
+
 func (conn *connection) resetBuffers() {
 	conn.delivery = deliverUnknown
 	conn.sendAs = nil
 	conn.mailFrom = nil
 	conn.rcptTo = make([]mail.Address, 0)
+	conn.spf = nil
+	conn.declaredSize = 0
+	conn.bodyType = ""
+	conn.smtpUTF8 = false
+	conn.dsnReturn = ""
+	conn.envelopeID = ""
+	conn.rcptDSN = nil
+	conn.maxSize = 0
+	if conn.chunks != nil {
+		conn.chunks.discard()
+		conn.chunks = nil
+	}
 }
@@ -7,6 +7,8 @@
 package smtp
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/base64"
 	"fmt"
@@ -14,12 +16,16 @@ import (
 	"net/mail"
 	"net/textproto"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
 	"testing"
 	"time"
 
 	"go.uber.org/zap"
+
+	"src.bluestatic.org/mailpopbox/sasl"
+	"src.bluestatic.org/mailpopbox/spf"
 )
 
 func _fl(depth int) string {
@@ -74,6 +80,9 @@ type testServer struct {
 	tlsConfig *tls.Config
 	*userAuth
 	relayed []Envelope
+	// maxSizes is the MaxMessageSize of each domain, with the empty domain
+	// used for any address. If nil, the default is used.
+	maxSizes map[string]int64
 }
 
 func (s *testServer) Name() string {
@@ -88,12 +97,16 @@ func (s *testServer) VerifyAddress(addr mail.Address) ReplyLine {
 	if DomainForAddress(addr) != s.domain {
 		return ReplyBadMailbox
 	}
+	return ReplyOK
+}
+
+func (s *testServer) IsBlocked(addr mail.Address) bool {
 	for _, block := range s.blockList {
-		if strings.ToLower(block) == addr.Address {
-			return ReplyBadMailbox
+		if strings.EqualFold(block, addr.Address) {
+			return true
 		}
 	}
-	return ReplyOK
+	return false
 }
 
 func (s *testServer) Authenticate(authz, authc, passwd string) bool {
@@ -102,8 +115,33 @@ func (s *testServer) Authenticate(authz, authc, passwd string) bool {
 		s.userAuth.passwd == passwd
 }
 
-func (s *testServer) RelayMessage(en Envelope) {
+func (s *testServer) ScramCredentials(authz, authc string) (sasl.ScramCredentials, bool) {
+	if s.userAuth == nil || s.userAuth.authz != authz || s.userAuth.authc != authc {
+		return sasl.ScramCredentials{}, false
+	}
+	creds, err := sasl.NewScramCredentials(s.userAuth.passwd)
+	return creds, err == nil
+}
+
+func (s *testServer) MaxMessageSize(addr mail.Address) int64 {
+	if s.maxSizes == nil {
+		return DefaultMaxMessageSize
+	}
+	if size, ok := s.maxSizes[DomainForAddress(addr)]; ok {
+		return size
+	}
+	return s.maxSizes[""]
+}
+
+func (s *testServer) RelayMessage(en Envelope) *ReplyLine {
+	// The body is closed after the message is relayed, so it is copied.
+	data, err := en.Data.Bytes()
+	if err != nil {
+		return &ReplyLocalError
+	}
+	en.Data = NewBody(data)
 	s.relayed = append(s.relayed, en)
+	return nil
 }
 
 func createClient(t *testing.T, addr net.Addr) *textproto.Conn {
@@ -184,6 +222,252 @@ func TestScenarioTypical(t *testing.T) {
 	readCodeLine(t, conn, 221)
 }
 
+func TestEHLOSize(t *testing.T) {
+	cases := []struct {
+		maxSizes map[string]int64
+		want     string
+	}{
+		{nil, "\nSIZE 40960000"},
+		{map[string]int64{"": 1024}, "\nSIZE 1024"},
+		{map[string]int64{"": 0}, "\nSIZE"},
+	}
+	for i, c := range cases {
+		l := runServer(t, &testServer{domain: "foo.com", maxSizes: c.maxSizes})
+		conn := createClient(t, l.Addr())
+		readCodeLine(t, conn, 220)
+
+		ok(t, conn.PrintfLine("EHLO test"))
+		_, message, err := conn.ReadResponse(250)
+		ok(t, err)
+		if !strings.HasSuffix(message, c.want) {
+			t.Errorf("Case %d: want EHLO to end with %q, got %q", i, c.want, message)
+		}
+		l.Close()
+	}
+}
+
+func TestMailFromSize(t *testing.T) {
+	s := &testServer{
+		domain:   "foo.com",
+		maxSizes: map[string]int64{"": 1000, "foo.com": 100},
+	}
+	l := runServer(t, s)
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	runTableTest(t, conn, []requestResponse{
+		{"EHLO test", 0, func(t testing.TB, conn *textproto.Conn) { conn.ReadResponse(250) }},
+		{"MAIL FROM:<sender@bar.com> SIZE=1001", 552, nil},
+		{"MAIL FROM:<sender@bar.com> SIZE=big", 501, nil},
+		{"MAIL FROM:<sender@bar.com> size=1000", 250, nil},
+		{"RSET", 250, nil},
+		{"MAIL FROM:<sender@bar.com> SIZE=500", 250, nil},
+		// The recipient's domain has a smaller limit.
+		{"RCPT TO:<receive@foo.com>", 552, nil},
+		{"RSET", 250, nil},
+		{"MAIL FROM:<sender@bar.com> SIZE=100", 250, nil},
+		{"RCPT TO:<receive@foo.com>", 250, nil},
+		{"QUIT", 221, nil},
+	})
+}
+
+func TestDataTooLarge(t *testing.T) {
+	s := &testServer{
+		domain:   "foo.com",
+		maxSizes: map[string]int64{"": 2000, "foo.com": 1000},
+	}
+	l := runServer(t, s)
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	sendData := func(lines int, code int) func(testing.TB, *textproto.Conn) {
+		return func(t testing.TB, conn *textproto.Conn) {
+			readCodeLine(t, conn, 354)
+			ok(t, conn.PrintfLine("Subject: big\n"))
+			for i := 0; i < lines; i++ {
+				ok(t, conn.PrintfLine("This line makes the message larger."))
+			}
+			ok(t, conn.PrintfLine("."))
+			_, message, err := conn.ReadResponse(code)
+			ok(t, err)
+			if code == 552 && !strings.HasPrefix(message, "5.3.4 ") {
+				t.Errorf("Want enhanced status code 5.3.4, got %q", message)
+			}
+		}
+	}
+
+	runTableTest(t, conn, []requestResponse{
+		{"EHLO test", 0, func(t testing.TB, conn *textproto.Conn) { conn.ReadResponse(250) }},
+		{"MAIL FROM:<sender@bar.com>", 250, nil},
+		{"RCPT TO:<receive@foo.com>", 250, nil},
+		{"DATA", 0, sendData(100, 552)},
+		// The transaction was aborted and the rest of the message was drained.
+		{"RCPT TO:<receive@foo.com>", 503, nil},
+		{"MAIL FROM:<sender@bar.com>", 250, nil},
+		{"RCPT TO:<receive@foo.com>", 250, nil},
+		{"DATA", 0, sendData(2, 250)},
+		// The limit of the recipient's domain is smaller than the server's.
+		{"MAIL FROM:<sender@bar.com>", 250, nil},
+		{"RCPT TO:<receive@foo.com>", 250, nil},
+		{"DATA", 0, sendData(40, 552)},
+		{"QUIT", 221, nil},
+	})
+}
+
+// rejectingServer refuses every message that is delivered or relayed.
+type rejectingServer struct {
+	testServer
+}
+
+func (s *rejectingServer) DeliverMessage(Envelope) *ReplyLine {
+	return &ReplyLine{550, "5.7.1", "rejected by policy"}
+}
+
+func (s *rejectingServer) RelayMessage(Envelope) *ReplyLine {
+	return &ReplyLocalError
+}
+
+func TestRejectedDataEndsTransaction(t *testing.T) {
+	s := &rejectingServer{
+		testServer: testServer{
+			domain:    "foo.com",
+			tlsConfig: getTLSConfig(t),
+			userAuth:  &userAuth{authc: "mailbox@foo.com", passwd: "test"},
+		},
+	}
+	l := runServer(t, s)
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	sendData := func(code int) func(testing.TB, *textproto.Conn) {
+		return func(t testing.TB, conn *textproto.Conn) {
+			readCodeLine(t, conn, 354)
+			ok(t, conn.PrintfLine("Subject: rejected\n\nHello"))
+			ok(t, conn.PrintfLine("."))
+			readCodeLine(t, conn, code)
+		}
+	}
+
+	runTableTest(t, conn, []requestResponse{
+		{"EHLO test", 0, func(t testing.TB, conn *textproto.Conn) { conn.ReadResponse(250) }},
+		{"MAIL FROM:<sender@bar.com>", 250, nil},
+		{"RCPT TO:<receive@foo.com>", 250, nil},
+		{"DATA", 0, sendData(550)},
+		// The recipients of the rejected message are not kept.
+		{"DATA", 503, nil},
+		{"MAIL FROM:<sender@bar.com>", 250, nil},
+		{"RCPT TO:<receive@foo.com>", 250, nil},
+		{"DATA", 0, sendData(550)},
+		{"RSET", 250, nil},
+	})
+
+	// A message that cannot be queued for relay also ends the transaction.
+	conn = setupTLSClient(t, l.Addr())
+	runTableTest(t, conn, []requestResponse{
+		{"AUTH PLAIN " + b64enc("\x00mailbox@foo.com\x00test"), 235, nil},
+		{"MAIL FROM:<mailbox@foo.com>", 250, nil},
+		{"RCPT TO:<receive@bar.com>", 250, nil},
+		{"DATA", 0, sendData(451)},
+		{"RCPT TO:<receive@bar.com>", 503, nil},
+		{"MAIL FROM:<mailbox@foo.com>", 250, nil},
+		{"QUIT", 221, nil},
+	})
+}
+
+func TestEHLOExtensions(t *testing.T) {
+	l := runServer(t, &testServer{domain: "foo.com"})
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	ok(t, conn.PrintfLine("EHLO test"))
+	_, message, err := conn.ReadResponse(250)
+	ok(t, err)
+	for _, ext := range []string{"PIPELINING", "8BITMIME", "CHUNKING", "BINARYMIME", "ENHANCEDSTATUSCODES", "SMTPUTF8", "DSN"} {
+		if !strings.Contains(message, "\n"+ext+"\n") {
+			t.Errorf("EHLO response does not contain %s, got %q", ext, message)
+		}
+	}
+}
+
+func TestPipelining(t *testing.T) {
+	s := &testServer{
+		domain:    "foo.com",
+		blockList: []string{"green@foo.com"},
+	}
+	l := runServer(t, s)
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	// The whole group of commands is sent at once, before reading any reply.
+	ok(t, conn.PrintfLine("EHLO test\r\n"+
+		"MAIL FROM:<smith@bar.com>\r\n"+
+		"RCPT TO:<jones@foo.com>\r\n"+
+		"RCPT TO:<green@foo.com>\r\n"+
+		"RCPT TO:<brown@foo.com>\r\n"+
+		"DATA"))
+
+	_, _, err := conn.ReadResponse(250)
+	ok(t, err)
+	readCodeLine(t, conn, 250)
+	readCodeLine(t, conn, 250)
+	if want, got := "5.1.1 mailbox unavailable", readCodeLine(t, conn, 550); want != got {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+	readCodeLine(t, conn, 250)
+	readCodeLine(t, conn, 354)
+
+	ok(t, conn.PrintfLine("Subject: pipelined\r\n\r\nHello\r\n.\r\nRSET\r\nNOOP\r\nQUIT"))
+	readCodeLine(t, conn, 250)
+	readCodeLine(t, conn, 250)
+	readCodeLine(t, conn, 250)
+	if want, got := "2.0.0 Goodbye", readCodeLine(t, conn, 221); want != got {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+}
+
+func TestEnhancedStatusCodes(t *testing.T) {
+	l := runServer(t, &testServer{domain: "foo.com"})
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	cases := []struct {
+		request string
+		code    int
+		message string
+	}{
+		{"RCPT TO:<jones@foo.com>", 503, "5.5.1 bad sequence of commands"},
+		{"EHLO test", 250, ""},
+		{"BOGUS", 500, "5.5.1 unrecognized command"},
+		{"MAIL FROM:<smith@bar.com> SIZE=big", 501, "5.5.4 invalid command parameter"},
+		{"MAIL FROM:<smith@bar.com>", 250, "2.0.0 OK"},
+		{"RCPT TO:<jones@other.com>", 550, "5.1.1 mailbox unavailable"},
+		{"RCPT TO:<jones@foo.com", 501, "5.5.2 syntax error"},
+		{"NOOP", 250, "2.0.0 OK"},
+	}
+	for i, c := range cases {
+		ok(t, conn.PrintfLine(c.request))
+		_, message, err := conn.ReadResponse(c.code)
+		if err != nil {
+			t.Errorf("Case %d: %v", i, err)
+		}
+		if c.message != "" && c.message != message {
+			t.Errorf("Case %d: want %q, got %q", i, c.message, message)
+		}
+	}
+}
+
 func TestVerifyAddress(t *testing.T) {
 	s := testServer{
 		domain:    "test.mail",
@@ -253,7 +537,7 @@ func TestCaseSensitivty(t *testing.T) {
 func TestGetReceivedInfo(t *testing.T) {
 	conn := connection{
 		server:     &testServer{},
-		remoteAddr: &net.IPAddr{net.IPv4(127, 0, 0, 1), ""},
+		remoteAddr: &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)},
 	}
 
 	now := time.Now()
@@ -292,7 +576,7 @@ func TestGetReceivedInfo(t *testing.T) {
 		//conn.tls = test.params.tls
 
 		envelope := Envelope{
-			RcptTo:   []mail.Address{{"", test.params.address}},
+			RcptTo:   []mail.Address{{Address: test.params.address}},
 			Received: now,
 			ID:       msgId,
 		}
@@ -400,10 +684,19 @@ func TestAuth(t *testing.T) {
 
 	conn := setupTLSClient(t, l.Addr())
 
+	emptyChallenge := func(t testing.TB, conn *textproto.Conn) {
+		line, err := conn.ReadLine()
+		ok(t, err)
+		if want, got := "334 ", line; want != got {
+			t.Errorf("Want empty challenge %q, got %q", want, got)
+		}
+	}
+
 	runTableTest(t, conn, []requestResponse{
 		{"AUTH", 501, nil},
 		{"AUTH OAUTHBEARER", 504, nil},
-		{"AUTH PLAIN", 501, nil}, // Bad syntax, missing space.
+		{"AUTH PLAIN", 0, emptyChallenge},
+		{"*", 501, nil}, // Cancelled.
 		{"AUTH PLAIN ", 334, nil},
 		{b64enc("abc\x00def\x00ghf"), 535, nil},
 		{"AUTH PLAIN ", 334, nil},
@@ -435,6 +728,133 @@ func TestAuthNoInitialResponse(t *testing.T) {
 	})
 }
 
+func TestAuthMechanisms(t *testing.T) {
+	l := runServer(t, &testServer{tlsConfig: getTLSConfig(t)})
+	defer l.Close()
+
+	conn := setupTLSClient(t, l.Addr())
+	ok(t, conn.PrintfLine("EHLO test"))
+	_, resp, err := conn.ReadResponse(250)
+	ok(t, err)
+	if want := "\nAUTH SCRAM-SHA-256 PLAIN LOGIN\n"; !strings.Contains(resp, want) {
+		t.Errorf("Want %q in EHLO response, got %q", want, resp)
+	}
+}
+
+func TestAuthLogin(t *testing.T) {
+	l := runServer(t, &testServer{
+		tlsConfig: getTLSConfig(t),
+		userAuth: &userAuth{
+			authc:  "user",
+			passwd: "longpassword",
+		},
+	})
+	defer l.Close()
+
+	conn := setupTLSClient(t, l.Addr())
+
+	challenge := func(want string) func(testing.TB, *textproto.Conn) {
+		return func(t testing.TB, conn *textproto.Conn) {
+			if got := readCodeLine(t, conn, 334); got != b64enc(want) {
+				t.Errorf("Want challenge %q, got %q", b64enc(want), got)
+			}
+		}
+	}
+
+	runTableTest(t, conn, []requestResponse{
+		{"AUTH LOGIN", 0, challenge("Username:")},
+		{b64enc("user"), 0, challenge("Password:")},
+		{b64enc("wrong"), 535, nil},
+		{"AUTH LOGIN " + b64enc("user"), 0, challenge("Password:")},
+		{b64enc("longpassword"), 235, nil},
+	})
+}
+
+// scramClient computes the messages of the client in a SCRAM-SHA-256
+// exchange.
+type scramClient struct {
+	password, clientFirstBare string
+}
+
+// final returns the client-final-message for the |serverFirst| message, and
+// the server-final-message that proves that the server knows the password.
+func (c scramClient) final(t testing.TB, serverFirst string) (string, string) {
+	var nonce, salt string
+	var iterations int
+	for _, attr := range strings.Split(serverFirst, ",") {
+		switch attr[:2] {
+		case "r=":
+			nonce = attr[2:]
+		case "s=":
+			salt = attr[2:]
+		case "i=":
+			fmt.Sscanf(attr[2:], "%d", &iterations)
+		}
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	ok(t, err)
+
+	mac := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	u := mac([]byte(c.password), string(saltBytes)+"\x00\x00\x00\x01")
+	salted := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		u = mac([]byte(c.password), string(u))
+		for j := range salted {
+			salted[j] ^= u[j]
+		}
+	}
+
+	withoutProof := "c=biws,r=" + nonce
+	authMessage := c.clientFirstBare + "," + serverFirst + "," + withoutProof
+	clientKey := mac(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	proof := mac(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	serverSignature := mac(mac(salted, "Server Key"), authMessage)
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof),
+		"v=" + base64.StdEncoding.EncodeToString(serverSignature)
+}
+
+func TestAuthScram(t *testing.T) {
+	l := runServer(t, &testServer{
+		tlsConfig: getTLSConfig(t),
+		userAuth: &userAuth{
+			authc:  "user",
+			passwd: "longpassword",
+		},
+	})
+	defer l.Close()
+
+	for _, password := range []string{"wrong", "longpassword"} {
+		conn := setupTLSClient(t, l.Addr())
+		client := scramClient{password: password, clientFirstBare: "n=user,r=fyko+d2lbbFgONRv9qkxdawL"}
+
+		ok(t, conn.PrintfLine("AUTH SCRAM-SHA-256 %s", b64enc("n,,"+client.clientFirstBare)))
+		serverFirst, err := base64.StdEncoding.DecodeString(readCodeLine(t, conn, 334))
+		ok(t, err)
+		clientFinal, serverFinal := client.final(t, string(serverFirst))
+		ok(t, conn.PrintfLine(b64enc(clientFinal)))
+
+		if password == "wrong" {
+			readCodeLine(t, conn, 535)
+			continue
+		}
+		if want, got := b64enc(serverFinal), readCodeLine(t, conn, 334); want != got {
+			t.Errorf("Want server-final-message %q, got %q", want, got)
+		}
+		runTableTest(t, conn, []requestResponse{
+			{"", 235, nil},
+			{"QUIT", 221, nil},
+		})
+	}
+}
+
 func TestRelayRequiresAuth(t *testing.T) {
 	l := runServer(t, &testServer{
 		domain:    "example.com",
@@ -477,6 +897,42 @@ func setupRelayTest(t *testing.T) (server *testServer, l net.Listener, conn *tex
 	return
 }
 
+func TestBlockedAddress(t *testing.T) {
+	l := runServer(t, &testServer{
+		domain:    "example.com",
+		blockList: []string{"blocked@example.com"},
+		tlsConfig: getTLSConfig(t),
+		userAuth: &userAuth{
+			authz:  "",
+			authc:  "mailbox@example.com",
+			passwd: "test",
+		},
+	})
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	runTableTest(t, conn, []requestResponse{
+		{"EHLO test", 0, func(t testing.TB, conn *textproto.Conn) { conn.ReadResponse(250) }},
+		// A blocked address of the server cannot be used to send inbound mail.
+		{"MAIL FROM:<blocked@example.com>", 550, nil},
+		{"MAIL FROM:<sender@other.net>", 250, nil},
+		{"RCPT TO:<blocked@example.com>", 550, nil},
+		{"RCPT TO:<allowed@example.com>", 250, nil},
+		{"QUIT", 221, nil},
+	})
+
+	// The authenticated user can still send mail from a blocked address.
+	conn = setupTLSClient(t, l.Addr())
+	runTableTest(t, conn, []requestResponse{
+		{"AUTH PLAIN " + b64enc("\x00mailbox@example.com\x00test"), 235, nil},
+		{"MAIL FROM:<blocked@example.com>", 250, nil},
+		{"RCPT TO:<friend@other.net>", 250, nil},
+		{"QUIT", 221, nil},
+	})
+}
+
 func TestBasicRelay(t *testing.T) {
 	server, l, conn := setupRelayTest(t)
 	defer l.Close()
@@ -539,7 +995,7 @@ func TestSendAsRelay(t *testing.T) {
 		t.Errorf("Unexpected RcptTo %q", got)
 	}
 
-	msg := string(en.Data)
+	msg := bodyString(t, en.Data)
 
 	if strings.Index(msg, original) != -1 {
 		t.Errorf("Should not find %q in message %q", original, msg)
@@ -554,6 +1010,389 @@ func TestSendAsRelay(t *testing.T) {
 	}
 }
 
+func TestSMTPUTF8(t *testing.T) {
+	l := runServer(t, &testServer{domain: "xn--bcher-kva.example"})
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	runTableTest(t, conn, []requestResponse{
+		{"EHLO test", 0, func(t testing.TB, conn *textproto.Conn) { conn.ReadResponse(250) }},
+		{"MAIL FROM:<jösé@sender.example>", 553, nil},
+		{"MAIL FROM:<sender@sender.example> SMTPUTF8=yes", 501, nil},
+		{"MAIL FROM:<sender@sender.example>", 250, nil},
+		{"RCPT TO:<jösé@bücher.example>", 553, nil},
+		{"RSET", 250, nil},
+		{"MAIL FROM:<jösé@sender.example> SMTPUTF8", 250, nil},
+		{"RCPT TO:<jösé@Bücher.example>", 250, nil},
+		{"RCPT TO:<user@xn--bcher-kva.example>", 250, nil},
+		{"RCPT TO:<user@-bücher.example>", 553, nil},
+	})
+}
+
+func TestSMTPUTF8Relay(t *testing.T) {
+	server, l, conn := setupRelayTest(t)
+	defer l.Close()
+
+	runTableTest(t, conn, []requestResponse{
+		{"MAIL FROM:<mailbox@example.com> SMTPUTF8", 250, nil},
+		{"RCPT TO:<Jösé@Bücher.example>", 250, nil},
+		{"DATA", 354, func(t testing.TB, conn *textproto.Conn) {
+			readCodeLine(t, conn, 354)
+
+			ok(t, conn.PrintfLine("From: <mailbox@example.com>"))
+			ok(t, conn.PrintfLine("Subject: =?utf-8?q?Gr=C3=BC=C3=9Fe_[sendas:j=C3=B6s=C3=A9]?=\n"))
+			ok(t, conn.PrintfLine("Hallo!"))
+			ok(t, conn.PrintfLine("."))
+			readCodeLine(t, conn, 250)
+		}},
+	})
+
+	if want, got := 1, len(server.relayed); want != got {
+		t.Fatalf("Want %d relayed message, got %d", want, got)
+	}
+	en := server.relayed[0]
+	if !en.SMTPUTF8 {
+		t.Errorf("Want SMTPUTF8 envelope")
+	}
+	if want, got := "Jösé@xn--bcher-kva.example", en.RcptTo[0].Address; want != got {
+		t.Errorf("Want RcptTo %q, got %q", want, got)
+	}
+	if want, got := "jösé@example.com", en.MailFrom.Address; want != got {
+		t.Errorf("Want mail to be from %q, got %q", want, got)
+	}
+
+	msg := bodyString(t, en.Data)
+	if !strings.Contains(msg, "\nFrom: <jösé@example.com>\n") {
+		t.Errorf("Could not find From: header in message %q", msg)
+	}
+	if !strings.Contains(msg, "\nSubject: =?utf-8?q?Gr=C3=BC=C3=9Fe?=\n") {
+		t.Errorf("Could not find modified Subject: header in message %q", msg)
+	}
+}
+
+func TestSendAsSpooled(t *testing.T) {
+	defer func(threshold int) { spoolThreshold = threshold }(spoolThreshold)
+	spoolThreshold = 64
+
+	server, l, conn := setupRelayTest(t)
+	defer l.Close()
+
+	body := strings.Repeat("A long line of the message body.\n", 100)
+	runTableTest(t, conn, []requestResponse{
+		{"MAIL FROM:<mailbox@example.com>", 250, nil},
+		{"RCPT TO:<valid@dest.xyz>", 250, nil},
+		{"DATA", 354, func(t testing.TB, conn *textproto.Conn) {
+			readCodeLine(t, conn, 354)
+
+			ok(t, conn.PrintfLine("From: <mailbox@example.com>"))
+			ok(t, conn.PrintfLine("Subject: Spooled [sendas:source]\n"))
+			ok(t, conn.PrintfLine("%s.", body))
+			readCodeLine(t, conn, 250)
+		}},
+	})
+
+	if want, got := 1, len(server.relayed); want != got {
+		t.Fatalf("Want %d relayed message, got %d", want, got)
+	}
+
+	en := server.relayed[0]
+	if want, got := "source@example.com", en.MailFrom.Address; want != got {
+		t.Errorf("Want mail to be from %q, got %q", want, got)
+	}
+
+	msg := bodyString(t, en.Data)
+	if !strings.Contains(msg, "\nFrom: <source@example.com>\nSubject: Spooled \n\n") {
+		t.Errorf("Could not find modified header in message %q", msg)
+	}
+	if !strings.HasSuffix(msg, "\n\n"+body) {
+		t.Errorf("Message body was not relayed intact: %q", msg)
+	}
+}
+
+func TestBodyType(t *testing.T) {
+	server, l, conn := setupRelayTest(t)
+	defer l.Close()
+
+	runTableTest(t, conn, []requestResponse{
+		{"MAIL FROM:<mailbox@example.com> BODY=BINARY", 501, nil},
+		{"MAIL FROM:<mailbox@example.com> BODY=BINARYMIME", 250, nil},
+		{"RCPT TO:<valid@dest.xyz>", 250, nil},
+		// A binary message must be sent with BDAT.
+		{"DATA", 503, nil},
+		{"RSET", 250, nil},
+		{"MAIL FROM:<mailbox@example.com> BODY=8bitmime", 250, nil},
+		{"RCPT TO:<valid@dest.xyz>", 250, nil},
+		{"DATA", 354, func(t testing.TB, conn *textproto.Conn) {
+			readCodeLine(t, conn, 354)
+			ok(t, conn.PrintfLine("Subject: caf\xc3\xa9\n"))
+			ok(t, conn.PrintfLine("."))
+			readCodeLine(t, conn, 250)
+		}},
+		{"MAIL FROM:<mailbox@example.com> BODY=7BIT", 250, nil},
+		{"RCPT TO:<valid@dest.xyz>", 250, nil},
+		{"DATA", 354, func(t testing.TB, conn *textproto.Conn) {
+			readCodeLine(t, conn, 354)
+			ok(t, conn.PrintfLine("Subject: cafe\n"))
+			ok(t, conn.PrintfLine("."))
+			readCodeLine(t, conn, 250)
+		}},
+	})
+
+	if want, got := 2, len(server.relayed); want != got {
+		t.Fatalf("Want %d relayed messages, got %d", want, got)
+	}
+	if want, got := BodyType8BitMIME, server.relayed[0].BodyType; want != got {
+		t.Errorf("Want body type %q, got %q", want, got)
+	}
+	if want, got := BodyType7Bit, server.relayed[1].BodyType; want != got {
+		t.Errorf("Want body type %q, got %q", want, got)
+	}
+}
+
+// writeChunk sends |chunk| with a BDAT command.
+func writeChunk(t testing.TB, conn *textproto.Conn, chunk string, last bool) {
+	cmd := fmt.Sprintf("BDAT %d", len(chunk))
+	if last {
+		cmd += " LAST"
+	}
+	_, err := conn.W.WriteString(cmd + "\r\n" + chunk)
+	ok(t, err)
+	ok(t, conn.W.Flush())
+}
+
+func TestBDAT(t *testing.T) {
+	s := &deliveryServer{
+		testServer: testServer{domain: "foo.com"},
+	}
+	l := runServer(t, s)
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	runTableTest(t, conn, []requestResponse{
+		{"EHLO test", 0, func(t testing.TB, conn *textproto.Conn) { conn.ReadResponse(250) }},
+		{"MAIL FROM:<sender@bar.com> BODY=BINARYMIME", 250, nil},
+	})
+
+	// A chunk before any recipient is still read.
+	writeChunk(t, conn, "RSET\r\n", false)
+	readCodeLine(t, conn, 503)
+
+	ok(t, conn.PrintfLine("RCPT TO:<receive@foo.com>"))
+	readCodeLine(t, conn, 250)
+
+	writeChunk(t, conn, "Subject: chunked\r\n\r\n", false)
+	if want, got := "2.0.0 20 octets received", readCodeLine(t, conn, 250); want != got {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+	writeChunk(t, conn, "", false)
+	readCodeLine(t, conn, 250)
+
+	// Commands other than BDAT are out of sequence until the last chunk.
+	runTableTest(t, conn, []requestResponse{
+		{"DATA", 503, nil},
+		{"RCPT TO:<other@foo.com>", 503, nil},
+	})
+
+	body := "Hello\r\n.\r\nbinary \x00\xff"
+	writeChunk(t, conn, body, true)
+	readCodeLine(t, conn, 250)
+
+	runTableTest(t, conn, []requestResponse{
+		{"BDAT 0 LAST", 503, nil},
+		{"BDAT 10 NOTLAST", 501, nil},
+		{"QUIT", 221, nil},
+	})
+
+	if want, got := 1, len(s.messages); want != got {
+		t.Fatalf("Want %d message to be delivered, got %d", want, got)
+	}
+	env := s.messages[0]
+	if want, got := BodyTypeBinaryMIME, env.BodyType; want != got {
+		t.Errorf("Want body type %q, got %q", want, got)
+	}
+	msg := bodyString(t, env.Data)
+	if !strings.HasPrefix(msg, "Received: from test") {
+		t.Errorf("Message does not have a Received trace: %q", msg)
+	}
+	if want := "\r\nSubject: chunked\r\n\r\n" + body; !strings.HasSuffix(msg, want) {
+		t.Errorf("Want message to end with %q, got %q", want, msg)
+	}
+}
+
+func TestBDATTooLarge(t *testing.T) {
+	s := &deliveryServer{
+		testServer: testServer{
+			domain:   "foo.com",
+			maxSizes: map[string]int64{"": 100},
+		},
+	}
+	l := runServer(t, s)
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	runTableTest(t, conn, []requestResponse{
+		{"EHLO test", 0, func(t testing.TB, conn *textproto.Conn) { conn.ReadResponse(250) }},
+		{"MAIL FROM:<sender@bar.com>", 250, nil},
+		{"RCPT TO:<receive@foo.com>", 250, nil},
+	})
+
+	writeChunk(t, conn, strings.Repeat("a", 60), false)
+	readCodeLine(t, conn, 250)
+	writeChunk(t, conn, strings.Repeat("b", 60), true)
+	if want, got := "5.3.4 message size exceeds fixed maximum message size", readCodeLine(t, conn, 552); want != got {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+
+	// The transaction was aborted and the rest of the chunk was drained.
+	runTableTest(t, conn, []requestResponse{
+		{"RCPT TO:<receive@foo.com>", 503, nil},
+		{"MAIL FROM:<sender@bar.com>", 250, nil},
+		{"RCPT TO:<receive@foo.com>", 250, nil},
+	})
+	writeChunk(t, conn, strings.Repeat("c", 100), true)
+	readCodeLine(t, conn, 250)
+
+	if want, got := 1, len(s.messages); want != got {
+		t.Fatalf("Want %d message to be delivered, got %d", want, got)
+	}
+}
+
+func TestBDATPipelined(t *testing.T) {
+	s := &deliveryServer{
+		testServer: testServer{domain: "foo.com"},
+	}
+	l := runServer(t, s)
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	ok(t, conn.PrintfLine("EHLO test\r\n"+
+		"MAIL FROM:<smith@bar.com>\r\n"+
+		"RCPT TO:<jones@foo.com>\r\n"+
+		"BDAT 18\r\nSubject: a\r\n\r\nHi\r\n"+
+		"BDAT 7 LAST\r\nthere\r\n"+
+		"QUIT"))
+
+	_, _, err := conn.ReadResponse(250)
+	ok(t, err)
+	readCodeLine(t, conn, 250)
+	readCodeLine(t, conn, 250)
+	readCodeLine(t, conn, 250)
+	readCodeLine(t, conn, 250)
+	readCodeLine(t, conn, 221)
+
+	if want, got := 1, len(s.messages); want != got {
+		t.Fatalf("Want %d message to be delivered, got %d", want, got)
+	}
+	if want, got := "Subject: a\r\n\r\nHi\r\nthere\r\n", bodyString(t, s.messages[0].Data); !strings.HasSuffix(got, want) {
+		t.Errorf("Want message to end with %q, got %q", want, got)
+	}
+}
+
+func TestDSNParameters(t *testing.T) {
+	server, l, conn := setupRelayTest(t)
+	defer l.Close()
+
+	runTableTest(t, conn, []requestResponse{
+		{"MAIL FROM:<mailbox@example.com> RET=ALL", 501, nil},
+		{"MAIL FROM:<mailbox@example.com> ENVID=a=b", 501, nil},
+		{"MAIL FROM:<mailbox@example.com> ENVID=" + strings.Repeat("x", 101), 501, nil},
+		{"MAIL FROM:<mailbox@example.com> RET=hdrs ENVID=QQ+2B314159", 250, nil},
+		{"RCPT TO:<a@dest.xyz> NOTIFY=NEVER,SUCCESS", 501, nil},
+		{"RCPT TO:<a@dest.xyz> NOTIFY=SOMETIMES", 501, nil},
+		{"RCPT TO:<a@dest.xyz> ORCPT=user@dest.xyz", 501, nil},
+		{"RCPT TO:<a@dest.xyz> NOTIFY=success,delay ORCPT=rfc822;Alias+40dest.xyz", 250, nil},
+		{"RCPT TO:<b@dest.xyz>", 250, nil},
+		{"DATA", 354, func(t testing.TB, conn *textproto.Conn) {
+			readCodeLine(t, conn, 354)
+			ok(t, conn.PrintfLine("Subject: dsn\n"))
+			ok(t, conn.PrintfLine("."))
+			readCodeLine(t, conn, 250)
+		}},
+	})
+
+	if want, got := 1, len(server.relayed); want != got {
+		t.Fatalf("Want %d relayed message, got %d", want, got)
+	}
+	en := server.relayed[0]
+	if want, got := DSNReturnHeaders, en.DSNReturn; want != got {
+		t.Errorf("Want RET %q, got %q", want, got)
+	}
+	if want, got := "QQ+314159", en.EnvelopeID; want != got {
+		t.Errorf("Want ENVID %q, got %q", want, got)
+	}
+	want := map[string]RecipientDSN{
+		"a@dest.xyz": {
+			Notify:            []string{NotifySuccess, NotifyDelay},
+			OriginalRecipient: "rfc822;Alias@dest.xyz",
+		},
+	}
+	if got := en.RcptDSN; !reflect.DeepEqual(want, got) {
+		t.Errorf("Want recipient DSN parameters %v, got %v", want, got)
+	}
+}
+
+func TestDSNDelivered(t *testing.T) {
+	s := &deliveryServer{
+		testServer: testServer{domain: "foo.com"},
+	}
+	l := runServer(t, s)
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	runTableTest(t, conn, []requestResponse{
+		{"EHLO test", 0, func(t testing.TB, conn *textproto.Conn) { conn.ReadResponse(250) }},
+		{"MAIL FROM:<sender@bar.com> RET=FULL ENVID=abc", 250, nil},
+		{"RCPT TO:<receive@foo.com> NOTIFY=SUCCESS", 250, nil},
+		{"RCPT TO:<other@foo.com>", 250, nil},
+		{"DATA", 354, func(t testing.TB, conn *textproto.Conn) {
+			readCodeLine(t, conn, 354)
+			ok(t, conn.PrintfLine("Subject: delivered\n\nBody"))
+			ok(t, conn.PrintfLine("."))
+			readCodeLine(t, conn, 250)
+		}},
+		{"QUIT", 221, nil},
+	})
+
+	if want, got := 1, len(s.messages); want != got {
+		t.Fatalf("Want %d delivered message, got %d", want, got)
+	}
+	if want, got := 1, len(s.relayed); want != got {
+		t.Fatalf("Want %d notification to be relayed, got %d", want, got)
+	}
+	notice := s.relayed[0]
+	if want, got := "sender@bar.com", notice.RcptTo[0].Address; want != got {
+		t.Errorf("Want notification to %q, got %q", want, got)
+	}
+	// The notification has the null reverse-path, and does not return the
+	// message to the unverified sender despite RET=FULL.
+	if want, got := "", notice.MailFrom.Address; want != got {
+		t.Errorf("Want notification from %q, got %q", want, got)
+	}
+	dsn := bodyString(t, notice.Data)
+	if want := "From: \"mailpopbox\" <mailbox@foo.com>\n"; !strings.HasPrefix(dsn, want) {
+		t.Errorf("Want notification to start with %q, got %q", want, dsn)
+	}
+	if !strings.Contains(dsn, "text/rfc822-headers") || strings.Contains(dsn, "Body") {
+		t.Errorf("Notification returns more than the header: %q", dsn)
+	}
+	if want := "\nFinal-Recipient: rfc822; receive@foo.com\nAction: delivered\nStatus: 2.0.0\n"; !strings.Contains(dsn, want) {
+		t.Errorf("Missing %q in %q", want, dsn)
+	}
+	if strings.Contains(dsn, "other@foo.com") {
+		t.Errorf("Notification reports a recipient that did not ask for it: %q", dsn)
+	}
+}
+
 func TestSendMultipleRelay(t *testing.T) {
 	server, l, conn := setupRelayTest(t)
 	defer l.Close()
@@ -593,7 +1432,7 @@ func TestSendMultipleRelay(t *testing.T) {
 		t.Errorf("Unexpected RcptTo %q", got)
 	}
 
-	msg := string(en.Data)
+	msg := bodyString(t, en.Data)
 
 	if strings.Index(msg, original) != -1 {
 		t.Errorf("Should not find %q in message %q", original, msg)
@@ -607,3 +1446,88 @@ func TestSendMultipleRelay(t *testing.T) {
 		t.Errorf("Could not find modified Subject: header in message %q", msg)
 	}
 }
+
+type spfServer struct {
+	testServer
+	result    spf.Result
+	reject    map[string]bool
+	delivered []Envelope
+}
+
+func (s *spfServer) CheckSender(remoteAddr net.Addr, ehlo string, mailFrom mail.Address) *spf.Check {
+	return &spf.Check{
+		Result:   s.result,
+		Identity: "mailfrom",
+		Sender:   mailFrom.Address,
+		Domain:   DomainForAddress(mailFrom),
+		IP:       net.IPv4(127, 0, 0, 1),
+		HELO:     ehlo,
+	}
+}
+
+func (s *spfServer) RejectSPFFailure(rcpt mail.Address) bool {
+	return s.reject[DomainForAddress(rcpt)]
+}
+
+func (s *spfServer) DeliverMessage(en Envelope) *ReplyLine {
+	s.delivered = append(s.delivered, en)
+	return nil
+}
+
+func TestSPFReject(t *testing.T) {
+	s := &spfServer{
+		testServer: testServer{domain: "example.com"},
+		result:     spf.ResultFail,
+		reject:     map[string]bool{"example.com": true},
+	}
+	l := runServer(t, s)
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	runTableTest(t, conn, []requestResponse{
+		{"EHLO client.net", 0, func(t testing.TB, conn *textproto.Conn) { conn.ReadResponse(250) }},
+		{"MAIL FROM:<spoof@bank.net>", 250, nil},
+		{"RCPT TO:<victim@example.com>", 550, nil},
+		{"DATA", 503, nil},
+		{"QUIT", 221, nil},
+	})
+
+	if len(s.delivered) != 0 {
+		t.Errorf("Message should not have been delivered")
+	}
+}
+
+func TestSPFAnnotate(t *testing.T) {
+	s := &spfServer{
+		testServer: testServer{domain: "example.com"},
+		result:     spf.ResultFail,
+	}
+	l := runServer(t, s)
+	defer l.Close()
+
+	conn := createClient(t, l.Addr())
+	readCodeLine(t, conn, 220)
+
+	runTableTest(t, conn, []requestResponse{
+		{"EHLO client.net", 0, func(t testing.TB, conn *textproto.Conn) { conn.ReadResponse(250) }},
+		{"MAIL FROM:<spoof@bank.net>", 250, nil},
+		{"RCPT TO:<victim@example.com>", 250, nil},
+		{"DATA", 354, nil},
+		{"Subject: Hi\r\n\r\nHello\r\n.", 250, nil},
+		{"QUIT", 221, nil},
+	})
+
+	if len(s.delivered) != 1 {
+		t.Fatalf("Expected 1 delivered message, got %d", len(s.delivered))
+	}
+	en := s.delivered[0]
+	if en.SPF == nil || en.SPF.Result != spf.ResultFail {
+		t.Errorf("Envelope does not have SPF result: %v", en.SPF)
+	}
+	want := "Received-SPF: fail (Test-Server: domain of spoof@bank.net does not designate 127.0.0.1 as permitted sender) client-ip=127.0.0.1;"
+	if !strings.HasPrefix(bodyString(t, en.Data), want) {
+		t.Errorf("Message does not start with Received-SPF, got %q", bodyString(t, en.Data))
+	}
+}
@@ -0,0 +1,374 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package smtp
+
+import (
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// The actions that are reported for a recipient in a delivery status
+// notification (RFC 3464 § 2.3.3).
+const (
+	dsnActionFailed    = "failed"
+	dsnActionDelayed   = "delayed"
+	dsnActionDelivered = "delivered"
+	dsnActionRelayed   = "relayed"
+)
+
+// maxEnvelopeIDLength is the longest ENVID parameter that is accepted (RFC
+// 3461 § 4.4).
+const maxEnvelopeIDLength = 100
+
+var errInvalidXtext = errors.New("invalid xtext")
+
+// statusCodePattern matches an RFC 3463 enhanced status code.
+var statusCodePattern = regexp.MustCompile(`^[245]\.[0-9]{1,3}\.[0-9]{1,3}$`)
+
+// decodeXtext decodes |s| from the xtext encoding of DSN parameters, in which
+// a character is written as "+" and two hexadecimal digits (RFC 3461 § 4).
+// The decoded value must be printable ASCII.
+func decodeXtext(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < '!' || c > '~' || c == '=' {
+			return "", errInvalidXtext
+		}
+		if c == '+' {
+			if i+2 >= len(s) {
+				return "", errInvalidXtext
+			}
+			v, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+			if err != nil || v < ' ' || v > '~' {
+				return "", errInvalidXtext
+			}
+			c = byte(v)
+			i += 2
+		}
+		b.WriteByte(c)
+	}
+	return b.String(), nil
+}
+
+// parseNotify parses the NOTIFY parameter of RCPT TO, which is either NEVER
+// or a list of the events to report.
+func parseNotify(value string) ([]string, bool) {
+	notify := strings.Split(strings.ToUpper(value), ",")
+	for _, n := range notify {
+		switch n {
+		case NotifySuccess, NotifyFailure, NotifyDelay:
+		case NotifyNever:
+			if len(notify) != 1 {
+				return nil, false
+			}
+		default:
+			return nil, false
+		}
+	}
+	return notify, true
+}
+
+// parseOriginalRecipient parses the ORCPT parameter of RCPT TO, an address
+// type and an xtext-encoded address separated by a semicolon.
+func parseOriginalRecipient(value string) (string, bool) {
+	semi := strings.IndexByte(value, ';')
+	if semi <= 0 {
+		return "", false
+	}
+	addrType := value[:semi]
+	if decoded, err := decodeXtext(addrType); err != nil || decoded != addrType {
+		return "", false
+	}
+	address, err := decodeXtext(value[semi+1:])
+	if err != nil || address == "" {
+		return "", false
+	}
+	return addrType + ";" + address, true
+}
+
+// notifies returns whether the sender of |env| asked to be notified of
+// |event|, one of the NOTIFY values, for the recipient |to|.
+func (env Envelope) notifies(to, event string) bool {
+	notify := env.RcptDSN[to].Notify
+	if len(notify) == 0 {
+		return event == NotifyFailure
+	}
+	for _, n := range notify {
+		if n == event {
+			return true
+		}
+	}
+	return false
+}
+
+// dsnRecipient describes what happened to a message for one recipient, to be
+// reported in a delivery status notification.
+type dsnRecipient struct {
+	to     string
+	action string
+	// errorStr and err describe why delivery failed or was delayed. err is
+	// nil if the message was delivered.
+	errorStr string
+	err      error
+	// status is the RFC 3463 status code of the result.
+	status string
+	// retryUntil is when delivery stops being retried, for a delayed
+	// recipient.
+	retryUntil time.Time
+}
+
+// newRelayFailure creates a failed dsnRecipient for |to| from the relay error
+// |err|.
+func newRelayFailure(to string, err error) dsnRecipient {
+	errorStr, sendErr := relayFailureDetails(err)
+	return dsnRecipient{
+		to:       to,
+		action:   dsnActionFailed,
+		errorStr: errorStr,
+		err:      sendErr,
+		status:   relayStatus(err),
+	}
+}
+
+// newRelayDelay creates a delayed dsnRecipient for |to| from the temporary
+// relay error |err|. Delivery is retried until |retryUntil|.
+func newRelayDelay(to string, err error, retryUntil time.Time) dsnRecipient {
+	r := newRelayFailure(to, err)
+	r.action = dsnActionDelayed
+	r.retryUntil = retryUntil
+	return r
+}
+
+// newRelaySuccess creates a dsnRecipient for |to| once the message has been
+// relayed. The DSN parameters are not passed on to the next host, so the
+// message is reported as relayed rather than delivered.
+func newRelaySuccess(to string) dsnRecipient {
+	return dsnRecipient{
+		to:     to,
+		action: dsnActionRelayed,
+		status: "2.0.0",
+	}
+}
+
+// event returns the NOTIFY value for which the result is reported.
+func (r dsnRecipient) event() string {
+	switch r.action {
+	case dsnActionFailed:
+		return NotifyFailure
+	case dsnActionDelayed:
+		return NotifyDelay
+	}
+	return NotifySuccess
+}
+
+// relayStatus returns the RFC 3463 status code of the relay error |err|. This
+// is the enhanced status code of the remote server's reply, if it gave one.
+func relayStatus(err error) string {
+	class := "4"
+	if isPermanentRelayError(err) {
+		class = "5"
+	}
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		fields := strings.Fields(tpErr.Msg)
+		if len(fields) > 0 && statusCodePattern.MatchString(fields[0]) && fields[0][:1] == class {
+			return fields[0]
+		}
+	}
+	return class + ".0.0"
+}
+
+// diagnosticCode returns the Diagnostic-Code of a DSN for |err|, which is the
+// reply of the remote server if there was one.
+func diagnosticCode(err error) string {
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		return fmt.Sprintf("smtp; %d %s", tpErr.Code, strings.Join(strings.Fields(tpErr.Msg), " "))
+	}
+	return "X-mailpopbox; " + strings.Join(strings.Fields(err.Error()), " ")
+}
+
+// deliverStatusNotification logs each of the failed |rcpts| to |log|, and
+// delivers a delivery status notification to the sender of |env|, through
+// |server|, for the results that the sender asked to be notified of.
+func deliverStatusNotification(server Server, env Envelope, log *zap.Logger, rcpts []dsnRecipient) {
+	var notify []dsnRecipient
+	for _, r := range rcpts {
+		if r.action == dsnActionFailed {
+			log.Error(r.errorStr, zap.String("address", r.to), zap.Error(r.err))
+		}
+		if env.notifies(r.to, r.event()) {
+			notify = append(notify, r)
+		}
+	}
+	if len(notify) == 0 {
+		return
+	}
+
+	from := mail.Address{Name: "mailpopbox", Address: "mailbox@" + DomainForAddress(env.MailFrom)}
+	notice, err := newStatusNotification(server.Name(), from, env, notify)
+	if err != nil {
+		log.Error("failed to create delivery status notification", zap.Error(err))
+		return
+	}
+	defer notice.Data.Close()
+	server.DeliverMessage(notice)
+}
+
+// newStatusNotification creates a delivery status notification (RFC 3464)
+// from |from| to the sender of |env|, with the null reverse-path that DSNs
+// must have (RFC 3461 § 6.2), that reports the results of delivering
+// it to |rcpts|. The notification is reported by |reportingMTA|.
+func newStatusNotification(reportingMTA string, from mail.Address, env Envelope, rcpts []dsnRecipient) (Envelope, error) {
+	var failedRecipients []string
+	delayed := false
+	for _, r := range rcpts {
+		switch r.action {
+		case dsnActionFailed:
+			failedRecipients = append(failedRecipients, r.to)
+		case dsnActionDelayed:
+			delayed = true
+		}
+	}
+	kind := "Success"
+	if len(failedRecipients) > 0 {
+		kind = "Failure"
+	} else if delayed {
+		kind = "Delay"
+	}
+
+	// The original message may be large, so the notification is spooled like
+	// a received message.
+	buf := &bodyWriter{}
+	mw := multipart.NewWriter(buf)
+
+	now := time.Now()
+
+	notice := Envelope{
+		RcptTo:   []mail.Address{env.MailFrom},
+		ID:       generateEnvelopeId("f", now),
+		Received: now,
+	}
+
+	fmt.Fprintf(buf, "From: %s\n", from.String())
+	fmt.Fprintf(buf, "To: %s\n", notice.RcptTo[0].String())
+	fmt.Fprintf(buf, "Subject: Delivery Status Notification (%s)\n", kind)
+	if len(failedRecipients) > 0 {
+		fmt.Fprintf(buf, "X-Failed-Recipients: %s\n", strings.Join(failedRecipients, ", "))
+	}
+	fmt.Fprintf(buf, "Message-ID: %s\n", notice.ID)
+	fmt.Fprintf(buf, "Date: %s\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(buf, "Content-Type: multipart/report; boundary=%s; report-type=delivery-status\n\n", mw.Boundary())
+
+	tw, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": []string{"text/plain; charset=UTF-8"},
+	})
+	if err != nil {
+		buf.discard()
+		return notice, err
+	}
+	fmt.Fprintf(tw, "* * * Delivery %s * * *\n", kind)
+	groups := []struct {
+		action, intro string
+	}{
+		{dsnActionFailed, "The server failed to relay the message to the following recipients:"},
+		{dsnActionDelayed, "The server has not yet relayed the message to the following recipients, and will keep trying:"},
+		{dsnActionRelayed, "The server relayed the message to the following recipients:"},
+		{dsnActionDelivered, "The message was delivered to the following recipients:"},
+	}
+	for _, group := range groups {
+		intro := group.intro
+		for _, r := range rcpts {
+			if r.action != group.action {
+				continue
+			}
+			if intro != "" {
+				fmt.Fprintf(tw, "\n%s\n", intro)
+				intro = ""
+			}
+			if r.err != nil {
+				fmt.Fprintf(tw, "\n%s\n%s:\n%s\n", r.to, r.errorStr, r.err.Error())
+			} else {
+				fmt.Fprintf(tw, "\n%s\n", r.to)
+			}
+		}
+	}
+
+	sw, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": []string{"message/delivery-status"},
+	})
+	if err != nil {
+		buf.discard()
+		return notice, err
+	}
+	if env.EnvelopeID != "" {
+		fmt.Fprintf(sw, "Original-Envelope-Id: %s\n", env.EnvelopeID)
+	}
+	fmt.Fprintf(sw, "Reporting-MTA: dns; %s\n", reportingMTA)
+	if env.EHLO != "" {
+		fmt.Fprintf(sw, "Received-From-MTA: dns; %s\n", env.EHLO)
+	}
+	if !env.Received.IsZero() {
+		fmt.Fprintf(sw, "Arrival-Date: %s\n", env.Received.Format(time.RFC1123Z))
+	}
+	for _, r := range rcpts {
+		fmt.Fprintf(sw, "\n")
+		if orcpt := env.RcptDSN[r.to].OriginalRecipient; orcpt != "" {
+			fmt.Fprintf(sw, "Original-Recipient: %s\n", orcpt)
+		}
+		fmt.Fprintf(sw, "Final-Recipient: rfc822; %s\n", r.to)
+		fmt.Fprintf(sw, "Action: %s\n", r.action)
+		fmt.Fprintf(sw, "Status: %s\n", r.status)
+		if r.err != nil {
+			fmt.Fprintf(sw, "Diagnostic-Code: %s\n", diagnosticCode(r.err))
+		}
+		if !r.retryUntil.IsZero() {
+			fmt.Fprintf(sw, "Will-Retry-Until: %s\n", r.retryUntil.Format(time.RFC1123Z))
+		}
+	}
+
+	// The whole message is returned with a failure, unless the sender asked
+	// for only its header. Other notifications only return the header, even
+	// with RET=FULL, so that a forged sender of inbound mail cannot have it
+	// relayed to another address.
+	full := env.DSNReturn != DSNReturnHeaders && len(failedRecipients) > 0
+	contentType := "text/rfc822-headers"
+	if full {
+		contentType = "message/rfc822"
+	}
+	ocw, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": []string{contentType},
+	})
+	if err != nil {
+		buf.discard()
+		return notice, err
+	}
+	if full {
+		_, err = env.Data.WriteTo(ocw)
+	} else {
+		_, err = ocw.Write(env.Data.Header())
+	}
+	if err != nil {
+		buf.discard()
+		return notice, err
+	}
+
+	mw.Close()
+
+	notice.Data, err = buf.body()
+	return notice, err
+}
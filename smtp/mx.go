@@ -0,0 +1,79 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package smtp
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
+const relayDNSTimeout = 30 * time.Second
+
+// Resolver performs the DNS lookups needed to relay mail. It is implemented by
+// *net.Resolver.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
+// lookupRelayHosts returns the hosts that accept mail for |domain|, in the
+// order in which delivery should be attempted. MX records are sorted by
+// preference, with hosts of equal preference randomized (RFC 5321 § 5.1). If
+// the domain has no MX records but has an address record, the domain itself is
+// the implicit MX. A null MX (RFC 7505) is a permanent failure.
+func lookupRelayHosts(resolver Resolver, domain string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), relayDNSTimeout)
+	defer cancel()
+
+	mxs, err := resolver.LookupMX(ctx, domain)
+	if err != nil && !isNotFound(err) {
+		return nil, &relayError{"failed to lookup MX records", err, false}
+	}
+
+	if len(mxs) == 0 {
+		_, err := resolver.LookupHost(ctx, domain)
+		if err != nil {
+			return nil, &relayError{"failed to lookup MX records", err, isNotFound(err)}
+		}
+		return []string{domain}, nil
+	}
+
+	if len(mxs) == 1 && (mxs[0].Host == "." || mxs[0].Host == "") {
+		return nil, &relayError{"failed to lookup MX records",
+			fmt.Errorf("domain %s does not accept mail (null MX)", domain), true}
+	}
+
+	sorted := make([]*net.MX, len(mxs))
+	copy(sorted, mxs)
+	rand.Shuffle(len(sorted), func(i, j int) {
+		sorted[i], sorted[j] = sorted[j], sorted[i]
+	})
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Pref < sorted[j].Pref
+	})
+
+	hosts := make([]string, 0, len(sorted))
+	for _, mx := range sorted {
+		host := strings.TrimSuffix(mx.Host, ".")
+		if host == "" {
+			continue
+		}
+		hosts = append(hosts, host)
+	}
+	return hosts, nil
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
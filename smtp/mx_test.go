@@ -0,0 +1,157 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package smtp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+type testResolver struct {
+	mx    map[string][]*net.MX
+	hosts map[string][]string
+	err   error
+}
+
+func notFound(name string) error {
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *testResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if mx, ok := r.mx[name]; ok {
+		return mx, nil
+	}
+	return nil, notFound(name)
+}
+
+func (r *testResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, notFound(host)
+}
+
+func TestLookupRelayHostsPreference(t *testing.T) {
+	r := &testResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {
+				{Host: "backup.example.com.", Pref: 20},
+				{Host: "primary.example.com.", Pref: 10},
+				{Host: "last.example.com.", Pref: 30},
+			},
+		},
+	}
+
+	hosts, err := lookupRelayHosts(r, "example.com")
+	ok(t, err)
+
+	want := []string{"primary.example.com", "backup.example.com", "last.example.com"}
+	if !reflect.DeepEqual(want, hosts) {
+		t.Errorf("Want hosts %v, got %v", want, hosts)
+	}
+}
+
+func TestLookupRelayHostsEqualPreference(t *testing.T) {
+	r := &testResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {
+				{Host: "a.example.com.", Pref: 10},
+				{Host: "b.example.com.", Pref: 10},
+				{Host: "backup.example.com.", Pref: 20},
+			},
+		},
+	}
+
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		hosts, err := lookupRelayHosts(r, "example.com")
+		ok(t, err)
+		if len(hosts) != 3 {
+			t.Fatalf("Want 3 hosts, got %v", hosts)
+		}
+		if hosts[2] != "backup.example.com" {
+			t.Errorf("Higher preference host should be last, got %v", hosts)
+		}
+		seen[hosts[0]] = true
+	}
+
+	if !seen["a.example.com"] || !seen["b.example.com"] {
+		t.Errorf("Hosts of equal preference were not randomized, first hosts seen: %v", seen)
+	}
+}
+
+func TestLookupRelayHostsImplicitMX(t *testing.T) {
+	r := &testResolver{
+		hosts: map[string][]string{
+			"example.com": {"192.0.2.1"},
+		},
+	}
+
+	hosts, err := lookupRelayHosts(r, "example.com")
+	ok(t, err)
+
+	if want := []string{"example.com"}; !reflect.DeepEqual(want, hosts) {
+		t.Errorf("Want implicit MX %v, got %v", want, hosts)
+	}
+}
+
+func TestLookupRelayHostsNoDomain(t *testing.T) {
+	r := &testResolver{}
+
+	_, err := lookupRelayHosts(r, "nowhere.example")
+	if err == nil {
+		t.Fatalf("Expected error for domain without MX or address records")
+	}
+	if !isPermanentRelayError(err) {
+		t.Errorf("Missing domain should be a permanent failure, got %v", err)
+	}
+}
+
+func TestLookupRelayHostsNullMX(t *testing.T) {
+	r := &testResolver{
+		mx: map[string][]*net.MX{
+			"example.com": {{Host: ".", Pref: 0}},
+		},
+		hosts: map[string][]string{
+			"example.com": {"192.0.2.1"},
+		},
+	}
+
+	_, err := lookupRelayHosts(r, "example.com")
+	if err == nil {
+		t.Fatalf("Expected error for null MX")
+	}
+	if !isPermanentRelayError(err) {
+		t.Errorf("Null MX should be a permanent failure, got %v", err)
+	}
+}
+
+func TestLookupRelayHostsTemporaryError(t *testing.T) {
+	r := &testResolver{
+		err: &net.DNSError{Err: "server misbehaving", Name: "example.com", IsTemporary: true},
+	}
+
+	_, err := lookupRelayHosts(r, "example.com")
+	if err == nil {
+		t.Fatalf("Expected error for failed lookup")
+	}
+	if isPermanentRelayError(err) {
+		t.Errorf("DNS server failure should be temporary, got %v", err)
+	}
+	if !errors.Is(err, r.err) {
+		t.Errorf("Expected error to wrap %v, got %v", r.err, err)
+	}
+}
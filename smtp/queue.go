@@ -0,0 +1,527 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package smtp
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// DefaultQueueLifetime is how long a message is retried before it is returned
+// to the sender. RFC 5321 § 4.5.4.1 recommends at least 4-5 days.
+const DefaultQueueLifetime = 5 * 24 * time.Hour
+
+const (
+	queueMetadataExt = ".json"
+	queueMessageExt  = ".msg"
+
+	queueMinBackoff = 1 * time.Minute
+	queueMaxBackoff = 4 * time.Hour
+
+	// queueWorkers is the number of messages that are relayed at once, so
+	// that a destination that is slow to respond does not hold up the rest
+	// of the queue.
+	queueWorkers = 4
+)
+
+// Queue is a persistent store of outbound messages awaiting relay. Each
+// message is stored on disk as a pair of files: the message data and a JSON
+// metadata file that records the remaining recipients and retry state, so
+// that delivery resumes after a restart. Temporary failures are retried with
+// exponential backoff; permanent failures and messages that exceed the queue
+// lifetime are returned to the sender in a delivery status notification.
+type Queue struct {
+	server   Server
+	dir      string
+	lifetime time.Duration
+	log      *zap.Logger
+
+	minBackoff, maxBackoff time.Duration
+
+	resolver Resolver
+
+	// relay attempts to deliver a message to recipients that share a
+	// domain, returning the result for each. Tests replace it to avoid
+	// network access.
+	relay func(env Envelope, log *zap.Logger, domain string, to []mail.Address) []error
+
+	mu       sync.Mutex
+	messages map[string]*queuedMessage
+
+	// workers limits the number of delivery attempts that run at once.
+	workers chan struct{}
+
+	wake chan struct{}
+}
+
+// queuedMessage is the persisted metadata for a message in the Queue.
+type queuedMessage struct {
+	ID         string
+	RemoteAddr string `json:",omitempty"`
+	EHLO       string
+	MailFrom   mail.Address
+	// RcptTo holds only the recipients that have not yet been delivered to.
+	RcptTo   []mail.Address
+	Received time.Time
+	BodyType string `json:",omitempty"`
+	SMTPUTF8 bool   `json:",omitempty"`
+
+	DSNReturn  string                  `json:",omitempty"`
+	EnvelopeID string                  `json:",omitempty"`
+	RcptDSN    map[string]RecipientDSN `json:",omitempty"`
+
+	Queued      time.Time
+	Attempts    int
+	NextAttempt time.Time
+	// LastErrors maps a recipient address to the most recent error
+	// encountered delivering to it.
+	LastErrors map[string]string `json:",omitempty"`
+	// ReportedDelays holds the recipients for which a delay has already been
+	// reported to the sender, so that it is only reported once.
+	ReportedDelays map[string]bool `json:",omitempty"`
+
+	// attempting is set while a delivery attempt of the message is running.
+	attempting bool
+}
+
+// queuedAddr is a net.Addr that has been restored from its string form.
+type queuedAddr string
+
+func (a queuedAddr) Network() string {
+	return "tcp"
+}
+
+func (a queuedAddr) String() string {
+	return string(a)
+}
+
+// NewQueue creates a Queue that stores messages in |dir|, creating it if
+// necessary, and loads any messages left from a previous run. Messages are
+// relayed on behalf of |server| once Run is called.
+func NewQueue(server Server, dir string, lifetime time.Duration, log *zap.Logger) (*Queue, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	q := &Queue{
+		server:     server,
+		dir:        dir,
+		lifetime:   lifetime,
+		log:        log.With(zap.String("queue", dir)),
+		minBackoff: queueMinBackoff,
+		maxBackoff: queueMaxBackoff,
+		resolver:   net.DefaultResolver,
+		messages:   make(map[string]*queuedMessage),
+		workers:    make(chan struct{}, queueWorkers),
+		wake:       make(chan struct{}, 1),
+	}
+	q.relay = func(env Envelope, log *zap.Logger, domain string, to []mail.Address) []error {
+		return relayToDomain(q.server, q.resolver, env, log, domain, to)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), queueMetadataExt) {
+			continue
+		}
+		m, err := q.readMetadata(filepath.Join(dir, file.Name()))
+		if err != nil {
+			q.log.Error("failed to load queued message", zap.String("file", file.Name()), zap.Error(err))
+			continue
+		}
+		q.messages[m.ID] = m
+	}
+
+	q.log.Info("loaded queue", zap.Int("messages", len(q.messages)))
+
+	return q, nil
+}
+
+// Enqueue persists |env| for relay. Once this returns without error, the
+// Queue is responsible for the message.
+func (q *Queue) Enqueue(env Envelope) error {
+	now := time.Now()
+	m := &queuedMessage{
+		ID:          env.ID,
+		EHLO:        env.EHLO,
+		MailFrom:    env.MailFrom,
+		RcptTo:      env.RcptTo,
+		Received:    env.Received,
+		BodyType:    env.BodyType,
+		SMTPUTF8:    env.SMTPUTF8,
+		DSNReturn:   env.DSNReturn,
+		EnvelopeID:  env.EnvelopeID,
+		RcptDSN:     env.RcptDSN,
+		Queued:      now,
+		NextAttempt: now,
+	}
+	if env.RemoteAddr != nil {
+		m.RemoteAddr = env.RemoteAddr.String()
+	}
+
+	if err := writeBodyFile(q.path(m.ID, queueMessageExt), env.Data); err != nil {
+		os.Remove(q.path(m.ID, queueMessageExt))
+		return err
+	}
+	if err := q.writeMetadata(m); err != nil {
+		os.Remove(q.path(m.ID, queueMessageExt))
+		return err
+	}
+
+	q.mu.Lock()
+	q.messages[m.ID] = m
+	q.mu.Unlock()
+
+	q.log.Info("queued message", zap.String("id", m.ID), zap.Int("recipients", len(m.RcptTo)))
+
+	q.wakeUp()
+	return nil
+}
+
+// Run delivers messages as they become due. It does not return.
+func (q *Queue) Run() {
+	for {
+		q.startDue(time.Now())
+		next := q.nextAttempt()
+
+		var timer <-chan time.Time
+		if !next.IsZero() {
+			timer = time.After(time.Until(next))
+		}
+
+		select {
+		case <-q.wake:
+		case <-timer:
+		}
+	}
+}
+
+// wakeUp causes Run to check the queue for due messages.
+func (q *Queue) wakeUp() {
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// deliverDue attempts delivery of every message whose next attempt is at or
+// before |now| and waits for the attempts to finish. It returns the time at
+// which the next message becomes due, or the zero time if the queue is empty.
+func (q *Queue) deliverDue(now time.Time) time.Time {
+	q.startDue(now).Wait()
+	return q.nextAttempt()
+}
+
+// startDue starts a delivery attempt for every message whose next attempt is
+// at or before |now| and that is not already being attempted. At most
+// queueWorkers attempts run at once. The returned WaitGroup is done when the
+// started attempts have finished.
+func (q *Queue) startDue(now time.Time) *sync.WaitGroup {
+	q.mu.Lock()
+	var due []*queuedMessage
+	for _, m := range q.messages {
+		if !m.attempting && !m.NextAttempt.After(now) {
+			m.attempting = true
+			due = append(due, m)
+		}
+	}
+	q.mu.Unlock()
+
+	wg := &sync.WaitGroup{}
+	for _, m := range due {
+		wg.Add(1)
+		go func(m *queuedMessage) {
+			defer wg.Done()
+
+			q.workers <- struct{}{}
+			q.attempt(m, now)
+			<-q.workers
+
+			q.mu.Lock()
+			m.attempting = false
+			q.mu.Unlock()
+
+			// The message may need to be scheduled again.
+			q.wakeUp()
+		}(m)
+	}
+	return wg
+}
+
+// nextAttempt returns the time at which the next message that is not being
+// attempted becomes due, or the zero time if there is none.
+func (q *Queue) nextAttempt() time.Time {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var next time.Time
+	for _, m := range q.messages {
+		if m.attempting {
+			continue
+		}
+		if next.IsZero() || m.NextAttempt.Before(next) {
+			next = m.NextAttempt
+		}
+	}
+	return next
+}
+
+// attempt tries to deliver |m| to all of its remaining recipients and then
+// either removes it from the queue or schedules the next attempt.
+func (q *Queue) attempt(m *queuedMessage, now time.Time) {
+	log := q.log.With(zap.String("id", m.ID))
+
+	env, err := q.loadEnvelope(m)
+	if err != nil {
+		log.Error("failed to read queued message", zap.Error(err))
+		q.deferUnreadable(m, env, log, now, err)
+		return
+	}
+	defer env.Data.Close()
+
+	m.Attempts++
+	if m.LastErrors == nil {
+		m.LastErrors = make(map[string]string)
+	}
+
+	expired := now.Sub(m.Queued) >= q.lifetime
+	retryUntil := m.Queued.Add(q.lifetime)
+
+	var remaining []mail.Address
+	var reports []dsnRecipient
+	for _, domain := range groupByDomain(m.RcptTo) {
+		domainLog := log.With(zap.String("domain", domain.name))
+		results := q.relay(env, domainLog, domain.name, domain.rcpts)
+		for i, rcpt := range domain.rcpts {
+			err := results[i]
+			if err == nil {
+				delete(m.LastErrors, rcpt.Address)
+				reports = append(reports, newRelaySuccess(rcpt.Address))
+				continue
+			}
+
+			if isPermanentRelayError(err) {
+				reports = append(reports, newRelayFailure(rcpt.Address, err))
+				delete(m.LastErrors, rcpt.Address)
+				continue
+			}
+
+			domainLog.Warn("temporary relay failure",
+				zap.String("address", rcpt.Address),
+				zap.Int("attempt", m.Attempts),
+				zap.Error(err))
+
+			if expired {
+				reports = append(reports, dsnRecipient{
+					to:       rcpt.Address,
+					action:   dsnActionFailed,
+					errorStr: fmt.Sprintf("message expired after %d attempts", m.Attempts),
+					err:      err,
+					status:   "4.4.7",
+				})
+				delete(m.LastErrors, rcpt.Address)
+				continue
+			}
+
+			m.LastErrors[rcpt.Address] = err.Error()
+			remaining = append(remaining, rcpt)
+
+			if !m.ReportedDelays[rcpt.Address] {
+				if m.ReportedDelays == nil {
+					m.ReportedDelays = make(map[string]bool)
+				}
+				m.ReportedDelays[rcpt.Address] = true
+				reports = append(reports, newRelayDelay(rcpt.Address, err, retryUntil))
+			}
+		}
+	}
+
+	if len(reports) > 0 {
+		deliverStatusNotification(q.server, env, log, reports)
+	}
+
+	if len(remaining) == 0 {
+		q.remove(m)
+		return
+	}
+
+	q.mu.Lock()
+	m.RcptTo = remaining
+	m.NextAttempt = now.Add(q.backoff(m.Attempts))
+	q.mu.Unlock()
+
+	if err := q.writeMetadata(m); err != nil {
+		log.Error("failed to update queued message", zap.Error(err))
+	}
+	log.Info("deferred message", zap.Time("next-attempt", m.NextAttempt))
+}
+
+// deferUnreadable handles an attempt to deliver |m|, whose message could not
+// be read because of |err|, as a temporary failure for all of its recipients.
+// It is kept in the queue, in case it can be read again, until it expires and
+// is returned to the sender of |env| without its content.
+func (q *Queue) deferUnreadable(m *queuedMessage, env Envelope, log *zap.Logger, now time.Time, err error) {
+	m.Attempts++
+
+	if now.Sub(m.Queued) >= q.lifetime {
+		var reports []dsnRecipient
+		for _, rcpt := range m.RcptTo {
+			reports = append(reports, dsnRecipient{
+				to:       rcpt.Address,
+				action:   dsnActionFailed,
+				errorStr: fmt.Sprintf("message expired after %d attempts", m.Attempts),
+				err:      err,
+				status:   "4.4.7",
+			})
+		}
+		deliverStatusNotification(q.server, env, log, reports)
+		q.remove(m)
+		return
+	}
+
+	q.mu.Lock()
+	m.NextAttempt = now.Add(q.backoff(m.Attempts))
+	q.mu.Unlock()
+
+	if err := q.writeMetadata(m); err != nil {
+		log.Error("failed to update queued message", zap.Error(err))
+	}
+	log.Info("deferred message", zap.Time("next-attempt", m.NextAttempt))
+}
+
+// domainRecipients is a group of recipients that share a domain.
+type domainRecipients struct {
+	name  string
+	rcpts []mail.Address
+}
+
+// groupByDomain groups |rcpts| by domain, so that each domain can be relayed
+// to in a single SMTP transaction. Groups are returned in the order in which
+// their domain first appears.
+func groupByDomain(rcpts []mail.Address) []*domainRecipients {
+	var groups []*domainRecipients
+	byName := make(map[string]*domainRecipients)
+	for _, rcpt := range rcpts {
+		name := strings.ToLower(DomainForAddress(rcpt))
+		group, ok := byName[name]
+		if !ok {
+			group = &domainRecipients{name: name}
+			byName[name] = group
+			groups = append(groups, group)
+		}
+		group.rcpts = append(group.rcpts, rcpt)
+	}
+	return groups
+}
+
+// backoff returns the delay before the next delivery attempt, given the number
+// of |attempts| already made.
+func (q *Queue) backoff(attempts int) time.Duration {
+	d := q.minBackoff
+	for i := 1; i < attempts && d < q.maxBackoff; i++ {
+		d *= 2
+	}
+	if d > q.maxBackoff {
+		d = q.maxBackoff
+	}
+	return d
+}
+
+func (q *Queue) remove(m *queuedMessage) {
+	q.mu.Lock()
+	delete(q.messages, m.ID)
+	q.mu.Unlock()
+
+	os.Remove(q.path(m.ID, queueMetadataExt))
+	os.Remove(q.path(m.ID, queueMessageExt))
+}
+
+// loadEnvelope restores the Envelope of |m| and opens its message. If the
+// message cannot be opened, the Envelope is returned without its Data.
+func (q *Queue) loadEnvelope(m *queuedMessage) (Envelope, error) {
+	env := Envelope{
+		EHLO:     m.EHLO,
+		MailFrom: m.MailFrom,
+		RcptTo:   m.RcptTo,
+		Received: m.Received,
+		ID:       m.ID,
+		BodyType: m.BodyType,
+		SMTPUTF8: m.SMTPUTF8,
+
+		DSNReturn:  m.DSNReturn,
+		EnvelopeID: m.EnvelopeID,
+		RcptDSN:    m.RcptDSN,
+	}
+	if m.RemoteAddr != "" {
+		env.RemoteAddr = queuedAddr(m.RemoteAddr)
+	}
+	var err error
+	env.Data, err = OpenBody(q.path(m.ID, queueMessageExt))
+	return env, err
+}
+
+// writeBodyFile writes the message |body| to the file at |path|.
+func writeBodyFile(path string, body *Body) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := body.WriteTo(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (q *Queue) readMetadata(filename string) (*queuedMessage, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	m := &queuedMessage{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, err
+	}
+	if m.ID == "" {
+		return nil, errors.New("missing message ID")
+	}
+	return m, nil
+}
+
+// writeMetadata atomically replaces the metadata file for |m|.
+func (q *Queue) writeMetadata(m *queuedMessage) error {
+	q.mu.Lock()
+	data, err := json.Marshal(m)
+	q.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := q.path(m.ID, queueMetadataExt+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.path(m.ID, queueMetadataExt))
+}
+
+func (q *Queue) path(id, ext string) string {
+	return filepath.Join(q.dir, id+ext)
+}
@@ -0,0 +1,514 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package smtp
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/mail"
+	"net/textproto"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// fakeRelay records relay attempts and returns the next queued result for
+// each recipient address.
+type fakeRelay struct {
+	mu       sync.Mutex
+	results  map[string][]error
+	attempts map[string]int
+	// transactions records the recipients of each relay call.
+	transactions [][]string
+}
+
+func newFakeRelay() *fakeRelay {
+	return &fakeRelay{
+		results:  make(map[string][]error),
+		attempts: make(map[string]int),
+	}
+}
+
+func (r *fakeRelay) relay(env Envelope, log *zap.Logger, domain string, to []mail.Address) []error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	errs := make([]error, len(to))
+	var txn []string
+	for i, rcpt := range to {
+		txn = append(txn, rcpt.Address)
+		r.attempts[rcpt.Address]++
+		results := r.results[rcpt.Address]
+		if len(results) == 0 {
+			continue
+		}
+		r.results[rcpt.Address] = results[1:]
+		errs[i] = results[0]
+	}
+	r.transactions = append(r.transactions, txn)
+	return errs
+}
+
+var (
+	errTempFailure = newRelayError("failed to RCPT TO", &textproto.Error{Code: 451, Msg: "greylisted"})
+	errPermFailure = newRelayError("failed to RCPT TO", &textproto.Error{Code: 550, Msg: "no such user"})
+)
+
+func newTestQueue(t *testing.T, dir string, server Server, relay *fakeRelay) *Queue {
+	q, err := NewQueue(server, dir, time.Hour, zap.NewNop())
+	if err != nil {
+		t.Fatalf("Failed to create queue: %v", err)
+	}
+	q.relay = relay.relay
+	return q
+}
+
+func queueTestEnvelope(rcpts ...string) Envelope {
+	env := Envelope{
+		MailFrom: mail.Address{Address: "mailbox@example.com"},
+		Data:     NewBody([]byte("Subject: queued\n\nHello\n")),
+		ID:       "m.queued",
+		Received: time.Now(),
+	}
+	for _, rcpt := range rcpts {
+		env.RcptTo = append(env.RcptTo, mail.Address{Address: rcpt})
+	}
+	return env
+}
+
+func queueFiles(t *testing.T, dir string) []string {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(files))
+	for i, f := range files {
+		names[i] = f.Name()
+	}
+	return names
+}
+
+func TestQueueDeliverImmediately(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	server := &deliveryServer{}
+	relay := newFakeRelay()
+	q := newTestQueue(t, dir, server, relay)
+
+	ok(t, q.Enqueue(queueTestEnvelope("a@dest.net", "b@dest.net")))
+	if want, got := 2, len(queueFiles(t, dir)); want != got {
+		t.Errorf("Want %d queue files, got %d", want, got)
+	}
+
+	if next := q.deliverDue(time.Now()); !next.IsZero() {
+		t.Errorf("Expected queue to be empty, next attempt at %v", next)
+	}
+
+	if want, got := 1, relay.attempts["a@dest.net"]; want != got {
+		t.Errorf("Want %d attempts, got %d", want, got)
+	}
+	if want, got := 1, relay.attempts["b@dest.net"]; want != got {
+		t.Errorf("Want %d attempts, got %d", want, got)
+	}
+	if files := queueFiles(t, dir); len(files) != 0 {
+		t.Errorf("Expected queue directory to be empty, got %v", files)
+	}
+	if want, got := 0, len(server.messages); want != got {
+		t.Errorf("Want %d failure notifications, got %d", want, got)
+	}
+}
+
+func TestQueueRetryTemporaryFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	server := &deliveryServer{}
+	relay := newFakeRelay()
+	relay.results["a@dest.net"] = []error{errTempFailure, errTempFailure}
+	q := newTestQueue(t, dir, server, relay)
+
+	ok(t, q.Enqueue(queueTestEnvelope("a@dest.net", "b@dest.net")))
+
+	now := time.Now()
+	next := q.deliverDue(now)
+	if want, got := now.Add(q.minBackoff), next; !want.Equal(got) {
+		t.Errorf("Want next attempt at %v, got %v", want, got)
+	}
+
+	// Nothing is due before the backoff expires.
+	q.deliverDue(now.Add(q.minBackoff / 2))
+	if want, got := 1, relay.attempts["a@dest.net"]; want != got {
+		t.Errorf("Want %d attempts, got %d", want, got)
+	}
+
+	now = next
+	next = q.deliverDue(now)
+	if want, got := now.Add(2*q.minBackoff), next; !want.Equal(got) {
+		t.Errorf("Want exponential backoff to %v, got %v", want, got)
+	}
+
+	q.deliverDue(next)
+
+	if want, got := 3, relay.attempts["a@dest.net"]; want != got {
+		t.Errorf("Want %d attempts, got %d", want, got)
+	}
+	if want, got := 1, relay.attempts["b@dest.net"]; want != got {
+		t.Errorf("Delivered recipient should not be retried, got %d attempts", got)
+	}
+	if files := queueFiles(t, dir); len(files) != 0 {
+		t.Errorf("Expected queue directory to be empty, got %v", files)
+	}
+	if want, got := 0, len(server.messages); want != got {
+		t.Errorf("Want %d failure notifications, got %d", want, got)
+	}
+}
+
+func TestQueuePermanentFailure(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	server := &deliveryServer{}
+	relay := newFakeRelay()
+	relay.results["bad@dest.net"] = []error{errPermFailure}
+	q := newTestQueue(t, dir, server, relay)
+
+	ok(t, q.Enqueue(queueTestEnvelope("bad@dest.net", "good@dest.net")))
+	q.deliverDue(time.Now())
+
+	if want, got := 1, relay.attempts["bad@dest.net"]; want != got {
+		t.Errorf("Want %d attempts, got %d", want, got)
+	}
+	if want, got := 1, len(server.messages); want != got {
+		t.Fatalf("Want %d failure notification, got %d", want, got)
+	}
+	dsn := bodyString(t, server.messages[0].Data)
+	if !strings.Contains(dsn, "X-Failed-Recipients: bad@dest.net\n") {
+		t.Errorf("Failure notification does not name failed recipient: %q", dsn)
+	}
+	if !strings.Contains(dsn, "no such user") {
+		t.Errorf("Failure notification does not contain remote error: %q", dsn)
+	}
+	if files := queueFiles(t, dir); len(files) != 0 {
+		t.Errorf("Expected queue directory to be empty, got %v", files)
+	}
+}
+
+func TestQueueStatusNotifications(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	server := &deliveryServer{}
+	relay := newFakeRelay()
+	relay.results["slow@dest.net"] = []error{errTempFailure, errTempFailure}
+	q := newTestQueue(t, dir, server, relay)
+
+	env := queueTestEnvelope("fast@dest.net", "slow@dest.net")
+	env.EnvelopeID = "QQ314159"
+	env.RcptDSN = map[string]RecipientDSN{
+		"fast@dest.net": {Notify: []string{NotifySuccess}},
+		"slow@dest.net": {Notify: []string{NotifyFailure, NotifyDelay}},
+	}
+	ok(t, q.Enqueue(env))
+
+	// The queue is reloaded, so the DSN parameters must be persisted.
+	q = newTestQueue(t, dir, server, relay)
+
+	now := time.Now()
+	next := q.deliverDue(now)
+	if want, got := 1, len(server.messages); want != got {
+		t.Fatalf("Want %d notification, got %d", want, got)
+	}
+	dsn := bodyString(t, server.messages[0].Data)
+	for _, want := range []string{
+		"Subject: Delivery Status Notification (Delay)\n",
+		"Original-Envelope-Id: QQ314159\n",
+		"\nFinal-Recipient: rfc822; fast@dest.net\nAction: relayed\nStatus: 2.0.0\n",
+		"\nFinal-Recipient: rfc822; slow@dest.net\nAction: delayed\nStatus: 4.0.0\nDiagnostic-Code: smtp; 451 greylisted\n",
+	} {
+		if !strings.Contains(dsn, want) {
+			t.Errorf("Missing %q in %q", want, dsn)
+		}
+	}
+
+	// The delay is only reported once, and success was not asked for.
+	next = q.deliverDue(next)
+	q.deliverDue(next)
+	if want, got := 3, relay.attempts["slow@dest.net"]; want != got {
+		t.Errorf("Want %d attempts, got %d", want, got)
+	}
+	if want, got := 1, len(server.messages); want != got {
+		t.Errorf("Want %d notification, got %d", want, got)
+	}
+}
+
+func TestQueueGroupsByDomain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	server := &deliveryServer{}
+	relay := newFakeRelay()
+	relay.results["bad@one.net"] = []error{errPermFailure}
+	relay.results["bad@two.net"] = []error{errPermFailure}
+	q := newTestQueue(t, dir, server, relay)
+
+	ok(t, q.Enqueue(queueTestEnvelope("a@one.net", "x@two.net", "bad@one.net", "bad@two.net", "b@ONE.net")))
+	q.deliverDue(time.Now())
+
+	want := [][]string{
+		{"a@one.net", "bad@one.net", "b@ONE.net"},
+		{"x@two.net", "bad@two.net"},
+	}
+	if !reflect.DeepEqual(want, relay.transactions) {
+		t.Errorf("Want transactions %v, got %v", want, relay.transactions)
+	}
+
+	if want, got := 1, len(server.messages); want != got {
+		t.Fatalf("Want %d failure notification, got %d", want, got)
+	}
+	dsn := bodyString(t, server.messages[0].Data)
+	if !strings.Contains(dsn, "X-Failed-Recipients: bad@one.net, bad@two.net\n") {
+		t.Errorf("Failure notification does not name failed recipients: %q", dsn)
+	}
+	for _, delivered := range []string{"a@one.net", "x@two.net", "b@ONE.net"} {
+		if strings.Contains(dsn, delivered) {
+			t.Errorf("Failure notification should not mention %s: %q", delivered, dsn)
+		}
+	}
+}
+
+func TestQueueExpiry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	server := &deliveryServer{}
+	relay := newFakeRelay()
+	relay.results["slow@dest.net"] = []error{
+		errTempFailure,
+		newRelayError("failed to dial host", errors.New("connection refused")),
+	}
+	q := newTestQueue(t, dir, server, relay)
+
+	ok(t, q.Enqueue(queueTestEnvelope("slow@dest.net")))
+	now := time.Now()
+	q.deliverDue(now)
+
+	if want, got := 0, len(server.messages); want != got {
+		t.Errorf("Want %d failure notifications, got %d", want, got)
+	}
+
+	if next := q.deliverDue(now.Add(q.lifetime)); !next.IsZero() {
+		t.Errorf("Expected queue to be empty, next attempt at %v", next)
+	}
+
+	if want, got := 2, relay.attempts["slow@dest.net"]; want != got {
+		t.Errorf("Want %d attempts, got %d", want, got)
+	}
+	if want, got := 1, len(server.messages); want != got {
+		t.Fatalf("Want %d failure notification, got %d", want, got)
+	}
+	dsn := bodyString(t, server.messages[0].Data)
+	if !strings.Contains(dsn, "message expired after 2 attempts") {
+		t.Errorf("Failure notification does not describe expiry: %q", dsn)
+	}
+	if !strings.Contains(dsn, "connection refused") {
+		t.Errorf("Failure notification does not contain last error: %q", dsn)
+	}
+}
+
+func TestQueueUnreadableMessage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	server := &deliveryServer{}
+	relay := newFakeRelay()
+	q := newTestQueue(t, dir, server, relay)
+
+	env := queueTestEnvelope("a@dest.net")
+	ok(t, q.Enqueue(env))
+	msgPath := q.path(env.ID, queueMessageExt)
+	ok(t, os.Rename(msgPath, msgPath+".moved"))
+
+	// The message is kept for retry while it cannot be read.
+	now := time.Now()
+	next := q.deliverDue(now)
+	if want, got := now.Add(q.minBackoff), next; !want.Equal(got) {
+		t.Errorf("Want next attempt at %v, got %v", want, got)
+	}
+	if want, got := 0, relay.attempts["a@dest.net"]; want != got {
+		t.Errorf("Want %d attempts, got %d", want, got)
+	}
+	if want, got := []string{env.ID + queueMetadataExt, env.ID + queueMessageExt + ".moved"}, queueFiles(t, dir); !reflect.DeepEqual(want, got) {
+		t.Errorf("Want queue files %v, got %v", want, got)
+	}
+
+	// It is relayed once it can be read again.
+	ok(t, os.Rename(msgPath+".moved", msgPath))
+	if next := q.deliverDue(next); !next.IsZero() {
+		t.Errorf("Expected queue to be empty, next attempt at %v", next)
+	}
+	if want, got := 1, relay.attempts["a@dest.net"]; want != got {
+		t.Errorf("Want %d attempts, got %d", want, got)
+	}
+
+	// If it cannot be read before it expires, it is returned to the sender.
+	env.ID = "m.unreadable"
+	ok(t, q.Enqueue(env))
+	ok(t, os.Remove(q.path(env.ID, queueMessageExt)))
+	now = time.Now()
+	q.deliverDue(now)
+	if want, got := 0, len(server.messages); want != got {
+		t.Errorf("Want %d failure notifications, got %d", want, got)
+	}
+	if next := q.deliverDue(now.Add(q.lifetime)); !next.IsZero() {
+		t.Errorf("Expected queue to be empty, next attempt at %v", next)
+	}
+	if want, got := 1, len(server.messages); want != got {
+		t.Fatalf("Want %d failure notification, got %d", want, got)
+	}
+	dsn := bodyString(t, server.messages[0].Data)
+	if !strings.Contains(dsn, "message expired after 2 attempts") {
+		t.Errorf("Failure notification does not describe expiry: %q", dsn)
+	}
+	if !strings.Contains(dsn, "Final-Recipient: rfc822; a@dest.net") {
+		t.Errorf("Failure notification does not name the recipient: %q", dsn)
+	}
+	if files := queueFiles(t, dir); len(files) != 0 {
+		t.Errorf("Expected queue directory to be empty, got %v", files)
+	}
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	server := &deliveryServer{}
+	relay := newFakeRelay()
+	relay.results["a@dest.net"] = []error{errTempFailure}
+	q := newTestQueue(t, dir, server, relay)
+
+	env := queueTestEnvelope("a@dest.net", "b@dest.net")
+	ok(t, q.Enqueue(env))
+	now := time.Now()
+	next := q.deliverDue(now)
+
+	// Simulate a restart by loading a new Queue from the same directory.
+	relay = newFakeRelay()
+	q = newTestQueue(t, dir, server, relay)
+
+	if want, got := 1, len(q.messages); want != got {
+		t.Fatalf("Want %d message loaded, got %d", want, got)
+	}
+	m := q.messages[env.ID]
+	if want, got := 1, m.Attempts; want != got {
+		t.Errorf("Want %d attempts recorded, got %d", want, got)
+	}
+	if !m.NextAttempt.Equal(next) {
+		t.Errorf("Want next attempt at %v, got %v", next, m.NextAttempt)
+	}
+
+	q.deliverDue(next)
+
+	if want, got := 1, relay.attempts["a@dest.net"]; want != got {
+		t.Errorf("Want %d attempts after restart, got %d", want, got)
+	}
+	if want, got := 0, relay.attempts["b@dest.net"]; want != got {
+		t.Errorf("Delivered recipient should not be retried after restart, got %d attempts", got)
+	}
+	if files := queueFiles(t, dir); len(files) != 0 {
+		t.Errorf("Expected queue directory to be empty, got %v", files)
+	}
+}
+
+func TestQueueDeliversConcurrently(t *testing.T) {
+	dir, err := ioutil.TempDir("", "queue")
+	ok(t, err)
+	defer os.RemoveAll(dir)
+
+	server := &deliveryServer{}
+	q := newTestQueue(t, dir, server, newFakeRelay())
+
+	// Relaying to slow.net blocks until fast.net has been relayed to, which
+	// only happens if the messages are delivered concurrently.
+	fastDone := make(chan struct{})
+	q.relay = func(env Envelope, log *zap.Logger, domain string, to []mail.Address) []error {
+		if domain == "fast.net" {
+			close(fastDone)
+			return make([]error, len(to))
+		}
+		select {
+		case <-fastDone:
+			return make([]error, len(to))
+		case <-time.After(5 * time.Second):
+			t.Errorf("Message to fast.net was not relayed while slow.net was in progress")
+			return []error{errTempFailure}
+		}
+	}
+
+	slow := queueTestEnvelope("a@slow.net")
+	slow.ID = "m.slow"
+	ok(t, q.Enqueue(slow))
+	fast := queueTestEnvelope("b@fast.net")
+	fast.ID = "m.fast"
+	ok(t, q.Enqueue(fast))
+
+	if next := q.deliverDue(time.Now()); !next.IsZero() {
+		t.Errorf("Expected queue to be empty, next attempt at %v", next)
+	}
+	if files := queueFiles(t, dir); len(files) != 0 {
+		t.Errorf("Expected queue directory to be empty, got %v", files)
+	}
+}
+
+func TestQueueBackoff(t *testing.T) {
+	q := &Queue{minBackoff: time.Minute, maxBackoff: time.Hour}
+	cases := []struct {
+		attempts int
+		backoff  time.Duration
+	}{
+		{1, time.Minute},
+		{2, 2 * time.Minute},
+		{3, 4 * time.Minute},
+		{6, 32 * time.Minute},
+		{7, time.Hour},
+		{50, time.Hour},
+	}
+	for _, c := range cases {
+		if got := q.backoff(c.attempts); got != c.backoff {
+			t.Errorf("Want backoff %v after %d attempts, got %v", c.backoff, c.attempts, got)
+		}
+	}
+}
+
+func TestRelayErrorPermanence(t *testing.T) {
+	cases := []struct {
+		err       error
+		permanent bool
+	}{
+		{errTempFailure, false},
+		{errPermFailure, true},
+		{newRelayError("failed to dial host", errors.New("timeout")), false},
+		{errors.New("other"), false},
+	}
+	for i, c := range cases {
+		if got := isPermanentRelayError(c.err); got != c.permanent {
+			t.Errorf("Case %d: want permanent=%v, got %v", i, c.permanent, got)
+		}
+	}
+}
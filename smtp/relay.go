@@ -7,10 +7,9 @@
 package smtp
 
 import (
-	"bytes"
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"mime/multipart"
 	"net"
 	"net/mail"
 	"net/smtp"
@@ -20,138 +19,285 @@ import (
 	"go.uber.org/zap"
 )
 
-func RelayMessage(server Server, env Envelope, log *zap.Logger) {
-	for _, rcptTo := range env.RcptTo {
-		sendLog := log.With(zap.String("address", rcptTo.Address))
+const (
+	relayDialTimeout    = 1 * time.Minute
+	relaySessionTimeout = 10 * time.Minute
+)
+
+// relayError describes a failed attempt to relay a message to a recipient.
+type relayError struct {
+	// msg describes the step of the SMTP session that failed.
+	msg string
+	err error
+	// permanent is true if the failure should not be retried.
+	permanent bool
+}
+
+func (e *relayError) Error() string {
+	if e.err == nil {
+		return e.msg
+	}
+	return fmt.Sprintf("%s: %v", e.msg, e.err)
+}
+
+func (e *relayError) Unwrap() error {
+	return e.err
+}
+
+// newRelayError creates a relayError for a failed SMTP session step. The error
+// is permanent if the remote server replied with a 5xx code; network errors and
+// 4xx codes are considered temporary.
+func newRelayError(msg string, err error) *relayError {
+	re := &relayError{msg: msg, err: err}
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) {
+		re.permanent = tpErr.Code >= 500
+	}
+	return re
+}
+
+// isPermanentRelayError returns whether |err| should cause the message to be
+// returned to the sender rather than retried.
+func isPermanentRelayError(err error) bool {
+	var re *relayError
+	if errors.As(err, &re) {
+		return re.permanent
+	}
+	return false
+}
 
-		domain := DomainForAddress(rcptTo)
-		mx, err := net.LookupMX(domain)
-		if err != nil || len(mx) < 1 {
-			deliverRelayFailure(server, env, log, rcptTo.Address, "failed to lookup MX records", err)
-			return
+// relayFailureDetails splits |err| into the description and cause that are
+// reported in a delivery status notification.
+func relayFailureDetails(err error) (string, error) {
+	var re *relayError
+	if errors.As(err, &re) && re.err != nil {
+		return re.msg, re.err
+	}
+	return "failed to relay message", err
+}
+
+// relayToDomain looks up the mail exchangers for |domain| and attempts to
+// deliver |env| to each of the recipients in |to|, all of which must be at that
+// domain. It returns the result of delivery for each recipient, in order.
+func relayToDomain(server Server, resolver Resolver, env Envelope, log *zap.Logger, domain string, to []mail.Address) []error {
+	hosts, err := lookupRelayHosts(resolver, domain)
+	if err != nil {
+		results := make([]error, len(to))
+		for i := range results {
+			results[i] = err
 		}
-		relayMessageToHost(server, env, sendLog, rcptTo.Address, mx[0].Host, "25")
+		return results
 	}
+
+	addrs := make([]string, len(to))
+	for i, rcpt := range to {
+		addrs[i] = rcpt.Address
+	}
+	return relayMessageToHosts(server, env, log, addrs, hosts, "25")
 }
 
-func relayMessageToHost(server Server, env Envelope, log *zap.Logger, to, host, port string) {
+// relayMessageToHosts tries to deliver |env| to each of |hosts| in order.
+// Recipients that are accepted or permanently rejected by a host are not
+// tried again; those that fail temporarily are tried at the next host. The
+// result for each recipient in |to| is returned, in order.
+func relayMessageToHosts(server Server, env Envelope, log *zap.Logger, to []string, hosts []string, port string) []error {
+	results := make([]error, len(to))
+	for i := range results {
+		results[i] = &relayError{"failed to lookup MX records", errors.New("no usable mail exchangers"), true}
+	}
+
+	pending := make([]int, len(to))
+	for i := range pending {
+		pending[i] = i
+	}
+
+	for _, host := range hosts {
+		pendingTo := make([]string, len(pending))
+		for i, idx := range pending {
+			pendingTo[i] = to[idx]
+		}
+
+		hostResults := relayMessageToHost(server, env, log, pendingTo, host, port)
+
+		var retry []int
+		for i, idx := range pending {
+			results[idx] = hostResults[i]
+			if hostResults[i] != nil && !isPermanentRelayError(hostResults[i]) {
+				retry = append(retry, idx)
+			}
+		}
+		if len(retry) == 0 {
+			break
+		}
+		log.Warn("failed to relay to host, trying next", zap.String("host", host), zap.Int("recipients", len(retry)))
+		pending = retry
+	}
+
+	return results
+}
+
+// relayMessageToHost delivers |env| to all the recipients in |to| using a
+// single SMTP transaction with |host|. The result for each recipient is
+// returned, in order. An error that affects the whole transaction is reported
+// for every recipient.
+func relayMessageToHost(server Server, env Envelope, log *zap.Logger, to []string, host, port string) []error {
 	from := env.MailFrom.Address
 	hostPort := net.JoinHostPort(host, port)
 	log = log.With(zap.String("host", hostPort))
 
-	c, err := smtp.Dial(hostPort)
+	results := make([]error, len(to))
+	failAll := func(err error) []error {
+		for i := range results {
+			if results[i] == nil {
+				results[i] = err
+			}
+		}
+		return results
+	}
+
+	nc, err := net.DialTimeout("tcp", hostPort, relayDialTimeout)
 	if err != nil {
-		// TODO - retry, or look at other MX records
-		deliverRelayFailure(server, env, log, to, "failed to dial host", err)
-		return
+		return failAll(newRelayError("failed to dial host", err))
+	}
+	nc.SetDeadline(time.Now().Add(relaySessionTimeout))
+
+	c, err := smtp.NewClient(nc, host)
+	if err != nil {
+		nc.Close()
+		return failAll(newRelayError("failed to read greeting", err))
 	}
 	defer c.Quit()
 
 	if err = c.Hello(server.Name()); err != nil {
-		deliverRelayFailure(server, env, log, to, "failed to HELO", err)
-		return
+		return failAll(newRelayError("failed to HELO", err))
 	}
 
 	if hasTls, _ := c.Extension("STARTTLS"); hasTls {
 		config := &tls.Config{ServerName: host}
 		if err = c.StartTLS(config); err != nil {
-			deliverRelayFailure(server, env, log, to, "failed to STARTTLS", err)
-			return
+			return failAll(newRelayError("failed to STARTTLS", err))
 		}
 	}
 
-	if err = c.Mail(from); err != nil {
-		deliverRelayFailure(server, env, log, to, "failed MAIL FROM", err)
-		return
+	// The client sends BODY=8BITMIME if the host supports it. A message that
+	// was declared to be 8-bit cannot be sent to a host that does not, as it
+	// is not converted (RFC 6152 § 3).
+	if has8BitMIME, _ := c.Extension("8BITMIME"); env.BodyType == BodyType8BitMIME && !has8BitMIME {
+		return failAll(&relayError{msg: "host does not support 8BITMIME", permanent: true})
 	}
 
-	if err = c.Rcpt(to); err != nil {
-		deliverRelayFailure(server, env, log, to, "failed to RCPT TO", err)
-		return
+	// The client sends SMTPUTF8 if the host supports it. A message that needs
+	// it cannot be downgraded, so it is returned to the sender instead (RFC
+	// 6531 § 3.2).
+	if hasSMTPUTF8, _ := c.Extension("SMTPUTF8"); !hasSMTPUTF8 && env.needsSMTPUTF8(to) {
+		return failAll(&relayError{msg: "host does not support SMTPUTF8", permanent: true})
 	}
 
-	wc, err := c.Data()
-	if err != nil {
-		deliverRelayFailure(server, env, log, to, "failed to DATA", err)
-		return
+	// A binary message can only be sent with BDAT, which net/smtp does not
+	// support, so that part of the transaction is done directly.
+	binary := env.BodyType == BodyTypeBinaryMIME
+	if binary {
+		hasChunking, _ := c.Extension("CHUNKING")
+		hasBinaryMIME, _ := c.Extension("BINARYMIME")
+		if !hasChunking || !hasBinaryMIME {
+			return failAll(&relayError{msg: "host does not support BINARYMIME", permanent: true})
+		}
+		params := " BODY=BINARYMIME"
+		if hasSMTPUTF8, _ := c.Extension("SMTPUTF8"); hasSMTPUTF8 {
+			params += " SMTPUTF8"
+		}
+		err = textCmd(c.Text, 250, "MAIL FROM:<%s>%s", from, params)
+	} else {
+		err = c.Mail(from)
 	}
-
-	_, err = wc.Write(env.Data)
 	if err != nil {
-		wc.Close()
-		deliverRelayFailure(server, env, log, to, "failed to write DATA", err)
-		return
+		return failAll(newRelayError("failed MAIL FROM", err))
 	}
 
-	if err = wc.Close(); err != nil {
-		deliverRelayFailure(server, env, log, to, "failed to close DATA", err)
-		return
+	accepted := 0
+	for i, rcpt := range to {
+		if err = c.Rcpt(rcpt); err != nil {
+			log.Warn("recipient rejected", zap.String("address", rcpt), zap.Error(err))
+			results[i] = newRelayError("failed to RCPT TO", err)
+			continue
+		}
+		accepted++
+	}
+	if accepted == 0 {
+		return results
 	}
-}
 
-// deliverRelayFailure logs and generates a delivery status notification. It
-// writes to |log| the |errorStr| and |sendErr|, as well as preparing a new
-// message, based of |env|, delivered to |server| that reports error
-// information about the attempted delivery.
-func deliverRelayFailure(server Server, env Envelope, log *zap.Logger, to, errorStr string, sendErr error) {
-	log.Error(errorStr, zap.Error(sendErr))
+	if binary {
+		if err = sendChunk(c.Text, env.Data); err != nil {
+			return failAll(newRelayError("failed to BDAT", err))
+		}
+		log.Info("relayed message", zap.Int("recipients", accepted))
+		return results
+	}
 
-	buf := &bytes.Buffer{}
-	mw := multipart.NewWriter(buf)
+	wc, err := c.Data()
+	if err != nil {
+		return failAll(newRelayError("failed to DATA", err))
+	}
 
-	now := time.Now()
+	_, err = env.Data.WriteTo(wc)
+	if err != nil {
+		wc.Close()
+		return failAll(newRelayError("failed to write DATA", err))
+	}
 
-	failure := Envelope{
-		MailFrom: mail.Address{"mailpopbox", "mailbox@" + DomainForAddress(env.MailFrom)},
-		RcptTo:   []mail.Address{env.MailFrom},
-		ID:       generateEnvelopeId("f", now),
-		Received: now,
+	if err = wc.Close(); err != nil {
+		return failAll(newRelayError("failed to close DATA", err))
 	}
 
-	fmt.Fprintf(buf, "From: %s\n", failure.MailFrom.String())
-	fmt.Fprintf(buf, "To: %s\n", failure.RcptTo[0].String())
-	fmt.Fprintf(buf, "Subject: Delivery Status Notification (Failure)\n")
-	fmt.Fprintf(buf, "X-Failed-Recipients: %s\n", to)
-	fmt.Fprintf(buf, "Message-ID: %s\n", failure.ID)
-	fmt.Fprintf(buf, "Date: %s\n", now.Format(time.RFC1123Z))
-	fmt.Fprintf(buf, "Content-Type: multipart/report; boundary=%s; report-type=delivery-status\n\n", mw.Boundary())
+	log.Info("relayed message", zap.Int("recipients", accepted))
+	return results
+}
 
-	tw, err := mw.CreatePart(textproto.MIMEHeader{
-		"Content-Type": []string{"text/plain; charset=UTF-8"},
-	})
+// textCmd sends a command on |text| and reads a reply with |expectCode|.
+func textCmd(text *textproto.Conn, expectCode int, format string, args ...interface{}) error {
+	id, err := text.Cmd(format, args...)
 	if err != nil {
-		log.Error("failed to create multipart 0", zap.Error(err))
-		return
+		return err
 	}
-	fmt.Fprintf(tw, "* * * Delivery Failure * * *\n\n")
-	fmt.Fprintf(tw, "The server failed to relay the message:\n\n%s:\n%s\n", errorStr, sendErr.Error())
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	_, _, err = text.ReadResponse(expectCode)
+	return err
+}
 
-	sw, err := mw.CreatePart(textproto.MIMEHeader{
-		"Content-Type": []string{"message/delivery-status"},
-	})
+// sendChunk sends all of |data| on |text| as a single BDAT LAST chunk.
+func sendChunk(text *textproto.Conn, data *Body) error {
+	id, err := text.Cmd("BDAT %d LAST", data.Len())
 	if err != nil {
-		log.Error("failed to create multipart 1", zap.Error(err))
-		return
+		return err
 	}
-	fmt.Fprintf(sw, "Original-Envelope-ID: %s\n", env.ID)
-	fmt.Fprintf(sw, "Reporting-UA: %s\n", env.EHLO)
-	if env.RemoteAddr != nil {
-		fmt.Fprintf(sw, "Reporting-MTA: dns; %s\n", lookupRemoteHost(env.RemoteAddr))
+	text.StartResponse(id)
+	defer text.EndResponse(id)
+	if _, err = data.WriteTo(text.W); err != nil {
+		return err
 	}
-	fmt.Fprintf(sw, "Date: %s\n", env.Received.Format(time.RFC1123Z))
-
-	ocw, err := mw.CreatePart(textproto.MIMEHeader{
-		"Content-Type": []string{"message/rfc822"},
-	})
-	if err != nil {
-		log.Error("failed to create multipart 2", zap.Error(err))
-		return
+	if err = text.W.Flush(); err != nil {
+		return err
 	}
+	_, _, err = text.ReadResponse(250)
+	return err
+}
 
-	ocw.Write(env.Data)
-
-	mw.Close()
-
-	failure.Data = buf.Bytes()
-	server.DeliverMessage(failure)
+// needsSMTPUTF8 returns whether relaying |env| to |to| requires the SMTPUTF8
+// extension, because the client declared it and an address or the header of
+// the message is not ASCII.
+func (env Envelope) needsSMTPUTF8(to []string) bool {
+	if !env.SMTPUTF8 {
+		return false
+	}
+	if !isASCII(env.MailFrom.Address) || !isASCII(string(env.Data.Header())) {
+		return true
+	}
+	for _, rcpt := range to {
+		if !isASCII(rcpt) {
+			return true
+		}
+	}
+	return false
 }
@@ -14,8 +14,10 @@ import (
 	"mime/multipart"
 	"net"
 	"net/mail"
+	"net/textproto"
 	"strings"
 	"testing"
+	"time"
 
 	"go.uber.org/zap"
 )
@@ -40,12 +42,13 @@ func TestRelayRoundTrip(t *testing.T) {
 	env := Envelope{
 		MailFrom: mail.Address{Address: "from@sender.org"},
 		RcptTo:   []mail.Address{{Address: "to@receive.net"}},
-		Data:     []byte("~~~Message~~~\n"),
+		Data:     NewBody([]byte("~~~Message~~~\n")),
 		ID:       "ididid",
 	}
 
 	host, port, _ := net.SplitHostPort(l.Addr().String())
-	relayMessageToHost(s, env, zap.NewNop(), env.RcptTo[0].Address, host, port)
+	results := relayMessageToHost(s, env, zap.NewNop(), []string{env.RcptTo[0].Address}, host, port)
+	ok(t, results[0])
 
 	if want, got := 1, len(s.messages); want != got {
 		t.Errorf("Want %d message to be delivered, got %d", want, got)
@@ -65,8 +68,202 @@ func TestRelayRoundTrip(t *testing.T) {
 		t.Errorf("Want RcptTo %s, got %s", want, got)
 	}
 
-	if !bytes.HasSuffix(received.Data, env.Data) {
-		t.Errorf("Delivered message does not match relayed one. Delivered=%q Relayed=%q", string(env.Data), string(received.Data))
+	if !strings.HasSuffix(bodyString(t, received.Data), bodyString(t, env.Data)) {
+		t.Errorf("Delivered message does not match relayed one. Delivered=%q Relayed=%q", bodyString(t, env.Data), bodyString(t, received.Data))
+	}
+}
+
+func TestRelayTriesNextHost(t *testing.T) {
+	s := &deliveryServer{
+		testServer: testServer{domain: "receive.net"},
+	}
+	l := runServer(t, s)
+	defer l.Close()
+
+	env := Envelope{
+		MailFrom: mail.Address{Address: "from@sender.org"},
+		RcptTo:   []mail.Address{{Address: "to@receive.net"}},
+		Data:     NewBody([]byte("~~~Message~~~\n")),
+		ID:       "ididid",
+	}
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	hosts := []string{"unreachable.invalid", host}
+	results := relayMessageToHosts(s, env, zap.NewNop(), []string{env.RcptTo[0].Address}, hosts, port)
+	ok(t, results[0])
+
+	if want, got := 1, len(s.messages); want != got {
+		t.Errorf("Want %d message to be delivered, got %d", want, got)
+	}
+}
+
+func TestRelayStopsAtPermanentFailure(t *testing.T) {
+	s := &deliveryServer{
+		testServer: testServer{domain: "receive.net"},
+	}
+	l := runServer(t, s)
+	defer l.Close()
+
+	env := Envelope{
+		MailFrom: mail.Address{Address: "from@sender.org"},
+		RcptTo:   []mail.Address{{Address: "to@elsewhere.net"}},
+		Data:     NewBody([]byte("~~~Message~~~\n")),
+		ID:       "ididid",
+	}
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	hosts := []string{host, "unreachable.invalid"}
+	results := relayMessageToHosts(s, env, zap.NewNop(), []string{env.RcptTo[0].Address}, hosts, port)
+	if err := results[0]; !isPermanentRelayError(err) {
+		t.Errorf("Want permanent error from rejected RCPT, got %v", err)
+	}
+}
+
+func TestRelaySMTPUTF8(t *testing.T) {
+	s := &deliveryServer{
+		testServer: testServer{domain: "xn--bcher-kva.example"},
+	}
+	l := runServer(t, s)
+	defer l.Close()
+
+	env := Envelope{
+		MailFrom: mail.Address{Address: "jösé@sender.org"},
+		RcptTo:   []mail.Address{{Address: "to@xn--bcher-kva.example"}},
+		Data:     NewBody([]byte("Subject: Grüße\n\n~~~Message~~~\n")),
+		ID:       "ididid",
+		SMTPUTF8: true,
+	}
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	results := relayMessageToHost(s, env, zap.NewNop(), []string{env.RcptTo[0].Address}, host, port)
+	ok(t, results[0])
+
+	if want, got := 1, len(s.messages); want != got {
+		t.Fatalf("Want %d message to be delivered, got %d", want, got)
+	}
+	if received := s.messages[0]; received.MailFrom.Address != env.MailFrom.Address || !received.SMTPUTF8 {
+		t.Errorf("Want SMTPUTF8 mail from %s, got %+v", env.MailFrom.Address, received)
+	}
+}
+
+func TestRelayBinaryMIME(t *testing.T) {
+	s := &deliveryServer{
+		testServer: testServer{domain: "receive.net"},
+	}
+	l := runServer(t, s)
+	defer l.Close()
+
+	env := Envelope{
+		MailFrom: mail.Address{Address: "from@sender.org"},
+		RcptTo:   []mail.Address{{Address: "to@receive.net"}},
+		Data:     NewBody([]byte("Subject: binary\r\n\r\n\x00\xff\r\n.\r\n")),
+		ID:       "ididid",
+		BodyType: BodyTypeBinaryMIME,
+	}
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	results := relayMessageToHost(s, env, zap.NewNop(), []string{env.RcptTo[0].Address}, host, port)
+	ok(t, results[0])
+
+	if want, got := 1, len(s.messages); want != got {
+		t.Fatalf("Want %d message to be delivered, got %d", want, got)
+	}
+	received := s.messages[0]
+	if want, got := BodyTypeBinaryMIME, received.BodyType; want != got {
+		t.Errorf("Want body type %q, got %q", want, got)
+	}
+	if !strings.HasSuffix(bodyString(t, received.Data), bodyString(t, env.Data)) {
+		t.Errorf("Delivered message does not match relayed one: %q", bodyString(t, received.Data))
+	}
+}
+
+func TestRelaySMTPUTF8Unsupported(t *testing.T) {
+	l, err := net.Listen("tcp", "localhost:0")
+	ok(t, err)
+	defer l.Close()
+
+	// The host supports no extensions.
+	go func() {
+		nc, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer nc.Close()
+		conn := textproto.NewConn(nc)
+		conn.PrintfLine("220 host")
+		for {
+			line, err := conn.ReadLine()
+			if err != nil {
+				return
+			}
+			switch strings.ToUpper(strings.Fields(line)[0]) {
+			case "EHLO":
+				conn.PrintfLine("250 host")
+			case "QUIT":
+				conn.PrintfLine("221 bye")
+				return
+			default:
+				conn.PrintfLine("250 OK")
+			}
+		}
+	}()
+
+	env := Envelope{
+		MailFrom: mail.Address{Address: "jösé@sender.org"},
+		RcptTo:   []mail.Address{{Address: "to@receive.net"}},
+		Data:     NewBody([]byte("~~~Message~~~\n")),
+		ID:       "ididid",
+		SMTPUTF8: true,
+	}
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	results := relayMessageToHost(&testServer{}, env, zap.NewNop(), []string{env.RcptTo[0].Address}, host, port)
+	if err := results[0]; !isPermanentRelayError(err) {
+		t.Errorf("Want permanent error for host without SMTPUTF8, got %v", err)
+	}
+}
+
+func TestRelayMultipleRecipients(t *testing.T) {
+	s := &deliveryServer{
+		testServer: testServer{
+			domain:    "receive.net",
+			blockList: []string{"blocked@receive.net"},
+		},
+	}
+	l := runServer(t, s)
+	defer l.Close()
+
+	env := Envelope{
+		MailFrom: mail.Address{Address: "from@sender.org"},
+		RcptTo: []mail.Address{
+			{Address: "one@receive.net"},
+			{Address: "blocked@receive.net"},
+			{Address: "two@receive.net"},
+		},
+		Data: NewBody([]byte("~~~Message~~~\n")),
+		ID:   "ididid",
+	}
+	to := []string{env.RcptTo[0].Address, env.RcptTo[1].Address, env.RcptTo[2].Address}
+
+	host, port, _ := net.SplitHostPort(l.Addr().String())
+	results := relayMessageToHost(s, env, zap.NewNop(), to, host, port)
+
+	ok(t, results[0])
+	if !isPermanentRelayError(results[1]) {
+		t.Errorf("Want permanent error for blocked recipient, got %v", results[1])
+	}
+	ok(t, results[2])
+
+	if want, got := 1, len(s.messages); want != got {
+		t.Fatalf("Want %d message to be delivered in one transaction, got %d", want, got)
+	}
+
+	received := s.messages[0].RcptTo
+	if want, got := 2, len(received); want != got {
+		t.Fatalf("Want %d recipients, got %d", want, got)
+	}
+	if received[0].Address != "one@receive.net" || received[1].Address != "two@receive.net" {
+		t.Errorf("Unexpected recipients %v", received)
 	}
 }
 
@@ -76,15 +273,18 @@ func TestDeliveryFailureMessage(t *testing.T) {
 	env := Envelope{
 		MailFrom:   mail.Address{Address: "from@sender.org"},
 		RcptTo:     []mail.Address{{Address: "to@receive.net"}},
-		Data:       []byte("Message\n"),
+		Data:       NewBody([]byte("Message\n")),
 		ID:         "m.willfail",
 		EHLO:       "mx.receive.net",
-		RemoteAddr: &net.IPAddr{net.IPv4(127, 0, 0, 1), ""},
+		RemoteAddr: &net.IPAddr{IP: net.IPv4(127, 0, 0, 1)},
+		EnvelopeID: "envid-1",
 	}
 
 	errorStr1 := "internal message"
 	errorStr2 := "general error 122"
-	deliverRelayFailure(s, env, zap.NewNop(), env.RcptTo[0].Address, errorStr1, fmt.Errorf(errorStr2))
+	deliverStatusNotification(s, env, zap.NewNop(), []dsnRecipient{
+		{to: env.RcptTo[0].Address, action: dsnActionFailed, errorStr: errorStr1, err: fmt.Errorf(errorStr2), status: "5.0.0"},
+	})
 
 	if want, got := 1, len(s.messages); want != got {
 		t.Errorf("Want %d failure notification, got %d", want, got)
@@ -98,7 +298,7 @@ func TestDeliveryFailureMessage(t *testing.T) {
 	}
 
 	// Read the failure message.
-	buf := bytes.NewBuffer(failure.Data)
+	buf := bytes.NewBufferString(bodyString(t, failure.Data))
 	msg, err := mail.ReadMessage(buf)
 	if err != nil {
 		t.Errorf("Failed to read message: %v", err)
@@ -176,15 +376,20 @@ func TestDeliveryFailureMessage(t *testing.T) {
 	}
 	contentStr = string(content)
 
-	if want := "Original-Envelope-ID: " + env.ID + "\n"; !strings.Contains(contentStr, want) {
+	if want := "Original-Envelope-Id: " + env.EnvelopeID + "\n"; !strings.Contains(contentStr, want) {
 		t.Errorf("Missing %q in %q", want, contentStr)
 	}
 
-	if want := "Reporting-UA: " + env.EHLO + "\n"; !strings.Contains(contentStr, want) {
+	if want := "Reporting-MTA: dns; Test-Server\n"; !strings.Contains(contentStr, want) {
 		t.Errorf("Missing %q in %q", want, contentStr)
 	}
 
-	if want := "Reporting-MTA: dns; localhost [127.0.0.1]\n"; !strings.Contains(contentStr, want) {
+	if want := "Received-From-MTA: dns; " + env.EHLO + "\n"; !strings.Contains(contentStr, want) {
+		t.Errorf("Missing %q in %q", want, contentStr)
+	}
+
+	if want := "\nFinal-Recipient: rfc822; " + env.RcptTo[0].Address + "\nAction: failed\nStatus: 5.0.0\n" +
+		"Diagnostic-Code: X-mailpopbox; " + errorStr2 + "\n"; !strings.Contains(contentStr, want) {
 		t.Errorf("Missing %q in %q", want, contentStr)
 	}
 
@@ -205,7 +410,168 @@ func TestDeliveryFailureMessage(t *testing.T) {
 		return
 	}
 
-	if !bytes.Equal(content, env.Data) {
+	if string(content) != bodyString(t, env.Data) {
 		t.Errorf("Byte content of original message does not match")
 	}
 }
+
+// readStatusNotification returns the header of the notification |msg|, and
+// the content of each of its parts, with its content type.
+func readStatusNotification(t *testing.T, msg string) (mail.Header, [][2]string) {
+	m, err := mail.ReadMessage(strings.NewReader(msg))
+	if err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	_, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil {
+		t.Fatalf("Failed to parse Content-Type: %v", err)
+	}
+	var parts [][2]string
+	mpr := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		part, err := mpr.NextPart()
+		if err != nil {
+			break
+		}
+		content, err := ioutil.ReadAll(part)
+		ok(t, err)
+		parts = append(parts, [2]string{part.Header.Get("Content-Type"), string(content)})
+	}
+	return m.Header, parts
+}
+
+func TestStatusNotification(t *testing.T) {
+	env := Envelope{
+		MailFrom: mail.Address{Address: "from@sender.org"},
+		RcptTo: []mail.Address{
+			{Address: "fail@receive.net"},
+			{Address: "slow@receive.net"},
+			{Address: "ok@receive.net"},
+		},
+		Data:      NewBody([]byte("Subject: report\n\nThe body\n")),
+		ID:        "m.report",
+		DSNReturn: DSNReturnHeaders,
+		RcptDSN: map[string]RecipientDSN{
+			"ok@receive.net": {OriginalRecipient: "rfc822;Alias@receive.net"},
+		},
+	}
+	retryUntil := time.Date(2020, time.March, 1, 12, 0, 0, 0, time.UTC)
+	rcpts := []dsnRecipient{
+		newRelayFailure("fail@receive.net", errPermFailure),
+		newRelayDelay("slow@receive.net", newRelayError("failed to RCPT TO", &textproto.Error{Code: 450, Msg: "4.2.1 try later"}), retryUntil),
+		newRelaySuccess("ok@receive.net"),
+	}
+	notice, err := newStatusNotification("mx.sender.org", mail.Address{Address: "mailbox@sender.org"}, env, rcpts)
+	ok(t, err)
+
+	header, parts := readStatusNotification(t, bodyString(t, notice.Data))
+	if want, got := "Delivery Status Notification (Failure)", header.Get("Subject"); want != got {
+		t.Errorf("Want Subject %q, got %q", want, got)
+	}
+	if want, got := "fail@receive.net", header.Get("X-Failed-Recipients"); want != got {
+		t.Errorf("Want X-Failed-Recipients %q, got %q", want, got)
+	}
+	if want, got := 3, len(parts); want != got {
+		t.Fatalf("Want %d parts, got %d", want, got)
+	}
+
+	status := parts[1][1]
+	for _, want := range []string{
+		"\nFinal-Recipient: rfc822; fail@receive.net\nAction: failed\nStatus: 5.0.0\nDiagnostic-Code: smtp; 550 no such user\n",
+		"\nFinal-Recipient: rfc822; slow@receive.net\nAction: delayed\nStatus: 4.2.1\n" +
+			"Diagnostic-Code: smtp; 450 4.2.1 try later\nWill-Retry-Until: Sun, 01 Mar 2020 12:00:00 +0000\n",
+		"\nOriginal-Recipient: rfc822;Alias@receive.net\nFinal-Recipient: rfc822; ok@receive.net\nAction: relayed\nStatus: 2.0.0\n",
+	} {
+		if !strings.Contains(status, want) {
+			t.Errorf("Missing %q in %q", want, status)
+		}
+	}
+	if strings.Contains(status, "Original-Envelope-Id") {
+		t.Errorf("Unexpected Original-Envelope-Id in %q", status)
+	}
+
+	// Only the header is returned for RET=HDRS.
+	if want, got := "text/rfc822-headers", parts[2][0]; want != got {
+		t.Errorf("Want returned content type %q, got %q", want, got)
+	}
+	if want, got := "Subject: report\n\n", parts[2][1]; want != got {
+		t.Errorf("Want returned content %q, got %q", want, got)
+	}
+}
+
+func TestStatusNotificationNotify(t *testing.T) {
+	cases := []struct {
+		notify  []string
+		rcpt    dsnRecipient
+		subject string
+	}{
+		{nil, newRelayFailure("to@receive.net", errPermFailure), "Delivery Status Notification (Failure)"},
+		{nil, newRelaySuccess("to@receive.net"), ""},
+		{nil, newRelayDelay("to@receive.net", errTempFailure, time.Now()), ""},
+		{[]string{NotifyNever}, newRelayFailure("to@receive.net", errPermFailure), ""},
+		{[]string{NotifySuccess}, newRelayFailure("to@receive.net", errPermFailure), ""},
+		{[]string{NotifySuccess}, newRelaySuccess("to@receive.net"), "Delivery Status Notification (Success)"},
+		{[]string{NotifyFailure, NotifyDelay}, newRelayDelay("to@receive.net", errTempFailure, time.Now()), "Delivery Status Notification (Delay)"},
+	}
+	for i, c := range cases {
+		s := &deliveryServer{}
+		env := Envelope{
+			MailFrom: mail.Address{Address: "from@sender.org"},
+			RcptTo:   []mail.Address{{Address: "to@receive.net"}},
+			Data:     NewBody([]byte("Subject: report\n\nThe body\n")),
+			ID:       "m.report",
+			RcptDSN:  map[string]RecipientDSN{"to@receive.net": {Notify: c.notify}},
+		}
+		deliverStatusNotification(s, env, zap.NewNop(), []dsnRecipient{c.rcpt})
+
+		if c.subject == "" {
+			if len(s.messages) != 0 {
+				t.Errorf("Case %d: want no notification, got %d", i, len(s.messages))
+			}
+			continue
+		}
+		if want, got := 1, len(s.messages); want != got {
+			t.Errorf("Case %d: want %d notification, got %d", i, want, got)
+			continue
+		}
+		header, parts := readStatusNotification(t, bodyString(t, s.messages[0].Data))
+		if want, got := c.subject, header.Get("Subject"); want != got {
+			t.Errorf("Case %d: want Subject %q, got %q", i, want, got)
+		}
+		// The whole message is only returned with a failure.
+		wantType := "text/rfc822-headers"
+		if c.rcpt.action == dsnActionFailed {
+			wantType = "message/rfc822"
+		}
+		if got := parts[len(parts)-1][0]; wantType != got {
+			t.Errorf("Case %d: want returned content type %q, got %q", i, wantType, got)
+		}
+	}
+}
+
+func TestDecodeXtext(t *testing.T) {
+	cases := []struct {
+		in, out string
+		valid   bool
+	}{
+		{"abc", "abc", true},
+		{"a+2Bb+3Dc", "a+b=c", true},
+		{"rfc822;user+40example.com", "rfc822;user@example.com", true},
+		{"a+2bc", "a+c", true},
+		{"a+2", "", false},
+		{"a+zz", "", false},
+		{"a=b", "", false},
+		{"a+0Ab", "", false},
+		{"a\x01b", "", false},
+		{"caf\xc3\xa9", "", false},
+	}
+	for i, c := range cases {
+		out, err := decodeXtext(c.in)
+		if want, got := c.valid, err == nil; want != got {
+			t.Errorf("Case %d: want valid=%v, got error %v", i, want, err)
+		}
+		if want, got := c.out, out; want != got {
+			t.Errorf("Case %d: want %q, got %q", i, want, got)
+		}
+	}
+}
@@ -16,28 +16,57 @@ import (
 	"regexp"
 	"strings"
 	"time"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+
+	"src.bluestatic.org/mailpopbox/sasl"
+	"src.bluestatic.org/mailpopbox/spf"
 )
 
 type ReplyLine struct {
-	Code    int
+	Code int
+	// Status is the RFC 3463 enhanced status code, like "5.1.1".
+	Status  string
 	Message string
 }
 
 func (l ReplyLine) String() string {
-	return fmt.Sprintf("%d %s", l.Code, l.Message)
+	return fmt.Sprintf("%d %s", l.Code, l.text())
+}
+
+// text returns the Message of the reply, prefixed by its Status.
+func (l ReplyLine) text() string {
+	if l.Status == "" {
+		return l.Message
+	}
+	return l.Status + " " + l.Message
 }
 
-var SendAsSubject = regexp.MustCompile(`(?i)\[sendas:\s*([a-zA-Z0-9\.\-_]+)\]`)
+// SendAsSubject matches the command in a Subject header that sets the local
+// part of the address to send a relayed message from, which may be UTF-8.
+var SendAsSubject = regexp.MustCompile(`(?i)\[sendas:\s*([\p{L}\p{M}\p{N}\.\-_]+)\]`)
 
 var (
-	ReplyOK               = ReplyLine{250, "OK"}
-	ReplyAuthOK           = ReplyLine{235, "auth success"}
-	ReplyBadSyntax        = ReplyLine{501, "syntax error"}
-	ReplyBadSequence      = ReplyLine{503, "bad sequence of commands"}
-	ReplyBadMailbox       = ReplyLine{550, "mailbox unavailable"}
-	ReplyMailboxUnallowed = ReplyLine{553, "mailbox name not allowed"}
+	ReplyOK               = ReplyLine{250, "2.0.0", "OK"}
+	ReplyAuthOK           = ReplyLine{235, "2.7.0", "auth success"}
+	ReplyBadCommand       = ReplyLine{500, "5.5.1", "unrecognized command"}
+	ReplyBadSyntax        = ReplyLine{501, "5.5.2", "syntax error"}
+	ReplyBadParameter     = ReplyLine{501, "5.5.4", "invalid command parameter"}
+	ReplyBadSequence      = ReplyLine{503, "5.5.1", "bad sequence of commands"}
+	ReplyBadMailbox       = ReplyLine{550, "5.1.1", "mailbox unavailable"}
+	ReplyMailboxUnallowed = ReplyLine{553, "5.1.3", "mailbox name not allowed"}
+	ReplyLocalError       = ReplyLine{451, "4.3.0", "local error in processing"}
+	ReplyTooLarge         = ReplyLine{552, "5.3.4", "message size exceeds fixed maximum message size"}
+	ReplyNeedsSMTPUTF8    = ReplyLine{553, "5.6.7", "non-ASCII addresses require SMTPUTF8"}
 )
 
+// DefaultMaxMessageSize is the largest message, in bytes, that is accepted by
+// default.
+const DefaultMaxMessageSize = 40960000
+
+// DomainForAddress returns the domain of |addr|, normalized by
+// NormalizeDomain.
 func DomainForAddress(addr mail.Address) string {
 	return DomainForAddressString(addr.Address)
 }
@@ -47,7 +76,50 @@ func DomainForAddressString(address string) string {
 	if domainIdx == -1 {
 		return ""
 	}
-	return address[domainIdx+1:]
+	return NormalizeDomain(address[domainIdx+1:])
+}
+
+// NormalizeDomain returns |domain| in the form in which domains are compared
+// and looked up: in lower case, with internationalized labels converted to
+// their IDNA A-labels (RFC 5891). A domain that is not valid IDNA is only
+// lowercased.
+func NormalizeDomain(domain string) string {
+	if normalized, err := normalizeDomain(domain); err == nil {
+		return normalized
+	}
+	return strings.ToLower(domain)
+}
+
+func normalizeDomain(domain string) (string, error) {
+	if isASCII(domain) {
+		return strings.ToLower(domain), nil
+	}
+	return idna.Lookup.ToASCII(domain)
+}
+
+// NormalizeAddress returns |address| with its domain normalized by
+// NormalizeDomain. The local part is kept as it is, since it may be case
+// sensitive and UTF-8 (RFC 6531). An error is returned if the domain is not
+// valid IDNA.
+func NormalizeAddress(address string) (string, error) {
+	domainIdx := strings.LastIndex(address, "@")
+	if domainIdx == -1 {
+		return address, nil
+	}
+	domain, err := normalizeDomain(address[domainIdx+1:])
+	if err != nil {
+		return "", err
+	}
+	return address[:domainIdx+1] + domain, nil
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
 }
 
 type Envelope struct {
@@ -55,15 +127,68 @@ type Envelope struct {
 	EHLO       string
 	MailFrom   mail.Address
 	RcptTo     []mail.Address
-	Data       []byte
-	Received   time.Time
-	ID         string
+	// Data is the content of the message, which may be backed by a file.
+	Data     *Body
+	Received time.Time
+	ID       string
+	// SPF is the result of checking the sender of inbound mail, if it was
+	// checked.
+	SPF *spf.Check
+	// BodyType is the BODY parameter of MAIL FROM, BodyType7Bit,
+	// BodyType8BitMIME or BodyTypeBinaryMIME, or empty if the client did not
+	// declare it.
+	BodyType string
+	// SMTPUTF8 is whether the client gave the SMTPUTF8 parameter of MAIL
+	// FROM, which allows UTF-8 addresses and header fields (RFC 6531).
+	SMTPUTF8 bool
+	// DSNReturn is the RET parameter of MAIL FROM, DSNReturnFull or
+	// DSNReturnHeaders, or empty if the client did not declare it (RFC 3461).
+	DSNReturn string
+	// EnvelopeID is the decoded ENVID parameter of MAIL FROM, or empty.
+	EnvelopeID string
+	// RcptDSN holds the DSN parameters of each recipient in RcptTo that gave
+	// any, keyed by address.
+	RcptDSN map[string]RecipientDSN
+}
+
+// RecipientDSN holds the delivery status notification parameters of RCPT TO
+// (RFC 3461).
+type RecipientDSN struct {
+	// Notify is the NOTIFY parameter, either NotifyNever or any of
+	// NotifySuccess, NotifyFailure and NotifyDelay. If it is empty, only
+	// failures are reported.
+	Notify []string `json:",omitempty"`
+	// OriginalRecipient is the decoded ORCPT parameter, an address type and
+	// an address separated by a semicolon.
+	OriginalRecipient string `json:",omitempty"`
 }
 
-func WriteEnvelopeForDelivery(w io.Writer, e Envelope) {
+// The values of the RET parameter of MAIL FROM.
+const (
+	DSNReturnFull    = "FULL"
+	DSNReturnHeaders = "HDRS"
+)
+
+// The values of the NOTIFY parameter of RCPT TO.
+const (
+	NotifyNever   = "NEVER"
+	NotifySuccess = "SUCCESS"
+	NotifyFailure = "FAILURE"
+	NotifyDelay   = "DELAY"
+)
+
+// The values of the BODY parameter of MAIL FROM (RFC 6152, RFC 3030).
+const (
+	BodyType7Bit       = "7BIT"
+	BodyType8BitMIME   = "8BITMIME"
+	BodyTypeBinaryMIME = "BINARYMIME"
+)
+
+func WriteEnvelopeForDelivery(w io.Writer, e Envelope) error {
 	fmt.Fprintf(w, "Delivered-To: <%s>\r\n", e.RcptTo[0].Address)
 	fmt.Fprintf(w, "Return-Path: <%s>\r\n", e.MailFrom.Address)
-	w.Write(e.Data)
+	_, err := e.Data.WriteTo(w)
+	return err
 }
 
 func generateEnvelopeId(prefix string, t time.Time) string {
@@ -93,13 +218,33 @@ type Server interface {
 	Name() string
 	TLSConfig() *tls.Config
 	VerifyAddress(mail.Address) ReplyLine
+	// IsBlocked returns whether inbound mail for |rcpt|, which is an address
+	// of the server, is refused.
+	IsBlocked(rcpt mail.Address) bool
 	// Verify that the authc+passwd identity can send mail as authz.
 	Authenticate(authz, authc, passwd string) bool
+	// ScramCredentials returns the credentials with which the authc identity
+	// is verified by SCRAM-SHA-256, if it can send mail as authz.
+	ScramCredentials(authz, authc string) (sasl.ScramCredentials, bool)
 	DeliverMessage(Envelope) *ReplyLine
 
+	// CheckSender evaluates the SPF policy of the reverse-path of inbound mail,
+	// for the client at |remoteAddr| that gave the |ehlo| name. It may return
+	// nil to skip the check.
+	CheckSender(remoteAddr net.Addr, ehlo string, mailFrom mail.Address) *spf.Check
+	// RejectSPFFailure returns whether inbound mail for |rcpt| should be
+	// refused if its sender fails the SPF check.
+	RejectSPFFailure(rcpt mail.Address) bool
+
+	// MaxMessageSize returns the largest message, in bytes, that is accepted
+	// for or relayed from |addr|. If |addr| is empty, it returns the largest
+	// message that is accepted for any address. Zero means there is no limit.
+	MaxMessageSize(addr mail.Address) int64
+
 	// RelayMessage instructs the server to send the Envelope to another
-	// MTA for outbound delivery.
-	RelayMessage(Envelope)
+	// MTA for outbound delivery. A non-nil ReplyLine is returned if the
+	// server could not accept responsibility for the message.
+	RelayMessage(Envelope) *ReplyLine
 }
 
 type EmptyServerCallbacks struct{}
@@ -112,13 +257,34 @@ func (*EmptyServerCallbacks) VerifyAddress(mail.Address) ReplyLine {
 	return ReplyOK
 }
 
+func (*EmptyServerCallbacks) IsBlocked(mail.Address) bool {
+	return false
+}
+
 func (*EmptyServerCallbacks) Authenticate(authz, authc, passwd string) bool {
 	return false
 }
 
+func (*EmptyServerCallbacks) ScramCredentials(authz, authc string) (sasl.ScramCredentials, bool) {
+	return sasl.ScramCredentials{}, false
+}
+
 func (*EmptyServerCallbacks) DeliverMessage(Envelope) *ReplyLine {
 	return nil
 }
 
-func (*EmptyServerCallbacks) RelayMessage(Envelope) {
+func (*EmptyServerCallbacks) CheckSender(net.Addr, string, mail.Address) *spf.Check {
+	return nil
+}
+
+func (*EmptyServerCallbacks) RejectSPFFailure(mail.Address) bool {
+	return false
+}
+
+func (*EmptyServerCallbacks) MaxMessageSize(mail.Address) int64 {
+	return DefaultMaxMessageSize
+}
+
+func (*EmptyServerCallbacks) RelayMessage(Envelope) *ReplyLine {
+	return nil
 }
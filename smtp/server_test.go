@@ -18,6 +18,8 @@ func TestDomainForAddress(t *testing.T) {
 		{"foo@bar.com", "bar.com"},
 		{"abc", ""},
 		{"abc@one.two.three.four.net", "one.two.three.four.net"},
+		{"foo@Bar.COM", "bar.com"},
+		{"jösé@Bücher.example", "xn--bcher-kva.example"},
 	}
 	for i, c := range cases {
 		actual := DomainForAddress(mail.Address{Address: c.address})
@@ -26,3 +28,25 @@ func TestDomainForAddress(t *testing.T) {
 		}
 	}
 }
+
+func TestNormalizeAddress(t *testing.T) {
+	cases := []struct {
+		address, normalized string
+		valid               bool
+	}{
+		{"Foo@Bar.com", "Foo@bar.com", true},
+		{"Jösé@Bücher.Example", "Jösé@xn--bcher-kva.example", true},
+		{"user@xn--bcher-kva.example", "user@xn--bcher-kva.example", true},
+		{"abc", "abc", true},
+		{"user@-bücher.example", "", false},
+	}
+	for i, c := range cases {
+		normalized, err := NormalizeAddress(c.address)
+		if want, got := c.valid, err == nil; want != got {
+			t.Errorf("case %d, want valid %t, got error %v", i, want, err)
+		}
+		if want, got := c.normalized, normalized; want != got {
+			t.Errorf("case %d, got %q, expected %q", i, got, want)
+		}
+	}
+}
@@ -8,15 +8,26 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"io/ioutil"
+	"net"
 	"net/mail"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"go.uber.org/zap"
 
+	"src.bluestatic.org/mailpopbox/dkim"
 	"src.bluestatic.org/mailpopbox/smtp"
+	"src.bluestatic.org/mailpopbox/spf"
 )
 
 func TestVerifyAddress(t *testing.T) {
@@ -57,6 +68,118 @@ func TestVerifyAddress(t *testing.T) {
 	}
 }
 
+func TestInternationalizedDomain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Errorf("Failed to create temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	s := smtpServer{
+		config: Config{
+			Hostname: "mx.bücher.example",
+			Servers: []Server{
+				{
+					Domain:               "Bücher.example",
+					MailboxPassword:      "letmein",
+					MaildropPath:         dir,
+					BlacklistedAddresses: []string{"spam@bücher.example"},
+				},
+			},
+		},
+		log: zap.NewNop(),
+	}
+	if err := s.loadBlocklists(s.config); err != nil {
+		t.Fatal(err)
+	}
+
+	// Envelope addresses have IDNA A-label domains.
+	if s.VerifyAddress(mail.Address{Address: "jösé@xn--bcher-kva.example"}) != smtp.ReplyOK {
+		t.Errorf("Valid mailbox is not reported to be valid")
+	}
+	if !s.IsBlocked(mail.Address{Address: "Spam@xn--bcher-kva.example"}) {
+		t.Errorf("Blacklisted address is not blocked")
+	}
+	if s.IsBlocked(mail.Address{Address: "jösé@xn--bcher-kva.example"}) {
+		t.Errorf("Address is blocked")
+	}
+	if !s.Authenticate("", "mailbox@bücher.example", "letmein") {
+		t.Errorf("Failed to authenticate with the Unicode domain")
+	}
+	if !s.Authenticate("", "mailbox@xn--bcher-kva.example", "letmein") {
+		t.Errorf("Failed to authenticate with the A-label domain")
+	}
+}
+
+func TestVerifyBlacklistedAddress(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Errorf("Failed to create temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	configPath := filepath.Join(dir, "config.json")
+	writeConfig := func(blacklist ...string) {
+		config, _ := json.Marshal(Config{
+			Servers: []Server{
+				{
+					Domain:               "example.com",
+					MaildropPath:         dir,
+					BlacklistedAddresses: blacklist,
+				},
+			},
+		})
+		if err := ioutil.WriteFile(configPath, config, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("leaked@example.com", "*")
+
+	config, err := ReadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := smtpServer{
+		config:     config,
+		configPath: configPath,
+		log:        zap.NewNop(),
+	}
+	if err := s.loadBlocklists(config); err != nil {
+		t.Fatal(err)
+	}
+
+	if !s.IsBlocked(mail.Address{Address: "Leaked@Example.com"}) {
+		t.Errorf("Blacklisted address reports to be valid")
+	}
+	// Blocking only refuses inbound mail, so the address is still one of the
+	// server's own.
+	if s.VerifyAddress(mail.Address{Address: "leaked@example.com"}) != smtp.ReplyOK {
+		t.Errorf("Blacklisted address is not an address of the server")
+	}
+	if s.IsBlocked(mail.Address{Address: "mailbox@example.com"}) {
+		t.Errorf("Mailbox account must not be blocked")
+	}
+
+	writeConfig("leaked@example.com")
+	s.reloadBlocklists()
+
+	if !s.IsBlocked(mail.Address{Address: "leaked@example.com"}) {
+		t.Errorf("Blacklisted address reports to be valid after reload")
+	}
+	if s.IsBlocked(mail.Address{Address: "other@example.com"}) {
+		t.Errorf("Address removed from blacklist is not valid after reload")
+	}
+
+	writeConfig("[invalid")
+	s.reloadBlocklists()
+
+	if !s.IsBlocked(mail.Address{Address: "leaked@example.com"}) {
+		t.Errorf("Invalid config should not replace the blacklist")
+	}
+}
+
 func TestMessageDelivery(t *testing.T) {
 	dir, err := ioutil.TempDir("", "maildrop")
 	if err != nil {
@@ -81,7 +204,7 @@ func TestMessageDelivery(t *testing.T) {
 	env := smtp.Envelope{
 		MailFrom: mail.Address{Address: "sender@mail.net"},
 		RcptTo:   []mail.Address{{Address: "receive@example.com"}},
-		Data:     []byte("Hello, world"),
+		Data:     smtp.NewBody([]byte("Hello, world")),
 		ID:       "msgid",
 	}
 
@@ -100,11 +223,84 @@ func TestMessageDelivery(t *testing.T) {
 		t.Errorf("Failed to read message: %v", err)
 	}
 
-	if !bytes.Contains(data, env.Data) {
+	if !bytes.Contains(data, []byte("Hello, world")) {
 		t.Errorf("Could not find expected data in message")
 	}
 }
 
+func TestUserMessageDelivery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"mailbox", "alice", "bob"} {
+		if err := os.Mkdir(filepath.Join(dir, name), 0700); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := smtpServer{
+		config: Config{
+			Hostname: "mx.example.com",
+			Servers: []Server{
+				{
+					Domain:       "example.com",
+					MaildropPath: filepath.Join(dir, "mailbox"),
+					Users: []User{
+						{Name: "alice", MaildropPath: filepath.Join(dir, "alice"), Prefixes: []string{"shop-"}},
+						{Name: "bob", MaildropPath: filepath.Join(dir, "bob")},
+					},
+				},
+			},
+		},
+		log: zap.NewNop(),
+	}
+
+	env := smtp.Envelope{
+		MailFrom: mail.Address{Address: "sender@mail.net"},
+		RcptTo: []mail.Address{
+			{Address: "shop-books@example.com"},
+			{Address: "alice@example.com"},
+			{Address: "bob@example.com"},
+		},
+		Data: smtp.NewBody([]byte("Hello, world")),
+		ID:   "msgid",
+	}
+
+	if rl := s.DeliverMessage(env); rl != nil {
+		t.Errorf("Failed to deliver message: %v", rl)
+	}
+
+	deliveredTo := map[string]string{
+		"alice": "Delivered-To: <shop-books@example.com>",
+		"bob":   "Delivered-To: <bob@example.com>",
+	}
+	for name, header := range deliveredTo {
+		data, err := ioutil.ReadFile(filepath.Join(dir, name, "msgid.msg"))
+		if err != nil {
+			t.Errorf("Failed to read message for %s: %v", name, err)
+			continue
+		}
+		if !bytes.HasPrefix(data, []byte(header)) {
+			t.Errorf("Message for %s does not start with %q", name, header)
+		}
+	}
+
+	files, err := ioutil.ReadDir(filepath.Join(dir, "mailbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("Expected no messages for the mailbox account, got %d", len(files))
+	}
+
+	if s.IsBlocked(mail.Address{Address: "alice@example.com"}) {
+		t.Errorf("User account must not be blocked")
+	}
+}
+
 func TestAuthenticate(t *testing.T) {
 	server := smtpServer{
 		config: Config{
@@ -116,6 +312,13 @@ func TestAuthenticate(t *testing.T) {
 				Server{
 					Domain:          "domain2.xyz",
 					MailboxPassword: "d2",
+					Users: []User{
+						{Name: "user", Password: "u2"},
+					},
+				},
+				Server{
+					Domain:          "domain3.com",
+					MailboxPassword: "$2a$04$gDd3Bd2EcOmCmaYardwsduaPtNiTDpWwYT5JfBvpDNEFAjtLAYjuO",
 				},
 			},
 		},
@@ -133,6 +336,12 @@ func TestAuthenticate(t *testing.T) {
 		{"invalid", "mailbox@domain2.xyz", "d2", false},
 		{"", "mailbox@domain2.xyz", "d2", true},
 		{"", "", "", false},
+		{"", "mailbox@domain3.com", "d3", true},
+		{"", "user@domain2.xyz", "u2", true},
+		{"foo@domain2.xyz", "user@domain2.xyz", "u2", true},
+		{"", "user@domain2.xyz", "d2", false},
+		{"", "user@domain1.net", "u2", false},
+		{"", "mailbox@domain3.com", "$2a$04$gDd3Bd2EcOmCmaYardwsduaPtNiTDpWwYT5JfBvpDNEFAjtLAYjuO", false},
 	}
 
 	for i, test := range authTests {
@@ -141,4 +350,567 @@ func TestAuthenticate(t *testing.T) {
 			t.Errorf("Test %d, got %v, expected %v", i, actual, test.ok)
 		}
 	}
+
+	scramTests := []struct {
+		authz, authc string
+		ok           bool
+	}{
+		{"foo@domain1.net", "mailbox@domain1.net", true},
+		{"", "mailbox@domain2.xyz", true},
+		{"", "user@domain2.xyz", true},
+		{"foo@domain1.net", "mailbox@domain2.xyz", false},
+		{"", "mailbox@domain3.com", false}, // bcrypt hash.
+		{"", "mailbox@domain4.com", false},
+	}
+
+	for i, test := range scramTests {
+		creds, ok := server.ScramCredentials(test.authz, test.authc)
+		if ok != test.ok {
+			t.Errorf("SCRAM test %d, got %v, expected %v", i, ok, test.ok)
+		}
+		if ok && (len(creds.StoredKey) == 0 || len(creds.Salt) == 0) {
+			t.Errorf("SCRAM test %d, got empty credentials", i)
+		}
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	server := smtpServer{
+		config: Config{
+			Servers: []Server{
+				{Domain: "small.net", MaxMessageSize: 1024},
+				{Domain: "default.xyz"},
+			},
+		},
+	}
+
+	sizeTests := []struct {
+		address string
+		size    int64
+	}{
+		{"user@small.net", 1024},
+		{"user@default.xyz", smtp.DefaultMaxMessageSize},
+		{"user@other.com", smtp.DefaultMaxMessageSize},
+		{"", smtp.DefaultMaxMessageSize},
+	}
+	for i, test := range sizeTests {
+		if want, got := test.size, server.MaxMessageSize(mail.Address{Address: test.address}); want != got {
+			t.Errorf("Test %d, want %d, got %d", i, want, got)
+		}
+	}
+
+	server.config.Servers[1].MaxMessageSize = -1
+	if want, got := int64(0), server.MaxMessageSize(mail.Address{}); want != got {
+		t.Errorf("Want unlimited size, got %d", got)
+	}
+}
+
+func bodyBytes(t *testing.T, b *smtp.Body) []byte {
+	data, err := b.Bytes()
+	if err != nil {
+		t.Errorf("Failed to read message: %v", err)
+	}
+	return data
+}
+
+func TestDKIMSignRelayedMessage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dkim")
+	if err != nil {
+		t.Errorf("Failed to create temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPath := filepath.Join(dir, "dkim.pem")
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := smtpServer{
+		config: Config{
+			Servers: []Server{
+				{
+					Domain:   "example.com",
+					DKIMKeys: []DKIMKey{{Selector: "sel", KeyPath: keyPath}},
+				},
+				{
+					Domain: "unsigned.net",
+				},
+			},
+		},
+		log: zap.NewNop(),
+	}
+
+	signers, err := s.config.GetDKIMSigners()
+	if err != nil {
+		t.Fatalf("Failed to load DKIM keys: %v", err)
+	}
+	s.setDKIMSigners(signers)
+
+	data := []byte("From: <source@example.com>\nSubject: Hi\n\nHello\n")
+
+	env := smtp.Envelope{
+		MailFrom: mail.Address{Address: "source@example.com"},
+		Data:     smtp.NewBody(data),
+	}
+	s.signMessage(&env)
+
+	signed := bodyBytes(t, env.Data)
+	if !bytes.HasPrefix(signed, []byte("DKIM-Signature: ")) {
+		t.Errorf("Message was not signed: %q", signed)
+	}
+	if !bytes.Contains(signed, []byte("d=example.com; s=sel;")) {
+		t.Errorf("Signature has wrong domain or selector: %q", signed)
+	}
+	if !bytes.HasSuffix(signed, data) {
+		t.Errorf("Signed message does not end with original message: %q", signed)
+	}
+
+	env = smtp.Envelope{
+		MailFrom: mail.Address{Address: "source@unsigned.net"},
+		Data:     smtp.NewBody(data),
+	}
+	s.signMessage(&env)
+
+	if unsigned := bodyBytes(t, env.Data); !bytes.Equal(unsigned, data) {
+		t.Errorf("Message without DKIM key should not be modified: %q", unsigned)
+	}
+
+	// A notification with the null reverse-path is signed for its From.
+	env = smtp.Envelope{
+		Data: smtp.NewBody(data),
+	}
+	s.signMessage(&env)
+
+	if signed := bodyBytes(t, env.Data); !bytes.Contains(signed, []byte("d=example.com; s=sel;")) {
+		t.Errorf("Notification was not signed for its From: %q", signed)
+	}
+
+	// A key that cannot be read on reload leaves the loaded keys in place.
+	if err := os.Remove(keyPath); err != nil {
+		t.Fatal(err)
+	}
+	s.reloadDKIMSigners()
+
+	env = smtp.Envelope{
+		MailFrom: mail.Address{Address: "source@example.com"},
+		Data:     smtp.NewBody(data),
+	}
+	s.signMessage(&env)
+
+	if signed := bodyBytes(t, env.Data); !bytes.HasPrefix(signed, []byte("DKIM-Signature: ")) {
+		t.Errorf("Message was not signed after failed reload: %q", signed)
+	}
+}
+
+type testResolver struct {
+	txt map[string][]string
+	ips map[string][]net.IPAddr
+}
+
+func (r *testResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txt, ok := r.txt[name]; ok {
+		return txt, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *testResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	if ips, ok := r.ips[host]; ok {
+		return ips, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func (r *testResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *testResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	return nil, &net.DNSError{Err: "no such host", Name: addr, IsNotFound: true}
+}
+
+func TestAuthenticationResults(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Errorf("Failed to create temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := smtpServer{
+		config: Config{
+			Hostname: "mx.example.com",
+			Servers: []Server{
+				{
+					Domain:       "example.com",
+					MaildropPath: dir,
+				},
+			},
+		},
+		resolver: &testResolver{
+			txt: map[string][]string{
+				"sel._domainkey.sender.net": {"v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(pub)},
+			},
+		},
+		log: zap.NewNop(),
+	}
+
+	msg := []byte("From: <source@sender.net>\n" +
+		"Authentication-Results: mx.example.com; dkim=pass\n" +
+		"\theader.d=forged.net\n" +
+		"Authentication-Results: other.example.net; dkim=fail\n" +
+		"Subject: Hi\n\nHello\n")
+	signer := &dkim.Signer{Domain: "sender.net", Selector: "sel", Key: key}
+	sig, err := signer.Sign(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliver := func(data []byte) string {
+		env := smtp.Envelope{
+			RemoteAddr: &net.IPAddr{IP: net.ParseIP("127.0.0.1")},
+			MailFrom:   mail.Address{Address: "source@sender.net"},
+			RcptTo:     []mail.Address{{Address: "receive@example.com"}},
+			Data:       smtp.NewBody(data),
+			ID:         "msgid",
+		}
+		if rl := s.DeliverMessage(env); rl != nil {
+			t.Fatalf("Failed to deliver message: %v", rl)
+		}
+		delivered, err := ioutil.ReadFile(filepath.Join(dir, "msgid.msg"))
+		if err != nil {
+			t.Fatalf("Failed to read message: %v", err)
+		}
+		return string(delivered)
+	}
+
+	delivered := deliver(append([]byte(sig), msg...))
+	if !strings.Contains(delivered, "Authentication-Results: mx.example.com;\r\n\tdkim=pass header.d=sender.net header.i=@sender.net header.s=sel header.a=ed25519-sha256") {
+		t.Errorf("Missing passing Authentication-Results: %q", delivered)
+	}
+	if strings.Contains(delivered, "forged.net") {
+		t.Errorf("Forged Authentication-Results was not removed: %q", delivered)
+	}
+	if !strings.Contains(delivered, "Authentication-Results: other.example.net; dkim=fail\n") {
+		t.Errorf("Authentication-Results from another server was removed: %q", delivered)
+	}
+
+	delivered = deliver(bytes.Replace(append([]byte(sig), msg...), []byte("Hello"), []byte("Goodbye"), 1))
+	if !strings.Contains(delivered, "Authentication-Results: mx.example.com;\r\n\tdkim=fail (body hash did not verify)") {
+		t.Errorf("Missing failing Authentication-Results: %q", delivered)
+	}
+
+	delivered = deliver([]byte("From: <source@sender.net>\n\nHello\n"))
+	if !strings.Contains(delivered, "Authentication-Results: mx.example.com;\r\n\tdkim=none;\r\n\tdmarc=none header.from=sender.net\r\n") {
+		t.Errorf("Missing Authentication-Results for unsigned message: %q", delivered)
+	}
+}
+
+func TestCheckSender(t *testing.T) {
+	s := smtpServer{
+		config: Config{
+			Hostname: "mx.example.com",
+			Servers: []Server{
+				{
+					Domain:    "example.com",
+					SPFPolicy: SPFPolicyReject,
+				},
+				{
+					Domain: "annotate.net",
+				},
+			},
+		},
+		resolver: &testResolver{
+			txt: map[string][]string{
+				"sender.net": {"v=spf1 ip4:192.0.2.0/24 -all"},
+			},
+		},
+		log: zap.NewNop(),
+	}
+
+	check := s.CheckSender(&net.TCPAddr{IP: net.ParseIP("192.0.2.5"), Port: 4321}, "mail.sender.net", mail.Address{Address: "a@sender.net"})
+	if check == nil || check.Result != spf.ResultPass {
+		t.Errorf("Expected SPF pass, got %v", check)
+	}
+
+	check = s.CheckSender(&net.TCPAddr{IP: net.ParseIP("198.51.100.5"), Port: 4321}, "mail.sender.net", mail.Address{Address: "a@sender.net"})
+	if check == nil || check.Result != spf.ResultFail {
+		t.Errorf("Expected SPF fail, got %v", check)
+	}
+
+	if !s.RejectSPFFailure(mail.Address{Address: "user@example.com"}) {
+		t.Errorf("Expected example.com to reject SPF failures")
+	}
+	if s.RejectSPFFailure(mail.Address{Address: "user@annotate.net"}) {
+		t.Errorf("Expected annotate.net to accept SPF failures")
+	}
+
+	en := smtp.Envelope{
+		RemoteAddr: &net.IPAddr{IP: net.ParseIP("198.51.100.5")},
+		RcptTo:     []mail.Address{{Address: "user@example.com"}},
+		Data:       smtp.NewBody([]byte("From: <a@sender.net>\n\nHello\n")),
+		SPF:        check,
+	}
+	if reply := s.authenticateMessage(&en); reply != nil {
+		t.Errorf("Unexpected reply: %v", reply)
+	}
+	want := "Authentication-Results: mx.example.com;\r\n\tspf=fail smtp.mailfrom=a@sender.net;\r\n\tdkim=none;\r\n\tdmarc=none header.from=sender.net\r\n"
+	if got := bodyBytes(t, en.Data); !bytes.HasPrefix(got, []byte(want)) {
+		t.Errorf("Expected Authentication-Results %q, got %q", want, got)
+	}
+}
+
+func TestDMARCPolicy(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Errorf("Failed to create temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	s := smtpServer{
+		config: Config{
+			Hostname: "mx.example.com",
+			Servers: []Server{
+				{
+					Domain:       "enforce.com",
+					MaildropPath: dir,
+					DMARCPolicy:  DMARCPolicyEnforce,
+				},
+				{
+					Domain:       "quarantine.com",
+					MaildropPath: dir,
+					DMARCPolicy:  DMARCPolicyQuarantine,
+				},
+				{
+					Domain:       "annotate.com",
+					MaildropPath: dir,
+				},
+			},
+		},
+		resolver: &testResolver{
+			txt: map[string][]string{
+				"_dmarc.bank.net": {"v=DMARC1; p=reject"},
+			},
+		},
+		log: zap.NewNop(),
+	}
+
+	deliver := func(rcpt string) (*smtp.ReplyLine, string) {
+		env := smtp.Envelope{
+			RemoteAddr: &net.IPAddr{IP: net.ParseIP("198.51.100.5")},
+			MailFrom:   mail.Address{Address: "spoof@bank.net"},
+			RcptTo:     []mail.Address{{Address: rcpt}},
+			Data:       smtp.NewBody([]byte("From: Bank <support@bank.net>\nSubject: Urgent\n\nHello\n")),
+			ID:         "msgid",
+			SPF:        &spf.Check{Result: spf.ResultFail, Domain: "bank.net"},
+		}
+		os.Remove(filepath.Join(dir, "msgid.msg"))
+		reply := s.DeliverMessage(env)
+		delivered, _ := ioutil.ReadFile(filepath.Join(dir, "msgid.msg"))
+		return reply, string(delivered)
+	}
+
+	reply, delivered := deliver("victim@enforce.com")
+	if reply == nil || reply.Code != 550 {
+		t.Errorf("Expected message to be rejected, got %v", reply)
+	}
+	if delivered != "" {
+		t.Errorf("Rejected message was delivered: %q", delivered)
+	}
+
+	reply, delivered = deliver("victim@quarantine.com")
+	if reply != nil {
+		t.Errorf("Unexpected reply: %v", reply)
+	}
+	if !strings.Contains(delivered, "X-Quarantine-Reason: DMARC policy of bank.net\r\n") {
+		t.Errorf("Message was not quarantined: %q", delivered)
+	}
+	if !strings.Contains(delivered, "dmarc=fail (p=reject dis=reject) header.from=bank.net") {
+		t.Errorf("Missing DMARC Authentication-Results: %q", delivered)
+	}
+
+	reply, delivered = deliver("victim@annotate.com")
+	if reply != nil {
+		t.Errorf("Unexpected reply: %v", reply)
+	}
+	if strings.Contains(delivered, "X-Quarantine-Reason") {
+		t.Errorf("Message should not be quarantined: %q", delivered)
+	}
+	if !strings.Contains(delivered, "dmarc=fail (p=reject dis=reject) header.from=bank.net") {
+		t.Errorf("Missing DMARC Authentication-Results: %q", delivered)
+	}
+}
+
+func TestBlockCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Errorf("Failed to create temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	s := smtpServer{
+		config: Config{
+			Hostname: "mx.example.com",
+			Servers: []Server{
+				{
+					Domain:       "example.com",
+					MaildropPath: dir,
+				},
+			},
+		},
+		log: zap.NewNop(),
+	}
+
+	sendCommand := func(id, subject string) {
+		env := smtp.Envelope{
+			MailFrom: mail.Address{Address: "shop@example.com"},
+			RcptTo:   []mail.Address{{Address: "MAILBOX@example.com"}},
+			Data:     smtp.NewBody([]byte("From: <shop@example.com>\nSubject: " + subject + "\n\n")),
+			ID:       id,
+		}
+		if rl := s.RelayMessage(env); rl != nil {
+			t.Errorf("Failed to handle command: %v", rl)
+		}
+	}
+
+	alias := mail.Address{Address: "Leaked.Shop@example.com"}
+	if s.IsBlocked(alias) {
+		t.Errorf("Alias should be valid before blocking")
+	}
+
+	sendCommand("block", "[block:leaked.shop]")
+
+	if !s.IsBlocked(alias) {
+		t.Errorf("Blocked alias reports to be valid")
+	}
+	aliases, err := ioutil.ReadFile(filepath.Join(dir, "blocked-aliases"))
+	if err != nil {
+		t.Errorf("Failed to read blocked aliases: %v", err)
+	}
+	if want, got := "leaked.shop@example.com\n", string(aliases); want != got {
+		t.Errorf("Want blocked aliases %q, got %q", want, got)
+	}
+	confirmation, err := ioutil.ReadFile(filepath.Join(dir, "block.confirm.msg"))
+	if err != nil {
+		t.Errorf("Failed to read confirmation: %v", err)
+	}
+	if !bytes.Contains(confirmation, []byte("leaked.shop@example.com is now blocked")) {
+		t.Errorf("Unexpected confirmation: %q", confirmation)
+	}
+
+	// The blocked aliases survive a restart.
+	if err := s.loadBlocklists(s.config); err != nil {
+		t.Fatal(err)
+	}
+	if !s.IsBlocked(alias) {
+		t.Errorf("Blocked alias reports to be valid after reload")
+	}
+
+	sendCommand("unblock", "Re: [UNBLOCK: leaked.shop]")
+
+	if s.IsBlocked(alias) {
+		t.Errorf("Unblocked alias should be valid")
+	}
+	confirmation, err = ioutil.ReadFile(filepath.Join(dir, "unblock.confirm.msg"))
+	if err != nil {
+		t.Errorf("Failed to read confirmation: %v", err)
+	}
+	if !bytes.Contains(confirmation, []byte("leaked.shop@example.com is no longer blocked")) {
+		t.Errorf("Unexpected confirmation: %q", confirmation)
+	}
+
+	sendCommand("mailbox", "[block:mailbox]")
+	if s.IsBlocked(mail.Address{Address: "mailbox@example.com"}) {
+		t.Errorf("Mailbox account must not be blocked")
+	}
+
+	// A UTF-8 alias, in an encoded Subject, can be blocked too.
+	utf8Alias := mail.Address{Address: "Bücher@example.com"}
+	sendCommand("utf8", "=?UTF-8?Q?[block:B=C3=BCcher]?=")
+	if !s.IsBlocked(utf8Alias) {
+		t.Errorf("UTF-8 alias was not blocked")
+	}
+	if s.IsBlocked(mail.Address{Address: "bucher@example.com"}) {
+		t.Errorf("Blocking a UTF-8 alias blocked a different alias")
+	}
+}
+
+func TestBlockCommandAfterReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "maildrop")
+	if err != nil {
+		t.Errorf("Failed to create temp dir: %v", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	configPath := filepath.Join(dir, "config.json")
+	writeConfig := func(blacklist ...string) {
+		config, _ := json.Marshal(Config{
+			Hostname: "mx.example.com",
+			Servers: []Server{
+				{
+					Domain:               "example.com",
+					MaildropPath:         dir,
+					BlacklistedAddresses: blacklist,
+				},
+			},
+		})
+		if err := ioutil.WriteFile(configPath, config, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeConfig("old@example.com")
+
+	config, err := ReadConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := smtpServer{
+		config:     config,
+		configPath: configPath,
+		log:        zap.NewNop(),
+	}
+	if err := s.loadBlocklists(config); err != nil {
+		t.Fatal(err)
+	}
+
+	writeConfig("new@example.com")
+	s.reloadBlocklists()
+
+	env := smtp.Envelope{
+		MailFrom: mail.Address{Address: "shop@example.com"},
+		RcptTo:   []mail.Address{{Address: "mailbox@example.com"}},
+		Data:     smtp.NewBody([]byte("From: <shop@example.com>\nSubject: [block:alias]\n\n")),
+		ID:       "block",
+	}
+	if rl := s.RelayMessage(env); rl != nil {
+		t.Errorf("Failed to handle command: %v", rl)
+	}
+
+	if !s.IsBlocked(mail.Address{Address: "alias@example.com"}) {
+		t.Errorf("Blocked alias reports to be valid")
+	}
+	if !s.IsBlocked(mail.Address{Address: "new@example.com"}) {
+		t.Errorf("Reloaded blacklisted address is not blocked after alias command")
+	}
+	if s.IsBlocked(mail.Address{Address: "old@example.com"}) {
+		t.Errorf("Blacklisted address removed by reload is blocked after alias command")
+	}
 }
@@ -0,0 +1,66 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package spf
+
+import (
+	"fmt"
+	"strings"
+)
+
+// comment explains the result of the Check, as seen by |receiver|.
+func (c Check) comment(receiver string) string {
+	var s string
+	switch c.Result {
+	case ResultPass:
+		s = fmt.Sprintf("domain of %s designates %s as permitted sender", c.Sender, c.IP)
+	case ResultFail:
+		s = fmt.Sprintf("domain of %s does not designate %s as permitted sender", c.Sender, c.IP)
+	case ResultSoftFail:
+		s = fmt.Sprintf("domain of transitioning %s does not designate %s as permitted sender", c.Sender, c.IP)
+	case ResultNeutral:
+		s = fmt.Sprintf("%s is neither permitted nor denied by domain of %s", c.IP, c.Sender)
+	case ResultNone:
+		s = fmt.Sprintf("domain of %s does not publish an SPF record", c.Sender)
+	default:
+		s = fmt.Sprintf("error evaluating SPF record of %s", c.Domain)
+		if c.Err != nil {
+			s += ": " + c.Err.Error()
+		}
+	}
+	return receiver + ": " + strings.NewReplacer("(", "", ")", "").Replace(s)
+}
+
+// ReceivedSPF formats the Check as the value of a Received-SPF header field
+// (RFC 7208 § 9.1) added by the host named |receiver|.
+func (c Check) ReceivedSPF(receiver string) string {
+	return fmt.Sprintf("%s (%s) client-ip=%s; envelope-from=%s; helo=%s; receiver=%s; identity=%s;",
+		c.Result, c.comment(receiver), c.IP, quoteValue(c.Sender), quoteValue(c.HELO), receiver, c.Identity)
+}
+
+// AuthResult formats the Check as a method result for an
+// Authentication-Results header field (RFC 8601).
+func (c Check) AuthResult() string {
+	s := "spf=" + string(c.Result)
+	if c.Err != nil {
+		s += " (" + strings.NewReplacer("(", "", ")", "").Replace(c.Err.Error()) + ")"
+	}
+	if c.Identity == "helo" {
+		return s + " smtp.helo=" + quoteValue(c.HELO)
+	}
+	if at := strings.LastIndexByte(c.Sender, '@'); at > 0 && quoteValue(c.Sender[:at]) == c.Sender[:at] {
+		return s + " smtp.mailfrom=" + c.Sender
+	}
+	return s + " smtp.mailfrom=" + quoteValue(c.Sender)
+}
+
+// quoteValue returns |s| as a quoted-string if it is not a dot-atom.
+func quoteValue(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789.-_+") == "" {
+		return s
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
@@ -0,0 +1,202 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package spf
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// expandMacro expands the macro-string |s| (RFC 7208 § 7), calling |lookup| to
+// get the value of each macro letter.
+func expandMacro(s string, lookup func(letter byte) (string, error)) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b.WriteByte(s[i])
+			continue
+		}
+
+		i++
+		if i == len(s) {
+			return "", fmt.Errorf("invalid macro in %q", s)
+		}
+		switch s[i] {
+		case '%':
+			b.WriteByte('%')
+			continue
+		case '_':
+			b.WriteByte(' ')
+			continue
+		case '-':
+			b.WriteString("%20")
+			continue
+		case '{':
+		default:
+			return "", fmt.Errorf("invalid macro in %q", s)
+		}
+
+		end := strings.IndexByte(s[i:], '}')
+		if end == -1 || end < 2 {
+			return "", fmt.Errorf("invalid macro in %q", s)
+		}
+		macro := s[i+1 : i+end]
+		i += end
+
+		value, err := expandOne(macro, lookup)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(value)
+	}
+	return b.String(), nil
+}
+
+// expandOne expands the body of a single %{...} macro.
+func expandOne(macro string, lookup func(letter byte) (string, error)) (string, error) {
+	letter := macro[0]
+	lower := letter | 0x20
+	if strings.IndexByte("slodiphv", lower) == -1 {
+		return "", fmt.Errorf("invalid macro letter %q", letter)
+	}
+
+	value, err := lookup(lower)
+	if err != nil {
+		return "", err
+	}
+
+	rest := macro[1:]
+	digits := 0
+	for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+		digits++
+	}
+	keep := -1
+	if digits > 0 {
+		keep, err = strconv.Atoi(rest[:digits])
+		if err != nil || keep == 0 {
+			return "", fmt.Errorf("invalid macro transformer %q", macro)
+		}
+	}
+	rest = rest[digits:]
+
+	reverse := false
+	if len(rest) > 0 && (rest[0] == 'r' || rest[0] == 'R') {
+		reverse = true
+		rest = rest[1:]
+	}
+
+	delimiters := "."
+	if rest != "" {
+		if strings.Trim(rest, ".-+,/_=") != "" {
+			return "", fmt.Errorf("invalid macro delimiter %q", macro)
+		}
+		delimiters = rest
+	}
+
+	parts := strings.FieldsFunc(value, func(r rune) bool {
+		return strings.ContainsRune(delimiters, r)
+	})
+	if reverse {
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+	}
+	if keep > 0 && keep < len(parts) {
+		parts = parts[len(parts)-keep:]
+	}
+	value = strings.Join(parts, ".")
+
+	if letter != lower {
+		value = url.QueryEscape(value)
+		value = strings.ReplaceAll(value, "+", "%20")
+	}
+	return value, nil
+}
+
+// validateMacro checks the syntax of the macro-string |s|.
+func validateMacro(s string) error {
+	_, err := expandMacro(s, func(byte) (string, error) {
+		return "", nil
+	})
+	return err
+}
+
+// expandDomain expands the domain-spec |spec| in the context of the record
+// for |domain|, and shortens the result to a valid length (RFC 7208 § 7.3).
+func (e *evaluator) expandDomain(spec, domain string) (string, error) {
+	expanded, err := expandMacro(spec, func(letter byte) (string, error) {
+		return e.macroValue(letter, domain), nil
+	})
+	if err != nil {
+		return "", permError("%v", err)
+	}
+
+	expanded = strings.TrimSuffix(expanded, ".")
+	for len(expanded) > 253 {
+		idx := strings.IndexByte(expanded, '.')
+		if idx == -1 {
+			break
+		}
+		expanded = expanded[idx+1:]
+	}
+	return expanded, nil
+}
+
+// macroValue returns the value of the macro |letter| (RFC 7208 § 7.2).
+func (e *evaluator) macroValue(letter byte, domain string) string {
+	at := strings.LastIndexByte(e.sender, '@')
+	switch letter {
+	case 's':
+		return e.sender
+	case 'l':
+		if at <= 0 {
+			return "postmaster"
+		}
+		return e.sender[:at]
+	case 'o':
+		return e.sender[at+1:]
+	case 'd':
+		return domain
+	case 'i':
+		return macroIP(e.ip)
+	case 'p':
+		names := e.validatedNames()
+		for _, name := range names {
+			if strings.EqualFold(name, domain) || hasSuffixFold(name, "."+domain) {
+				return name
+			}
+		}
+		if len(names) > 0 {
+			return names[0]
+		}
+		return "unknown"
+	case 'v':
+		if e.ip.To4() != nil {
+			return "in-addr"
+		}
+		return "ip6"
+	case 'h':
+		return e.helo
+	}
+	return ""
+}
+
+// macroIP formats |ip| for the "i" macro: IPv4 addresses in dotted-quad form
+// and IPv6 addresses as dot-separated nibbles.
+func macroIP(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+	nibbles := make([]string, 0, 32)
+	for _, b := range ip.To16() {
+		nibbles = append(nibbles, strconv.FormatUint(uint64(b>>4), 16), strconv.FormatUint(uint64(b&0xf), 16))
+	}
+	return strings.Join(nibbles, ".")
+}
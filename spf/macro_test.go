@@ -0,0 +1,74 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package spf
+
+import (
+	"net"
+	"testing"
+)
+
+// RFC 7208 § 7.4
+func TestMacroExpansion(t *testing.T) {
+	e := &evaluator{
+		resolver: &testResolver{},
+		ip:       net.ParseIP("192.0.2.3").To4(),
+		sender:   "strong-bad@email.example.com",
+		helo:     "mx.example.org",
+	}
+
+	tests := []struct {
+		macro, expanded string
+	}{
+		{"%{s}", "strong-bad@email.example.com"},
+		{"%{o}", "email.example.com"},
+		{"%{d}", "email.example.com"},
+		{"%{d4}", "email.example.com"},
+		{"%{d3}", "email.example.com"},
+		{"%{d2}", "example.com"},
+		{"%{d1}", "com"},
+		{"%{dr}", "com.example.email"},
+		{"%{d2r}", "example.email"},
+		{"%{l}", "strong-bad"},
+		{"%{l-}", "strong.bad"},
+		{"%{lr}", "strong-bad"},
+		{"%{lr-}", "bad.strong"},
+		{"%{l1r-}", "strong"},
+		{"%{h}", "mx.example.org"},
+		{"%{p}", "unknown"},
+		{"%%%_%-", "% %20"},
+		{"%{S}", "strong-bad%40email.example.com"},
+		{"%{ir}.%{v}._spf.%{d2}", "3.2.0.192.in-addr._spf.example.com"},
+		{"%{lr-}.lp._spf.%{d2}", "bad.strong.lp._spf.example.com"},
+		{"%{lr-}.lp.%{ir}.%{v}._spf.%{d2}", "bad.strong.lp.3.2.0.192.in-addr._spf.example.com"},
+		{"%{ir}.%{v}.%{l1r-}.lp._spf.%{d2}", "3.2.0.192.in-addr.strong.lp._spf.example.com"},
+		{"%{d2}.trusted-domains.example.net", "example.com.trusted-domains.example.net"},
+	}
+	for _, test := range tests {
+		expanded, err := e.expandDomain(test.macro, "email.example.com")
+		if err != nil {
+			t.Errorf("Failed to expand %q: %v", test.macro, err)
+			continue
+		}
+		if expanded != test.expanded {
+			t.Errorf("Expand %q: want %q, got %q", test.macro, test.expanded, expanded)
+		}
+	}
+
+	e.ip = net.ParseIP("2001:db8::cb01")
+	want := "1.0.b.c.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6._spf.example.com"
+	if got, _ := e.expandDomain("%{ir}.%{v}._spf.%{d2}", "email.example.com"); want != got {
+		t.Errorf("Want %q, got %q", want, got)
+	}
+}
+
+func TestInvalidMacro(t *testing.T) {
+	for _, macro := range []string{"%", "%a", "%{", "%{}", "%{x}", "%{d0}", "%{d2x}", "%{c}"} {
+		if err := validateMacro(macro); err == nil {
+			t.Errorf("Expected %q to be invalid", macro)
+		}
+	}
+}
@@ -0,0 +1,590 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+// Package spf implements the Sender Policy Framework (RFC 7208), which
+// determines whether a host is authorized to send mail for a domain.
+package spf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxDNSLookups is the number of mechanisms and modifiers that cause DNS
+	// queries that may be evaluated for a single check (RFC 7208 § 4.6.4).
+	maxDNSLookups = 10
+	// maxVoidLookups is the number of DNS queries that may return no records.
+	maxVoidLookups = 2
+	// maxNames is the number of MX or PTR names that are examined by a single
+	// mechanism.
+	maxNames = 10
+)
+
+// Resolver performs the DNS queries needed to evaluate SPF records. It is
+// implemented by *net.Resolver.
+type Resolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupAddr(ctx context.Context, addr string) ([]string, error)
+}
+
+// Result is the outcome of an SPF evaluation (RFC 7208 § 2.6).
+type Result string
+
+const (
+	ResultNone      Result = "none"
+	ResultNeutral   Result = "neutral"
+	ResultPass      Result = "pass"
+	ResultFail      Result = "fail"
+	ResultSoftFail  Result = "softfail"
+	ResultTempError Result = "temperror"
+	ResultPermError Result = "permerror"
+)
+
+// evalError is an error that ends evaluation with a temperror or permerror
+// result.
+type evalError struct {
+	result Result
+	msg    string
+}
+
+func (e *evalError) Error() string {
+	return e.msg
+}
+
+func tempError(format string, args ...interface{}) error {
+	return &evalError{ResultTempError, fmt.Sprintf(format, args...)}
+}
+
+func permError(format string, args ...interface{}) error {
+	return &evalError{ResultPermError, fmt.Sprintf(format, args...)}
+}
+
+// resultForError returns the Result that |err| causes.
+func resultForError(err error) Result {
+	var ee *evalError
+	if errors.As(err, &ee) {
+		return ee.result
+	}
+	return ResultTempError
+}
+
+// Check is the outcome of evaluating the SPF policy for the sender of a
+// message.
+type Check struct {
+	Result Result
+	// Identity is the identity that was checked, either "mailfrom" or "helo".
+	Identity string
+	// Sender is the checked address. For the "helo" identity, it is
+	// postmaster@<HELO>.
+	Sender string
+	// Domain is the domain whose policy was evaluated.
+	Domain string
+	// IP is the address of the client.
+	IP net.IP
+	// HELO is the name the client gave in its HELO or EHLO command.
+	HELO string
+	// Err describes the cause of a temperror or permerror Result.
+	Err error
+}
+
+// Evaluate checks whether the client at |ip| is authorized to send mail for
+// the reverse-path |mailFrom|. If |mailFrom| is empty, as it is for delivery
+// status notifications, the |helo| identity is checked instead (RFC 7208
+// § 2.4).
+func Evaluate(ctx context.Context, resolver Resolver, ip net.IP, helo, mailFrom string) Check {
+	c := Check{
+		Identity: "mailfrom",
+		Sender:   mailFrom,
+		IP:       ip,
+		HELO:     helo,
+	}
+	if mailFrom == "" {
+		c.Identity = "helo"
+		c.Sender = "postmaster@" + helo
+	}
+	if !strings.Contains(c.Sender, "@") {
+		c.Sender = "postmaster@" + c.Sender
+	}
+
+	c.Domain = c.Sender[strings.LastIndexByte(c.Sender, '@')+1:]
+	c.Result, c.Err = CheckHost(ctx, resolver, ip, c.Domain, c.Sender, helo)
+	return c
+}
+
+// CheckHost implements the check_host() function of RFC 7208 § 4, evaluating
+// the SPF record of |domain| for a message from |sender| sent by the client at
+// |ip|, which gave the |helo| name. The error describes the reason for a
+// temperror or permerror Result.
+func CheckHost(ctx context.Context, resolver Resolver, ip net.IP, domain, sender, helo string) (Result, error) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	e := &evaluator{
+		ctx:      ctx,
+		resolver: resolver,
+		ip:       ip,
+		sender:   sender,
+		helo:     helo,
+	}
+	return e.checkHost(strings.TrimSuffix(domain, "."))
+}
+
+// evaluator holds the state of a single check, which is shared by all the
+// records visited through include and redirect.
+type evaluator struct {
+	ctx      context.Context
+	resolver Resolver
+
+	ip     net.IP
+	sender string
+	helo   string
+
+	// The number of DNS-querying terms and void lookups so far.
+	lookups int
+	voids   int
+}
+
+func (e *evaluator) checkHost(domain string) (Result, error) {
+	if !isValidDomain(domain) {
+		return ResultNone, fmt.Errorf("invalid domain %q", domain)
+	}
+
+	record, err := e.lookupRecord(domain)
+	if err != nil {
+		return resultForError(err), err
+	}
+	if record == nil {
+		return ResultNone, nil
+	}
+
+	for _, m := range record.mechanisms {
+		match, err := e.matches(m, domain)
+		if err != nil {
+			return resultForError(err), err
+		}
+		if match {
+			return m.result(), nil
+		}
+	}
+
+	if record.redirect != "" {
+		if err := e.countLookup(); err != nil {
+			return ResultPermError, err
+		}
+		target, err := e.expandDomain(record.redirect, domain)
+		if err != nil {
+			return ResultPermError, err
+		}
+		result, err := e.checkHost(target)
+		if result == ResultNone {
+			return ResultPermError, fmt.Errorf("redirect domain %s has no SPF record", target)
+		}
+		return result, err
+	}
+
+	return ResultNeutral, nil
+}
+
+// lookupRecord finds and parses the SPF record of |domain|. It returns nil if
+// the domain does not publish one.
+func (e *evaluator) lookupRecord(domain string) (*record, error) {
+	txts, err := e.resolver.LookupTXT(e.ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, nil
+		}
+		return nil, tempError("failed to look up SPF record of %s: %v", domain, err)
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if strings.EqualFold(txt, "v=spf1") || (len(txt) > 7 && strings.EqualFold(txt[:7], "v=spf1 ")) {
+			records = append(records, txt)
+		}
+	}
+
+	switch len(records) {
+	case 0:
+		return nil, nil
+	case 1:
+		r, err := parseRecord(records[0])
+		if err != nil {
+			return nil, permError("%s: %v", domain, err)
+		}
+		return r, nil
+	}
+	return nil, permError("%s has %d SPF records", domain, len(records))
+}
+
+// countLookup records a term that causes DNS queries and fails once the limit
+// is exceeded.
+func (e *evaluator) countLookup() error {
+	e.lookups++
+	if e.lookups > maxDNSLookups {
+		return permError("more than %d DNS lookups", maxDNSLookups)
+	}
+	return nil
+}
+
+// countVoid records a DNS query that returned no records and fails once the
+// limit is exceeded.
+func (e *evaluator) countVoid() error {
+	e.voids++
+	if e.voids > maxVoidLookups {
+		return permError("more than %d void DNS lookups", maxVoidLookups)
+	}
+	return nil
+}
+
+// lookupIPs returns the addresses of |host|.
+func (e *evaluator) lookupIPs(host string) ([]net.IP, error) {
+	addrs, err := e.resolver.LookupIPAddr(e.ctx, host)
+	if err != nil && !isNotFound(err) {
+		return nil, tempError("failed to look up %s: %v", host, err)
+	}
+	if len(addrs) == 0 {
+		return nil, e.countVoid()
+	}
+
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+func (e *evaluator) matches(m mechanism, domain string) (bool, error) {
+	switch m.name {
+	case "all":
+		return true, nil
+	case "ip4", "ip6":
+		return m.network.Contains(e.ip) && (e.ip.To4() != nil) == (m.name == "ip4"), nil
+	}
+
+	if err := e.countLookup(); err != nil {
+		return false, err
+	}
+
+	target := domain
+	if m.domain != "" {
+		var err error
+		target, err = e.expandDomain(m.domain, domain)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	switch m.name {
+	case "include":
+		result, err := e.checkHost(target)
+		switch result {
+		case ResultPass:
+			return true, nil
+		case ResultFail, ResultSoftFail, ResultNeutral:
+			return false, nil
+		case ResultTempError:
+			return false, err
+		case ResultNone:
+			return false, permError("included domain %s has no SPF record", target)
+		}
+		return false, err
+
+	case "a":
+		ips, err := e.lookupIPs(target)
+		if err != nil {
+			return false, err
+		}
+		return m.matchesAny(e.ip, ips), nil
+
+	case "mx":
+		mxs, err := e.resolver.LookupMX(e.ctx, target)
+		if err != nil && !isNotFound(err) {
+			return false, tempError("failed to look up MX of %s: %v", target, err)
+		}
+		if len(mxs) == 0 {
+			return false, e.countVoid()
+		}
+		if len(mxs) > maxNames {
+			return false, permError("%s has more than %d MX records", target, maxNames)
+		}
+		for _, mx := range mxs {
+			ips, err := e.lookupIPs(strings.TrimSuffix(mx.Host, "."))
+			if err != nil {
+				return false, err
+			}
+			if m.matchesAny(e.ip, ips) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "ptr":
+		for _, name := range e.validatedNames() {
+			if strings.EqualFold(name, target) || hasSuffixFold(name, "."+target) {
+				return true, nil
+			}
+		}
+		return false, nil
+
+	case "exists":
+		ips, err := e.lookupIPs(target)
+		if err != nil {
+			return false, err
+		}
+		for _, ip := range ips {
+			if ip.To4() != nil {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	return false, permError("unknown mechanism %q", m.name)
+}
+
+// validatedNames returns the names that the client's address reverse-resolves
+// to and which resolve back to that address (RFC 7208 § 5.5). DNS errors are
+// treated as the name not being validated.
+func (e *evaluator) validatedNames() []string {
+	names, err := e.resolver.LookupAddr(e.ctx, e.ip.String())
+	if err != nil {
+		return nil
+	}
+	if len(names) > maxNames {
+		names = names[:maxNames]
+	}
+
+	var validated []string
+	for _, name := range names {
+		name = strings.TrimSuffix(name, ".")
+		addrs, err := e.resolver.LookupIPAddr(e.ctx, name)
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if addr.IP.Equal(e.ip) {
+				validated = append(validated, name)
+				break
+			}
+		}
+	}
+	return validated
+}
+
+// record is a parsed SPF record.
+type record struct {
+	mechanisms []mechanism
+	redirect   string
+	exp        string
+}
+
+type mechanism struct {
+	qualifier byte
+	name      string
+	// domain is the unexpanded domain-spec, if any.
+	domain string
+	// network is the address range of an ip4 or ip6 mechanism.
+	network *net.IPNet
+	// cidr4 and cidr6 are the prefix lengths of an a or mx mechanism.
+	cidr4, cidr6 int
+}
+
+func (m mechanism) result() Result {
+	switch m.qualifier {
+	case '-':
+		return ResultFail
+	case '~':
+		return ResultSoftFail
+	case '?':
+		return ResultNeutral
+	}
+	return ResultPass
+}
+
+// matchesAny returns whether |ip| is in the range of any of the addresses in
+// |ips|, using the mechanism's prefix lengths.
+func (m mechanism) matchesAny(ip net.IP, ips []net.IP) bool {
+	ip4 := ip.To4()
+	for _, candidate := range ips {
+		c4 := candidate.To4()
+		if ip4 != nil && c4 != nil {
+			mask := net.CIDRMask(m.cidr4, 32)
+			if ip4.Mask(mask).Equal(c4.Mask(mask)) {
+				return true
+			}
+		} else if ip4 == nil && c4 == nil {
+			mask := net.CIDRMask(m.cidr6, 128)
+			if ip.Mask(mask).Equal(candidate.Mask(mask)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+var (
+	modifierName = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9\-_\.]*$`)
+	dualCIDR     = regexp.MustCompile(`^(.*?)(?:/([0-9]+))?(?://([0-9]+))?$`)
+)
+
+// parseRecord parses an SPF record. Any syntax error makes the whole record
+// invalid (RFC 7208 § 4.6).
+func parseRecord(txt string) (*record, error) {
+	r := &record{}
+	for _, term := range strings.Fields(txt)[1:] {
+		if eq := strings.IndexByte(term, '='); eq != -1 && modifierName.MatchString(term[:eq]) {
+			name, value := strings.ToLower(term[:eq]), term[eq+1:]
+			if err := validateMacro(value); err != nil {
+				return nil, err
+			}
+			switch name {
+			case "redirect":
+				if r.redirect != "" {
+					return nil, errors.New("duplicate redirect modifier")
+				}
+				r.redirect = value
+			case "exp":
+				if r.exp != "" {
+					return nil, errors.New("duplicate exp modifier")
+				}
+				r.exp = value
+			}
+			continue
+		}
+
+		m, err := parseMechanism(term)
+		if err != nil {
+			return nil, err
+		}
+		r.mechanisms = append(r.mechanisms, m)
+	}
+
+	// A redirect is not used if the record has an "all" mechanism.
+	for _, m := range r.mechanisms {
+		if m.name == "all" {
+			r.redirect = ""
+		}
+	}
+	return r, nil
+}
+
+func parseMechanism(term string) (mechanism, error) {
+	m := mechanism{qualifier: '+', cidr4: 32, cidr6: 128}
+	if strings.IndexByte("+-~?", term[0]) != -1 {
+		m.qualifier = term[0]
+		term = term[1:]
+	}
+
+	arg := ""
+	if idx := strings.IndexAny(term, ":/"); idx != -1 {
+		m.name, arg = strings.ToLower(term[:idx]), term[idx:]
+	} else {
+		m.name = strings.ToLower(term)
+	}
+
+	switch m.name {
+	case "all":
+		if arg != "" {
+			return m, fmt.Errorf("invalid term %q", term)
+		}
+
+	case "include", "exists", "ptr":
+		if strings.HasPrefix(arg, ":") {
+			m.domain = arg[1:]
+		} else if arg != "" || m.name != "ptr" {
+			return m, fmt.Errorf("invalid term %q", term)
+		}
+
+	case "a", "mx":
+		parts := dualCIDR.FindStringSubmatch(arg)
+		if parts[1] != "" {
+			if !strings.HasPrefix(parts[1], ":") {
+				return m, fmt.Errorf("invalid term %q", term)
+			}
+			m.domain = parts[1][1:]
+		}
+		var err error
+		if m.cidr4, err = parseCIDR(parts[2], 32); err != nil {
+			return m, err
+		}
+		if m.cidr6, err = parseCIDR(parts[3], 128); err != nil {
+			return m, err
+		}
+
+	case "ip4", "ip6":
+		if !strings.HasPrefix(arg, ":") {
+			return m, fmt.Errorf("invalid term %q", term)
+		}
+		arg = arg[1:]
+		bits := 32
+		if m.name == "ip6" {
+			bits = 128
+		}
+		if !strings.Contains(arg, "/") {
+			arg += "/" + strconv.Itoa(bits)
+		}
+		ip, network, err := net.ParseCIDR(arg)
+		if err != nil || (ip.To4() != nil) != (m.name == "ip4") {
+			return m, fmt.Errorf("invalid address in %q", term)
+		}
+		m.network = network
+
+	default:
+		return m, fmt.Errorf("unknown mechanism %q", term)
+	}
+
+	if m.domain != "" {
+		if err := validateMacro(m.domain); err != nil {
+			return m, err
+		}
+	}
+	return m, nil
+}
+
+func parseCIDR(s string, max int) (int, error) {
+	if s == "" {
+		return max, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n > max || (len(s) > 1 && s[0] == '0') {
+		return 0, fmt.Errorf("invalid prefix length %q", s)
+	}
+	return n, nil
+}
+
+// isValidDomain performs the domain checks of RFC 7208 § 4.3.
+func isValidDomain(domain string) bool {
+	if len(domain) == 0 || len(domain) > 253 {
+		return false
+	}
+	labels := strings.Split(domain, ".")
+	if len(labels) < 2 {
+		return false
+	}
+	for _, label := range labels {
+		if len(label) == 0 || len(label) > 63 {
+			return false
+		}
+	}
+	return true
+}
+
+func hasSuffixFold(s, suffix string) bool {
+	return len(s) >= len(suffix) && strings.EqualFold(s[len(s)-len(suffix):], suffix)
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
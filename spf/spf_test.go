@@ -0,0 +1,223 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package spf
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+type testResolver struct {
+	txt  map[string][]string
+	ips  map[string][]string
+	mx   map[string][]string
+	ptr  map[string][]string
+	fail map[string]bool
+}
+
+func (r *testResolver) err(name string) error {
+	if r.fail[name] {
+		return &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	return &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *testResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if txt, ok := r.txt[name]; ok {
+		return txt, nil
+	}
+	return nil, r.err(name)
+}
+
+func (r *testResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	ips, ok := r.ips[host]
+	if !ok {
+		return nil, r.err(host)
+	}
+	addrs := make([]net.IPAddr, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.IPAddr{IP: net.ParseIP(ip)}
+	}
+	return addrs, nil
+}
+
+func (r *testResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	hosts, ok := r.mx[name]
+	if !ok {
+		return nil, r.err(name)
+	}
+	mxs := make([]*net.MX, len(hosts))
+	for i, host := range hosts {
+		mxs[i] = &net.MX{Host: host + ".", Pref: uint16(i)}
+	}
+	return mxs, nil
+}
+
+func (r *testResolver) LookupAddr(ctx context.Context, addr string) ([]string, error) {
+	if names, ok := r.ptr[addr]; ok {
+		return names, nil
+	}
+	return nil, r.err(addr)
+}
+
+func TestCheckHost(t *testing.T) {
+	resolver := &testResolver{
+		txt: map[string][]string{
+			"ip4.com":       {"v=spf1 ip4:192.0.2.0/24 -all"},
+			"ip6.com":       {"v=spf1 ip6:2001:db8::/32 -all"},
+			"soft.com":      {"v=spf1 ~all"},
+			"neutral.com":   {"v=spf1 ?all"},
+			"empty.com":     {"v=spf1"},
+			"notspf.com":    {"google-site-verification=abc"},
+			"two.com":       {"v=spf1 -all", "v=spf1 +all"},
+			"include.com":   {"v=spf1 include:ip4.com -all"},
+			"incnone.com":   {"v=spf1 include:nothing.com -all"},
+			"a.com":         {"v=spf1 a -all"},
+			"acidr.com":     {"v=spf1 a:host.a.com/24 -all"},
+			"mx.com":        {"v=spf1 mx -all"},
+			"redirect.com":  {"v=spf1 redirect=ip4.com"},
+			"redirall.com":  {"v=spf1 redirect=ip4.com +all"},
+			"exists.com":    {"v=spf1 exists:%{ir}.%{l}._spf.%{d} -all"},
+			"ptr.com":       {"v=spf1 ptr -all"},
+			"temp.com":      {"v=spf1 a:broken.com -all"},
+			"syntax.com":    {"v=spf1 ip4:192.0.2.0/24 bogus -all"},
+			"badmacro.com":  {"v=spf1 -all exists:%{z}"},
+			"case.com":      {"V=SPF1 IP4:192.0.2.1 -ALL"},
+			"voids.com":     {"v=spf1 a:v1.com a:v2.com a:v3.com -all"},
+			"mxdual.com":    {"v=spf1 mx//64 -all"},
+			"duplicate.com": {"v=spf1 redirect=a.com redirect=b.com"},
+			"loop.com":      {"v=spf1 include:loop.com -all"},
+		},
+		ips: map[string][]string{
+			"a.com":                           {"192.0.2.10", "2001:db8::10"},
+			"host.a.com":                      {"198.51.100.1"},
+			"mx1.mx.com":                      {"203.0.113.5"},
+			"mx2.mx.com":                      {"2001:db8:1::5"},
+			"10.2.0.192.user._spf.exists.com": {"127.0.0.2"},
+			"mail.ptr.com":                    {"192.0.2.20"},
+			"forged.ptr.com":                  {"198.51.100.98"},
+		},
+		mx: map[string][]string{
+			"mx.com":     {"mx1.mx.com", "mx2.mx.com"},
+			"mxdual.com": {"mx2.mx.com"},
+		},
+		ptr: map[string][]string{
+			"192.0.2.20":    {"mail.ptr.com."},
+			"198.51.100.99": {"forged.ptr.com."},
+		},
+		fail: map[string]bool{
+			"broken.com":  true,
+			"tempdns.com": true,
+		},
+	}
+
+	tests := []struct {
+		domain string
+		ip     string
+		result Result
+	}{
+		{"ip4.com", "192.0.2.1", ResultPass},
+		{"ip4.com", "192.0.3.1", ResultFail},
+		{"ip4.com", "2001:db8::1", ResultFail},
+		{"ip6.com", "2001:db8::1", ResultPass},
+		{"ip6.com", "192.0.2.1", ResultFail},
+		{"soft.com", "192.0.2.1", ResultSoftFail},
+		{"neutral.com", "192.0.2.1", ResultNeutral},
+		{"empty.com", "192.0.2.1", ResultNeutral},
+		{"nothing.com", "192.0.2.1", ResultNone},
+		{"notspf.com", "192.0.2.1", ResultNone},
+		{"tempdns.com", "192.0.2.1", ResultTempError},
+		{"two.com", "192.0.2.1", ResultPermError},
+		{"include.com", "192.0.2.1", ResultPass},
+		{"include.com", "198.51.100.1", ResultFail},
+		{"incnone.com", "192.0.2.1", ResultPermError},
+		{"a.com", "192.0.2.10", ResultPass},
+		{"a.com", "2001:db8::10", ResultPass},
+		{"a.com", "192.0.2.11", ResultFail},
+		{"acidr.com", "198.51.100.200", ResultPass},
+		{"acidr.com", "198.51.101.1", ResultFail},
+		{"mx.com", "203.0.113.5", ResultPass},
+		{"mx.com", "2001:db8:1::5", ResultPass},
+		{"mx.com", "203.0.113.6", ResultFail},
+		{"mxdual.com", "2001:db8:1::ffff", ResultPass},
+		{"redirect.com", "192.0.2.1", ResultPass},
+		{"redirect.com", "198.51.100.1", ResultFail},
+		{"redirall.com", "198.51.100.1", ResultPass},
+		{"exists.com", "192.0.2.10", ResultPass},
+		{"exists.com", "192.0.2.11", ResultFail},
+		{"ptr.com", "192.0.2.20", ResultPass},
+		{"ptr.com", "198.51.100.99", ResultFail},
+		{"temp.com", "192.0.2.1", ResultTempError},
+		{"syntax.com", "192.0.2.1", ResultPermError},
+		{"badmacro.com", "192.0.2.1", ResultPermError},
+		{"case.com", "192.0.2.1", ResultPass},
+		{"voids.com", "192.0.2.1", ResultPermError},
+		{"duplicate.com", "192.0.2.1", ResultPermError},
+		{"loop.com", "192.0.2.1", ResultPermError},
+		{"invalid", "192.0.2.1", ResultNone},
+	}
+	for _, test := range tests {
+		result, err := CheckHost(context.Background(), resolver, net.ParseIP(test.ip), test.domain, "user@"+test.domain, "helo.example.com")
+		if result != test.result {
+			t.Errorf("%s from %s: want %s, got %s (%v)", test.domain, test.ip, test.result, result, err)
+		}
+	}
+}
+
+func TestLookupLimit(t *testing.T) {
+	resolver := &testResolver{
+		txt: map[string][]string{},
+		ips: map[string][]string{},
+	}
+	for i := 0; i < 12; i++ {
+		resolver.txt[fmt.Sprintf("d%d.com", i)] = []string{fmt.Sprintf("v=spf1 a include:d%d.com -all", i+1)}
+		resolver.ips[fmt.Sprintf("d%d.com", i)] = []string{"198.51.100.1"}
+	}
+
+	result, err := CheckHost(context.Background(), resolver, net.ParseIP("192.0.2.1"), "d0.com", "user@d0.com", "")
+	if result != ResultPermError || !strings.Contains(err.Error(), "DNS lookups") {
+		t.Errorf("Want permerror for too many lookups, got %s (%v)", result, err)
+	}
+
+	resolver.txt["d5.com"] = []string{"v=spf1 a -all"}
+	result, err = CheckHost(context.Background(), resolver, net.ParseIP("198.51.100.1"), "d0.com", "user@d0.com", "")
+	if result != ResultPass {
+		t.Errorf("Want pass within lookup limit, got %s (%v)", result, err)
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	resolver := &testResolver{
+		txt: map[string][]string{
+			"example.com":      {"v=spf1 ip4:192.0.2.1 -all"},
+			"mail.example.com": {"v=spf1 ip4:192.0.2.2 -all"},
+		},
+	}
+
+	c := Evaluate(context.Background(), resolver, net.ParseIP("192.0.2.1"), "mail.example.com", "user@example.com")
+	if c.Result != ResultPass || c.Identity != "mailfrom" || c.Domain != "example.com" {
+		t.Errorf("Unexpected check: %+v", c)
+	}
+	want := `pass (mx.test: domain of user@example.com designates 192.0.2.1 as permitted sender) client-ip=192.0.2.1; envelope-from="user@example.com"; helo=mail.example.com; receiver=mx.test; identity=mailfrom;`
+	if got := c.ReceivedSPF("mx.test"); want != got {
+		t.Errorf("Want Received-SPF %q, got %q", want, got)
+	}
+	if want, got := "spf=pass smtp.mailfrom=user@example.com", c.AuthResult(); want != got {
+		t.Errorf("Want AuthResult %q, got %q", want, got)
+	}
+
+	c = Evaluate(context.Background(), resolver, net.ParseIP("192.0.2.1"), "mail.example.com", "")
+	if c.Result != ResultFail || c.Identity != "helo" || c.Sender != "postmaster@mail.example.com" {
+		t.Errorf("Unexpected check: %+v", c)
+	}
+	if want, got := "spf=fail smtp.helo=mail.example.com", c.AuthResult(); want != got {
+		t.Errorf("Want AuthResult %q, got %q", want, got)
+	}
+}
@@ -0,0 +1,228 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	"src.bluestatic.org/mailpopbox/smtp"
+)
+
+// User is an account of a Server besides the mailbox account, with its own
+// login and maildrop. Mail to the user's address, and to the addresses
+// matched by its routing rules, is delivered to the user rather than to the
+// mailbox account.
+type User struct {
+	// Name is the local part of the user's address, <name@domain.com>, which
+	// is also the user's login.
+	Name string
+
+	// Password of the user, which is stored like the MailboxPassword.
+	Password string
+
+	// Location to store the user's mail messages.
+	MaildropPath string
+
+	// Aliases are local parts, besides the Name, that are delivered to the
+	// user.
+	Aliases []string
+
+	// Prefixes of local parts that are delivered to the user, e.g. "shop-".
+	Prefixes []string
+
+	// Patterns are regular expressions that match the whole local parts
+	// that are delivered to the user.
+	Patterns []string
+}
+
+// localPart returns the part of |address| before the domain.
+func localPart(address string) string {
+	if idx := strings.LastIndex(address, "@"); idx != -1 {
+		return address[:idx]
+	}
+	return address
+}
+
+// compileUserPattern compiles one of the Patterns of a User, which are
+// matched case-insensitively against the whole local part.
+func compileUserPattern(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("(?i)^(?:" + pattern + ")$")
+}
+
+// userForLocalPart returns the User to which mail for |local| at the domain
+// is delivered, or nil if it is delivered to the mailbox account. The Name and
+// Aliases of the users are checked first, then the longest matching prefix,
+// and then the Patterns in the order of the users.
+func (s Server) userForLocalPart(local string) *User {
+	for i, u := range s.Users {
+		if strings.EqualFold(u.Name, local) {
+			return &s.Users[i]
+		}
+		for _, alias := range u.Aliases {
+			if strings.EqualFold(alias, local) {
+				return &s.Users[i]
+			}
+		}
+	}
+
+	lower := strings.ToLower(local)
+	var user *User
+	longest := 0
+	for i, u := range s.Users {
+		for _, prefix := range u.Prefixes {
+			if len(prefix) > longest && strings.HasPrefix(lower, strings.ToLower(prefix)) {
+				user = &s.Users[i]
+				longest = len(prefix)
+			}
+		}
+	}
+	if user != nil {
+		return user
+	}
+
+	for i, u := range s.Users {
+		for _, pattern := range u.Patterns {
+			// The patterns are checked by Config.Validate.
+			if re, err := compileUserPattern(pattern); err == nil && re.MatchString(local) {
+				return &s.Users[i]
+			}
+		}
+	}
+	return nil
+}
+
+// maildropForLocalPart returns the directory to which mail for |local| at the
+// domain is delivered. This is the maildrop of the account, or with
+// AliasSubfolders, its subfolder for |local| unless that is the account's own
+// address.
+func (s Server) maildropForLocalPart(local string) string {
+	maildrop := s.accountMaildropForLocalPart(local)
+	if !s.AliasSubfolders || s.isAccount(local) {
+		return maildrop
+	}
+	return path.Join(maildrop, aliasSubfolder(local))
+}
+
+// accountMaildropForLocalPart returns the maildrop of the account to which
+// mail for |local| at the domain is delivered, which contains the alias
+// subfolder, if any.
+func (s Server) accountMaildropForLocalPart(local string) string {
+	if u := s.userForLocalPart(local); u != nil {
+		return u.MaildropPath
+	}
+	return s.MaildropPath
+}
+
+// isAccount returns whether |local| at the domain is the mailbox account or
+// the address of one of the Users.
+func (s Server) isAccount(local string) bool {
+	return strings.EqualFold(local+"@", MailboxAccount) || s.user(local) != nil
+}
+
+// account returns the password of the account that logs in as |login|, which
+// is either the mailbox account or the address of one of the Users, and the
+// messages that it sees. With AliasSubfolders, the account sees the messages
+// of all of its aliases, or only those of one alias if the login is of the
+// form <account+alias@domain.com>. If there is no such account, ok is false.
+func (s Server) account(login string) (password string, view maildropView, ok bool) {
+	local, alias, ok := s.parseLogin(login)
+	if !ok {
+		return "", view, false
+	}
+
+	if local+"@" == MailboxAccount {
+		password, view.dir = s.MailboxPassword, s.MaildropPath
+	} else if u := s.user(local); u != nil {
+		password, view.dir = u.Password, u.MaildropPath
+	} else {
+		return "", view, false
+	}
+
+	view.maildrop = view.dir
+	if alias != "" {
+		view.alias = aliasSubfolder(alias)
+		view.dir = path.Join(view.dir, view.alias)
+	} else {
+		view.subfolders = s.AliasSubfolders
+	}
+	return password, view, true
+}
+
+// sameAccount returns whether the logins |a| and |b| are of the same account,
+// such as <account@domain.com> and one of its aliases
+// <account+alias@domain.com>.
+func (s Server) sameAccount(a, b string) bool {
+	localA, _, okA := s.parseLogin(a)
+	localB, _, okB := s.parseLogin(b)
+	return okA && okB && strings.EqualFold(localA, localB)
+}
+
+// parseLogin splits |login| at the domain into the local part of the account
+// and, with AliasSubfolders, the alias after a "+". It does not check that the
+// account exists.
+func (s Server) parseLogin(login string) (local, alias string, ok bool) {
+	address, err := smtp.NormalizeAddress(login)
+	if err != nil || smtp.DomainForAddressString(address) != s.normalizedDomain() {
+		return "", "", false
+	}
+	local = localPart(address)
+	if idx := strings.IndexByte(local, '+'); idx != -1 && s.AliasSubfolders {
+		local, alias = local[:idx], local[idx+1:]
+		if alias == "" {
+			return "", "", false
+		}
+	}
+	return local, alias, true
+}
+
+// user returns the User called |name|, or nil if there is none.
+func (s Server) user(name string) *User {
+	for i, u := range s.Users {
+		if strings.EqualFold(u.Name, name) {
+			return &s.Users[i]
+		}
+	}
+	return nil
+}
+
+// maildrops returns the maildrops of the mailbox account and of the Users.
+func (s Server) maildrops() []string {
+	maildrops := []string{s.MaildropPath}
+	for _, u := range s.Users {
+		maildrops = append(maildrops, u.MaildropPath)
+	}
+	return maildrops
+}
+
+// validateUsers checks that the Users of |s| have valid, distinct names and
+// valid routing rules.
+func (s Server) validateUsers() error {
+	names := make(map[string]bool)
+	for _, u := range s.Users {
+		name := strings.ToLower(u.Name)
+		switch {
+		case name == "" || strings.ContainsAny(name, "@+"):
+			return fmt.Errorf("%s: invalid user name %q", s.Domain, u.Name)
+		case name+"@" == MailboxAccount:
+			return fmt.Errorf("%s: user name %q is reserved for the mailbox account", s.Domain, u.Name)
+		case names[name]:
+			return fmt.Errorf("%s: duplicate user %q", s.Domain, u.Name)
+		case u.MaildropPath == "":
+			return fmt.Errorf("%s: user %q has no MaildropPath", s.Domain, u.Name)
+		}
+		names[name] = true
+		for _, pattern := range u.Patterns {
+			if _, err := compileUserPattern(pattern); err != nil {
+				return fmt.Errorf("%s: user %q: %v", s.Domain, u.Name, err)
+			}
+		}
+	}
+	return nil
+}
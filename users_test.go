@@ -0,0 +1,118 @@
+// mailpopbox
+// Copyright 2020 Blue Static <https://www.bluestatic.org>
+// This program is free software licensed under the GNU General Public License,
+// version 3.0. The full text of the license can be found in LICENSE.txt.
+// SPDX-License-Identifier: GPL-3.0-only
+
+package main
+
+import (
+	"testing"
+)
+
+var testUsersServer = Server{
+	Domain:          "example.com",
+	MailboxPassword: "letmein",
+	MaildropPath:    "/maildrop/mailbox",
+	Users: []User{
+		{
+			Name:         "alice",
+			Password:     "alice-pass",
+			MaildropPath: "/maildrop/alice",
+			Aliases:      []string{"al", "shop-special"},
+			Prefixes:     []string{"a-", "shop-"},
+			Patterns:     []string{`school[0-9]+`},
+		},
+		{
+			Name:         "bob",
+			Password:     "bob-pass",
+			MaildropPath: "/maildrop/bob",
+			Prefixes:     []string{"shop-b"},
+			Patterns:     []string{`.*school.*`, `b\..+`},
+		},
+	},
+}
+
+func TestUserRouting(t *testing.T) {
+	cases := []struct {
+		local, maildrop string
+	}{
+		{"mailbox", "/maildrop/mailbox"},
+		{"anything", "/maildrop/mailbox"},
+		{"alice", "/maildrop/alice"},
+		{"Alice", "/maildrop/alice"},
+		{"bob", "/maildrop/bob"},
+		{"al", "/maildrop/alice"},
+		{"AL", "/maildrop/alice"},
+		{"alan", "/maildrop/mailbox"},
+		{"a-news", "/maildrop/alice"},
+		{"shop-news", "/maildrop/alice"},
+		{"shop-books", "/maildrop/bob"},
+		{"Shop-Books", "/maildrop/bob"},
+		{"shop-special", "/maildrop/alice"},
+		{"school12", "/maildrop/alice"},
+		{"school", "/maildrop/bob"},
+		{"highschool12", "/maildrop/bob"},
+		{"b.club", "/maildrop/bob"},
+		{"b.", "/maildrop/mailbox"},
+		{"xb.club", "/maildrop/mailbox"},
+	}
+	for _, c := range cases {
+		if want, got := c.maildrop, testUsersServer.maildropForLocalPart(c.local); want != got {
+			t.Errorf("%s: want maildrop %q, got %q", c.local, want, got)
+		}
+	}
+}
+
+func TestUserAccounts(t *testing.T) {
+	cases := []struct {
+		login              string
+		password, maildrop string
+		ok                 bool
+	}{
+		{"mailbox@example.com", "letmein", "/maildrop/mailbox", true},
+		{"mailbox@EXAMPLE.com", "letmein", "/maildrop/mailbox", true},
+		{"alice@example.com", "alice-pass", "/maildrop/alice", true},
+		{"ALICE@example.com", "alice-pass", "/maildrop/alice", true},
+		{"bob@example.com", "bob-pass", "/maildrop/bob", true},
+		{"al@example.com", "", "", false},
+		{"alice@example.net", "", "", false},
+		{"alice", "", "", false},
+		{"MAILBOX@example.com", "", "", false},
+		{"mailbox+shop@example.com", "", "", false},
+	}
+	for _, c := range cases {
+		password, view, ok := testUsersServer.account(c.login)
+		if ok != c.ok || password != c.password || view.dir != c.maildrop || view.subfolders {
+			t.Errorf("%s: want (%q, %q, %v), got (%q, %+v, %v)", c.login,
+				c.password, c.maildrop, c.ok, password, view, ok)
+		}
+	}
+
+	for local, want := range map[string]bool{"mailbox": true, "alice": true, "Bob": true, "al": false, "carol": false} {
+		if got := testUsersServer.isAccount(local); want != got {
+			t.Errorf("isAccount(%q): want %v, got %v", local, want, got)
+		}
+	}
+}
+
+func TestValidateUsers(t *testing.T) {
+	if err := (Config{Servers: []Server{testUsersServer}}).Validate(); err != nil {
+		t.Errorf("Valid users: %v", err)
+	}
+
+	invalid := [][]User{
+		{{Name: "", MaildropPath: "/a"}},
+		{{Name: "a@b", MaildropPath: "/a"}},
+		{{Name: "Mailbox", MaildropPath: "/a"}},
+		{{Name: "alice", MaildropPath: "/a"}, {Name: "ALICE", MaildropPath: "/b"}},
+		{{Name: "alice"}},
+		{{Name: "alice", MaildropPath: "/a", Patterns: []string{"[invalid"}}},
+	}
+	for i, users := range invalid {
+		config := Config{Servers: []Server{{Domain: "example.com", Users: users}}}
+		if err := config.Validate(); err == nil {
+			t.Errorf("Case %d: expected error", i)
+		}
+	}
+}